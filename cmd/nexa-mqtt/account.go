@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/internal/backfill"
+	"nexa-mqtt/internal/config"
+	"nexa-mqtt/internal/devicefilter"
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/internal/growatt_app"
+	"nexa-mqtt/internal/growatt_auto"
+	"nexa-mqtt/internal/growatt_web"
+	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
+	"strings"
+	"time"
+)
+
+// account holds the services of a single Growatt account
+type account struct {
+	name              string // empty for the first account
+	mode              string
+	growattWebService *growatt_web.GrowattService
+	growattAppService *growatt_app.GrowattAppService
+	// in auto mode the web and app services are only used by the auto service
+	growattAutoService *growatt_auto.GrowattAutoService
+	// polls the history data and backfills its gaps, also set in auto mode
+	backfillService *growatt_web.GrowattService
+	loggedIn        bool
+}
+
+func newAccount(cfg config.Account, backfillMaxAge time.Duration, filter *devicefilter.Filter) *account {
+	mode := strings.ToLower(strings.TrimSpace(cfg.Growatt.APIMode))
+	log := slog.With(slog.String("account", cfg.Name))
+
+	switch mode {
+	case "app":
+		log.Info("setting mode", slog.String("mode", mode))
+		growattApp := growatt_app.NewGrowattAppService(growatt_app.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlApp,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			DeviceFilter:                  filter,
+		})
+
+		return &account{
+			name:              cfg.Name,
+			mode:              mode,
+			growattAppService: growattApp,
+		}
+
+	case "web":
+		log.Info("setting mode", slog.String("mode", mode))
+		growattService := growatt_web.NewGrowattService(growatt_web.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlWeb,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			Location:                      cfg.Growatt.Location,
+			BackfillMaxAge:                backfillMaxAge,
+			DeviceFilter:                  filter,
+		})
+
+		return &account{
+			name:              cfg.Name,
+			mode:              mode,
+			growattWebService: growattService,
+			backfillService:   growattService,
+		}
+
+	case "web+app":
+		log.Info("setting mode", slog.String("mode", mode))
+		growattService := growatt_web.NewGrowattService(growatt_web.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlWeb,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			Location:                      cfg.Growatt.Location,
+			BackfillMaxAge:                backfillMaxAge,
+			DeviceFilter:                  filter,
+		})
+
+		growattApp := growatt_app.NewGrowattAppService(growatt_app.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlApp,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			DeviceFilter:                  filter,
+		})
+
+		return &account{
+			name:              cfg.Name,
+			mode:              mode,
+			growattWebService: growattService,
+			growattAppService: growattApp,
+			backfillService:   growattService,
+		}
+
+	case "auto":
+		log.Info("setting mode", slog.String("mode", mode), slog.Int("failoverThreshold", cfg.Growatt.FailoverThreshold))
+		growattService := growatt_web.NewGrowattService(growatt_web.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlWeb,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			Location:                      cfg.Growatt.Location,
+			BackfillMaxAge:                backfillMaxAge,
+			DeviceFilter:                  filter,
+		})
+
+		growattApp := growatt_app.NewGrowattAppService(growatt_app.Options{
+			ServerUrl:                     cfg.Growatt.ServerUrlApp,
+			Username:                      cfg.Growatt.Username,
+			Password:                      cfg.Growatt.Password,
+			PollingInterval:               cfg.PollingInterval,
+			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+			EnumerationInterval:           cfg.EnumerationInterval,
+			DeviceFilter:                  filter,
+		})
+
+		growattAuto := growatt_auto.NewGrowattAutoService(growatt_auto.Options{
+			Threshold: cfg.Growatt.FailoverThreshold,
+		}, growatt_auto.WebSource(growattService), growattApp)
+
+		return &account{
+			name:               cfg.Name,
+			mode:               mode,
+			growattAutoService: growattAuto,
+			backfillService:    growattService,
+		}
+
+	default:
+		misc.Panic(fmt.Errorf("invalid growatt api type: %s", cfg.Growatt.APIMode))
+		return nil
+	}
+}
+
+func (a *account) login() error {
+	switch a.mode {
+	case "app":
+		return a.growattAppService.Login()
+	case "auto":
+		return a.growattAutoService.Login()
+	default:
+		// in web+app mode the app service logs in when the first parameter is set
+		return a.growattWebService.Login()
+	}
+}
+
+// startPolling sets the endpoint and returns the function that enumerates
+// the devices and starts polling
+func (a *account) startPolling(ep endpoint.Endpoint) func() error {
+	switch a.mode {
+	case "app":
+		a.growattAppService.SetEndpoint(ep)
+		return a.growattAppService.StartPolling
+
+	case "auto":
+		a.growattAutoService.SetEndpoint(ep)
+		return a.growattAutoService.StartPolling
+
+	default:
+		a.growattWebService.SetEndpoint(ep)
+		return func() error {
+			return a.growattWebService.StartPolling(growatt_web.NewDefaultDurationCalculator(a.growattWebService))
+		}
+	}
+}
+
+// webAppApplier applies the parameters with the app service but refreshes
+// the devices with the web service, which polls them in web+app mode
+type webAppApplier struct {
+	*growatt_app.GrowattAppService
+	web *growatt_web.GrowattService
+}
+
+func (w webAppApplier) Refresh(device models.NoahDevicePayload) error {
+	return w.web.Refresh(device)
+}
+
+func (w webAppApplier) Reenumerate(device models.NoahDevicePayload) error {
+	return w.web.Reenumerate(device)
+}
+
+// setParameterApplier sets the service that applies the parameter commands
+// of the devices of the account
+func (a *account) setParameterApplier(ep endpoint.Endpoint) {
+	switch a.mode {
+	case "app":
+		ep.SetParameterApplier(a.growattAppService)
+
+	case "web":
+		ep.SetParameterApplier(a.growattWebService)
+
+	case "web+app":
+		a.growattAppService.SetEndpoint(ep)
+		a.growattAppService.SetParameterQuery(a.growattWebService)
+		ep.SetParameterApplier(webAppApplier{a.growattAppService, a.growattWebService})
+
+	case "auto":
+		ep.SetParameterApplier(a.growattAutoService)
+	}
+}
+
+func (a *account) setBackfill(sink backfill.Sink, state *backfill.State) {
+	if a.backfillService != nil {
+		a.backfillService.SetBackfill(sink, state)
+	}
+}
+
+// stopPolling stops the pollers after the mqtt connection was lost
+func (a *account) stopPolling() {
+	if a.growattWebService != nil {
+		a.growattWebService.StopPolling()
+		a.growattWebService.SetEndpoint(nil)
+	}
+	if a.growattAppService != nil {
+		a.growattAppService.StopPolling()
+		a.growattAppService.SetEndpoint(nil)
+	}
+	if a.growattAutoService != nil {
+		a.growattAutoService.StopPolling()
+		a.growattAutoService.SetEndpoint(nil)
+	}
+}
+
+// shutdown stops the pollers and waits for them until ctx is done
+func (a *account) shutdown(ctx context.Context) {
+	log := slog.With(slog.String("account", a.name))
+	if a.growattWebService != nil {
+		if err := a.growattWebService.Shutdown(ctx); err != nil {
+			log.Warn("pollers did not stop in time (web)", slog.String("error", err.Error()))
+		}
+	}
+	if a.growattAppService != nil {
+		if err := a.growattAppService.Shutdown(ctx); err != nil {
+			log.Warn("pollers did not stop in time (app)", slog.String("error", err.Error()))
+		}
+	}
+	if a.growattAutoService != nil {
+		if err := a.growattAutoService.Shutdown(ctx); err != nil {
+			log.Warn("pollers did not stop in time (auto)", slog.String("error", err.Error()))
+		}
+	}
+}
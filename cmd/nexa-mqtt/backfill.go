@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/internal/backfill"
+	"nexa-mqtt/internal/config"
+	"nexa-mqtt/internal/endpoint_mqtt"
+	"nexa-mqtt/internal/growatt_web"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// setupBackfill restores the time of the last polled samples and creates the
+// sink for the backfill of gaps after a downtime.
+func (a *App) setupBackfill() error {
+	supported := false
+	for _, acc := range a.accounts {
+		if acc.backfillService != nil {
+			supported = true
+		} else {
+			slog.Warn("backfill is only supported in API modes web, web+app and auto", slog.String("account", acc.name), slog.String("mode", acc.mode))
+		}
+	}
+	if !supported {
+		return nil
+	}
+
+	state, err := backfill.NewState(a.cfg.Backfill.StateFile)
+	if err != nil {
+		return err
+	}
+	sink, err := newBackfillSink(a.cfg.Backfill)
+	if err != nil {
+		return err
+	}
+
+	a.backfillState = state
+	a.backfillSink = sink
+	return nil
+}
+
+// newBackfillSink returns the csv or influx sink. The mqtt sink is the mqtt
+// endpoint, nil is returned for it.
+func newBackfillSink(cfg config.Backfill) (backfill.Sink, error) {
+	switch cfg.Sink {
+	case backfill.SinkCsv:
+		return backfill.NewCsvSink(cfg.Target), nil
+	case backfill.SinkInflux:
+		return backfill.NewInfluxSink(cfg.Target, cfg.Token)
+	}
+	return nil, nil
+}
+
+// backfillOnce writes the history of all devices of all accounts between from
+// and to to the configured sink. It always uses the web API.
+func backfillOnce(ctx context.Context, cfg config.Config, from string, to string) error {
+	if cfg.Backfill.Sink == "" {
+		return errors.New("BACKFILL_SINK is required for a backfill")
+	}
+
+	// the times are in the zone of the first account
+	fromTime, err := parseBackfillTime(from, cfg.Growatt.Location)
+	if err != nil {
+		return err
+	}
+	toTime := time.Now()
+	if to != "" {
+		if toTime, err = parseBackfillTime(to, cfg.Growatt.Location); err != nil {
+			return err
+		}
+	}
+	if !toTime.After(fromTime) {
+		return fmt.Errorf("backfill end %s is not after the start %s", toTime, fromTime)
+	}
+
+	sink, err := newBackfillSink(cfg.Backfill)
+	if err != nil {
+		return err
+	}
+	if cfg.Backfill.Sink == backfill.SinkMqtt {
+		client, err := connectToolMqtt(cfg.Mqtt, "backfill")
+		if err != nil {
+			return err
+		}
+		defer client.Disconnect(250)
+		sink = endpoint_mqtt.NewEndpoint(endpoint_mqtt.Options{
+			MqttClient:  client,
+			TopicPrefix: cfg.Mqtt.TopicPrefix,
+		})
+	}
+
+	// excluded devices are not backfilled either
+	filter := newDeviceFilter(cfg.Devices)
+	for _, account := range cfg.Accounts {
+		growattService := growatt_web.NewGrowattService(growatt_web.Options{
+			ServerUrl:    account.Growatt.ServerUrlWeb,
+			Username:     account.Growatt.Username,
+			Password:     account.Growatt.Password,
+			Location:     account.Growatt.Location,
+			DeviceFilter: filter,
+		})
+		if err := growattService.Login(); err != nil {
+			return err
+		}
+		if err := growattService.BackfillAll(ctx, fromTime, toTime, sink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBackfillTime parses a date, a date and time or an RFC 3339 timestamp.
+// Times without a zone are in the zone of the Growatt account.
+func parseBackfillTime(s string, location *time.Location) (time.Time, error) {
+	if tm, err := time.Parse(time.RFC3339, s); err == nil {
+		return tm, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if tm, err := time.ParseInLocation(layout, s, location); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid backfill time '%s', expected e.g. '2025-05-20 08:00'", s)
+}
+
+// connectToolMqtt connects to the mqtt broker with its own client id, so a
+// running nexa-mqtt keeps its connection.
+func connectToolMqtt(mqttCfg config.Mqtt, tool string) (mqtt.Client, error) {
+	brokerUrl := mqttCfg.BrokerURL
+	if brokerUrl == "" {
+		brokerUrl = fmt.Sprintf("tcp://%s:%d", mqttCfg.Host, mqttCfg.Port)
+	}
+
+	c := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker(brokerUrl).
+		SetClientID(mqttCfg.ClientId + "-" + tool).
+		SetUsername(mqttCfg.Username).
+		SetPassword(mqttCfg.Password))
+
+	token := c.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("could not connect to mqtt broker: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log/slog"
+	"nexa-mqtt/internal/config"
+	"nexa-mqtt/internal/homeassistant"
+	"time"
+)
+
+// cleanupHomeAssistant retires all Home Assistant entities of nexa-mqtt,
+// including the retained discovery messages left on the broker
+func cleanupHomeAssistant(cfg config.Config) error {
+	client, err := connectToolMqtt(cfg.Mqtt, "cleanup")
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(250)
+
+	retired, err := homeassistant.Cleanup(client, cfg.HomeAssistant.TopicPrefix, cfg.HomeAssistant.StateFile, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	slog.Info("home assistant entities removed", slog.Int("topics", len(retired)))
+	return nil
+}
@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
+	"nexa-mqtt/internal/backfill"
 	"nexa-mqtt/internal/config"
+	"nexa-mqtt/internal/devicefilter"
+	"nexa-mqtt/internal/endpoint"
 	"nexa-mqtt/internal/endpoint_mqtt"
-	"nexa-mqtt/internal/growatt_app"
-	"nexa-mqtt/internal/growatt_web"
+	"nexa-mqtt/internal/endpoint_prometheus"
+	"nexa-mqtt/internal/energy"
 	"nexa-mqtt/internal/homeassistant"
 	"nexa-mqtt/internal/logging"
 	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
 	"os"
 	"os/signal"
 	"os/user"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 var (
@@ -25,8 +34,25 @@ var (
 )
 
 func main() {
+	configFile := flag.String("config", "", "path of a YAML or TOML configuration file")
+	backfillFrom := flag.String("backfill-from", "", "backfill the history since this time, e.g. '2025-05-20 08:00', to BACKFILL_SINK and exit")
+	backfillTo := flag.String("backfill-to", "", "end of the backfill, default now")
+	cleanup := flag.Bool("cleanup", false, "remove all entities of nexa-mqtt from Home Assistant and exit")
+	flag.Parse()
+
+	if *configFile != "" {
+		if err := config.Load(*configFile); err != nil {
+			slog.Error("couldn't load config file", slog.String("error", err.Error()))
+			misc.Panic(err)
+		}
+	}
+
 	cfg := config.Get()
 	logging.Init(cfg.LogLevel)
+	logging.AddSecret(cfg.Mqtt.Password, cfg.Backfill.Token)
+	for _, account := range cfg.Accounts {
+		logging.AddSecret(account.Growatt.Password)
+	}
 	if err := config.Validate(); err != nil {
 		slog.Error("couldn't validate config", slog.String("error", err.Error()))
 		misc.Panic(err)
@@ -38,39 +64,217 @@ func main() {
 		fmt.Fprintf(os.Stdout, "    running as user: %s (uid: %s)\n", currentUser.Username, currentUser.Uid)
 	}
 
-	app := NewApp(cfg)
-	connectMqtt(cfg.Mqtt, app)
-
+	ctx, cancel := context.WithCancel(context.Background())
 	cancelChan := make(chan os.Signal, 1)
 	signal.Notify(cancelChan, syscall.SIGTERM, syscall.SIGINT)
-	sig := <-cancelChan
-	slog.Info("Caught signal", slog.Any("signal", sig))
+	go func() {
+		sig := <-cancelChan
+		slog.Info("Caught signal", slog.Any("signal", sig))
+		cancel()
+	}()
+
+	if *backfillFrom != "" {
+		if err := backfillOnce(ctx, cfg, *backfillFrom, *backfillTo); err != nil {
+			slog.Error("backfill failed", slog.String("error", err.Error()))
+			misc.Panic(err)
+		}
+		return
+	}
+
+	if *cleanup {
+		if err := cleanupHomeAssistant(cfg); err != nil {
+			slog.Error("cleanup failed", slog.String("error", err.Error()))
+			misc.Panic(err)
+		}
+		return
+	}
+
+	app := NewApp(cfg)
+	counters, err := energy.NewCounters(energy.Options{
+		File:         cfg.Energy.File,
+		MaxGap:       10 * maxPollingInterval(cfg.Accounts),
+		MaxBridge:    time.Hour,
+		SaveInterval: 5 * time.Minute,
+	})
+	if err != nil {
+		slog.Error("couldn't load energy counters", slog.String("error", err.Error()))
+		misc.Panic(err)
+	}
+	app.energy = counters
+	if cfg.Backfill.Sink != "" {
+		if err := app.setupBackfill(); err != nil {
+			slog.Error("couldn't set up the backfill", slog.String("error", err.Error()))
+			misc.Panic(err)
+		}
+	}
+	if cfg.Metrics.Listen != "" {
+		app.metricsEndpoint = endpoint_prometheus.NewEndpoint(endpoint_prometheus.Options{
+			Listen: cfg.Metrics.Listen,
+		})
+		app.metricsEndpoint.Start()
+	}
+
+	client, err := connectMqtt(ctx, cfg.Mqtt, app)
+	if err != nil {
+		if errors.Is(err, misc.ErrInvalidCredentials) {
+			misc.Panic(err)
+		}
+		return
+	}
+
+	<-ctx.Done()
+	app.shutdown(client, cfg.ShutdownTimeout)
 }
 
 type App struct {
-	mode              string
-	cfg               config.Config
-	growattWebService *growatt_web.GrowattService
-	growattAppService *growatt_app.GrowattAppService
+	cfg config.Config
+	// the first account is made of the top-level settings
+	accounts []*account
+	// optional, receives the same data as the mqtt endpoint
+	metricsEndpoint *endpoint_prometheus.Endpoint
+	// adds the energy totals to the device status of all endpoints
+	energy *energy.Counters
+	// nil disables the backfill of gaps
+	backfillState *backfill.State
+	// csv or influx sink, the mqtt sink is the mqtt endpoint
+	backfillSink backfill.Sink
+
+	lock         sync.Mutex
+	mqttEndpoint *endpoint_mqtt.Endpoint
+	endpoint     *endpoint.Multi // forwards to the mqtt and metrics endpoints
+	stopping     bool
+	cancelRun    context.CancelFunc
+	running      sync.WaitGroup
+}
+
+// shutdown stops the pollers, applies or rejects pending parameter commands,
+// publishes the offline state and disconnects from the mqtt broker. Steps
+// that do not finish within timeout are abandoned.
+func (a *App) shutdown(client mqtt.Client, timeout time.Duration) {
+	slog.Info("shutting down", slog.String("timeout", timeout.String()))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	a.lock.Lock()
+	a.stopping = true
+	if a.cancelRun != nil {
+		a.cancelRun()
+	}
+	mqttEndpoint := a.mqttEndpoint
+	ep := a.endpoint
+	a.lock.Unlock()
+
+	if err := wait(ctx, &a.running); err != nil {
+		slog.Warn("startup did not stop in time", slog.String("error", err.Error()))
+	}
+
+	for _, acc := range a.accounts {
+		acc.shutdown(ctx)
+	}
+
+	if ep != nil {
+		if err := ep.Shutdown(ctx); err != nil {
+			slog.Warn("endpoints did not stop in time", slog.String("error", err.Error()))
+		}
+	}
+
+	if mqttEndpoint != nil {
+		mqttEndpoint.Shutdown(ctx)
+	}
+
+	if a.metricsEndpoint != nil {
+		if err := a.metricsEndpoint.Shutdown(ctx); err != nil {
+			slog.Warn("metrics server did not stop in time", slog.String("error", err.Error()))
+		}
+	}
+
+	if err := a.energy.Save(); err != nil {
+		slog.Error("could not save energy counters", slog.String("error", err.Error()))
+	}
+
+	if client.IsConnectionOpen() {
+		token := client.Publish(fmt.Sprintf("%s/availability", a.cfg.Mqtt.TopicPrefix), 1, true, "offline")
+		if !token.WaitTimeout(remaining(ctx)) {
+			slog.Warn("could not publish offline state in time")
+		} else if token.Error() != nil {
+			slog.Warn("could not publish offline state", slog.String("error", token.Error().Error()))
+		}
+	}
+
+	client.Disconnect(uint(remaining(ctx).Milliseconds()))
+	slog.Info("shutdown complete")
+}
+
+// wait waits for wg until ctx is done
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// remaining returns the time left until the deadline of ctx
+func remaining(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	return max(0, time.Until(deadline))
 }
 
 func (a *App) onMqttDisconnect() {
-	if a.growattWebService != nil {
-		a.growattWebService.StopPolling()
-		a.growattWebService.SetEndpoint(nil)
+	a.lock.Lock()
+	if a.cancelRun != nil {
+		a.cancelRun()
 	}
-	if a.growattAppService != nil {
-		a.growattAppService.StopPolling()
-		a.growattAppService.SetEndpoint(nil)
+	ep := a.endpoint
+	a.endpoint = nil
+	a.lock.Unlock()
+	a.running.Wait()
+
+	for _, acc := range a.accounts {
+		acc.stopPolling()
+	}
+
+	if ep != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), a.cfg.ShutdownTimeout)
+		defer cancel()
+		if err := ep.Shutdown(ctx); err != nil {
+			slog.Warn("endpoints did not stop in time", slog.String("error", err.Error()))
+		}
 	}
 }
 
 func (a *App) onMqttConnect(client mqtt.Client) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.stopping {
+		return
+	}
+
+	// the entities expire after missed polls of the slowest account, the
+	// details are not polled more often than the status
+	pollingInterval := maxPollingInterval(a.cfg.Accounts)
 	haService := homeassistant.NewService(homeassistant.Options{
-		MqttClient:     client,
-		TopicPrefix:    a.cfg.HomeAssistant.TopicPrefix,
-		SwitchAsSelect: a.cfg.HomeAssistant.SwitchAsSelect,
-		Version:        version,
+		MqttClient:             client,
+		TopicPrefix:            a.cfg.HomeAssistant.TopicPrefix,
+		SwitchAsSelect:         a.cfg.HomeAssistant.SwitchAsSelect,
+		DeviceDiscovery:        a.cfg.HomeAssistant.Discovery == "device",
+		StateFile:              a.cfg.HomeAssistant.StateFile,
+		BatteryDevices:         a.cfg.HomeAssistant.BatteryDevices,
+		PVDevices:              a.cfg.HomeAssistant.PVDevices,
+		PollingInterval:        pollingInterval,
+		DetailsPollingInterval: max(maxDetailsPollingInterval(a.cfg.Accounts), pollingInterval),
+		Version:                version,
 	})
 
 	mqttEndpoint := endpoint_mqtt.NewEndpoint(endpoint_mqtt.Options{
@@ -79,116 +283,152 @@ func (a *App) onMqttConnect(client mqtt.Client) {
 		HaClient:    haService,
 	})
 
-	client.Publish(fmt.Sprintf("%s/availability", a.cfg.Mqtt.TopicPrefix), 1, true, "online")
-
-	switch a.mode {
-	case "app":
-		a.growattAppService.SetEndpoint(mqttEndpoint)
-		a.growattAppService.StartPolling()
-		mqttEndpoint.SetParameterApplier(a.growattAppService)
+	a.mqttEndpoint = mqttEndpoint
+	if a.backfillState != nil {
+		sink := a.backfillSink
+		if a.cfg.Backfill.Sink == backfill.SinkMqtt {
+			sink = mqttEndpoint
+		}
+		for _, acc := range a.accounts {
+			acc.setBackfill(sink, a.backfillState)
+		}
+	}
+	if a.metricsEndpoint != nil {
+		a.endpoint = endpoint.NewMulti(mqttEndpoint, a.metricsEndpoint)
+	} else {
+		a.endpoint = endpoint.NewMulti(mqttEndpoint)
+	}
+	ep := a.endpoint
 
-	case "web":
-		a.growattWebService.SetEndpoint(mqttEndpoint)
-		a.growattWebService.StartPolling(growatt_web.NewDefaultDurationCalculator(a.growattWebService))
-		mqttEndpoint.SetParameterApplier(a.growattWebService)
+	client.Publish(fmt.Sprintf("%s/availability", a.cfg.Mqtt.TopicPrefix), 1, true, "online")
 
-	case "web+app":
-		a.growattWebService.SetEndpoint(mqttEndpoint)
-		a.growattWebService.StartPolling(growatt_web.NewDefaultDurationCalculator(a.growattWebService))
-		a.growattAppService.SetEndpoint(mqttEndpoint)
-		a.growattAppService.SetParameterQuery(a.growattWebService)
-		mqttEndpoint.SetParameterApplier(a.growattAppService)
+	var ctx context.Context
+	ctx, a.cancelRun = context.WithCancel(context.Background())
+	accounts := endpoint.NewAccounts(energy.NewEndpoint(ep, a.energy))
+	for _, acc := range a.accounts {
+		accountEndpoint := accounts.Account(acc.name)
+		a.running.Add(1)
+		go func() {
+			defer a.running.Done()
+			a.run(ctx, acc, mqttEndpoint, accountEndpoint)
+		}()
 	}
 }
 
-func NewApp(cfg config.Config) *App {
-
-	mode := strings.ToLower(strings.TrimSpace(cfg.Growatt.APIMode))
-	switch mode {
-	case "app":
-		slog.Info("setting mode", slog.String("mode", mode))
-		growattApp := growatt_app.NewGrowattAppService(growatt_app.Options{
-			ServerUrl:                     cfg.Growatt.ServerUrlApp,
-			Username:                      cfg.Growatt.Username,
-			Password:                      cfg.Growatt.Password,
-			PollingInterval:               cfg.PollingInterval,
-			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
-			ParameterPollingInterval:      cfg.ParameterPollingInterval,
-		})
+// run logs in to an account and starts polling. Both are retried with
+// backoff until they succeed or ctx is cancelled. The state is published on
+// the health topic of the account while waiting. Only invalid credentials end
+// the process. The services publish to ep, the service state is only
+// published via mqtt.
+func (a *App) run(ctx context.Context, acc *account, mqttEndpoint *endpoint_mqtt.Endpoint, ep endpoint.Endpoint) {
+	publishState := func(state models.ServiceState) {
+		state.Account = acc.name
+		mqttEndpoint.PublishServiceState(state)
+	}
 
-		if err := growattApp.Login(); err != nil {
-			slog.Error("could not login to growatt account", slog.String("error", err.Error()))
-			misc.Panic(err)
-		}
-		return &App{
-			mode:              mode,
-			cfg:               cfg,
-			growattAppService: growattApp,
+	if !acc.loggedIn {
+		publishState(models.ServiceState{State: models.ServiceStateLogin, Status: models.HealthUndefined})
+		err := misc.Retry(ctx, "growatt login", misc.DefaultBackoff, acc.login, reportRetry(publishState, models.ServiceStateLogin))
+		if err != nil {
+			a.fail(publishState, acc, err)
+			return
 		}
+		acc.loggedIn = true
+	}
 
-	case "web":
-		slog.Info("setting mode", slog.String("mode", mode))
-		growattService := growatt_web.NewGrowattService(growatt_web.Options{
-			ServerUrl:                     cfg.Growatt.ServerUrlWeb,
-			Username:                      cfg.Growatt.Username,
-			Password:                      cfg.Growatt.Password,
-			PollingInterval:               cfg.PollingInterval,
-			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
-			ParameterPollingInterval:      cfg.ParameterPollingInterval,
-			Location:                      cfg.Growatt.Location,
-		})
+	publishState(models.ServiceState{State: models.ServiceStateEnumerating, Status: models.HealthUndefined})
+	err := misc.Retry(ctx, "device enumeration", misc.DefaultBackoff, acc.startPolling(ep), reportRetry(publishState, models.ServiceStateEnumerating))
+	if err != nil {
+		a.fail(publishState, acc, err)
+		return
+	}
 
-		if err := growattService.Login(); err != nil {
-			slog.Error("could not login to growatt account", slog.String("error", err.Error()))
-			misc.Panic(err)
-		}
+	acc.setParameterApplier(ep)
 
-		return &App{
-			mode:              mode,
-			cfg:               cfg,
-			growattWebService: growattService,
-		}
+	publishState(models.ServiceState{State: models.ServiceStateRunning, Status: models.HealthOk})
+}
 
-	case "web+app":
-		slog.Info("setting mode", slog.String("mode", mode))
-		growattService := growatt_web.NewGrowattService(growatt_web.Options{
-			ServerUrl:                     cfg.Growatt.ServerUrlWeb,
-			Username:                      cfg.Growatt.Username,
-			Password:                      cfg.Growatt.Password,
-			PollingInterval:               cfg.PollingInterval,
-			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
-			ParameterPollingInterval:      cfg.ParameterPollingInterval,
-			Location:                      cfg.Growatt.Location,
-		})
+// fail handles an error that ended a retry loop. Invalid credentials end the
+// process, a cancelled context is part of a disconnect or the shutdown.
+func (a *App) fail(publishState func(models.ServiceState), acc *account, err error) {
+	if !errors.Is(err, misc.ErrInvalidCredentials) {
+		return
+	}
 
-		if err := growattService.Login(); err != nil {
-			slog.Error("could not login to growatt account", slog.String("error", err.Error()))
-			misc.Panic(err)
-		}
+	slog.Error("could not login to growatt account", slog.String("account", acc.name), slog.String("error", err.Error()))
+	publishState(models.ServiceState{State: models.ServiceStateFailed, Status: models.HealthError, Message: err.Error()})
+	misc.Panic(err)
+}
 
-		growattApp := growatt_app.NewGrowattAppService(growatt_app.Options{
-			ServerUrl:                     cfg.Growatt.ServerUrlApp,
-			Username:                      cfg.Growatt.Username,
-			Password:                      cfg.Growatt.Password,
-			PollingInterval:               cfg.PollingInterval,
-			BatteryDetailsPollingInterval: cfg.BatteryDetailsPollingInterval,
-			ParameterPollingInterval:      cfg.ParameterPollingInterval,
+func reportRetry(publishState func(models.ServiceState), state string) misc.RetryFunc {
+	return func(attempt int, err error, wait time.Duration) {
+		nextRetry := time.Now().Add(wait).Round(time.Second)
+		publishState(models.ServiceState{
+			State:     state,
+			Status:    models.HealthError,
+			Message:   err.Error(),
+			Attempt:   attempt,
+			NextRetry: &nextRetry,
 		})
+	}
+}
 
-		return &App{
-			mode:              mode,
-			cfg:               cfg,
-			growattWebService: growattService,
-			growattAppService: growattApp,
-		}
+func NewApp(cfg config.Config) *App {
+	filter := newDeviceFilter(cfg.Devices)
 
-	default:
-		misc.Panic(fmt.Errorf("invalid growatt api type: %s", cfg.Growatt.APIMode))
+	app := &App{cfg: cfg}
+	for _, accountCfg := range cfg.Accounts {
+		app.accounts = append(app.accounts, newAccount(accountCfg, cfg.Backfill.MaxAge, filter))
+	}
+	return app
+}
+
+// maxPollingInterval returns the longest polling interval of the accounts
+func maxPollingInterval(accounts []config.Account) time.Duration {
+	var interval time.Duration
+	for _, account := range accounts {
+		interval = max(interval, account.PollingInterval)
+	}
+	return interval
+}
+
+// maxDetailsPollingInterval returns the longest battery details polling
+// interval of the accounts
+func maxDetailsPollingInterval(accounts []config.Account) time.Duration {
+	var interval time.Duration
+	for _, account := range accounts {
+		interval = max(interval, account.BatteryDetailsPollingInterval)
+	}
+	return interval
+}
+
+// newDeviceFilter returns the filter of the configured devices, nil if all
+// devices are published unchanged
+func newDeviceFilter(cfg config.Devices) *devicefilter.Filter {
+	if len(cfg.Include) == 0 && len(cfg.Exclude) == 0 && len(cfg.Overrides) == 0 {
 		return nil
 	}
+
+	overrides := make(map[string]devicefilter.Override)
+	for serial, o := range cfg.Overrides {
+		overrides[serial] = devicefilter.Override{
+			Alias:     o.Alias,
+			Model:     o.Model,
+			Batteries: o.Batteries,
+		}
+	}
+	slog.Info("filtering devices", slog.Any("include", cfg.Include), slog.Any("exclude", cfg.Exclude), slog.Int("overrides", len(overrides)))
+	return devicefilter.New(devicefilter.Options{
+		Include:   cfg.Include,
+		Exclude:   cfg.Exclude,
+		Overrides: overrides,
+	})
 }
 
-func connectMqtt(mqttCfg config.Mqtt, app *App) {
+// connectMqtt connects to the mqtt broker, retrying with backoff until the
+// connection is established or ctx is cancelled. A broker that rejects the
+// credentials is not retried.
+func connectMqtt(ctx context.Context, mqttCfg config.Mqtt, app *App) (mqtt.Client, error) {
 	var brokerUrl string
 	if mqttCfg.BrokerURL != "" {
 		brokerUrl = mqttCfg.BrokerURL
@@ -215,8 +455,20 @@ func connectMqtt(mqttCfg config.Mqtt, app *App) {
 
 	c := mqtt.NewClient(opts)
 	slog.Info("connecting to mqtt broker", slog.String("brokerUrl", brokerUrl), slog.String("host", mqttCfg.Host), slog.Int("port", mqttCfg.Port), slog.String("clientId", mqttCfg.ClientId), slog.String("username", mqttCfg.Username))
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		slog.Error("could not connect to mqtt broker", slog.String("error", token.Error().Error()))
-		misc.Panic(token.Error())
+	err := misc.Retry(ctx, "mqtt connect", misc.DefaultBackoff, func() error {
+		token := c.Connect()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			if errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) || errors.Is(err, packets.ErrorRefusedNotAuthorised) {
+				return fmt.Errorf("%w: %w", misc.ErrInvalidCredentials, err)
+			}
+			return err
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		slog.Error("could not connect to mqtt broker", slog.String("error", err.Error()))
+		return nil, err
 	}
+	return c, nil
 }
@@ -0,0 +1,117 @@
+package backfill
+
+import (
+	"encoding/csv"
+	"fmt"
+	"nexa-mqtt/pkg/models"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// batteries and pvs are the number of battery and pv columns of a csv row
+const (
+	batteries = 4
+	pvs       = 4
+)
+
+// CsvSink appends the samples to a csv file. The header is written if the
+// file is empty.
+type CsvSink struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewCsvSink(path string) *CsvSink {
+	return &CsvSink{path: path}
+}
+
+func (c *CsvSink) WriteSample(device models.NoahDevicePayload, sample models.HistorySample) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		if err := w.Write(csvHeader()); err != nil {
+			return err
+		}
+	}
+	if err := w.Write(csvRow(device, sample)); err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func csvHeader() []string {
+	header := []string{
+		"time", "serial", "ac_w", "solar_w", "soc", "charge_w", "discharge_w",
+		"generation_total_kwh", "generation_today_kwh", "work_mode", "status",
+		"system_temp", "battery_soh",
+	}
+	for i := range batteries {
+		header = append(header, fmt.Sprintf("bat%d_soc", i), fmt.Sprintf("bat%d_temp", i))
+	}
+	for i := range pvs {
+		header = append(header, fmt.Sprintf("pv%d_voltage", i), fmt.Sprintf("pv%d_current", i))
+	}
+	return append(header, "meter_active_power_w", "meter_forward_active_energy_kwh", "meter_reverse_active_energy_kwh")
+}
+
+// csvRow returns the values of sample, values that are not available are
+// empty
+func csvRow(device models.NoahDevicePayload, sample models.HistorySample) []string {
+	d := sample.Device
+	row := []string{
+		sample.Time.Format(time.RFC3339), device.Serial,
+		formatFloat(d.ACPower), formatFloat(d.SolarPower), formatFloat(d.Soc),
+		formatFloat(d.ChargePower), formatFloat(d.DischargePower),
+		formatFloat(d.GenerationTotalEnergy), formatFloat(d.GenerationTodayEnergy),
+		string(d.WorkMode), d.Status,
+		formatOptional(d.SystemTemperature), formatOptional(d.BatterySoh),
+	}
+	for i := range batteries {
+		if i < len(sample.Batteries) {
+			row = append(row, formatFloat(sample.Batteries[i].Soc), formatFloat(sample.Batteries[i].Temperature))
+		} else {
+			row = append(row, "", "")
+		}
+	}
+	for i := range pvs {
+		if i < len(sample.Pvs) {
+			row = append(row, formatFloat(sample.Pvs[i].Voltage), formatFloat(sample.Pvs[i].Current))
+		} else {
+			row = append(row, "", "")
+		}
+	}
+	if m := sample.Meter; m != nil {
+		return append(row, formatFloat(m.ActivePower), formatFloat(m.ForwardActiveEnergy), formatFloat(m.ReverseActiveEnergy))
+	}
+	return append(row, "", "", "")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatOptional(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return formatFloat(*f)
+}
@@ -0,0 +1,109 @@
+package backfill
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"nexa-mqtt/pkg/models"
+	"strings"
+	"time"
+)
+
+// InfluxSink writes the samples in the InfluxDB line protocol to the write
+// endpoint of an InfluxDB, e.g.
+// http://influxdb:8086/api/v2/write?org=home&bucket=nexa
+type InfluxSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewInfluxSink returns a sink that writes to writeUrl. The precision of the
+// timestamps is seconds. token is sent as API token if it is not empty.
+func NewInfluxSink(writeUrl string, token string) (*InfluxSink, error) {
+	u, err := url.Parse(writeUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid influxdb url: %w", err)
+	}
+	q := u.Query()
+	q.Set("precision", "s")
+	u.RawQuery = q.Encode()
+
+	return &InfluxSink{
+		url:    u.String(),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *InfluxSink) WriteSample(device models.NoahDevicePayload, sample models.HistorySample) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(lineProtocol(device, sample)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb write failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// lineProtocol returns one line for the device and one for each battery, pv
+// and the meter
+func lineProtocol(device models.NoahDevicePayload, sample models.HistorySample) string {
+	var b strings.Builder
+	ts := sample.Time.Unix()
+	serial := tagEscaper.Replace(device.Serial)
+	d := sample.Device
+
+	fields := []string{
+		field("ac_w", d.ACPower),
+		field("solar_w", d.SolarPower),
+		field("soc", d.Soc),
+		field("charge_w", d.ChargePower),
+		field("discharge_w", d.DischargePower),
+		field("generation_total_kwh", d.GenerationTotalEnergy),
+		field("generation_today_kwh", d.GenerationTodayEnergy),
+	}
+	if d.SystemTemperature != nil {
+		fields = append(fields, field("system_temp", *d.SystemTemperature))
+	}
+	if d.BatterySoh != nil {
+		fields = append(fields, field("battery_soh", *d.BatterySoh))
+	}
+	fmt.Fprintf(&b, "nexa,serial=%s %s %d\n", serial, strings.Join(fields, ","), ts)
+
+	for i, bat := range sample.Batteries {
+		fmt.Fprintf(&b, "nexa_battery,serial=%s,battery=%d %s,%s %d\n", serial, i, field("soc", bat.Soc), field("temp", bat.Temperature), ts)
+	}
+	for i, pv := range sample.Pvs {
+		fmt.Fprintf(&b, "nexa_pv,serial=%s,pv=%d %s,%s,%s %d\n", serial, i, field("voltage", pv.Voltage), field("current", pv.Current), field("temp", pv.Temp), ts)
+	}
+	if m := sample.Meter; m != nil {
+		fmt.Fprintf(&b, "nexa_meter,serial=%s %s,%s,%s,%s %d\n", serial,
+			field("active_power_w", m.ActivePower),
+			field("frequency", m.Frequency),
+			field("forward_active_energy_kwh", m.ForwardActiveEnergy),
+			field("reverse_active_energy_kwh", m.ReverseActiveEnergy),
+			ts)
+	}
+	return b.String()
+}
+
+func field(name string, value float64) string {
+	return name + "=" + formatFloat(value)
+}
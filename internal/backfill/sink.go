@@ -0,0 +1,18 @@
+// Package backfill writes the samples of the Growatt history data with their
+// original timestamp to a sink, to fill the gaps left by an outage.
+package backfill
+
+import (
+	"nexa-mqtt/pkg/models"
+)
+
+// Sink receives the samples of a backfill, oldest first
+type Sink interface {
+	WriteSample(device models.NoahDevicePayload, sample models.HistorySample) error
+}
+
+const (
+	SinkMqtt   = "mqtt"
+	SinkCsv    = "csv"
+	SinkInflux = "influx"
+)
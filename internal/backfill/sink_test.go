@@ -0,0 +1,94 @@
+package backfill
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nexa-mqtt/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSample(tm time.Time) models.HistorySample {
+	temp := 31.5
+	return models.HistorySample{
+		Time: tm,
+		Device: models.DevicePayload{
+			ACPower:               -314,
+			SolarPower:            420.5,
+			Soc:                   63,
+			DischargePower:        120,
+			GenerationTotalEnergy: 319.8,
+			WorkMode:              models.WorkModeLoadFirst,
+			Status:                models.OnGrid,
+			SystemTemperature:     &temp,
+		},
+		Batteries: []models.BatteryPayload{{Time: tm, Soc: 64, Temperature: 21}},
+		Pvs:       []models.PvPayload{{Time: tm, Voltage: 33.15, Current: 1.72, Temp: 23}},
+	}
+}
+
+func TestCsvSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.csv")
+	device := models.NoahDevicePayload{Serial: "device123"}
+	tm := time.Date(2025, 5, 20, 8, 3, 0, 0, time.UTC)
+	sink := NewCsvSink(file)
+
+	assert.NoError(t, sink.WriteSample(device, testSample(tm)))
+	assert.NoError(t, sink.WriteSample(device, testSample(tm.Add(3*time.Minute))))
+
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "time,serial,ac_w,solar_w,soc,"))
+	assert.Equal(t, "2025-05-20T08:03:00Z,device123,-314,420.5,63,0,120,319.8,0,load_first,on_grid,31.5,,64,21,,,,,,,33.15,1.72,,,,,,,,,", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "2025-05-20T08:06:00Z,device123,"))
+}
+
+func TestInfluxSink(t *testing.T) {
+	var body string
+	var query string
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		query = r.URL.RawQuery
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL+"/api/v2/write?org=home&bucket=nexa", "token123")
+	assert.NoError(t, err)
+
+	tm := time.Date(2025, 5, 20, 8, 3, 0, 0, time.UTC)
+	sample := testSample(tm)
+	sample.Meter = &models.MeterPayload{Time: tm, ActivePower: -412.3, Frequency: 50}
+	assert.NoError(t, sink.WriteSample(models.NoahDevicePayload{Serial: "device123"}, sample))
+
+	assert.Equal(t, "bucket=nexa&org=home&precision=s", query)
+	assert.Equal(t, "Token token123", auth)
+	assert.Equal(t, "nexa,serial=device123 ac_w=-314,solar_w=420.5,soc=63,charge_w=0,discharge_w=120,generation_total_kwh=319.8,generation_today_kwh=0,system_temp=31.5 1747728180\n"+
+		"nexa_battery,serial=device123,battery=0 soc=64,temp=21 1747728180\n"+
+		"nexa_pv,serial=device123,pv=0 voltage=33.15,current=1.72,temp=23 1747728180\n"+
+		"nexa_meter,serial=device123 active_power_w=-412.3,frequency=50,forward_active_energy_kwh=0,reverse_active_energy_kwh=0 1747728180\n", body)
+}
+
+func TestInfluxSink_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bucket not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	sink, err := NewInfluxSink(server.URL, "")
+	assert.NoError(t, err)
+
+	err = sink.WriteSample(models.NoahDevicePayload{Serial: "device123"}, testSample(time.Now()))
+	assert.EqualError(t, err, "influxdb write failed: 404 Not Found: bucket not found")
+}
@@ -0,0 +1,74 @@
+package backfill
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/internal/misc"
+	"os"
+	"sync"
+	"time"
+)
+
+// State keeps the time of the last sample published by the pollers for each
+// device, so the gap since then can be backfilled.
+type State struct {
+	file string
+	lock sync.Mutex
+	last map[string]time.Time
+}
+
+// NewState returns the state, restored from file if it exists. Without a
+// file the state is kept in memory only and gaps are only detected while
+// nexa-mqtt is running, e.g. after a broker outage.
+func NewState(file string) (*State, error) {
+	s := &State{
+		file: file,
+		last: make(map[string]time.Time),
+	}
+
+	if file == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read backfill state: %w", err)
+	}
+	if err := json.Unmarshal(b, &s.last); err != nil {
+		return nil, fmt.Errorf("could not parse backfill state %s: %w", file, err)
+	}
+	return s, nil
+}
+
+// Seen records tm as the time of the last sample of the device and returns
+// the previous time. It returns the zero time if no sample was seen before.
+func (s *State) Seen(serial string, tm time.Time) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	previous := s.last[serial]
+	if !tm.After(previous) {
+		return previous
+	}
+	s.last[serial] = tm
+
+	if s.file != "" {
+		if err := s.save(); err != nil {
+			slog.Error("could not save backfill state", slog.String("error", err.Error()))
+		}
+	}
+	return previous
+}
+
+// save writes the state to the state file. s.lock must be held by the caller.
+func (s *State) save() error {
+	b, err := json.Marshal(s.last)
+	if err != nil {
+		return err
+	}
+	return misc.WriteFileAtomic(s.file, b)
+}
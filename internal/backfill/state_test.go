@@ -0,0 +1,35 @@
+package backfill
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestState_Seen(t *testing.T) {
+	s, err := NewState("")
+	assert.NoError(t, err)
+	tm := time.Now().Truncate(time.Second)
+
+	assert.True(t, s.Seen("device123", tm).IsZero())
+	assert.Equal(t, tm, s.Seen("device123", tm.Add(3*time.Minute)))
+	// older samples do not move the last time back
+	assert.Equal(t, tm.Add(3*time.Minute), s.Seen("device123", tm))
+	assert.Equal(t, tm.Add(3*time.Minute), s.Seen("device123", tm.Add(6*time.Minute)))
+	assert.True(t, s.Seen("device234", tm).IsZero())
+}
+
+func TestState_Persist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backfill.json")
+	tm := time.Now().Truncate(time.Second)
+
+	s, err := NewState(file)
+	assert.NoError(t, err)
+	s.Seen("device123", tm)
+
+	restored, err := NewState(file)
+	assert.NoError(t, err)
+	assert.True(t, tm.Equal(restored.Seen("device123", tm.Add(time.Minute))))
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,18 +19,41 @@ type Config struct {
 	PollingInterval               time.Duration
 	BatteryDetailsPollingInterval time.Duration
 	ParameterPollingInterval      time.Duration
+	EnumerationInterval           time.Duration
+	ShutdownTimeout               time.Duration
 	Growatt                       Growatt
 	Mqtt                          Mqtt
 	HomeAssistant                 HomeAssistant
+	Metrics                       Metrics
+	Energy                        Energy
+	Backfill                      Backfill
+	Devices                       Devices
+	// Accounts are all Growatt accounts, the first one is made of the
+	// settings above, followed by the named accounts sorted by name
+	Accounts []Account
 }
 
 type Growatt struct {
-	APIMode      string
-	ServerUrlWeb string
-	ServerUrlApp string
-	Username     string
-	Password     string
-	Location     *time.Location
+	APIMode           string
+	ServerUrlWeb      string
+	ServerUrlApp      string
+	Username          string
+	Password          string
+	Location          *time.Location
+	FailoverThreshold int
+}
+
+// Account is a Growatt account with its own API mode and intervals. Named
+// accounts are configured with the prefix ACCOUNT_{NAME}_, e.g.
+// ACCOUNT_RELATIVES_GROWATT_USERNAME. Their settings default to the ones of
+// the first account, except for the username and the password.
+type Account struct {
+	Name                          string // empty for the first account
+	Growatt                       Growatt
+	PollingInterval               time.Duration
+	BatteryDetailsPollingInterval time.Duration
+	ParameterPollingInterval      time.Duration
+	EnumerationInterval           time.Duration
 }
 
 type Mqtt struct {
@@ -40,13 +66,47 @@ type Mqtt struct {
 	TopicPrefix string
 }
 
+type Metrics struct {
+	Listen string
+}
+
+type Energy struct {
+	File string
+}
+
+type Backfill struct {
+	Sink      string // mqtt, csv or influx, empty disables the backfill
+	Target    string // file of the csv sink, write url of the influx sink
+	Token     string // api token of the influx sink
+	StateFile string
+	MaxAge    time.Duration
+}
+
+type Devices struct {
+	Include   []string // serials or plant ids, empty includes all devices
+	Exclude   []string // serials or plant ids
+	Overrides map[string]DeviceOverride
+}
+
+// DeviceOverride replaces the names of a device, the key is the serial
+type DeviceOverride struct {
+	Alias     string
+	Model     string
+	Batteries []string
+}
+
 type HomeAssistant struct {
 	TopicPrefix    string
 	SwitchAsSelect bool
+	Discovery      string // "entity" or "device"
+	StateFile      string
+	BatteryDevices bool
+	PVDevices      bool
 }
 
 var _config Config
 var _once sync.Once
+var _secretErrors []error
 
 func Get() Config {
 	_once.Do(func() {
@@ -55,13 +115,16 @@ func Get() Config {
 			PollingInterval:               time.Duration(s2i(getEnv("POLLING_INTERVAL", "30"))) * time.Second,
 			BatteryDetailsPollingInterval: time.Duration(s2i(getEnv("BATTERY_DETAILS_POLLING_INTERVAL", "180"))) * time.Second,
 			ParameterPollingInterval:      time.Duration(s2i(getEnv("PARAMETER_POLLING_INTERVAL", "180"))) * time.Second,
+			EnumerationInterval:           time.Duration(s2i(getEnv("ENUMERATION_INTERVAL", "3600"))) * time.Second,
+			ShutdownTimeout:               time.Duration(s2i(getEnv("SHUTDOWN_TIMEOUT", "10"))) * time.Second,
 			Growatt: Growatt{
-				APIMode:      getEnv("GROWATT_API_MODE", "web"),
-				ServerUrlWeb: getEnv("GROWATT_SERVER_URL_WEB", "https://openapi.growatt.com"),
-				ServerUrlApp: getEnv("GROWATT_SERVER_URL_APP", "https://server-api.growatt.com"),
-				Username:     getEnv("GROWATT_USERNAME", ""),
-				Password:     getEnv("GROWATT_PASSWORD", ""),
-				Location:     getLocation(getEnv("GROWATT_TZ", "")),
+				APIMode:           getEnv("GROWATT_API_MODE", "web"),
+				ServerUrlWeb:      getEnv("GROWATT_SERVER_URL_WEB", "https://openapi.growatt.com"),
+				ServerUrlApp:      getEnv("GROWATT_SERVER_URL_APP", "https://server-api.growatt.com"),
+				Username:          getEnv("GROWATT_USERNAME", ""),
+				Password:          getSecret("GROWATT_PASSWORD"),
+				Location:          getLocation(getEnv("GROWATT_TZ", "")),
+				FailoverThreshold: s2i(getEnv("GROWATT_FAILOVER_THRESHOLD", "3")),
 			},
 			Mqtt: Mqtt{
 				BrokerURL:   getEnv("MQTT_BROKER_URL", ""),
@@ -69,31 +132,90 @@ func Get() Config {
 				Port:        s2i(getEnv("MQTT_PORT", "1883")),
 				ClientId:    getEnv("MQTT_CLIENT_ID", "nexa-mqtt"),
 				Username:    getEnv("MQTT_USERNAME", ""),
-				Password:    getEnv("MQTT_PASSWORD", ""),
+				Password:    getSecret("MQTT_PASSWORD"),
 				TopicPrefix: getEnv("MQTT_TOPIC_PREFIX", "nexa2mqtt"),
 			},
 			HomeAssistant: HomeAssistant{
 				TopicPrefix:    getEnv("HOMEASSISTANT_TOPIC_PREFIX", "homeassistant"),
 				SwitchAsSelect: s2bool(getEnv("HOMEASSISTANT_SWITCH_AS_SELECT", "false"), false),
+				Discovery:      strings.ToLower(strings.TrimSpace(getEnv("HOMEASSISTANT_DISCOVERY", "entity"))),
+				StateFile:      getEnv("HOMEASSISTANT_STATE_FILE", ""),
+				BatteryDevices: s2bool(getEnv("HOMEASSISTANT_BATTERY_DEVICES", "false"), false),
+				PVDevices:      s2bool(getEnv("HOMEASSISTANT_PV_DEVICES", "false"), false),
+			},
+			Metrics: Metrics{
+				Listen: getEnv("METRICS_LISTEN", ""),
+			},
+			Energy: Energy{
+				File: getEnv("ENERGY_FILE", ""),
+			},
+			Backfill: Backfill{
+				Sink:      strings.ToLower(strings.TrimSpace(getEnv("BACKFILL_SINK", ""))),
+				Target:    getEnv("BACKFILL_TARGET", ""),
+				Token:     getSecret("BACKFILL_TOKEN"),
+				StateFile: getEnv("BACKFILL_STATE_FILE", ""),
+				MaxAge:    time.Duration(s2i(getEnv("BACKFILL_MAX_AGE", "86400"))) * time.Second,
 			},
+			Devices: Devices{
+				Include:   s2list(getEnv("DEVICES_INCLUDE", "")),
+				Exclude:   s2list(getEnv("DEVICES_EXCLUDE", "")),
+				Overrides: getDeviceOverrides(),
+			},
+		}
+		first := Account{
+			Growatt:                       _config.Growatt,
+			PollingInterval:               _config.PollingInterval,
+			BatteryDetailsPollingInterval: _config.BatteryDetailsPollingInterval,
+			ParameterPollingInterval:      _config.ParameterPollingInterval,
+			EnumerationInterval:           _config.EnumerationInterval,
 		}
+		_config.Accounts = append([]Account{first}, getAccounts(first)...)
 	})
 	return _config
 }
 
 func Validate() error {
 	config := Get()
+	if len(_secretErrors) > 0 {
+		return errors.Join(_secretErrors...)
+	}
 	if len(config.Mqtt.Host) == 0 && len(config.Mqtt.BrokerURL) == 0 {
-		return errors.New("MQTT_HOST or MQTT_BROKER_URL is required")
+		return fmt.Errorf("%s or %s is required", describe("MQTT_HOST"), describe("MQTT_BROKER_URL"))
 	}
 	if len(config.Growatt.Username) == 0 {
-		return errors.New("GROWATT_USERNAME is required")
+		return fmt.Errorf("%s is required", describe("GROWATT_USERNAME"))
 	}
 	if len(config.Growatt.Password) == 0 {
-		return errors.New("GROWATT_PASSWORD is required")
+		return fmt.Errorf("%s or %s is required", describe("GROWATT_PASSWORD"), describe("GROWATT_PASSWORD_FILE"))
 	}
 	if config.Growatt.Location == nil {
-		return fmt.Errorf("GROWATT_TZ '%s' is invalid", getEnv("GROWATT_TZ", ""))
+		return fmt.Errorf("%s '%s' is invalid", describe("GROWATT_TZ"), getEnv("GROWATT_TZ", ""))
+	}
+	for _, account := range config.Accounts[1:] {
+		prefix := accountPrefix(account.Name)
+		if len(account.Growatt.Username) == 0 {
+			return fmt.Errorf("%s is required for account '%s'", describe(prefix+"GROWATT_USERNAME"), account.Name)
+		}
+		if len(account.Growatt.Password) == 0 {
+			return fmt.Errorf("%s or %s is required for account '%s'", describe(prefix+"GROWATT_PASSWORD"), describe(prefix+"GROWATT_PASSWORD_FILE"), account.Name)
+		}
+		if account.Growatt.Location == nil {
+			return fmt.Errorf("%s '%s' is invalid", describe(prefix+"GROWATT_TZ"), getEnv(prefix+"GROWATT_TZ", ""))
+		}
+	}
+	switch config.HomeAssistant.Discovery {
+	case "entity", "device":
+	default:
+		return fmt.Errorf("%s '%s' is invalid", describe("HOMEASSISTANT_DISCOVERY"), config.HomeAssistant.Discovery)
+	}
+	switch config.Backfill.Sink {
+	case "", "mqtt":
+	case "csv", "influx":
+		if len(config.Backfill.Target) == 0 {
+			return fmt.Errorf("%s is required for %s '%s'", describe("BACKFILL_TARGET"), describe("BACKFILL_SINK"), config.Backfill.Sink)
+		}
+	default:
+		return fmt.Errorf("%s '%s' is invalid", describe("BACKFILL_SINK"), config.Backfill.Sink)
 	}
 	return nil
 }
@@ -102,9 +224,41 @@ func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
 	}
+	if value, ok := _file.lookup(key); ok {
+		return value
+	}
 	return fallback
 }
 
+// getSecret returns the value of a secret setting. If it is not given
+// directly, it is read from the file named by the setting with the suffix
+// _FILE, e.g. GROWATT_PASSWORD_FILE, so Docker secrets and systemd credentials
+// can be used. Environment variables take precedence over the config file.
+func getSecret(key string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	if path, ok := os.LookupEnv(key + "_FILE"); ok {
+		return readSecret(key+"_FILE", path)
+	}
+	if value, ok := _file.lookup(key); ok {
+		return value
+	}
+	if path, ok := _file.lookup(key + "_FILE"); ok {
+		return readSecret(key+"_FILE", path)
+	}
+	return ""
+}
+
+func readSecret(key string, path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		_secretErrors = append(_secretErrors, fmt.Errorf("%s: could not read secret: %w", describe(key), err))
+		return ""
+	}
+	return strings.TrimRight(string(b), "\r\n")
+}
+
 func s2i(s string) int {
 	i, err := strconv.Atoi(s)
 	if err != nil {
@@ -120,6 +274,128 @@ func s2bool(s string, fallback bool) bool {
 	return fallback
 }
 
+// s2list splits a comma separated list and drops empty entries
+func s2list(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// deviceOverridePattern matches the settings of a device override, e.g.
+// DEVICE_0PVPH6ZR23QT00D3_ALIAS
+var deviceOverridePattern = regexp.MustCompile(`^DEVICE_([A-Z0-9]+)_(ALIAS|MODEL|BATTERIES)$`)
+
+// getDeviceOverrides collects the overrides of all devices from the
+// environment and the configuration file.
+func getDeviceOverrides() map[string]DeviceOverride {
+	overrides := make(map[string]DeviceOverride)
+	for _, key := range settingKeys() {
+		m := deviceOverridePattern.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+		serial, value := m[1], strings.TrimSpace(getEnv(key, ""))
+		o := overrides[serial]
+		switch m[2] {
+		case "ALIAS":
+			o.Alias = value
+		case "MODEL":
+			o.Model = value
+		case "BATTERIES":
+			// keep empty names, so "Left,,Right" only renames the first and
+			// the third battery
+			o.Batteries = nil
+			for _, name := range strings.Split(value, ",") {
+				o.Batteries = append(o.Batteries, strings.TrimSpace(name))
+			}
+		}
+		overrides[serial] = o
+	}
+	return overrides
+}
+
+// accountSettings are the settings that can be given per account
+var accountSettings = []string{
+	"POLLING_INTERVAL",
+	"BATTERY_DETAILS_POLLING_INTERVAL",
+	"PARAMETER_POLLING_INTERVAL",
+	"ENUMERATION_INTERVAL",
+	"GROWATT_API_MODE",
+	"GROWATT_FAILOVER_THRESHOLD",
+	"GROWATT_SERVER_URL_WEB",
+	"GROWATT_SERVER_URL_APP",
+	"GROWATT_USERNAME",
+	"GROWATT_PASSWORD",
+	"GROWATT_PASSWORD_FILE",
+	"GROWATT_TZ",
+}
+
+// accountPattern matches the settings of a named account, e.g.
+// ACCOUNT_RELATIVES_GROWATT_USERNAME
+var accountPattern = regexp.MustCompile(`^ACCOUNT_([A-Z0-9]+)_(` + strings.Join(accountSettings, "|") + `)$`)
+
+func accountPrefix(name string) string {
+	return fmt.Sprintf("ACCOUNT_%s_", strings.ToUpper(name))
+}
+
+// getAccounts returns the named accounts of the environment and the
+// configuration file, sorted by name. Settings that are not given are taken
+// from first, except for the username and the password.
+func getAccounts(first Account) []Account {
+	var names []string
+	for _, key := range settingKeys() {
+		if m := accountPattern.FindStringSubmatch(key); m != nil && !slices.Contains(names, m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	slices.Sort(names)
+
+	seconds := func(key string, fallback time.Duration) time.Duration {
+		return time.Duration(s2i(getEnv(key, strconv.Itoa(int(fallback/time.Second))))) * time.Second
+	}
+
+	var accounts []Account
+	for _, name := range names {
+		prefix := accountPrefix(name)
+		accounts = append(accounts, Account{
+			Name: strings.ToLower(name),
+			Growatt: Growatt{
+				APIMode:           getEnv(prefix+"GROWATT_API_MODE", first.Growatt.APIMode),
+				ServerUrlWeb:      getEnv(prefix+"GROWATT_SERVER_URL_WEB", first.Growatt.ServerUrlWeb),
+				ServerUrlApp:      getEnv(prefix+"GROWATT_SERVER_URL_APP", first.Growatt.ServerUrlApp),
+				Username:          getEnv(prefix+"GROWATT_USERNAME", ""),
+				Password:          getSecret(prefix + "GROWATT_PASSWORD"),
+				Location:          getLocation(getEnv(prefix+"GROWATT_TZ", getEnv("GROWATT_TZ", ""))),
+				FailoverThreshold: s2i(getEnv(prefix+"GROWATT_FAILOVER_THRESHOLD", strconv.Itoa(first.Growatt.FailoverThreshold))),
+			},
+			PollingInterval:               seconds(prefix+"POLLING_INTERVAL", first.PollingInterval),
+			BatteryDetailsPollingInterval: seconds(prefix+"BATTERY_DETAILS_POLLING_INTERVAL", first.BatteryDetailsPollingInterval),
+			ParameterPollingInterval:      seconds(prefix+"PARAMETER_POLLING_INTERVAL", first.ParameterPollingInterval),
+			EnumerationInterval:           seconds(prefix+"ENUMERATION_INTERVAL", first.EnumerationInterval),
+		})
+	}
+	return accounts
+}
+
+// settingKeys returns the names of all environment variables and of all
+// settings of the configuration file
+func settingKeys() []string {
+	var keys []string
+	for _, kv := range os.Environ() {
+		keys = append(keys, strings.SplitN(kv, "=", 2)[0])
+	}
+	if _file != nil {
+		for env := range _file.values {
+			keys = append(keys, env)
+		}
+	}
+	return keys
+}
+
 func getLocation(s string) *time.Location {
 	if s == "" {
 		return time.Local
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSecret(t *testing.T) {
+	secretFile := writeConfigFile(t, "password", "from-secret-file\n")
+	path := writeConfigFile(t, "config.yaml", "growatt:\n  password: from-config\nmqtt:\n  password_file: "+secretFile+"\n")
+	file, err := readConfigFile(path)
+	assert.NoError(t, err)
+
+	_file = file
+	defer func() { _file = nil }()
+
+	// config file values
+	assert.Equal(t, "from-config", getSecret("GROWATT_PASSWORD"))
+	assert.Equal(t, "from-secret-file", getSecret("MQTT_PASSWORD"))
+
+	// environment overrides config file
+	t.Setenv("GROWATT_PASSWORD_FILE", secretFile)
+	assert.Equal(t, "from-secret-file", getSecret("GROWATT_PASSWORD"))
+
+	t.Setenv("GROWATT_PASSWORD", "from-env")
+	assert.Equal(t, "from-env", getSecret("GROWATT_PASSWORD"))
+
+	assert.Empty(t, _secretErrors)
+}
+
+func TestGetSecret_MissingFile(t *testing.T) {
+	defer func() { _secretErrors = nil }()
+	t.Setenv("MQTT_PASSWORD_FILE", "/does/not/exist")
+
+	assert.Equal(t, "", getSecret("MQTT_PASSWORD"))
+	assert.Len(t, _secretErrors, 1)
+	assert.Contains(t, _secretErrors[0].Error(), "MQTT_PASSWORD_FILE: could not read secret")
+}
+
+func TestGetDeviceOverrides(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+devices:
+  exclude: 4711
+  overrides:
+    Serial123:
+      alias: Garage
+      model: from-file
+      batteries: Left,,Right
+`)
+	file, err := readConfigFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "4711", file.values["DEVICES_EXCLUDE"].value)
+
+	_file = file
+	defer func() { _file = nil }()
+	t.Setenv("DEVICE_SERIAL123_MODEL", "NEXA 2000")
+	t.Setenv("DEVICE_SERIAL234_ALIAS", "Balcony")
+
+	assert.Equal(t, map[string]DeviceOverride{
+		"SERIAL123": {Alias: "Garage", Model: "NEXA 2000", Batteries: []string{"Left", "", "Right"}},
+		"SERIAL234": {Alias: "Balcony"},
+	}, getDeviceOverrides())
+}
+
+func TestS2list(t *testing.T) {
+	assert.Nil(t, s2list(""))
+	assert.Equal(t, []string{"Serial123", "4711"}, s2list(" Serial123, ,4711 "))
+}
+
+func TestGetAccounts(t *testing.T) {
+	secretFile := writeConfigFile(t, "password", "relatives-secret\n")
+	path := writeConfigFile(t, "config.yaml", `
+accounts:
+  relatives:
+    polling_interval: 60
+    growatt:
+      api_mode: app
+      username: relative
+      password_file: `+secretFile+`
+      tz: Europe/Vienna
+`)
+	file, err := readConfigFile(path)
+	assert.NoError(t, err)
+
+	_file = file
+	defer func() { _file = nil }()
+	t.Setenv("ACCOUNT_OFFICE_GROWATT_USERNAME", "office")
+	t.Setenv("ACCOUNT_OFFICE_GROWATT_PASSWORD", "office-secret")
+
+	first := Account{
+		Growatt: Growatt{
+			APIMode:           "web",
+			ServerUrlWeb:      "https://openapi.growatt.com",
+			ServerUrlApp:      "https://server-api.growatt.com",
+			Username:          "own",
+			Location:          time.UTC,
+			FailoverThreshold: 3,
+		},
+		PollingInterval:               30 * time.Second,
+		BatteryDetailsPollingInterval: 180 * time.Second,
+		ParameterPollingInterval:      180 * time.Second,
+		EnumerationInterval:           3600 * time.Second,
+	}
+
+	accounts := getAccounts(first)
+
+	assert.Len(t, accounts, 2)
+	assert.Equal(t, "office", accounts[0].Name)
+	assert.Equal(t, "web", accounts[0].Growatt.APIMode)
+	assert.Equal(t, "office", accounts[0].Growatt.Username)
+	assert.Equal(t, "office-secret", accounts[0].Growatt.Password)
+	assert.Equal(t, 30*time.Second, accounts[0].PollingInterval)
+	assert.Equal(t, 3600*time.Second, accounts[0].EnumerationInterval)
+
+	assert.Equal(t, "relatives", accounts[1].Name)
+	assert.Equal(t, "app", accounts[1].Growatt.APIMode)
+	assert.Equal(t, "relative", accounts[1].Growatt.Username)
+	assert.Equal(t, "relatives-secret", accounts[1].Growatt.Password)
+	assert.Equal(t, "Europe/Vienna", accounts[1].Growatt.Location.String())
+	assert.Equal(t, "https://server-api.growatt.com", accounts[1].Growatt.ServerUrlApp)
+	assert.Equal(t, 60*time.Second, accounts[1].PollingInterval)
+	assert.Equal(t, 180*time.Second, accounts[1].BatteryDetailsPollingInterval)
+	assert.Empty(t, _secretErrors)
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindInt
+	kindBool
+	// kindList is a comma separated string, in the configuration file it can
+	// also be a list of values
+	kindList
+)
+
+// setting maps a key of the configuration file to its environment variable
+type setting struct {
+	key  string
+	env  string
+	kind valueKind
+}
+
+var settings = []setting{
+	{"log_level", "LOG_LEVEL", kindString},
+	{"polling_interval", "POLLING_INTERVAL", kindInt},
+	{"battery_details_polling_interval", "BATTERY_DETAILS_POLLING_INTERVAL", kindInt},
+	{"parameter_polling_interval", "PARAMETER_POLLING_INTERVAL", kindInt},
+	{"enumeration_interval", "ENUMERATION_INTERVAL", kindInt},
+	{"shutdown_timeout", "SHUTDOWN_TIMEOUT", kindInt},
+	{"growatt.api_mode", "GROWATT_API_MODE", kindString},
+	{"growatt.failover_threshold", "GROWATT_FAILOVER_THRESHOLD", kindInt},
+	{"growatt.server_url_web", "GROWATT_SERVER_URL_WEB", kindString},
+	{"growatt.server_url_app", "GROWATT_SERVER_URL_APP", kindString},
+	{"growatt.username", "GROWATT_USERNAME", kindString},
+	{"growatt.password", "GROWATT_PASSWORD", kindString},
+	{"growatt.password_file", "GROWATT_PASSWORD_FILE", kindString},
+	{"growatt.tz", "GROWATT_TZ", kindString},
+	{"mqtt.broker_url", "MQTT_BROKER_URL", kindString},
+	{"mqtt.host", "MQTT_HOST", kindString},
+	{"mqtt.port", "MQTT_PORT", kindInt},
+	{"mqtt.client_id", "MQTT_CLIENT_ID", kindString},
+	{"mqtt.username", "MQTT_USERNAME", kindString},
+	{"mqtt.password", "MQTT_PASSWORD", kindString},
+	{"mqtt.password_file", "MQTT_PASSWORD_FILE", kindString},
+	{"mqtt.topic_prefix", "MQTT_TOPIC_PREFIX", kindString},
+	{"homeassistant.topic_prefix", "HOMEASSISTANT_TOPIC_PREFIX", kindString},
+	{"homeassistant.switch_as_select", "HOMEASSISTANT_SWITCH_AS_SELECT", kindBool},
+	{"homeassistant.discovery", "HOMEASSISTANT_DISCOVERY", kindString},
+	{"homeassistant.state_file", "HOMEASSISTANT_STATE_FILE", kindString},
+	{"homeassistant.battery_devices", "HOMEASSISTANT_BATTERY_DEVICES", kindBool},
+	{"homeassistant.pv_devices", "HOMEASSISTANT_PV_DEVICES", kindBool},
+	{"metrics.listen", "METRICS_LISTEN", kindString},
+	{"energy.file", "ENERGY_FILE", kindString},
+	{"backfill.sink", "BACKFILL_SINK", kindString},
+	{"backfill.target", "BACKFILL_TARGET", kindString},
+	{"backfill.token", "BACKFILL_TOKEN", kindString},
+	{"backfill.token_file", "BACKFILL_TOKEN_FILE", kindString},
+	{"backfill.state_file", "BACKFILL_STATE_FILE", kindString},
+	{"backfill.max_age", "BACKFILL_MAX_AGE", kindInt},
+	{"devices.include", "DEVICES_INCLUDE", kindList},
+	{"devices.exclude", "DEVICES_EXCLUDE", kindList},
+}
+
+// fileValue is a single value read from the configuration file
+type fileValue struct {
+	key   string
+	value string
+	line  int
+	list  bool // the value was a list, its items are joined with commas
+}
+
+type configFile struct {
+	path   string
+	values map[string]fileValue // by environment variable name
+}
+
+var _file *configFile
+
+// Load reads the configuration file at path. Values from the file are used for
+// all settings whose environment variable is not set. Load must be called
+// before the first call to Get.
+func Load(path string) error {
+	file, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	_file = file
+	return nil
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []fileValue
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYaml(data)
+	case ".toml":
+		values, err = parseToml(data)
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	file := &configFile{
+		path:   path,
+		values: make(map[string]fileValue),
+	}
+	for _, v := range values {
+		s := findSetting(v.key)
+		if s == nil {
+			return nil, fmt.Errorf("config file %s line %d: unknown key '%s'", path, v.line, v.key)
+		}
+		if v.list && s.kind != kindList {
+			return nil, fmt.Errorf("config file %s line %d: key '%s' must be a single value", path, v.line, v.key)
+		}
+		if err := checkKind(s.kind, v.value); err != nil {
+			return nil, fmt.Errorf("config file %s line %d: key '%s' %s", path, v.line, v.key, err.Error())
+		}
+		file.values[s.env] = v
+	}
+	return file, nil
+}
+
+func findSetting(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	if s := findDeviceOverride(key); s != nil {
+		return s
+	}
+	return findAccountSetting(key)
+}
+
+// findAccountSetting returns the setting of a named account, e.g. the key
+// accounts.relatives.growatt.username is ACCOUNT_RELATIVES_GROWATT_USERNAME
+func findAccountSetting(key string) *setting {
+	parts := strings.SplitN(key, ".", 3)
+	if len(parts) != 3 || parts[0] != "accounts" {
+		return nil
+	}
+	for _, s := range settings {
+		if s.key == parts[2] {
+			env := accountPrefix(parts[1]) + s.env
+			if !accountPattern.MatchString(env) {
+				return nil
+			}
+			return &setting{key: key, env: env, kind: s.kind}
+		}
+	}
+	return nil
+}
+
+// findDeviceOverride returns the setting of a device override, e.g. the key
+// devices.overrides.0PVPH6ZR23QT00D3.alias is DEVICE_0PVPH6ZR23QT00D3_ALIAS
+func findDeviceOverride(key string) *setting {
+	parts := strings.Split(key, ".")
+	if len(parts) != 4 || parts[0] != "devices" || parts[1] != "overrides" {
+		return nil
+	}
+	env := fmt.Sprintf("DEVICE_%s_%s", strings.ToUpper(parts[2]), strings.ToUpper(parts[3]))
+	if !deviceOverridePattern.MatchString(env) {
+		return nil
+	}
+	return &setting{key: key, env: env, kind: kindString}
+}
+
+func checkKind(kind valueKind, value string) error {
+	switch kind {
+	case kindInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("must be an integer, got '%s'", value)
+		}
+	case kindBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be true or false, got '%s'", value)
+		}
+	}
+	return nil
+}
+
+func parseYaml(data []byte) ([]fileValue, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return nil, nil
+	}
+	return flattenYaml("", root.Content[0])
+}
+
+func flattenYaml(prefix string, node *yaml.Node) ([]fileValue, error) {
+	if node.Kind != yaml.MappingNode {
+		if prefix == "" {
+			return nil, fmt.Errorf("line %d: expected a mapping", node.Line)
+		}
+		return nil, fmt.Errorf("line %d: key '%s' must be a mapping", node.Line, prefix)
+	}
+
+	var values []fileValue
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := keyNode.Value
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch valueNode.Kind {
+		case yaml.MappingNode:
+			nested, err := flattenYaml(key, valueNode)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, nested...)
+		case yaml.ScalarNode:
+			value := valueNode.Value
+			if valueNode.Tag == "!!null" {
+				value = ""
+			}
+			values = append(values, fileValue{key: key, value: value, line: keyNode.Line})
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(valueNode.Content))
+			for _, item := range valueNode.Content {
+				if item.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("line %d: key '%s' must be a list of single values", item.Line, key)
+				}
+				items = append(items, item.Value)
+			}
+			values = append(values, fileValue{key: key, value: strings.Join(items, ","), line: keyNode.Line, list: true})
+		default:
+			return nil, fmt.Errorf("line %d: key '%s' must be a single value", keyNode.Line, key)
+		}
+	}
+	return values, nil
+}
+
+func parseToml(data []byte) ([]fileValue, error) {
+	var root map[string]any
+	if _, err := toml.Decode(string(data), &root); err != nil {
+		return nil, err
+	}
+
+	lines := tomlKeyLines(data)
+	var values []fileValue
+	var flatten func(prefix string, m map[string]any) error
+	flatten = func(prefix string, m map[string]any) error {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			switch v := m[k].(type) {
+			case map[string]any:
+				if err := flatten(key, v); err != nil {
+					return err
+				}
+			case string, int64, float64, bool:
+				values = append(values, fileValue{key: key, value: fmt.Sprint(v), line: lines[key]})
+			case []any:
+				items := make([]string, 0, len(v))
+				for _, item := range v {
+					switch item.(type) {
+					case string, int64, float64, bool:
+						items = append(items, fmt.Sprint(item))
+					default:
+						return fmt.Errorf("line %d: key '%s' must be a list of single values", lines[key], key)
+					}
+				}
+				values = append(values, fileValue{key: key, value: strings.Join(items, ","), line: lines[key], list: true})
+			default:
+				return fmt.Errorf("line %d: key '%s' must be a single value", lines[key], key)
+			}
+		}
+		return nil
+	}
+	if err := flatten("", root); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// tomlKeyLines returns the line numbers of the keys of a TOML document. The
+// document must already be known to be valid. Only tables and simple
+// "key = value" assignments are recognized, which is all the configuration
+// file needs.
+func tomlKeyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			table = strings.Trim(line[:strings.Index(line, "]")+1], "[] ")
+			continue
+		}
+		key, _, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := lines[key]; !ok {
+			lines[key] = n
+		}
+	}
+	return lines
+}
+
+// lookup returns the value of a setting from the configuration file
+func (f *configFile) lookup(env string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	v, ok := f.values[env]
+	return v.value, ok
+}
+
+// describe names a setting in error messages: the environment variable if it
+// is set or the value is not in the configuration file, otherwise the key
+// and line of the configuration file.
+func describe(env string) string {
+	if _, ok := os.LookupEnv(env); !ok && _file != nil {
+		if v, ok := _file.values[env]; ok {
+			return fmt.Sprintf("'%s' (config file %s line %d)", v.key, _file.path, v.line)
+		}
+	}
+	for _, s := range settings {
+		if s.env == env && _file != nil {
+			return fmt.Sprintf("%s (config key '%s')", env, s.key)
+		}
+	}
+	return env
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile_Yaml(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+log_level: debug
+polling_interval: 10
+growatt:
+  username: user
+  password: "secret"
+  tz: Europe/Berlin
+mqtt:
+  host: localhost
+  port: 1884
+homeassistant:
+  switch_as_select: true
+`)
+
+	file, err := readConfigFile(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fileValue{key: "log_level", value: "debug", line: 2}, file.values["LOG_LEVEL"])
+	assert.Equal(t, fileValue{key: "polling_interval", value: "10", line: 3}, file.values["POLLING_INTERVAL"])
+	assert.Equal(t, fileValue{key: "growatt.username", value: "user", line: 5}, file.values["GROWATT_USERNAME"])
+	assert.Equal(t, "secret", file.values["GROWATT_PASSWORD"].value)
+	assert.Equal(t, "Europe/Berlin", file.values["GROWATT_TZ"].value)
+	assert.Equal(t, "localhost", file.values["MQTT_HOST"].value)
+	assert.Equal(t, fileValue{key: "mqtt.port", value: "1884", line: 10}, file.values["MQTT_PORT"])
+	assert.Equal(t, "true", file.values["HOMEASSISTANT_SWITCH_AS_SELECT"].value)
+	assert.Len(t, file.values, 8)
+}
+
+func TestReadConfigFile_Toml(t *testing.T) {
+	path := writeConfigFile(t, "config.toml", `
+log_level = "debug"
+polling_interval = 10
+
+[growatt]
+username = "user"
+password = 'secret'
+
+[mqtt]
+host = "localhost"
+port = 1884
+
+[homeassistant]
+switch_as_select = true
+`)
+
+	file, err := readConfigFile(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fileValue{key: "log_level", value: "debug", line: 2}, file.values["LOG_LEVEL"])
+	assert.Equal(t, fileValue{key: "polling_interval", value: "10", line: 3}, file.values["POLLING_INTERVAL"])
+	assert.Equal(t, fileValue{key: "growatt.username", value: "user", line: 6}, file.values["GROWATT_USERNAME"])
+	assert.Equal(t, "secret", file.values["GROWATT_PASSWORD"].value)
+	assert.Equal(t, fileValue{key: "mqtt.port", value: "1884", line: 11}, file.values["MQTT_PORT"])
+	assert.Equal(t, "true", file.values["HOMEASSISTANT_SWITCH_AS_SELECT"].value)
+	assert.Len(t, file.values, 7)
+}
+
+func TestReadConfigFile_Lists(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+devices:
+  include:
+    - 0PVPH6ZR23QT00D3
+    - 4711
+  exclude: "0PVPH6ZR23QT00D4, 4712"
+`)
+
+	file, err := readConfigFile(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fileValue{key: "devices.include", value: "0PVPH6ZR23QT00D3,4711", line: 3, list: true}, file.values["DEVICES_INCLUDE"])
+	assert.Equal(t, []string{"0PVPH6ZR23QT00D3", "4711"}, s2list(file.values["DEVICES_INCLUDE"].value))
+	assert.Equal(t, []string{"0PVPH6ZR23QT00D4", "4712"}, s2list(file.values["DEVICES_EXCLUDE"].value))
+
+	path = writeConfigFile(t, "config.toml", `
+[devices]
+include = ["0PVPH6ZR23QT00D3", 4711]
+`)
+
+	file, err = readConfigFile(path)
+
+	assert.NoError(t, err)
+	assert.Equal(t, fileValue{key: "devices.include", value: "0PVPH6ZR23QT00D3,4711", line: 3, list: true}, file.values["DEVICES_INCLUDE"])
+}
+
+func TestReadConfigFile_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+	}{
+		{
+			name:    "unknown key yaml",
+			file:    "config.yaml",
+			content: "mqtt:\n  host: localhost\n  hots: localhost\n",
+			err:     "line 3: unknown key 'mqtt.hots'",
+		},
+		{
+			name:    "unknown key toml",
+			file:    "config.toml",
+			content: "[mqtt]\nhost = \"localhost\"\n\n[growat]\nusername = \"user\"\n",
+			err:     "line 5: unknown key 'growat.username'",
+		},
+		{
+			name:    "invalid integer yaml",
+			file:    "config.yaml",
+			content: "polling_interval: 30\nmqtt:\n  port: abc\n",
+			err:     "line 3: key 'mqtt.port' must be an integer, got 'abc'",
+		},
+		{
+			name:    "invalid integer toml",
+			file:    "config.toml",
+			content: "polling_interval = 2.5\n",
+			err:     "line 1: key 'polling_interval' must be an integer, got '2.5'",
+		},
+		{
+			name:    "invalid bool",
+			file:    "config.yml",
+			content: "homeassistant:\n  switch_as_select: maybe\n",
+			err:     "line 2: key 'homeassistant.switch_as_select' must be true or false, got 'maybe'",
+		},
+		{
+			name:    "unknown device override",
+			file:    "config.yaml",
+			content: "devices:\n  overrides:\n    Serial123:\n      name: Garage\n",
+			err:     "line 4: unknown key 'devices.overrides.Serial123.name'",
+		},
+		{
+			name:    "account setting that is not per account",
+			file:    "config.yaml",
+			content: "accounts:\n  relatives:\n    mqtt:\n      host: localhost\n",
+			err:     "line 4: unknown key 'accounts.relatives.mqtt.host'",
+		},
+		{
+			name:    "value instead of section",
+			file:    "config.yaml",
+			content: "growatt: user\n",
+			err:     "line 1: unknown key 'growatt'",
+		},
+		{
+			name:    "list value",
+			file:    "config.yaml",
+			content: "mqtt:\n  host:\n    - a\n    - b\n",
+			err:     "line 2: key 'mqtt.host' must be a single value",
+		},
+		{
+			name:    "list value toml",
+			file:    "config.toml",
+			content: "[mqtt]\nhost = [\"a\", \"b\"]\n",
+			err:     "line 2: key 'mqtt.host' must be a single value",
+		},
+		{
+			name:    "nested list value",
+			file:    "config.yaml",
+			content: "devices:\n  include:\n    - [a, b]\n",
+			err:     "line 3: key 'devices.include' must be a list of single values",
+		},
+		{
+			name:    "syntax error",
+			file:    "config.yaml",
+			content: "mqtt:\n  host: \"localhost\n",
+			err:     "line 2",
+		},
+		{
+			name:    "unsupported format",
+			file:    "config.json",
+			content: "{}",
+			err:     "unsupported format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfigFile(t, tt.file, tt.content)
+
+			_, err := readConfigFile(path)
+
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+func TestGetEnv_EnvironmentOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "mqtt:\n  host: from-file\n  client_id: file-client\n")
+	file, err := readConfigFile(path)
+	assert.NoError(t, err)
+
+	_file = file
+	defer func() { _file = nil }()
+	t.Setenv("MQTT_HOST", "from-env")
+
+	assert.Equal(t, "from-env", getEnv("MQTT_HOST", "default"))
+	assert.Equal(t, "file-client", getEnv("MQTT_CLIENT_ID", "default"))
+	assert.Equal(t, "default", getEnv("MQTT_TOPIC_PREFIX", "default"))
+}
+
+func TestDescribe(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", "growatt:\n  username: user\n  tz: Mars/Olympus\n")
+	file, err := readConfigFile(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "GROWATT_TZ", describe("GROWATT_TZ"))
+
+	_file = file
+	defer func() { _file = nil }()
+
+	assert.Equal(t, "'growatt.tz' (config file "+path+" line 3)", describe("GROWATT_TZ"))
+	assert.Equal(t, "GROWATT_PASSWORD (config key 'growatt.password')", describe("GROWATT_PASSWORD"))
+
+	t.Setenv("GROWATT_TZ", "Mars/Olympus")
+	assert.Equal(t, "GROWATT_TZ (config key 'growatt.tz')", describe("GROWATT_TZ"))
+}
@@ -0,0 +1,93 @@
+package devicefilter
+
+import (
+	"nexa-mqtt/pkg/models"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Override replaces the names reported by Growatt for a single device. Empty
+// values keep the names of Growatt.
+type Override struct {
+	Alias     string
+	Model     string
+	Batteries []string // names of the batteries in the order of the device
+}
+
+type Options struct {
+	// Include lists the serials or plant ids of the devices to publish, all
+	// devices are published if it is empty
+	Include []string
+	// Exclude lists the serials or plant ids of the devices to skip, it takes
+	// precedence over Include
+	Exclude []string
+	// Overrides by serial
+	Overrides map[string]Override
+}
+
+// Filter selects the devices that are published and renames them. A nil
+// filter publishes all devices unchanged.
+type Filter struct {
+	opts Options
+}
+
+func New(opts Options) *Filter {
+	return &Filter{opts: opts}
+}
+
+// Skip reports whether the device with the given serial in the given plant
+// must not be published.
+func (f *Filter) Skip(serial string, plantId int) bool {
+	if f == nil {
+		return false
+	}
+
+	plant := strconv.Itoa(plantId)
+	matches := func(ids []string) bool {
+		return slices.ContainsFunc(ids, func(id string) bool {
+			return strings.EqualFold(id, serial) || id == plant
+		})
+	}
+
+	if matches(f.opts.Exclude) {
+		return true
+	}
+	return len(f.opts.Include) > 0 && !matches(f.opts.Include)
+}
+
+// Rename applies the override of the device, if there is one.
+func (f *Filter) Rename(device models.NoahDevicePayload) models.NoahDevicePayload {
+	if f == nil {
+		return device
+	}
+
+	var override Override
+	found := false
+	for serial, o := range f.opts.Overrides {
+		if strings.EqualFold(serial, device.Serial) {
+			override, found = o, true
+			break
+		}
+	}
+	if !found {
+		return device
+	}
+
+	if override.Alias != "" {
+		device.Alias = override.Alias
+	}
+	if override.Model != "" {
+		device.Model = override.Model
+	}
+	if len(override.Batteries) > 0 {
+		// do not modify the batteries of the caller
+		device.Batteries = slices.Clone(device.Batteries)
+		for i := range device.Batteries {
+			if i < len(override.Batteries) && override.Batteries[i] != "" {
+				device.Batteries[i].Alias = override.Batteries[i]
+			}
+		}
+	}
+	return device
+}
@@ -0,0 +1,57 @@
+package devicefilter
+
+import (
+	"nexa-mqtt/pkg/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkip(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		serial string
+		plant  int
+		skip   bool
+	}{
+		{"no filter", Options{}, "Serial123", 1, false},
+		{"included serial", Options{Include: []string{"SERIAL123"}}, "Serial123", 1, false},
+		{"included plant", Options{Include: []string{"1"}}, "Serial123", 1, false},
+		{"not included", Options{Include: []string{"Serial234", "2"}}, "Serial123", 1, true},
+		{"excluded serial", Options{Exclude: []string{"Serial123"}}, "Serial123", 1, true},
+		{"excluded plant", Options{Exclude: []string{"1"}}, "Serial123", 1, true},
+		{"exclude wins", Options{Include: []string{"1"}, Exclude: []string{"Serial123"}}, "Serial123", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.skip, New(tt.opts).Skip(tt.serial, tt.plant))
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	f := New(Options{Overrides: map[string]Override{
+		"SERIAL123": {Alias: "Garage", Batteries: []string{"Left", "", "Unused"}},
+	}})
+	device := models.NoahDevicePayload{
+		Serial:    "Serial123",
+		Model:     "NEXA 2000",
+		Alias:     "NEXA",
+		Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}, {Alias: "BAT1"}},
+	}
+
+	renamed := f.Rename(device)
+
+	assert.Equal(t, models.NoahDevicePayload{
+		Serial:    "Serial123",
+		Model:     "NEXA 2000",
+		Alias:     "Garage",
+		Batteries: []models.NoahDeviceBatteryPayload{{Alias: "Left"}, {Alias: "BAT1"}},
+	}, renamed)
+	assert.Equal(t, "BAT0", device.Batteries[0].Alias)
+
+	other := models.NoahDevicePayload{Serial: "Serial234", Alias: "NEXA"}
+	assert.Equal(t, other, f.Rename(other))
+}
@@ -0,0 +1,206 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/pkg/models"
+	"slices"
+	"sync"
+)
+
+// Accounts shares an endpoint between the services of several Growatt
+// accounts. Each account publishes to its own Endpoint returned by Account.
+// The devices of all accounts are merged before they are set on the shared
+// endpoint, and parameter commands are applied by the account of the device.
+type Accounts struct {
+	target   Endpoint
+	lock     sync.Mutex
+	names    []string                              // in the order of Account
+	devices  map[string][]models.NoahDevicePayload // by account
+	appliers map[string]ParameterApplier           // by account
+	owners   map[string]string                     // account by serial
+}
+
+func NewAccounts(target Endpoint) *Accounts {
+	a := &Accounts{
+		target:   target,
+		devices:  make(map[string][]models.NoahDevicePayload),
+		appliers: make(map[string]ParameterApplier),
+		owners:   make(map[string]string),
+	}
+	target.SetParameterApplier(a)
+	return a
+}
+
+// Account returns the endpoint of the account with the given name
+func (a *Accounts) Account(name string) Endpoint {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !slices.Contains(a.names, name) {
+		a.names = append(a.names, name)
+	}
+	return &accountEndpoint{Endpoint: a.target, accounts: a, name: name}
+}
+
+// setDevices replaces the devices of an account and sets the devices of all
+// accounts on the shared endpoint. A device found in several accounts
+// belongs to the first one.
+func (a *Accounts) setDevices(name string, devices []models.NoahDevicePayload) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.devices[name] = devices
+
+	var merged []models.NoahDevicePayload
+	owners := make(map[string]string)
+	for _, n := range a.names {
+		for _, d := range a.devices[n] {
+			if owner, ok := owners[d.Serial]; ok {
+				slog.Warn("device is found in several accounts", slog.String("device", d.Serial), slog.String("account", owner), slog.String("ignored", n))
+				continue
+			}
+			owners[d.Serial] = n
+			merged = append(merged, d)
+		}
+	}
+	a.owners = owners
+
+	a.target.SetDevices(merged)
+}
+
+func (a *Accounts) setParameterApplier(name string, applier ParameterApplier) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.appliers[name] = applier
+}
+
+// applier returns the parameter applier of the account of the device
+func (a *Accounts) applier(device models.NoahDevicePayload) (ParameterApplier, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var err error
+	name, ok := a.owners[device.Serial]
+	if !ok {
+		err = fmt.Errorf("device %s does not belong to an account", device.Serial)
+	} else if a.appliers[name] == nil {
+		err = fmt.Errorf("account '%s' of device %s does not apply parameters yet", name, device.Serial)
+	}
+	if err != nil {
+		slog.Error("parameter change is not applied", slog.String("error", err.Error()))
+		return nil, err
+	}
+	return a.appliers[name], nil
+}
+
+func (a *Accounts) SetOutputPowerW(device models.NoahDevicePayload, mode models.WorkMode, power float64) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetOutputPowerW(device, mode, power)
+}
+
+func (a *Accounts) SetChargingLimits(device models.NoahDevicePayload, chargingLimit float64, dischargeLimit float64) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetChargingLimits(device, chargingLimit, dischargeLimit)
+}
+
+func (a *Accounts) SetAllowGridCharging(device models.NoahDevicePayload, allow models.OnOff) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetAllowGridCharging(device, allow)
+}
+
+func (a *Accounts) SetGridConnectionControl(device models.NoahDevicePayload, offlineEnable models.OnOff) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetGridConnectionControl(device, offlineEnable)
+}
+
+func (a *Accounts) SetAcCouplePowerControl(device models.NoahDevicePayload, _1000WEnable models.OnOff) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetAcCouplePowerControl(device, _1000WEnable)
+}
+
+func (a *Accounts) SetLightLoadEnable(device models.NoahDevicePayload, enable models.OnOff) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetLightLoadEnable(device, enable)
+}
+
+func (a *Accounts) SetNeverPowerOff(device models.NoahDevicePayload, enable models.OnOff) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetNeverPowerOff(device, enable)
+}
+
+func (a *Accounts) SetBackflow(device models.NoahDevicePayload, enableLimit models.OnOff, powerSettingPercent float64) error {
+	applier, err := a.applier(device)
+	if err != nil {
+		return err
+	}
+	return applier.SetBackflow(device, enableLimit, powerSettingPercent)
+}
+
+// refresher returns the parameter applier of the account of the device if it
+// polls on demand
+func (a *Accounts) refresher(device models.NoahDevicePayload) (Refresher, error) {
+	applier, err := a.applier(device)
+	if err != nil {
+		return nil, err
+	}
+	refresher, ok := applier.(Refresher)
+	if !ok {
+		return nil, fmt.Errorf("account of device %s does not poll on demand", device.Serial)
+	}
+	return refresher, nil
+}
+
+func (a *Accounts) Refresh(device models.NoahDevicePayload) error {
+	refresher, err := a.refresher(device)
+	if err != nil {
+		return err
+	}
+	return refresher.Refresh(device)
+}
+
+func (a *Accounts) Reenumerate(device models.NoahDevicePayload) error {
+	refresher, err := a.refresher(device)
+	if err != nil {
+		return err
+	}
+	return refresher.Reenumerate(device)
+}
+
+// accountEndpoint is the endpoint of a single account, all data except the
+// devices is forwarded unchanged.
+type accountEndpoint struct {
+	Endpoint
+	accounts *Accounts
+	name     string
+}
+
+func (e *accountEndpoint) SetParameterApplier(applier ParameterApplier) {
+	e.accounts.setParameterApplier(e.name, applier)
+}
+
+func (e *accountEndpoint) SetDevices(devices []models.NoahDevicePayload) {
+	e.accounts.setDevices(e.name, devices)
+}
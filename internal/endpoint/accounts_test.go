@@ -0,0 +1,138 @@
+package endpoint
+
+import (
+	"nexa-mqtt/pkg/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockChargingApplier struct {
+	ParameterApplier
+	mock.Mock
+}
+
+func (m *mockChargingApplier) SetChargingLimits(device models.NoahDevicePayload, chargingLimit float64, dischargeLimit float64) error {
+	args := m.Called(device, chargingLimit, dischargeLimit)
+	return args.Error(0)
+}
+
+type mockRefreshingApplier struct {
+	ParameterApplier
+	mock.Mock
+}
+
+func (m *mockRefreshingApplier) Refresh(device models.NoahDevicePayload) error {
+	args := m.Called(device)
+	return args.Error(0)
+}
+
+func (m *mockRefreshingApplier) Reenumerate(device models.NoahDevicePayload) error {
+	args := m.Called(device)
+	return args.Error(0)
+}
+
+func TestAccounts_MergesDevices(t *testing.T) {
+	target := &MockEndpoint{}
+	target.On("SetParameterApplier", mock.AnythingOfType("*endpoint.Accounts"))
+	accounts := NewAccounts(target)
+	own := accounts.Account("")
+	relatives := accounts.Account("relatives")
+
+	dev1 := models.NoahDevicePayload{Serial: "device123"}
+	dev2 := models.NoahDevicePayload{Serial: "device234"}
+	dev3 := models.NoahDevicePayload{Serial: "device345"}
+	target.On("SetDevices", []models.NoahDevicePayload{dev2, dev3}).Once()
+	target.On("SetDevices", []models.NoahDevicePayload{dev1, dev2, dev3}).Once()
+	target.On("SetDevices", []models.NoahDevicePayload{dev2, dev3}).Once()
+
+	relatives.SetDevices([]models.NoahDevicePayload{dev2, dev3})
+	// dev2 in both accounts is only set once
+	own.SetDevices([]models.NoahDevicePayload{dev1, dev2})
+	own.SetDevices(nil)
+
+	target.AssertExpectations(t)
+}
+
+func TestAccounts_ForwardsData(t *testing.T) {
+	target := &MockEndpoint{}
+	target.On("SetParameterApplier", mock.Anything)
+	accounts := NewAccounts(target)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	target.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50})
+
+	accounts.Account("relatives").PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+
+	target.AssertExpectations(t)
+}
+
+func TestAccounts_RoutesParameters(t *testing.T) {
+	target := &MockEndpoint{}
+	target.On("SetParameterApplier", mock.Anything)
+	target.On("SetDevices", mock.Anything)
+	accounts := NewAccounts(target)
+	own := accounts.Account("")
+	relatives := accounts.Account("relatives")
+
+	dev1 := models.NoahDevicePayload{Serial: "device123"}
+	dev2 := models.NoahDevicePayload{Serial: "device234"}
+	own.SetDevices([]models.NoahDevicePayload{dev1})
+	relatives.SetDevices([]models.NoahDevicePayload{dev2})
+
+	ownApplier := &mockChargingApplier{}
+	relativesApplier := &mockChargingApplier{}
+	own.SetParameterApplier(ownApplier)
+	relatives.SetParameterApplier(relativesApplier)
+	ownApplier.On("SetChargingLimits", dev1, 90.0, 10.0).Return(nil)
+	relativesApplier.On("SetChargingLimits", dev2, 80.0, 20.0).Return(nil)
+
+	assert.NoError(t, accounts.SetChargingLimits(dev1, 90, 10))
+	assert.NoError(t, accounts.SetChargingLimits(dev2, 80, 20))
+	assert.Error(t, accounts.SetChargingLimits(models.NoahDevicePayload{Serial: "unknown"}, 80, 20))
+
+	ownApplier.AssertExpectations(t)
+	relativesApplier.AssertExpectations(t)
+}
+
+func TestAccounts_NoApplier(t *testing.T) {
+	target := &MockEndpoint{}
+	target.On("SetParameterApplier", mock.Anything)
+	target.On("SetDevices", mock.Anything)
+	accounts := NewAccounts(target)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	accounts.Account("").SetDevices([]models.NoahDevicePayload{device})
+
+	err := accounts.SetChargingLimits(device, 90, 10)
+
+	assert.ErrorContains(t, err, "does not apply parameters")
+}
+
+func TestAccounts_RoutesRefresh(t *testing.T) {
+	target := &MockEndpoint{}
+	target.On("SetParameterApplier", mock.Anything)
+	target.On("SetDevices", mock.Anything)
+	accounts := NewAccounts(target)
+	own := accounts.Account("")
+	relatives := accounts.Account("relatives")
+
+	dev1 := models.NoahDevicePayload{Serial: "device123"}
+	dev2 := models.NoahDevicePayload{Serial: "device234"}
+	own.SetDevices([]models.NoahDevicePayload{dev1})
+	relatives.SetDevices([]models.NoahDevicePayload{dev2})
+
+	ownApplier := &mockRefreshingApplier{}
+	own.SetParameterApplier(ownApplier)
+	// the applier of the relatives does not poll on demand
+	relatives.SetParameterApplier(&mockChargingApplier{})
+	ownApplier.On("Refresh", dev1).Return(nil).Once()
+	ownApplier.On("Reenumerate", dev1).Return(nil).Once()
+
+	assert.NoError(t, accounts.Refresh(dev1))
+	assert.NoError(t, accounts.Reenumerate(dev1))
+	assert.ErrorContains(t, accounts.Refresh(dev2), "does not poll on demand")
+
+	ownApplier.AssertExpectations(t)
+}
@@ -8,6 +8,8 @@ type Endpoint interface {
 	PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload)
 	PublishBatteryDetails(device models.NoahDevicePayload, details []models.BatteryPayload)
 	PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload)
+	PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload)
+	PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload)
 	PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload)
 	PublishHealth(device models.NoahDevicePayload, health *models.ServiceHealth)
 }
@@ -0,0 +1,48 @@
+package endpoint
+
+import (
+	"nexa-mqtt/pkg/models"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// MockEndpoint implements Endpoint
+type MockEndpoint struct {
+	mock.Mock
+}
+
+func (e *MockEndpoint) SetParameterApplier(applier ParameterApplier) {
+	e.Called(applier)
+}
+
+func (e *MockEndpoint) SetDevices(devices []models.NoahDevicePayload) {
+	e.Called(devices)
+}
+
+func (e *MockEndpoint) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
+	e.Called(device, status)
+}
+
+func (e *MockEndpoint) PublishBatteryDetails(device models.NoahDevicePayload, details []models.BatteryPayload) {
+	e.Called(device, details)
+}
+
+func (e *MockEndpoint) PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload) {
+	e.Called(device, details)
+}
+
+func (e *MockEndpoint) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	e.Called(device, meter)
+}
+
+func (e *MockEndpoint) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	e.Called(device, alarms)
+}
+
+func (e *MockEndpoint) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
+	e.Called(device, param)
+}
+
+func (e *MockEndpoint) PublishHealth(device models.NoahDevicePayload, health *models.ServiceHealth) {
+	e.Called(device, health)
+}
@@ -0,0 +1,213 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/pkg/models"
+	"sync"
+	"time"
+)
+
+// queueSize is the number of calls buffered for each endpoint of a Multi
+const queueSize = 100
+
+// stateTimeout is the time a call that changes the state of an endpoint waits
+// for room in a full queue before it is dropped
+var stateTimeout = 5 * time.Second
+
+// Multi forwards the data to several endpoints. Each endpoint gets its own
+// queue and goroutine, so a slow or failing endpoint does not delay the
+// others or the pollers. Data calls for an endpoint whose queue is full are
+// dropped, the next poll sends the data again. Calls that change the state of
+// the endpoint, i.e. the devices and the parameters, wait up to stateTimeout
+// for room in the queue instead. Parameter commands are only accepted by the
+// first endpoint, the others just receive the data.
+type Multi struct {
+	lock     sync.RWMutex
+	children []*child
+	closed   bool
+	workers  sync.WaitGroup
+}
+
+type child struct {
+	endpoint Endpoint
+	name     string
+	queue    chan func(Endpoint)
+	dropped  int // calls dropped since the queue was last full, guarded by Multi.lock
+}
+
+func NewMulti(endpoints ...Endpoint) *Multi {
+	m := &Multi{}
+	for _, e := range endpoints {
+		c := &child{
+			endpoint: e,
+			name:     fmt.Sprintf("%T", e),
+			queue:    make(chan func(Endpoint), queueSize),
+		}
+		m.children = append(m.children, c)
+
+		m.workers.Add(1)
+		go func() {
+			defer m.workers.Done()
+			c.run()
+		}()
+	}
+	return m
+}
+
+// Shutdown stops forwarding and waits until the queued calls are processed
+// or ctx is done.
+func (m *Multi) Shutdown(ctx context.Context) error {
+	m.lock.Lock()
+	if !m.closed {
+		m.closed = true
+		for _, c := range m.children {
+			close(c.queue)
+		}
+	}
+	m.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// forward queues the data call for every endpoint without waiting for it
+func (m *Multi) forward(method string, call func(Endpoint)) {
+	m.send(method, call, false)
+}
+
+// forwardState queues the call that changes the state of the endpoints, it
+// waits up to stateTimeout for each endpoint whose queue is full
+func (m *Multi) forwardState(method string, call func(Endpoint)) {
+	m.send(method, call, true)
+}
+
+// send queues the call for every endpoint, dropping it for the endpoints whose
+// queue stays full
+func (m *Multi) send(method string, call func(Endpoint), wait bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return
+	}
+
+	for _, c := range m.children {
+		if c.enqueue(call, wait) {
+			if c.dropped > 0 {
+				slog.Info("endpoint is processing calls again", slog.String("endpoint", c.name), slog.Int("dropped", c.dropped))
+				c.dropped = 0
+			}
+			continue
+		}
+		c.dropped++
+		if wait {
+			slog.Error("endpoint is too slow, dropping call", slog.String("endpoint", c.name), slog.String("method", method), slog.Duration("timeout", stateTimeout))
+		} else {
+			slog.Warn("endpoint is too slow, dropping call", slog.String("endpoint", c.name), slog.String("method", method))
+		}
+	}
+}
+
+// enqueue queues the call, it waits up to stateTimeout for room in a full
+// queue if wait is set. It reports whether the call was queued.
+func (c *child) enqueue(call func(Endpoint), wait bool) bool {
+	select {
+	case c.queue <- call:
+		return true
+	default:
+	}
+	if !wait {
+		return false
+	}
+
+	timer := time.NewTimer(stateTimeout)
+	defer timer.Stop()
+	select {
+	case c.queue <- call:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *child) run() {
+	for call := range c.queue {
+		c.call(call)
+	}
+}
+
+// call runs a single call, a panicking endpoint does not affect the others
+func (c *child) call(call func(Endpoint)) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("endpoint failed", slog.String("endpoint", c.name), slog.Any("error", r))
+		}
+	}()
+	call(c.endpoint)
+}
+
+func (m *Multi) SetParameterApplier(applier ParameterApplier) {
+	if len(m.children) > 0 {
+		m.children[0].endpoint.SetParameterApplier(applier)
+	}
+}
+
+func (m *Multi) SetDevices(devices []models.NoahDevicePayload) {
+	m.forwardState("SetDevices", func(e Endpoint) {
+		e.SetDevices(devices)
+	})
+}
+
+func (m *Multi) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
+	m.forward("PublishDeviceStatus", func(e Endpoint) {
+		e.PublishDeviceStatus(device, status)
+	})
+}
+
+func (m *Multi) PublishBatteryDetails(device models.NoahDevicePayload, details []models.BatteryPayload) {
+	m.forward("PublishBatteryDetails", func(e Endpoint) {
+		e.PublishBatteryDetails(device, details)
+	})
+}
+
+func (m *Multi) PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload) {
+	m.forward("PublishPvDetails", func(e Endpoint) {
+		e.PublishPvDetails(device, details)
+	})
+}
+
+func (m *Multi) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	m.forward("PublishMeterData", func(e Endpoint) {
+		e.PublishMeterData(device, meter)
+	})
+}
+
+func (m *Multi) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	m.forward("PublishAlarms", func(e Endpoint) {
+		e.PublishAlarms(device, alarms)
+	})
+}
+
+func (m *Multi) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
+	m.forwardState("PublishParameterData", func(e Endpoint) {
+		e.PublishParameterData(device, param)
+	})
+}
+
+func (m *Multi) PublishHealth(device models.NoahDevicePayload, health *models.ServiceHealth) {
+	m.forward("PublishHealth", func(e Endpoint) {
+		e.PublishHealth(device, health)
+	})
+}
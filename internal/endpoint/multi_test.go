@@ -0,0 +1,188 @@
+package endpoint
+
+import (
+	"context"
+	"nexa-mqtt/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type nopApplier struct {
+	ParameterApplier
+}
+
+func TestMulti_ForwardsToAll(t *testing.T) {
+	first := &MockEndpoint{}
+	second := &MockEndpoint{}
+	multi := NewMulti(first, second)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	status := models.DevicePayload{Soc: 50}
+	health := models.NewServiceHealth()
+	for _, e := range []*MockEndpoint{first, second} {
+		e.On("SetDevices", []models.NoahDevicePayload{device})
+		e.On("PublishDeviceStatus", device, status)
+		e.On("PublishBatteryDetails", device, []models.BatteryPayload{{Soc: 40}})
+		e.On("PublishPvDetails", device, []models.PvPayload{{Voltage: 30}})
+		e.On("PublishMeterData", device, models.MeterPayload{Frequency: 50})
+		e.On("PublishAlarms", device, models.AlarmPayload{Fault: true})
+		e.On("PublishParameterData", device, models.ParameterPayload{AllowGridCharging: models.ON})
+		e.On("PublishHealth", device, health)
+	}
+
+	multi.SetDevices([]models.NoahDevicePayload{device})
+	multi.PublishDeviceStatus(device, status)
+	multi.PublishBatteryDetails(device, []models.BatteryPayload{{Soc: 40}})
+	multi.PublishPvDetails(device, []models.PvPayload{{Voltage: 30}})
+	multi.PublishMeterData(device, models.MeterPayload{Frequency: 50})
+	multi.PublishAlarms(device, models.AlarmPayload{Fault: true})
+	multi.PublishParameterData(device, models.ParameterPayload{AllowGridCharging: models.ON})
+	multi.PublishHealth(device, health)
+	assert.NoError(t, multi.Shutdown(context.Background()))
+
+	first.AssertExpectations(t)
+	second.AssertExpectations(t)
+}
+
+func TestMulti_ParameterApplierOnlyFirst(t *testing.T) {
+	first := &MockEndpoint{}
+	second := &MockEndpoint{}
+	multi := NewMulti(first, second)
+
+	applier := &nopApplier{}
+	first.On("SetParameterApplier", applier)
+
+	multi.SetParameterApplier(applier)
+	assert.NoError(t, multi.Shutdown(context.Background()))
+
+	first.AssertExpectations(t)
+	assert.Len(t, second.Calls, 0)
+}
+
+func TestMulti_PanicIsolated(t *testing.T) {
+	failing := &MockEndpoint{}
+	healthy := &MockEndpoint{}
+	multi := NewMulti(failing, healthy)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	failing.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).Panic("broken sink")
+	failing.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 60})
+	healthy.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50})
+	healthy.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 60})
+
+	multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+	multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 60})
+	assert.NoError(t, multi.Shutdown(context.Background()))
+
+	// the failing endpoint keeps receiving calls after the panic
+	failing.AssertNumberOfCalls(t, "PublishDeviceStatus", 2)
+	healthy.AssertExpectations(t)
+}
+
+func TestMulti_SlowEndpoint(t *testing.T) {
+	slow := &MockEndpoint{}
+	fast := &MockEndpoint{}
+	multi := NewMulti(slow, fast)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	release := make(chan time.Time)
+	slow.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).WaitUntil(release)
+	processed := make(chan struct{})
+	fast.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).Run(func(mock.Arguments) {
+		processed <- struct{}{}
+	})
+
+	// more calls than fit into the queue of the blocked endpoint, the fast
+	// endpoint receives all of them
+	calls := queueSize + 10
+	for range calls {
+		multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+		select {
+		case <-processed:
+		case <-time.After(time.Second):
+			t.Fatal("publishing was blocked by the slow endpoint")
+		}
+	}
+
+	// the blocked endpoint only gets the queued calls
+	close(release)
+	assert.NoError(t, multi.Shutdown(context.Background()))
+	assert.LessOrEqual(t, len(slow.Calls), queueSize+1)
+}
+
+func TestMulti_SlowEndpointStateCalls(t *testing.T) {
+	slow := &MockEndpoint{}
+	multi := NewMulti(slow)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	release := make(chan time.Time)
+	slow.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).WaitUntil(release)
+	slow.On("SetDevices", []models.NoahDevicePayload{device})
+	slow.On("PublishParameterData", device, models.ParameterPayload{AllowGridCharging: models.ON})
+
+	// fill the queue of the blocked endpoint
+	for range queueSize + 1 {
+		multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+	}
+
+	// the state calls wait for room in the queue instead of being dropped
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+	}()
+	multi.SetDevices([]models.NoahDevicePayload{device})
+	multi.PublishParameterData(device, models.ParameterPayload{AllowGridCharging: models.ON})
+	assert.NoError(t, multi.Shutdown(context.Background()))
+
+	slow.AssertCalled(t, "SetDevices", []models.NoahDevicePayload{device})
+	slow.AssertCalled(t, "PublishParameterData", device, models.ParameterPayload{AllowGridCharging: models.ON})
+}
+
+func TestMulti_SlowEndpointStateTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { stateTimeout = timeout }(stateTimeout)
+	stateTimeout = 10 * time.Millisecond
+
+	slow := &MockEndpoint{}
+	multi := NewMulti(slow)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	release := make(chan time.Time)
+	slow.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).WaitUntil(release)
+
+	for range queueSize + 1 {
+		multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+	}
+
+	// a blocked endpoint does not block the state calls forever
+	start := time.Now()
+	multi.SetDevices([]models.NoahDevicePayload{device})
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+	assert.NoError(t, multi.Shutdown(context.Background()))
+	slow.AssertNotCalled(t, "SetDevices", mock.Anything)
+}
+
+func TestMulti_Shutdown(t *testing.T) {
+	e := &MockEndpoint{}
+	multi := NewMulti(e)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	release := make(chan time.Time)
+	e.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50}).WaitUntil(release)
+
+	multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, multi.Shutdown(ctx), context.DeadlineExceeded)
+
+	// calls after shutdown are ignored
+	multi.PublishDeviceStatus(device, models.DevicePayload{Soc: 60})
+	close(release)
+	assert.NoError(t, multi.Shutdown(context.Background()))
+	e.AssertNumberOfCalls(t, "PublishDeviceStatus", 1)
+}
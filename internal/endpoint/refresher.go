@@ -0,0 +1,13 @@
+package endpoint
+
+import "nexa-mqtt/pkg/models"
+
+// Refresher is implemented by parameter appliers that poll the devices on
+// demand, e.g. when a button in Home Assistant is pressed.
+type Refresher interface {
+	// Refresh polls the status, the battery details and the parameters of the
+	// device now
+	Refresh(device models.NoahDevicePayload) error
+	// Reenumerate enumerates the devices of the account of the device now
+	Reenumerate(device models.NoahDevicePayload) error
+}
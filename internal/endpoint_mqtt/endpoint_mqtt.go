@@ -1,12 +1,15 @@
 package endpoint_mqtt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"nexa-mqtt/internal/endpoint"
 	"nexa-mqtt/internal/homeassistant"
 	"nexa-mqtt/pkg/models"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,46 +22,117 @@ type Options struct {
 	HaClient    homeassistant.HaClient
 }
 
-type Endpoint struct {
-	opts          Options
-	devs          []models.NoahDevicePayload
-	param_applier endpoint.ParameterApplier
-	stateLock     sync.Mutex
+// parameterState holds the cached parameters and the pending debounced
+// parameter command of a single device.
+type parameterState struct {
 	lastParameter models.ParameterPayload
 	newParameter  models.ParameterPayload
 	publishTimer  *time.Timer
 }
 
+type Endpoint struct {
+	opts          Options
+	param_applier endpoint.ParameterApplier
+	// stateLock guards the fields below
+	stateLock   sync.Mutex
+	devs        []models.NoahDevicePayload
+	paramStates map[string]*parameterState
+	closed      bool
+	// serials of the devices that published meter data, their meter is
+	// announced to Home Assistant
+	meters map[string]bool
+	// battery serials by device serial, in the order of the batteries
+	batterySerials map[string][]string
+	// serializes the announcements, so an older list of devices never
+	// overwrites a newer one
+	announceLock sync.Mutex
+	// commands that are still running
+	commands sync.WaitGroup
+}
+
 func NewEndpoint(options Options) *Endpoint {
 	return &Endpoint{
-		opts:          options,
-		lastParameter: models.EmptyParameterPayload(),
+		opts:           options,
+		paramStates:    make(map[string]*parameterState),
+		meters:         make(map[string]bool),
+		batterySerials: make(map[string][]string),
 	}
 }
 
+// parameterState returns the parameter state of the device with the given
+// serial, creating it if necessary. e.stateLock must be held by the caller.
+func (e *Endpoint) parameterState(serial string) *parameterState {
+	if e.paramStates == nil {
+		e.paramStates = make(map[string]*parameterState)
+	}
+	state, ok := e.paramStates[serial]
+	if !ok {
+		state = &parameterState{
+			lastParameter: models.EmptyParameterPayload(),
+		}
+		e.paramStates[serial] = state
+	}
+	return state
+}
+
 func (e *Endpoint) SetParameterApplier(applier endpoint.ParameterApplier) {
 	e.param_applier = applier
 }
 
 func (e *Endpoint) SetDevices(devices []models.NoahDevicePayload) {
-	for _, dev := range e.devs {
+	e.stateLock.Lock()
+	oldDevs := e.devs
+	e.devs = devices
+	e.stateLock.Unlock()
+
+	for _, dev := range oldDevs {
 		e.opts.MqttClient.Unsubscribe(parameterCommandTopic(e.opts.TopicPrefix, dev.Serial))
+		e.opts.MqttClient.Unsubscribe(commandTopic(e.opts.TopicPrefix, dev.Serial))
 	}
 
-	e.devs = devices
+	e.removeStaleParameterStates(devices)
 
 	for _, dev := range devices {
 		e.opts.MqttClient.Subscribe(parameterCommandTopic(e.opts.TopicPrefix, dev.Serial), 0, e.parametersSubscription(dev))
+		e.opts.MqttClient.Subscribe(commandTopic(e.opts.TopicPrefix, dev.Serial), 0, e.commandSubscription(dev))
+	}
+
+	e.announceDevices()
+}
+
+// announceDevices sends the current devices to Home Assistant
+func (e *Endpoint) announceDevices() {
+	if e.opts.HaClient == nil {
+		// the endpoint of a backfill run announces nothing
+		return
 	}
 
+	e.announceLock.Lock()
+	defer e.announceLock.Unlock()
+
+	e.stateLock.Lock()
+	haDevices := e.haDevices()
+	e.stateLock.Unlock()
+
+	e.opts.HaClient.SetDevices(haDevices)
+}
+
+// haDevices returns the current devices for Home Assistant. e.stateLock must
+// be held by the caller.
+func (e *Endpoint) haDevices() []homeassistant.DeviceInfo {
 	var haDevices []homeassistant.DeviceInfo
-	for _, dev := range devices {
+	for _, dev := range e.devs {
 		var bats []homeassistant.BatteryInfo
+		serials := e.batterySerials[dev.Serial]
 		for i, bat := range dev.Batteries {
-			bats = append(bats, homeassistant.BatteryInfo{
+			info := homeassistant.BatteryInfo{
 				Alias:      bat.Alias,
 				StateTopic: stateTopicBattery(e.opts.TopicPrefix, dev.Serial, i),
-			})
+			}
+			if i < len(serials) {
+				info.SerialNumber = serials[i]
+			}
+			bats = append(bats, info)
 		}
 
 		var pvs []homeassistant.PVInfo
@@ -68,6 +142,13 @@ func (e *Endpoint) SetDevices(devices []models.NoahDevicePayload) {
 			})
 		}
 
+		var meter *homeassistant.MeterInfo
+		if e.meters[dev.Serial] {
+			meter = &homeassistant.MeterInfo{
+				StateTopic: stateTopicMeter(e.opts.TopicPrefix, dev.Serial),
+			}
+		}
+
 		haDevices = append(haDevices, homeassistant.DeviceInfo{
 			SerialNumber: dev.Serial,
 			Model:        dev.Model,
@@ -76,10 +157,31 @@ func (e *Endpoint) SetDevices(devices []models.NoahDevicePayload) {
 			TopicPrefix:  e.opts.TopicPrefix,
 			Batteries:    bats,
 			PVs:          pvs,
+			Meter:        meter,
 		})
 	}
+	return haDevices
+}
 
-	e.opts.HaClient.SetDevices(haDevices)
+func (e *Endpoint) removeStaleParameterStates(devices []models.NoahDevicePayload) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+
+	for serial, state := range e.paramStates {
+		found := false
+		for _, dev := range devices {
+			if dev.Serial == serial {
+				found = true
+				break
+			}
+		}
+		if !found {
+			if state.publishTimer != nil {
+				state.publishTimer.Stop()
+			}
+			delete(e.paramStates, serial)
+		}
+	}
 }
 
 func (e *Endpoint) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
@@ -103,6 +205,26 @@ func (e *Endpoint) PublishBatteryDetails(device models.NoahDevicePayload, detail
 	}
 	logData = append(logData, slog.String("device", device.Serial))
 	slog.Debug("battery data sent to mqtt", logData...)
+
+	// the batteries are announced as devices by their serial, which is only
+	// known from the battery data
+	var serials []string
+	for _, bat := range details {
+		serials = append(serials, bat.SerialNumber)
+	}
+	e.stateLock.Lock()
+	if e.batterySerials == nil {
+		e.batterySerials = make(map[string][]string)
+	}
+	changed := !slices.Equal(e.batterySerials[device.Serial], serials)
+	if changed {
+		e.batterySerials[device.Serial] = serials
+	}
+	e.stateLock.Unlock()
+
+	if changed {
+		e.announceDevices()
+	}
 }
 
 func (e *Endpoint) PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload) {
@@ -119,6 +241,56 @@ func (e *Endpoint) PublishPvDetails(device models.NoahDevicePayload, details []m
 	slog.Debug("pv data sent to mqtt", logData...)
 }
 
+// PublishMeterData publishes the meter data. The meter is announced to Home
+// Assistant with its first data, the device enumeration does not tell whether
+// a meter is connected.
+func (e *Endpoint) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	if b, err := json.Marshal(meter); err != nil {
+		slog.Error("could not marshal meter data", slog.String("error", err.Error()), slog.String("device", device.Serial))
+	} else {
+		e.opts.MqttClient.Publish(stateTopicMeter(e.opts.TopicPrefix, device.Serial), 0, false, string(b))
+		slog.Debug("meter data sent to mqtt", slog.String("data", string(b)), slog.String("device", device.Serial))
+	}
+
+	e.stateLock.Lock()
+	if e.meters == nil {
+		e.meters = make(map[string]bool)
+	}
+	added := !e.meters[device.Serial]
+	e.meters[device.Serial] = true
+	e.stateLock.Unlock()
+
+	if added {
+		e.announceDevices()
+	}
+}
+
+func (e *Endpoint) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	if b, err := json.Marshal(alarms); err != nil {
+		slog.Error("could not marshal alarm data", slog.String("error", err.Error()), slog.String("device", device.Serial))
+	} else {
+		e.opts.MqttClient.Publish(alarmsTopic(e.opts.TopicPrefix, device.Serial), 0, false, string(b))
+		slog.Debug("alarm data sent to mqtt", slog.String("data", string(b)), slog.String("device", device.Serial))
+	}
+}
+
+// WriteSample publishes a backfilled history sample with its original
+// timestamp. It implements backfill.Sink and waits until the broker has
+// received the sample.
+func (e *Endpoint) WriteSample(device models.NoahDevicePayload, sample models.HistorySample) error {
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return fmt.Errorf("could not marshal history sample: %w", err)
+	}
+	token := e.opts.MqttClient.Publish(historyTopic(e.opts.TopicPrefix, device.Serial), 1, false, string(b))
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+	slog.Debug("history sample sent to mqtt", slog.String("data", string(b)), slog.String("device", device.Serial))
+	return nil
+}
+
 func (e *Endpoint) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
 	if b, err := json.Marshal(param); err != nil {
 		slog.Error("could not marshal parameter data", slog.String("error", err.Error()), slog.String("device", device.Serial))
@@ -129,7 +301,7 @@ func (e *Endpoint) PublishParameterData(device models.NoahDevicePayload, param m
 		e.stateLock.Lock()
 		defer e.stateLock.Unlock()
 
-		e.lastParameter = param
+		e.parameterState(device.Serial).lastParameter = param
 	}
 }
 
@@ -137,25 +309,28 @@ func (e *Endpoint) PublishHealth(device models.NoahDevicePayload, health *models
 	health.StateLock.Lock()
 	defer health.StateLock.Unlock()
 
-	if health.Send[device.Serial] {
-		var lastSuccess *time.Time
-		if health.Status == "ok" {
-			lastSuccess = health.LastSuccess
-			health.LastSuccess = nil
-		}
-
+	if health.Send {
 		if b, err := json.Marshal(health); err != nil {
 			slog.Error("could not marshal health data", slog.String("error", err.Error()))
 		} else {
 			e.opts.MqttClient.Publish(healthTopic(e.opts.TopicPrefix, device.Serial), 0, true, string(b))
-			slog.Debug("health data sent to mqtt", slog.String("data", string(b)))
+			slog.Debug("health data sent to mqtt", slog.String("data", string(b)), slog.String("device", device.Serial))
+			health.LastSent = time.Now()
 		}
+	}
+	health.Send = false
+}
 
-		if health.Status == "ok" {
-			health.LastSuccess = lastSuccess
-		}
+// PublishServiceState publishes the state of nexa-mqtt itself, e.g. while
+// the login or the device enumeration is retried. The state of a named
+// account is published on its own topic.
+func (e *Endpoint) PublishServiceState(state models.ServiceState) {
+	if b, err := json.Marshal(state); err != nil {
+		slog.Error("could not marshal service state", slog.String("error", err.Error()))
+	} else {
+		e.opts.MqttClient.Publish(serviceHealthTopic(e.opts.TopicPrefix, state.Account), 0, true, string(b))
+		slog.Debug("service state sent to mqtt", slog.String("data", string(b)))
 	}
-	health.Send[device.Serial] = false
 }
 
 const debounceDelay = 500 * time.Millisecond
@@ -176,13 +351,19 @@ func (e *Endpoint) parametersSubscription(dev models.NoahDevicePayload) func(cli
 		e.stateLock.Lock()
 		defer e.stateLock.Unlock()
 
-		e.newParameter.UpdateFrom(payload)
+		if e.closed {
+			slog.Warn("parameter command rejected, shutting down", slog.String("payload", string(message.Payload())), slog.String("device", dev.Serial))
+			return
+		}
+
+		state := e.parameterState(dev.Serial)
+		state.newParameter.UpdateFrom(payload)
 
-		if e.publishTimer != nil {
-			e.publishTimer.Stop()
+		if state.publishTimer != nil {
+			state.publishTimer.Stop()
 		}
 
-		e.publishTimer = time.AfterFunc(debounceDelay, func() {
+		state.publishTimer = time.AfterFunc(debounceDelay, func() {
 			e.debouncedParametersSubscription(dev)
 		})
 	}
@@ -192,40 +373,157 @@ func (e *Endpoint) debouncedParametersSubscription(dev models.NoahDevicePayload)
 	e.stateLock.Lock()
 	defer e.stateLock.Unlock()
 
-	e.lastParameter.UpdateFrom(e.newParameter)
+	// a timer that already fired when the device was removed must not
+	// re-create its state
+	if !slices.ContainsFunc(e.devs, func(d models.NoahDevicePayload) bool { return d.Serial == dev.Serial }) {
+		slog.Warn("parameter command dropped, device was removed", slog.String("device", dev.Serial))
+		return
+	}
+
+	state := e.parameterState(dev.Serial)
+	state.lastParameter.UpdateFrom(state.newParameter)
 
-	if e.newParameter.DefaultACCouplePower != nil || e.newParameter.DefaultMode != nil {
-		e.param_applier.SetOutputPowerW(dev, *e.lastParameter.DefaultMode, *e.lastParameter.DefaultACCouplePower)
+	if state.newParameter.DefaultACCouplePower != nil || state.newParameter.DefaultMode != nil {
+		e.param_applier.SetOutputPowerW(dev, *state.lastParameter.DefaultMode, *state.lastParameter.DefaultACCouplePower)
 	}
 
-	if e.newParameter.ChargingLimit != nil || e.newParameter.DischargeLimit != nil {
-		e.param_applier.SetChargingLimits(dev, *e.lastParameter.ChargingLimit, *e.lastParameter.DischargeLimit)
+	if state.newParameter.ChargingLimit != nil || state.newParameter.DischargeLimit != nil {
+		e.param_applier.SetChargingLimits(dev, *state.lastParameter.ChargingLimit, *state.lastParameter.DischargeLimit)
 	}
 
-	if e.newParameter.AllowGridCharging != "" {
-		e.param_applier.SetAllowGridCharging(dev, e.lastParameter.AllowGridCharging)
+	if state.newParameter.AllowGridCharging != "" {
+		e.param_applier.SetAllowGridCharging(dev, state.lastParameter.AllowGridCharging)
 	}
 
-	if e.newParameter.GridConnectionControl != "" {
-		e.param_applier.SetGridConnectionControl(dev, e.lastParameter.GridConnectionControl)
+	if state.newParameter.GridConnectionControl != "" {
+		e.param_applier.SetGridConnectionControl(dev, state.lastParameter.GridConnectionControl)
 	}
 
-	if e.newParameter.AcCouplePowerControl != "" {
-		e.param_applier.SetAcCouplePowerControl(dev, e.lastParameter.AcCouplePowerControl)
+	if state.newParameter.AcCouplePowerControl != "" {
+		e.param_applier.SetAcCouplePowerControl(dev, state.lastParameter.AcCouplePowerControl)
 	}
 
-	if e.newParameter.LightLoadEnable != "" {
-		e.param_applier.SetLightLoadEnable(dev, e.lastParameter.LightLoadEnable)
+	if state.newParameter.LightLoadEnable != "" {
+		e.param_applier.SetLightLoadEnable(dev, state.lastParameter.LightLoadEnable)
 	}
 
-	if e.newParameter.NeverPowerOff != "" {
-		e.param_applier.SetNeverPowerOff(dev, e.lastParameter.NeverPowerOff)
+	if state.newParameter.NeverPowerOff != "" {
+		e.param_applier.SetNeverPowerOff(dev, state.lastParameter.NeverPowerOff)
 	}
 
-	if e.newParameter.AntiBackflowEnable != "" || e.newParameter.AntiBackflowPowerPercentage != nil {
-		e.param_applier.SetBackflow(dev, e.lastParameter.AntiBackflowEnable, *e.lastParameter.AntiBackflowPowerPercentage)
+	if state.newParameter.AntiBackflowEnable != "" || state.newParameter.AntiBackflowPowerPercentage != nil {
+		e.param_applier.SetBackflow(dev, state.lastParameter.AntiBackflowEnable, *state.lastParameter.AntiBackflowPowerPercentage)
 	}
 
-	e.newParameter = models.ParameterPayload{}
-	e.publishTimer = nil
+	state.newParameter = models.ParameterPayload{}
+	state.publishTimer = nil
+}
+
+// commandSubscription handles the commands of the command topic of the
+// device, e.g. sent by the buttons in Home Assistant
+func (e *Endpoint) commandSubscription(dev models.NoahDevicePayload) func(client mqtt.Client, message mqtt.Message) {
+	return func(client mqtt.Client, message mqtt.Message) {
+		command := strings.TrimSpace(string(message.Payload()))
+		slog.Info("command received", slog.String("command", command), slog.String("device", dev.Serial))
+
+		e.stateLock.Lock()
+		closed := e.closed
+		e.stateLock.Unlock()
+		if closed {
+			slog.Warn("command rejected, shutting down", slog.String("command", command), slog.String("device", dev.Serial))
+			return
+		}
+
+		refresher, ok := e.param_applier.(endpoint.Refresher)
+		if !ok {
+			slog.Error("commands are not supported by the parameter applier", slog.String("command", command), slog.String("device", dev.Serial))
+			return
+		}
+
+		// the command may poll the Growatt API, which must not block the
+		// handling of the other MQTT messages
+		e.commands.Add(1)
+		go func() {
+			defer e.commands.Done()
+			if err := e.runCommand(refresher, dev, command); err != nil {
+				slog.Error("command failed", slog.String("command", command), slog.String("device", dev.Serial), slog.String("error", err.Error()))
+			}
+		}()
+	}
+}
+
+func (e *Endpoint) runCommand(refresher endpoint.Refresher, dev models.NoahDevicePayload, command string) error {
+	switch command {
+	case models.CommandRefresh:
+		return refresher.Refresh(dev)
+	case models.CommandRediscover:
+		err := refresher.Reenumerate(dev)
+		// resend the discovery now, changed devices are announced again
+		// by SetDevices once the enumeration is done
+		e.announceDevices()
+		return err
+	default:
+		return fmt.Errorf("unknown command")
+	}
+}
+
+// Shutdown stops accepting parameter commands and applies the debounced
+// commands that are still pending. Pending commands that cannot be applied
+// before ctx is done are rejected. It waits for the running device commands
+// until ctx is done.
+func (e *Endpoint) Shutdown(ctx context.Context) {
+	e.stateLock.Lock()
+	e.closed = true
+	for _, dev := range e.devs {
+		e.opts.MqttClient.Unsubscribe(parameterCommandTopic(e.opts.TopicPrefix, dev.Serial))
+		e.opts.MqttClient.Unsubscribe(commandTopic(e.opts.TopicPrefix, dev.Serial))
+	}
+
+	var pending []models.NoahDevicePayload
+	for _, dev := range e.devs {
+		state, ok := e.paramStates[dev.Serial]
+		// a timer that cannot be stopped has already fired and applies the command itself
+		if ok && state.publishTimer != nil && state.publishTimer.Stop() {
+			pending = append(pending, dev)
+		}
+	}
+	e.stateLock.Unlock()
+
+	for _, dev := range pending {
+		if err := ctx.Err(); err != nil {
+			e.rejectPendingParameters(dev, err)
+			continue
+		}
+		e.debouncedParametersSubscription(dev)
+		slog.Info("pending parameter command applied on shutdown", slog.String("device", dev.Serial))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.commands.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		select {
+		case <-done:
+		default:
+			slog.Warn("running commands not finished on shutdown", slog.String("error", ctx.Err().Error()))
+		}
+	}
+}
+
+func (e *Endpoint) rejectPendingParameters(dev models.NoahDevicePayload, err error) {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+
+	state := e.parameterState(dev.Serial)
+	if b, jsonErr := json.Marshal(state.newParameter); jsonErr == nil {
+		slog.Error("pending parameter command rejected on shutdown", slog.String("payload", string(b)), slog.String("error", err.Error()), slog.String("device", dev.Serial))
+	} else {
+		slog.Error("pending parameter command rejected on shutdown", slog.String("error", err.Error()), slog.String("device", dev.Serial))
+	}
+	state.newParameter = models.ParameterPayload{}
+	state.publishTimer = nil
 }
@@ -1,9 +1,12 @@
 package endpoint_mqtt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"nexa-mqtt/internal/endpoint"
 	"nexa-mqtt/internal/homeassistant"
 	"nexa-mqtt/pkg/models"
 	"sync"
@@ -28,7 +31,7 @@ func (m *MockMqttMessage) Payload() []byte {
 	return args.Get(0).([]byte)
 }
 
-// MockParameterApplier implements endpoint.ParameterApplier
+// MockParameterApplier implements endpoint.ParameterApplier and endpoint.Refresher
 type MockParameterApplier struct {
 	mock.Mock
 }
@@ -73,6 +76,16 @@ func (p *MockParameterApplier) SetBackflow(device models.NoahDevicePayload, enab
 	return args.Error(0)
 }
 
+func (p *MockParameterApplier) Refresh(device models.NoahDevicePayload) error {
+	args := p.Called(device)
+	return args.Error(0)
+}
+
+func (p *MockParameterApplier) Reenumerate(device models.NoahDevicePayload) error {
+	args := p.Called(device)
+	return args.Error(0)
+}
+
 // MockHaClient implements homeassistant.HaClient
 type MockHaClient struct {
 	mock.Mock
@@ -87,8 +100,12 @@ func (s *MockHaClient) SetDevices(devices []homeassistant.DeviceInfo) {
 func TestNewEndpoint(t *testing.T) {
 	endpoint := NewEndpoint(Options{})
 
-	assert.Equal(t, models.EmptyParameterPayload(), endpoint.lastParameter)
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Empty(t, endpoint.paramStates)
+
+	state := endpoint.parameterState("device123")
+	assert.Equal(t, models.EmptyParameterPayload(), state.lastParameter)
+	assert.Equal(t, models.ParameterPayload{}, state.newParameter)
+	assert.Nil(t, state.publishTimer)
 }
 
 func TestSetDevices(t *testing.T) {
@@ -114,12 +131,24 @@ func TestSetDevices(t *testing.T) {
 		byte(0),
 		mock.AnythingOfType("mqtt.MessageHandler"),
 	).Return(mockToken)
+	mockClient.On(
+		"Subscribe",
+		"test/device123/command",
+		byte(0),
+		mock.AnythingOfType("mqtt.MessageHandler"),
+	).Return(mockToken)
 	mockClient.On(
 		"Subscribe",
 		"test/device234/parameters/set",
 		byte(0),
 		mock.AnythingOfType("mqtt.MessageHandler"),
 	).Return(mockToken)
+	mockClient.On(
+		"Subscribe",
+		"test/device234/command",
+		byte(0),
+		mock.AnythingOfType("mqtt.MessageHandler"),
+	).Return(mockToken)
 
 	haClient.On(
 		"SetDevices",
@@ -192,16 +221,30 @@ func TestSetDevices(t *testing.T) {
 		"Unsubscribe",
 		"test/device123/parameters/set",
 	).Return(mockToken)
+	mockClient.On(
+		"Unsubscribe",
+		"test/device123/command",
+	).Return(mockToken)
 	mockClient.On(
 		"Unsubscribe",
 		"test/device234/parameters/set",
 	).Return(mockToken)
+	mockClient.On(
+		"Unsubscribe",
+		"test/device234/command",
+	).Return(mockToken)
 	mockClient.On(
 		"Subscribe",
 		"test/device345/parameters/set",
 		byte(0),
 		mock.AnythingOfType("mqtt.MessageHandler"),
 	).Return(mockToken)
+	mockClient.On(
+		"Subscribe",
+		"test/device345/command",
+		byte(0),
+		mock.AnythingOfType("mqtt.MessageHandler"),
+	).Return(mockToken)
 
 	haClient.On(
 		"SetDevices",
@@ -421,6 +464,228 @@ func TestPublishPvDetails_Success(t *testing.T) {
 	mockClient.AssertExpectations(t)
 }
 
+func TestPublishBatteryDetails_AnnouncesBatterySerials(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	haClient := &MockHaClient{}
+
+	device := models.NoahDevicePayload{Serial: "device123", Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}, {Alias: "BAT1"}}}
+	haClient.On("SetDevices", mock.MatchedBy(func(devices []homeassistant.DeviceInfo) bool {
+		return len(devices) == 1 &&
+			devices[0].Batteries[0] == homeassistant.BatteryInfo{Alias: "BAT0", SerialNumber: "0PVPBAT01", StateTopic: "test/device123/BAT0"} &&
+			devices[0].Batteries[1] == homeassistant.BatteryInfo{Alias: "BAT1", SerialNumber: "0PVPBAT02", StateTopic: "test/device123/BAT1"}
+	})).Once()
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+			HaClient:    haClient,
+		},
+		devs: []models.NoahDevicePayload{device},
+	}
+
+	details := []models.BatteryPayload{{SerialNumber: "0PVPBAT01"}, {SerialNumber: "0PVPBAT02"}}
+	endpoint.PublishBatteryDetails(device, details)
+	// the serials are only announced when they change
+	endpoint.PublishBatteryDetails(device, details)
+
+	haClient.AssertExpectations(t)
+}
+
+func TestPublishBatteryDetails_ConcurrentAnnounce(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	haClient := &MockHaClient{}
+	haClient.On("SetDevices", mock.Anything)
+
+	device := models.NoahDevicePayload{Serial: "device123", Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}}}
+	endpoint := NewEndpoint(Options{MqttClient: mockClient, TopicPrefix: "test", HaClient: haClient})
+	endpoint.devs = []models.NoahDevicePayload{device}
+
+	// run with -race, e.g. a rediscover command announces the devices while
+	// the battery details are published
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			endpoint.announceDevices()
+		}
+	}()
+	for i := range 10 {
+		endpoint.PublishBatteryDetails(device, []models.BatteryPayload{{SerialNumber: fmt.Sprintf("0PVPBAT%02d", i)}})
+	}
+	wg.Wait()
+
+	assert.Equal(t, []string{"0PVPBAT09"}, endpoint.batterySerials["device123"])
+}
+
+func TestPublishMeterData_AnnouncesMeter(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	haClient := &MockHaClient{}
+
+	tm, _ := time.ParseInLocation("2006-01-02 15:04:05", "2025-05-21 10:54:51", time.Local)
+	expectedTime := tm.Format(time.RFC3339)
+	phase := `{"voltage":0,"current":0,"active_power_w":0,"reactive_power_var":0,"apparent_power_va":0,"power_factor":0}`
+
+	mockClient.On(
+		"Publish",
+		"test/device123/METER",
+		byte(0),
+		false,
+		`{"time":"`+expectedTime+`","frequency":50.01,"active_power_w":-230.5,"reactive_power_var":0,"apparent_power_va":0,"power_factor":0,`+
+			`"forward_active_energy_kwh":1234.5,"reverse_active_energy_kwh":321.9,"phases":[`+phase+`,`+phase+`,`+phase+`]}`,
+	).Return(mockToken)
+	haClient.On(
+		"SetDevices",
+		[]homeassistant.DeviceInfo{
+			{
+				SerialNumber: "device123",
+				TopicPrefix:  "test",
+				PVs: []homeassistant.PVInfo{
+					{StateTopic: "test/device123/PV0"},
+					{StateTopic: "test/device123/PV1"},
+					{StateTopic: "test/device123/PV2"},
+					{StateTopic: "test/device123/PV3"},
+				},
+				Meter: &homeassistant.MeterInfo{StateTopic: "test/device123/METER"},
+			},
+		},
+	).Once()
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+			HaClient:    haClient,
+		},
+		devs: []models.NoahDevicePayload{device},
+	}
+
+	meter := models.MeterPayload{Time: tm, Frequency: 50.01, ActivePower: -230.5, ForwardActiveEnergy: 1234.5, ReverseActiveEnergy: 321.9}
+	endpoint.PublishMeterData(device, meter)
+	// the meter is only announced once
+	endpoint.PublishMeterData(device, meter)
+
+	mockClient.AssertExpectations(t)
+	mockClient.AssertNumberOfCalls(t, "Publish", 2)
+	haClient.AssertExpectations(t)
+}
+
+func TestPublishMeterData_ConcurrentAnnounce(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	haClient := &MockHaClient{}
+	haClient.On("SetDevices", mock.Anything)
+
+	devices := []models.NoahDevicePayload{{Serial: "device123"}, {Serial: "device234"}}
+	endpoint := NewEndpoint(Options{MqttClient: mockClient, TopicPrefix: "test", HaClient: haClient})
+	endpoint.devs = devices
+
+	// run with -race, e.g. a rediscover command announces the devices while
+	// the meter data is published
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 10 {
+			endpoint.announceDevices()
+		}
+	}()
+	for _, device := range devices {
+		endpoint.PublishMeterData(device, models.MeterPayload{})
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]bool{"device123": true, "device234": true}, endpoint.meters)
+}
+
+func TestPublishAlarms(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+
+	tm, _ := time.ParseInLocation("2006-01-02 15:04:05", "2025-05-21 10:54:51", time.Local)
+	expectedTime := tm.Format(time.RFC3339)
+
+	mockClient.On(
+		"Publish",
+		"test/device123/alarms",
+		byte(0),
+		false,
+		`{"time":"`+expectedTime+`","fault":false,"warning":true,"protection":false,"alarms":[{"name":"bat0_warn_bit2","category":"warning","source":"bat0_warn_status","code":2}]}`,
+	).Return(mockToken)
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+		},
+	}
+
+	alarms := models.NewAlarmPayload(tm)
+	alarms.AddBits("bat0_warn", models.AlarmCategoryWarning, 0b100, nil)
+	endpoint.PublishAlarms(models.NoahDevicePayload{Serial: "device123"}, alarms)
+
+	mockClient.AssertExpectations(t)
+}
+
+func TestWriteSample(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	mockToken.On("Error", "Error").Return(nil).Once()
+
+	tm, _ := time.ParseInLocation("2006-01-02 15:04:05", "2025-05-21 10:54:51", time.Local)
+	expectedTime := tm.Format(time.RFC3339)
+
+	mockClient.On(
+		"Publish",
+		"test/device123/history",
+		byte(1),
+		false,
+		`{"time":"`+expectedTime+`","device":{"ac_w":0,"solar_w":420,"soc":63,"charge_w":0,"discharge_w":0,"battery_num":0,"generation_total_kwh":0,"generation_today_kwh":0},"batteries":[{"time":"`+expectedTime+`","serial":"","soc":64,"temp":21}],"pvs":null}`,
+	).Return(mockToken)
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+		},
+	}
+
+	err := endpoint.WriteSample(models.NoahDevicePayload{Serial: "device123"}, models.HistorySample{
+		Time:      tm,
+		Device:    models.DevicePayload{SolarPower: 420, Soc: 63},
+		Batteries: []models.BatteryPayload{{Time: tm, Soc: 64, Temperature: 21}},
+	})
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+	mockToken.AssertExpectations(t)
+}
+
+func TestWriteSample_Fail(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	mockToken.On("Error", "Error").Return(errors.New("not connected"))
+
+	mockClient.On("Publish", "test/device123/history", byte(1), false, mock.Anything).Return(mockToken)
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+		},
+	}
+
+	err := endpoint.WriteSample(models.NoahDevicePayload{Serial: "device123"}, models.HistorySample{Time: time.Now()})
+
+	assert.EqualError(t, err, "not connected")
+	mockClient.AssertExpectations(t)
+}
+
 func TestPublishPvDetails_Fail(t *testing.T) {
 	mockClient := new(MockMqttClient)
 
@@ -469,20 +734,26 @@ func TestPublishParameterData_Success(t *testing.T) {
 	mockClient.AssertExpectations(t)
 }
 
+func lastPublishedHealth(t *testing.T, mockClient *MockMqttClient) *models.ServiceHealth {
+	var h models.ServiceHealth
+	if len(mockClient.Calls) == 0 {
+		t.Fatal("no health payload published")
+	}
+	payload := mockClient.Calls[len(mockClient.Calls)-1].Arguments.String(3)
+	if err := json.Unmarshal([]byte(payload), &h); err != nil {
+		t.Fatalf("invalid health payload: %s", payload)
+	}
+	return &h
+}
+
 func TestPublishOkHealth(t *testing.T) {
 	mockClient := new(MockMqttClient)
 	mockToken := NewMockToken()
 	device := models.NoahDevicePayload{Serial: "device123"}
 	health := models.NewServiceHealth()
-	health.UpdateSuccess(device.Serial)
+	health.UpdateSuccess(models.HealthCallStatus, 120*time.Millisecond)
 
-	mockClient.On(
-		"Publish",
-		"test/device123/health",
-		byte(0),
-		true,
-		`{"status":"ok"}`,
-	).Return(mockToken)
+	mockClient.On("Publish", "test/device123/health", byte(0), true, mock.AnythingOfType("string")).Return(mockToken)
 
 	endpoint := &Endpoint{
 		opts: Options{
@@ -491,14 +762,50 @@ func TestPublishOkHealth(t *testing.T) {
 		},
 	}
 
-	endpoint.PublishHealth(device, &health)
+	endpoint.PublishHealth(device, health)
+
+	h := lastPublishedHealth(t, mockClient)
+	assert.Equal(t, "ok", h.Status)
+	assert.NotNil(t, h.LastSuccess)
+	assert.Nil(t, h.LastError)
+	assert.Empty(t, h.Message)
+	assert.Equal(t, "ok", h.Calls[models.HealthCallStatus].Status)
+	assert.Equal(t, 0, h.Calls[models.HealthCallStatus].ConsecutiveFailures)
+	assert.Equal(t, int64(120), h.Calls[models.HealthCallStatus].Latency.LastMs)
+	assert.Equal(t, 1, h.Calls[models.HealthCallStatus].Latency.Samples)
 
 	// further UpdateSuccess will not be published
 
-	health.UpdateSuccess(device.Serial)
-	endpoint.PublishHealth(device, &health)
+	health.UpdateSuccess(models.HealthCallStatus, 100*time.Millisecond)
+	endpoint.PublishHealth(device, health)
 
-	mockClient.AssertExpectations(t)
+	mockClient.AssertNumberOfCalls(t, "Publish", 1)
+}
+
+func TestPublishOkHealth_NewCallType(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	device := models.NoahDevicePayload{Serial: "device123"}
+	health := models.NewServiceHealth()
+
+	mockClient.On("Publish", "test/device123/health", byte(0), true, mock.AnythingOfType("string")).Return(mockToken)
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+		},
+	}
+
+	health.UpdateSuccess(models.HealthCallStatus, 100*time.Millisecond)
+	endpoint.PublishHealth(device, health)
+
+	// first success of another call type is published
+
+	health.UpdateSuccess(models.HealthCallParameters, 100*time.Millisecond)
+	endpoint.PublishHealth(device, health)
+
+	mockClient.AssertNumberOfCalls(t, "Publish", 2)
 }
 
 func TestPublishErrorHealthNotYetSuccess(t *testing.T) {
@@ -507,15 +814,9 @@ func TestPublishErrorHealthNotYetSuccess(t *testing.T) {
 	device := models.NoahDevicePayload{Serial: "device123"}
 	health := models.NewServiceHealth()
 
-	health.UpdateError(device.Serial, fmt.Errorf("test error"))
+	health.UpdateError(models.HealthCallStatus, 10*time.Second, fmt.Errorf("test error"))
 
-	mockClient.On(
-		"Publish",
-		"test/device123/health",
-		byte(0),
-		true,
-		fmt.Sprintf(`{"status":"error","message":"%v"}`, health.Message),
-	).Return(mockToken)
+	mockClient.On("Publish", "test/device123/health", byte(0), true, mock.AnythingOfType("string")).Return(mockToken)
 
 	endpoint := &Endpoint{
 		opts: Options{
@@ -524,9 +825,18 @@ func TestPublishErrorHealthNotYetSuccess(t *testing.T) {
 		},
 	}
 
-	endpoint.PublishHealth(device, &health)
-
-	mockClient.AssertExpectations(t)
+	endpoint.PublishHealth(device, health)
+
+	h := lastPublishedHealth(t, mockClient)
+	assert.Equal(t, "error", h.Status)
+	assert.Equal(t, "test error", h.Message)
+	assert.Nil(t, h.LastSuccess)
+	assert.NotNil(t, h.LastError)
+	assert.Equal(t, "error", h.Calls[models.HealthCallStatus].Status)
+	assert.Equal(t, "test error", h.Calls[models.HealthCallStatus].Message)
+	assert.Equal(t, 1, h.Calls[models.HealthCallStatus].ConsecutiveFailures)
+	assert.Equal(t, 1, h.Calls[models.HealthCallStatus].TotalFailures)
+	assert.Equal(t, int64(10000), h.Calls[models.HealthCallStatus].Latency.LastMs)
 }
 
 func TestPublishErrorHealthAfterSuccess(t *testing.T) {
@@ -535,16 +845,11 @@ func TestPublishErrorHealthAfterSuccess(t *testing.T) {
 	device := models.NoahDevicePayload{Serial: "device123"}
 
 	health := models.NewServiceHealth()
-	health.UpdateSuccess(device.Serial)
-	health.UpdateError(device.Serial, fmt.Errorf("test error"))
+	health.UpdateSuccess(models.HealthCallStatus, 100*time.Millisecond)
+	health.UpdateError(models.HealthCallStatus, 200*time.Millisecond, fmt.Errorf("test error"))
+	health.UpdateError(models.HealthCallStatus, 300*time.Millisecond, fmt.Errorf("another test error"))
 
-	mockClient.On(
-		"Publish",
-		"test/device123/health",
-		byte(0),
-		true,
-		fmt.Sprintf(`{"status":"error","last_success":"%v","message":"%v"}`, health.LastSuccess.Format(time.RFC3339), health.Message),
-	).Return(mockToken)
+	mockClient.On("Publish", "test/device123/health", byte(0), true, mock.AnythingOfType("string")).Return(mockToken)
 
 	endpoint := &Endpoint{
 		opts: Options{
@@ -553,17 +858,98 @@ func TestPublishErrorHealthAfterSuccess(t *testing.T) {
 		},
 	}
 
-	endpoint.PublishHealth(device, &health)
+	endpoint.PublishHealth(device, health)
+
+	h := lastPublishedHealth(t, mockClient)
+	assert.Equal(t, "error", h.Status)
+	assert.Equal(t, "another test error", h.Message)
+	assert.NotNil(t, h.LastSuccess)
+	assert.NotNil(t, h.LastError)
+	call := h.Calls[models.HealthCallStatus]
+	assert.Equal(t, 2, call.ConsecutiveFailures)
+	assert.Equal(t, int64(300), call.Latency.LastMs)
+	assert.Equal(t, int64(200), call.Latency.AvgMs)
+	assert.Equal(t, int64(100), call.Latency.MinMs)
+	assert.Equal(t, int64(300), call.Latency.MaxMs)
+	assert.Equal(t, 3, call.Latency.Samples)
+}
 
-	mockClient.On(
-		"Publish",
-		"test/device123/health",
-		byte(0),
-		true,
-		fmt.Sprintf(`{"status":"error","last_success":"%v","message":"%v"}`, health.LastSuccess.Format(time.RFC3339), health.Message),
-	).Return(mockToken)
+func TestPublishHealth_StatusPerCallType(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	device := models.NoahDevicePayload{Serial: "device123"}
+
+	health := models.NewServiceHealth()
+	health.UpdateError(models.HealthCallHistory, 0, fmt.Errorf("history error"))
+	health.UpdateSuccess(models.HealthCallParameters, 100*time.Millisecond)
 
-	health.UpdateError(device.Serial, fmt.Errorf("another test error"))
+	mockClient.On("Publish", "test/device123/health", byte(0), true, mock.AnythingOfType("string")).Return(mockToken)
+
+	endpoint := &Endpoint{
+		opts: Options{
+			MqttClient:  mockClient,
+			TopicPrefix: "test",
+		},
+	}
+
+	endpoint.PublishHealth(device, health)
+
+	h := lastPublishedHealth(t, mockClient)
+	assert.Equal(t, "error", h.Status)
+	assert.Equal(t, "history error", h.Message)
+	assert.Equal(t, "error", h.Calls[models.HealthCallHistory].Status)
+	assert.Equal(t, 0, h.Calls[models.HealthCallHistory].Latency.Samples)
+	assert.Equal(t, "ok", h.Calls[models.HealthCallParameters].Status)
+	assert.NotContains(t, h.Calls, models.HealthCallSet)
+
+	// recovery of the failing call is published with overall status ok
+
+	health.UpdateSuccess(models.HealthCallHistory, 100*time.Millisecond)
+	endpoint.PublishHealth(device, health)
+
+	mockClient.AssertNumberOfCalls(t, "Publish", 2)
+	h = lastPublishedHealth(t, mockClient)
+	assert.Equal(t, "ok", h.Status)
+	assert.Empty(t, h.Message)
+	assert.Equal(t, 0, h.Calls[models.HealthCallHistory].ConsecutiveFailures)
+	assert.Equal(t, 1, h.Calls[models.HealthCallHistory].TotalFailures)
+}
+
+func TestPublishServiceState(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+
+	nextRetry := time.Date(2025, 1, 1, 12, 0, 30, 0, time.UTC)
+	state := models.ServiceState{
+		State:     models.ServiceStateLogin,
+		Status:    models.HealthError,
+		Message:   "connection refused",
+		Attempt:   2,
+		NextRetry: &nextRetry,
+	}
+
+	mockClient.On("Publish", "test/health", byte(0), true, `{"state":"login","status":"error","message":"connection refused","attempt":2,"next_retry":"2025-01-01T12:00:30Z"}`).Return(mockToken)
+
+	endpoint := NewEndpoint(Options{MqttClient: mockClient, TopicPrefix: "test"})
+	endpoint.PublishServiceState(state)
+
+	mockClient.AssertExpectations(t)
+}
+
+func TestPublishServiceState_Account(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+
+	state := models.ServiceState{
+		Account: "relatives",
+		State:   models.ServiceStateRunning,
+		Status:  models.HealthOk,
+	}
+
+	mockClient.On("Publish", "test/health/relatives", byte(0), true, `{"account":"relatives","state":"running","status":"ok"}`).Return(mockToken)
+
+	endpoint := NewEndpoint(Options{MqttClient: mockClient, TopicPrefix: "test"})
+	endpoint.PublishServiceState(state)
 
 	mockClient.AssertExpectations(t)
 }
@@ -609,10 +995,19 @@ func setup_parametersSubscription() (*MockToken, *MockMqttClient, *MockParameter
 	endpoint := NewEndpoint(Options{MqttClient: mockClient, TopicPrefix: "test"})
 	endpoint.SetParameterApplier(&mockApplier)
 	device := models.NoahDevicePayload{Serial: "device123"}
+	endpoint.devs = []models.NoahDevicePayload{device}
 	f1 := endpoint.parametersSubscription(device)
 	return mockToken, mockClient, &mockApplier, endpoint, device, f1
 }
 
+// parameterStateOf returns a copy of the parameter state of the device. It
+// takes the state lock, so it waits for a running debounced command to finish.
+func parameterStateOf(e *Endpoint, serial string) parameterState {
+	e.stateLock.Lock()
+	defer e.stateLock.Unlock()
+	return *e.paramStates[serial]
+}
+
 func Test_parametersSubscription_InvalidPayload(t *testing.T) {
 	_, mockClient, mockApplier, _, _, f1 := setup_parametersSubscription()
 
@@ -651,7 +1046,7 @@ func Test_parametersSubscription_ChargingLimit(t *testing.T) {
 	mockApplier.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
 }
 
 func Test_parametersSubscription_ChargingAndDischargeLimit(t *testing.T) {
@@ -682,7 +1077,7 @@ func Test_parametersSubscription_ChargingAndDischargeLimit(t *testing.T) {
 	mockApplier.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
 }
 
 func Test_parametersSubscription_ChargingLimitAndMode(t *testing.T) {
@@ -720,7 +1115,7 @@ func Test_parametersSubscription_ChargingLimitAndMode(t *testing.T) {
 	mockApplier.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
 }
 
 func Test_parametersSubscription_AllowGridCharging(t *testing.T) {
@@ -746,7 +1141,7 @@ func Test_parametersSubscription_AllowGridCharging(t *testing.T) {
 	mockApplier.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
 }
 
 func Test_parametersSubscription_GridConnectionControlAndAcCouplePowerControl(t *testing.T) {
@@ -778,5 +1173,283 @@ func Test_parametersSubscription_GridConnectionControlAndAcCouplePowerControl(t
 	mockApplier.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 
-	assert.Equal(t, models.ParameterPayload{}, endpoint.newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
+}
+
+func Test_parametersSubscription_MultipleDevices(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device1, call1 := setup_parametersSubscription()
+	device2 := models.NoahDevicePayload{Serial: "device234"}
+	endpoint.devs = append(endpoint.devs, device2)
+	call2 := endpoint.parametersSubscription(device2)
+	empty := models.EmptyParameterPayload()
+
+	mockMqttMessage1 := MockMqttMessage{}
+	mockMqttMessage1.On("Payload").
+		Return([]byte(`{"charging_limit":90}`))
+
+	mockMqttMessage2 := MockMqttMessage{}
+	mockMqttMessage2.On("Payload").
+		Return([]byte(`{"discharge_limit":5}`))
+
+	var wg sync.WaitGroup
+
+	mockApplier.On("SetChargingLimits", device1, 90.0, *empty.DischargeLimit).
+		Run(func(args mock.Arguments) {
+			wg.Done()
+		}).
+		Return(nil)
+
+	mockApplier.On("SetChargingLimits", device2, *empty.ChargingLimit, 5.0).
+		Run(func(args mock.Arguments) {
+			wg.Done()
+		}).
+		Return(nil)
+
+	wg.Add(2)
+	call1(mockClient, &mockMqttMessage1)
+	call2(mockClient, &mockMqttMessage2)
+	wg.Wait()
+
+	mockMqttMessage1.AssertExpectations(t)
+	mockMqttMessage2.AssertExpectations(t)
+	mockApplier.AssertExpectations(t)
+	mockApplier.AssertNumberOfCalls(t, "SetChargingLimits", 2)
+	mockClient.AssertExpectations(t)
+
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device1.Serial).newParameter)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device2.Serial).newParameter)
+	assert.Equal(t, 90.0, *parameterStateOf(endpoint, device1.Serial).lastParameter.ChargingLimit)
+	assert.Equal(t, *empty.DischargeLimit, *parameterStateOf(endpoint, device1.Serial).lastParameter.DischargeLimit)
+	assert.Equal(t, *empty.ChargingLimit, *parameterStateOf(endpoint, device2.Serial).lastParameter.ChargingLimit)
+	assert.Equal(t, 5.0, *parameterStateOf(endpoint, device2.Serial).lastParameter.DischargeLimit)
+}
+
+func Test_parametersSubscription_MultipleDevicesUseOwnCache(t *testing.T) {
+	mockToken, mockClient, mockApplier, endpoint, device1, call1 := setup_parametersSubscription()
+	device2 := models.NoahDevicePayload{Serial: "device234"}
+	endpoint.devs = append(endpoint.devs, device2)
+	call2 := endpoint.parametersSubscription(device2)
+
+	param1 := models.EmptyParameterPayload()
+	*param1.DischargeLimit = 20
+	*param1.DefaultACCouplePower = 300
+	param2 := models.EmptyParameterPayload()
+	*param2.DischargeLimit = 25
+	*param2.DefaultACCouplePower = 600
+
+	mockClient.On("Publish", "test/device123/parameters", byte(0), false, mock.Anything).Return(mockToken)
+	mockClient.On("Publish", "test/device234/parameters", byte(0), false, mock.Anything).Return(mockToken)
+
+	endpoint.PublishParameterData(device1, param1)
+	endpoint.PublishParameterData(device2, param2)
+
+	mockMqttMessage1 := MockMqttMessage{}
+	mockMqttMessage1.On("Payload").
+		Return([]byte(`{"charging_limit":80}`))
+
+	mockMqttMessage2 := MockMqttMessage{}
+	mockMqttMessage2.On("Payload").
+		Return([]byte(`{"default_mode":"battery_first"}`))
+
+	var wg sync.WaitGroup
+
+	mockApplier.On("SetChargingLimits", device1, 80.0, 20.0).
+		Run(func(args mock.Arguments) {
+			wg.Done()
+		}).
+		Return(nil)
+
+	mockApplier.On("SetOutputPowerW", device2, models.WorkMode("battery_first"), 600.0).
+		Run(func(args mock.Arguments) {
+			wg.Done()
+		}).
+		Return(nil)
+
+	wg.Add(2)
+	call1(mockClient, &mockMqttMessage1)
+	call2(mockClient, &mockMqttMessage2)
+	wg.Wait()
+
+	mockApplier.AssertExpectations(t)
+	mockApplier.AssertNumberOfCalls(t, "SetChargingLimits", 1)
+	mockApplier.AssertNumberOfCalls(t, "SetOutputPowerW", 1)
+	mockClient.AssertExpectations(t)
+}
+
+func TestSetDevices_RemovesStaleParameterState(t *testing.T) {
+	mockClient := new(MockMqttClient)
+	mockToken := NewMockToken()
+	haClient := &MockHaClient{}
+	endpoint := NewEndpoint(Options{
+		MqttClient:  mockClient,
+		TopicPrefix: "test",
+		HaClient:    haClient,
+	})
+
+	mockClient.On("Subscribe", mock.Anything, byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken)
+	mockClient.On("Unsubscribe", mock.Anything).Return(mockToken)
+	haClient.On("SetDevices", mock.Anything)
+
+	endpoint.SetDevices([]models.NoahDevicePayload{{Serial: "device123"}, {Serial: "device234"}})
+
+	endpoint.stateLock.Lock()
+	endpoint.parameterState("device123")
+	endpoint.parameterState("device234").publishTimer = time.AfterFunc(time.Hour, func() {
+		t.Error("timer of removed device must not fire")
+	})
+	endpoint.stateLock.Unlock()
+
+	endpoint.SetDevices([]models.NoahDevicePayload{{Serial: "device123"}})
+
+	assert.Contains(t, endpoint.paramStates, "device123")
+	assert.NotContains(t, endpoint.paramStates, "device234")
+}
+
+func TestSetDevices_FiredTimerOfRemovedDevice(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, f1 := setup_parametersSubscription()
+	mockToken := NewMockToken()
+	haClient := &MockHaClient{}
+	endpoint.opts.HaClient = haClient
+	mockClient.On("Subscribe", mock.Anything, byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken)
+	mockClient.On("Unsubscribe", mock.Anything).Return(mockToken)
+	haClient.On("SetDevices", mock.Anything)
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(`{"charging_limit":90}`))
+	f1(mockClient, &mockMqttMessage)
+
+	endpoint.SetDevices([]models.NoahDevicePayload{{Serial: "device234"}})
+	// the timer fired before SetDevices could stop it
+	endpoint.debouncedParametersSubscription(device)
+
+	assert.NotContains(t, endpoint.paramStates, device.Serial)
+	mockApplier.AssertNotCalled(t, "SetChargingLimits", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestShutdown_FlushesPendingParameters(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, f1 := setup_parametersSubscription()
+	mockToken := NewMockToken()
+	empty := models.EmptyParameterPayload()
+	endpoint.devs = []models.NoahDevicePayload{device}
+
+	mockClient.On("Unsubscribe", "test/device123/parameters/set").Return(mockToken)
+	mockClient.On("Unsubscribe", "test/device123/command").Return(mockToken)
+	mockApplier.On("SetChargingLimits", device, 90.0, *empty.DischargeLimit).Return(nil).Once()
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(`{"charging_limit":90}`))
+	f1(mockClient, &mockMqttMessage)
+
+	// applied immediately instead of after the debounce delay
+	endpoint.Shutdown(context.Background())
+	mockApplier.AssertExpectations(t)
+
+	// commands after shutdown are rejected
+	f1(mockClient, &mockMqttMessage)
+	time.Sleep(2 * debounceDelay)
+
+	mockApplier.AssertNumberOfCalls(t, "SetChargingLimits", 1)
+	mockClient.AssertExpectations(t)
+}
+
+func TestShutdown_RejectsPendingParametersAfterTimeout(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, f1 := setup_parametersSubscription()
+	mockToken := NewMockToken()
+	endpoint.devs = []models.NoahDevicePayload{device}
+
+	mockClient.On("Unsubscribe", "test/device123/parameters/set").Return(mockToken)
+	mockClient.On("Unsubscribe", "test/device123/command").Return(mockToken)
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(`{"charging_limit":90}`))
+	f1(mockClient, &mockMqttMessage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	endpoint.Shutdown(ctx)
+	time.Sleep(2 * debounceDelay)
+
+	mockApplier.AssertNotCalled(t, "SetChargingLimits", mock.Anything, mock.Anything, mock.Anything)
+	assert.Equal(t, models.ParameterPayload{}, parameterStateOf(endpoint, device.Serial).newParameter)
+	assert.Nil(t, parameterStateOf(endpoint, device.Serial).publishTimer)
+	mockClient.AssertExpectations(t)
+}
+
+func Test_commandSubscription_Refresh(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, _ := setup_parametersSubscription()
+	mockApplier.On("Refresh", device).Return(nil).Once()
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(models.CommandRefresh))
+	endpoint.commandSubscription(device)(mockClient, &mockMqttMessage)
+	endpoint.commands.Wait()
+
+	mockApplier.AssertExpectations(t)
+}
+
+func Test_commandSubscription_Rediscover(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, _ := setup_parametersSubscription()
+	haClient := &MockHaClient{}
+	endpoint.opts.HaClient = haClient
+	endpoint.devs = []models.NoahDevicePayload{device}
+	mockApplier.On("Reenumerate", device).Return(nil).Once()
+	haClient.On("SetDevices", mock.MatchedBy(func(devices []homeassistant.DeviceInfo) bool {
+		return len(devices) == 1 && devices[0].SerialNumber == device.Serial
+	})).Once()
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(models.CommandRediscover))
+	endpoint.commandSubscription(device)(mockClient, &mockMqttMessage)
+	endpoint.commands.Wait()
+
+	mockApplier.AssertExpectations(t)
+	haClient.AssertExpectations(t)
+}
+
+func Test_commandSubscription_RediscoverConcurrentSetDevices(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, _ := setup_parametersSubscription()
+	mockToken := NewMockToken()
+	haClient := &MockHaClient{}
+	endpoint.opts.HaClient = haClient
+	mockApplier.On("Reenumerate", device).Return(nil)
+	mockClient.On("Subscribe", mock.Anything, byte(0), mock.AnythingOfType("mqtt.MessageHandler")).Return(mockToken)
+	mockClient.On("Unsubscribe", mock.Anything).Return(mockToken)
+	haClient.On("SetDevices", mock.Anything)
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(models.CommandRediscover))
+
+	// run with -race, the announcement reads the devices that SetDevices writes
+	for range 10 {
+		endpoint.commandSubscription(device)(mockClient, &mockMqttMessage)
+		endpoint.SetDevices([]models.NoahDevicePayload{device})
+	}
+	endpoint.commands.Wait()
+
+	mockApplier.AssertNumberOfCalls(t, "Reenumerate", 10)
+}
+
+func Test_commandSubscription_Unknown(t *testing.T) {
+	_, mockClient, mockApplier, endpoint, device, _ := setup_parametersSubscription()
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte("reboot"))
+	endpoint.commandSubscription(device)(mockClient, &mockMqttMessage)
+	endpoint.commands.Wait()
+
+	mockApplier.AssertNotCalled(t, "Refresh", mock.Anything)
+	mockApplier.AssertNotCalled(t, "Reenumerate", mock.Anything)
+}
+
+func Test_commandSubscription_NotSupported(t *testing.T) {
+	_, mockClient, mockApplier, e, device, _ := setup_parametersSubscription()
+	// hides the methods of endpoint.Refresher
+	e.SetParameterApplier(struct{ endpoint.ParameterApplier }{mockApplier})
+
+	mockMqttMessage := MockMqttMessage{}
+	mockMqttMessage.On("Payload").Return([]byte(models.CommandRefresh))
+	e.commandSubscription(device)(mockClient, &mockMqttMessage)
+	e.commands.Wait()
+
+	mockApplier.AssertNotCalled(t, "Refresh", mock.Anything)
 }
@@ -14,6 +14,18 @@ func stateTopicPv(topicPrefix string, serialNumber string, index int) string {
 	return fmt.Sprintf("%s/%s/PV%d", topicPrefix, serialNumber, index)
 }
 
+func stateTopicMeter(topicPrefix string, serialNumber string) string {
+	return fmt.Sprintf("%s/%s/METER", topicPrefix, serialNumber)
+}
+
+func alarmsTopic(topicPrefix string, serialNumber string) string {
+	return fmt.Sprintf("%s/%s/alarms", topicPrefix, serialNumber)
+}
+
+func historyTopic(topicPrefix string, serialNumber string) string {
+	return fmt.Sprintf("%s/%s/history", topicPrefix, serialNumber)
+}
+
 func parameterStateTopic(topicPrefix string, serialNumber string) string {
 	return fmt.Sprintf("%s/%s/parameters", topicPrefix, serialNumber)
 }
@@ -22,6 +34,17 @@ func parameterCommandTopic(topicPrefix string, serialNumber string) string {
 	return fmt.Sprintf("%s/%s/parameters/set", topicPrefix, serialNumber)
 }
 
+func commandTopic(topicPrefix string, serialNumber string) string {
+	return fmt.Sprintf("%s/%s/command", topicPrefix, serialNumber)
+}
+
 func healthTopic(topicPrefix string, serialNumber string) string {
 	return fmt.Sprintf("%s/%s/health", topicPrefix, serialNumber)
 }
+
+func serviceHealthTopic(topicPrefix string, account string) string {
+	if account == "" {
+		return fmt.Sprintf("%s/health", topicPrefix)
+	}
+	return fmt.Sprintf("%s/health/%s", topicPrefix, account)
+}
@@ -0,0 +1,308 @@
+package endpoint_prometheus
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/pkg/models"
+	"strconv"
+	"time"
+)
+
+type Options struct {
+	Listen string // address of the http server, e.g. ":9100"
+}
+
+// Endpoint serves the last published data of all devices on /metrics in the
+// Prometheus text format. It does not accept parameter commands.
+type Endpoint struct {
+	opts     Options
+	registry *registry
+	server   *http.Server
+}
+
+func NewEndpoint(options Options) *Endpoint {
+	e := &Endpoint{
+		opts:     options,
+		registry: newRegistry(),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	e.server = &http.Server{
+		Addr:              options.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return e
+}
+
+// Start starts the http server in the background.
+func (e *Endpoint) Start() {
+	slog.Info("starting metrics server", slog.String("listen", e.opts.Listen))
+	go func() {
+		if err := e.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", slog.String("error", err.Error()))
+		}
+	}()
+}
+
+func (e *Endpoint) Shutdown(ctx context.Context) error {
+	return e.server.Shutdown(ctx)
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := e.registry.write(w); err != nil {
+		slog.Debug("could not write metrics", slog.String("error", err.Error()))
+	}
+}
+
+func (e *Endpoint) SetParameterApplier(applier endpoint.ParameterApplier) {
+}
+
+func (e *Endpoint) SetDevices(devices []models.NoahDevicePayload) {
+	var serials []string
+	for _, dev := range devices {
+		serials = append(serials, dev.Serial)
+	}
+	e.registry.deleteExcept(serials)
+
+	for _, dev := range devices {
+		e.registry.replace("nexa_device_info", typeGauge, "Device information", dev.Serial, 1,
+			label{"model", dev.Model}, label{"version", dev.Version}, label{"alias", dev.Alias}, label{"plant_id", strconv.Itoa(dev.PlantId)})
+	}
+}
+
+func (e *Endpoint) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
+	r := e.registry
+	serial := device.Serial
+	r.set("nexa_ac_power_watts", typeGauge, "AC power, positive is input from the grid, negative is output", serial, status.ACPower)
+	r.set("nexa_solar_power_watts", typeGauge, "Solar input power", serial, status.SolarPower)
+	r.set("nexa_soc_percent", typeGauge, "State of charge of all batteries", serial, status.Soc)
+	r.set("nexa_charge_power_watts", typeGauge, "Battery charging power", serial, status.ChargePower)
+	r.set("nexa_discharge_power_watts", typeGauge, "Battery discharging power", serial, status.DischargePower)
+	r.set("nexa_batteries", typeGauge, "Number of batteries", serial, float64(status.BatteryNum))
+	r.set("nexa_generation_kwh_total", typeCounter, "Total generated energy", serial, status.GenerationTotalEnergy)
+	r.set("nexa_generation_today_kwh", typeGauge, "Energy generated today", serial, status.GenerationTodayEnergy)
+	if status.WorkMode != "" {
+		r.replace("nexa_work_mode", typeGauge, "Current work mode", serial, 1, label{"mode", string(status.WorkMode)})
+	}
+	if status.Status != "" {
+		r.replace("nexa_status", typeGauge, "Current device status", serial, 1, label{"status", status.Status})
+	}
+	if status.SystemTemperature != nil {
+		r.set("nexa_system_temperature_celsius", typeGauge, "System temperature", serial, *status.SystemTemperature)
+	}
+	if status.MaxCellVoltage != nil {
+		r.set("nexa_max_cell_voltage_volts", typeGauge, "Highest battery cell voltage", serial, *status.MaxCellVoltage)
+	}
+	if status.MinCellVoltage != nil {
+		r.set("nexa_min_cell_voltage_volts", typeGauge, "Lowest battery cell voltage", serial, *status.MinCellVoltage)
+	}
+	if status.BatterySoh != nil {
+		r.set("nexa_battery_soh_percent", typeGauge, "Battery state of health", serial, *status.BatterySoh)
+	}
+	if status.BatteryCycles != nil {
+		r.set("nexa_battery_cycles_total", typeCounter, "Battery charge cycles", serial, float64(*status.BatteryCycles))
+	}
+	if en := status.Energy; en != nil {
+		r.set("nexa_charge_energy_kwh_total", typeCounter, "Energy charged into the batteries, integrated by nexa-mqtt", serial, en.Charge)
+		r.set("nexa_discharge_energy_kwh_total", typeCounter, "Energy discharged from the batteries, integrated by nexa-mqtt", serial, en.Discharge)
+		r.set("nexa_solar_energy_kwh_total", typeCounter, "Solar input energy, integrated by nexa-mqtt", serial, en.Solar)
+		r.set("nexa_ac_input_energy_kwh_total", typeCounter, "AC input energy, integrated by nexa-mqtt", serial, en.ACInput)
+		r.set("nexa_ac_output_energy_kwh_total", typeCounter, "AC output energy, integrated by nexa-mqtt", serial, en.ACOutput)
+	}
+	if c := status.Consumption; c != nil {
+		consumption := []struct {
+			name  string
+			help  string
+			value *float64
+		}{
+			{"nexa_household_load_watts", "Power consumed by the household", c.HouseholdLoad},
+			{"nexa_household_load_apart_from_plugs_watts", "Household power not measured by smart plugs", c.HouseholdLoadApartPlug},
+			{"nexa_ct_power_watts", "Power measured by the CT clamp", c.CTPower},
+			{"nexa_grid_power_watts", "Power exchanged with the grid", c.GridPower},
+			{"nexa_smart_plug_power_watts", "Power measured by the smart plugs", c.SmartPlugPower},
+			{"nexa_other_power_watts", "Household power not assigned to a meter", c.OtherPower},
+		}
+		for _, m := range consumption {
+			if m.value != nil {
+				r.set(m.name, typeGauge, m.help, serial, *m.value)
+			}
+		}
+	}
+}
+
+func (e *Endpoint) PublishBatteryDetails(device models.NoahDevicePayload, details []models.BatteryPayload) {
+	r := e.registry
+	for i, bat := range details {
+		labels := []label{{"battery", strconv.Itoa(i)}, {"battery_serial", bat.SerialNumber}}
+		r.set("nexa_battery_soc_percent", typeGauge, "State of charge of the battery", device.Serial, bat.Soc, labels...)
+		r.set("nexa_battery_temperature_celsius", typeGauge, "Temperature of the battery", device.Serial, bat.Temperature, labels...)
+		if bat.WarnStatus != nil {
+			r.set("nexa_battery_warn_status", typeGauge, "Warning bits of the battery", device.Serial, float64(*bat.WarnStatus), labels...)
+		}
+		if bat.ProtectStatus != nil {
+			r.set("nexa_battery_protect_status", typeGauge, "Protection bits of the battery", device.Serial, float64(*bat.ProtectStatus), labels...)
+		}
+		if !bat.Time.IsZero() {
+			r.set("nexa_battery_timestamp_seconds", typeGauge, "Time of the battery data", device.Serial, float64(bat.Time.Unix()), labels...)
+		}
+	}
+}
+
+func (e *Endpoint) PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload) {
+	r := e.registry
+	for i, pv := range details {
+		l := label{"pv", strconv.Itoa(i)}
+		r.set("nexa_pv_voltage_volts", typeGauge, "Voltage of the PV input", device.Serial, pv.Voltage, l)
+		r.set("nexa_pv_current_amperes", typeGauge, "Current of the PV input", device.Serial, pv.Current, l)
+		r.set("nexa_pv_temperature_celsius", typeGauge, "Temperature of the PV input", device.Serial, pv.Temp, l)
+		if !pv.Time.IsZero() {
+			r.set("nexa_pv_timestamp_seconds", typeGauge, "Time of the PV input data", device.Serial, float64(pv.Time.Unix()), l)
+		}
+	}
+}
+
+func (e *Endpoint) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	r := e.registry
+	serial := device.Serial
+	r.set("nexa_meter_frequency_hertz", typeGauge, "Grid frequency measured by the meter", serial, meter.Frequency)
+	r.set("nexa_meter_forward_energy_kwh_total", typeCounter, "Active energy imported from the grid", serial, meter.ForwardActiveEnergy)
+	r.set("nexa_meter_reverse_energy_kwh_total", typeCounter, "Active energy exported to the grid", serial, meter.ReverseActiveEnergy)
+	r.set("nexa_meter_active_power_watts", typeGauge, "Active power measured by the meter", serial, meter.ActivePower, label{"phase", "total"})
+	r.set("nexa_meter_reactive_power_var", typeGauge, "Reactive power measured by the meter", serial, meter.ReactivePower, label{"phase", "total"})
+	r.set("nexa_meter_apparent_power_va", typeGauge, "Apparent power measured by the meter", serial, meter.ApparentPower, label{"phase", "total"})
+	r.set("nexa_meter_power_factor", typeGauge, "Power factor measured by the meter", serial, meter.PowerFactor, label{"phase", "total"})
+	for i, phase := range meter.Phases {
+		l := label{"phase", meterPhaseNames[i]}
+		r.set("nexa_meter_voltage_volts", typeGauge, "Voltage of the phase", serial, phase.Voltage, l)
+		r.set("nexa_meter_current_amperes", typeGauge, "Current of the phase", serial, phase.Current, l)
+		r.set("nexa_meter_active_power_watts", typeGauge, "Active power measured by the meter", serial, phase.ActivePower, l)
+		r.set("nexa_meter_reactive_power_var", typeGauge, "Reactive power measured by the meter", serial, phase.ReactivePower, l)
+		r.set("nexa_meter_apparent_power_va", typeGauge, "Apparent power measured by the meter", serial, phase.ApparentPower, l)
+		r.set("nexa_meter_power_factor", typeGauge, "Power factor measured by the meter", serial, phase.PowerFactor, l)
+	}
+	if !meter.Time.IsZero() {
+		r.set("nexa_meter_timestamp_seconds", typeGauge, "Time of the meter data", serial, float64(meter.Time.Unix()))
+	}
+}
+
+func (e *Endpoint) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	r := e.registry
+	serial := device.Serial
+	counts := map[models.AlarmCategory]float64{
+		models.AlarmCategoryFault:      0,
+		models.AlarmCategoryWarning:    0,
+		models.AlarmCategoryProtection: 0,
+	}
+	r.clear("nexa_alarm_active", serial)
+	for _, a := range alarms.Alarms {
+		counts[a.Category]++
+		r.set("nexa_alarm_active", typeGauge, "Active alarm", serial, 1, label{"category", string(a.Category)}, label{"alarm", a.Name})
+	}
+	for category, count := range counts {
+		r.set("nexa_alarms", typeGauge, "Number of active alarms", serial, count, label{"category", string(category)})
+	}
+}
+
+func (e *Endpoint) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
+	r := e.registry
+	serial := device.Serial
+	if param.ChargingLimit != nil {
+		r.set("nexa_charging_limit_percent", typeGauge, "Upper charging limit", serial, *param.ChargingLimit)
+	}
+	if param.DischargeLimit != nil {
+		r.set("nexa_discharge_limit_percent", typeGauge, "Lower discharging limit", serial, *param.DischargeLimit)
+	}
+	if param.DefaultACCouplePower != nil {
+		r.set("nexa_default_output_power_watts", typeGauge, "Default AC output power", serial, *param.DefaultACCouplePower)
+	}
+	if param.DefaultMode != nil {
+		r.replace("nexa_default_mode", typeGauge, "Default work mode", serial, 1, label{"mode", string(*param.DefaultMode)})
+	}
+	if param.AntiBackflowPowerPercentage != nil {
+		r.set("nexa_anti_backflow_power_percent", typeGauge, "Anti backflow power percentage", serial, *param.AntiBackflowPowerPercentage)
+	}
+
+	switches := []struct {
+		name  string
+		help  string
+		value models.OnOff
+	}{
+		{"nexa_allow_grid_charging", "Grid charging allowed (1 = on)", param.AllowGridCharging},
+		{"nexa_grid_connection_control", "Grid connection control (1 = on)", param.GridConnectionControl},
+		{"nexa_ac_couple_power_control", "AC couple power control (1 = on)", param.AcCouplePowerControl},
+		{"nexa_light_load_enable", "Light load enabled (1 = on)", param.LightLoadEnable},
+		{"nexa_never_power_off", "Never power off (1 = on)", param.NeverPowerOff},
+		{"nexa_anti_backflow_enable", "Anti backflow enabled (1 = on)", param.AntiBackflowEnable},
+	}
+	for _, sw := range switches {
+		if sw.value != "" {
+			r.set(sw.name, typeGauge, sw.help, serial, onOffValue(sw.value))
+		}
+	}
+}
+
+func (e *Endpoint) PublishHealth(device models.NoahDevicePayload, health *models.ServiceHealth) {
+	health.StateLock.Lock()
+	defer health.StateLock.Unlock()
+
+	r := e.registry
+	serial := device.Serial
+	if health.Status != models.HealthUndefined {
+		r.set("nexa_api_up", typeGauge, "API calls of the device succeed (1) or fail (0)", serial, healthValue(health.Status))
+	}
+	if health.Source != "" {
+		r.replace("nexa_api_source", typeGauge, "API in use in auto mode", serial, 1, label{"source", health.Source})
+	}
+
+	for call, c := range health.Calls {
+		l := label{"call", string(call)}
+		if c.Status != models.HealthUndefined {
+			r.set("nexa_api_call_up", typeGauge, "API call succeeds (1) or fails (0)", serial, healthValue(c.Status), l)
+		}
+		r.set("nexa_api_call_failures_total", typeCounter, "Failed API calls since start", serial, float64(c.TotalFailures), l)
+		r.set("nexa_api_call_consecutive_failures", typeGauge, "Failed API calls since the last success", serial, float64(c.ConsecutiveFailures), l)
+		if c.LastSuccess != nil {
+			r.set("nexa_api_call_last_success_timestamp_seconds", typeGauge, "Time of the last successful API call", serial, float64(c.LastSuccess.Unix()), l)
+		}
+		if c.LastError != nil {
+			r.set("nexa_api_call_last_error_timestamp_seconds", typeGauge, "Time of the last failed API call", serial, float64(c.LastError.Unix()), l)
+		}
+		if c.Latency.Samples > 0 {
+			latency := []struct {
+				stat string
+				ms   int64
+			}{
+				{"last", c.Latency.LastMs},
+				{"avg", c.Latency.AvgMs},
+				{"min", c.Latency.MinMs},
+				{"max", c.Latency.MaxMs},
+			}
+			for _, lat := range latency {
+				r.set("nexa_api_call_latency_seconds", typeGauge, "Latency of the last API calls", serial, float64(lat.ms)/1000, l, label{"stat", lat.stat})
+			}
+		}
+	}
+}
+
+// meterPhaseNames are the label values of the phases of models.MeterPayload
+var meterPhaseNames = [3]string{"a", "b", "c"}
+
+func onOffValue(v models.OnOff) float64 {
+	if v == models.ON {
+		return 1
+	}
+	return 0
+}
+
+func healthValue(status string) float64 {
+	if status == models.HealthOk {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,212 @@
+package endpoint_prometheus
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"nexa-mqtt/pkg/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, e *Endpoint) string {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestPublishDeviceStatus(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+
+	e.PublishDeviceStatus(device, models.DevicePayload{
+		ACPower:               250,
+		SolarPower:            400.5,
+		Soc:                   80,
+		ChargePower:           150,
+		BatteryNum:            2,
+		GenerationTotalEnergy: 123.4,
+		GenerationTodayEnergy: 1.2,
+		WorkMode:              models.WorkModeLoadFirst,
+		Status:                "online",
+	})
+	soh := 98.0
+	cycles := 112
+	load := 412.5
+	e.PublishDeviceStatus(device, models.DevicePayload{WorkMode: models.WorkModeBatteryFirst, Status: "online", BatterySoh: &soh, BatteryCycles: &cycles,
+		Consumption: &models.ConsumptionPayload{CT: true, HouseholdLoad: &load}, Energy: &models.EnergyPayload{Charge: 1.5}})
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "# HELP nexa_generation_kwh_total Total generated energy\n# TYPE nexa_generation_kwh_total counter\nnexa_generation_kwh_total{serial=\"ABC123\"} 0\n")
+	assert.Contains(t, body, "# TYPE nexa_ac_power_watts gauge\nnexa_ac_power_watts{serial=\"ABC123\"} 0\n")
+	assert.Contains(t, body, "nexa_work_mode{serial=\"ABC123\",mode=\"battery_first\"} 1\n")
+	assert.NotContains(t, body, "load_first")
+	assert.Contains(t, body, "nexa_status{serial=\"ABC123\",status=\"online\"} 1\n")
+	assert.Contains(t, body, "nexa_battery_soh_percent{serial=\"ABC123\"} 98\n")
+	assert.Contains(t, body, "# TYPE nexa_battery_cycles_total counter\nnexa_battery_cycles_total{serial=\"ABC123\"} 112\n")
+	assert.NotContains(t, body, "nexa_max_cell_voltage_volts")
+	assert.Contains(t, body, "nexa_household_load_watts{serial=\"ABC123\"} 412.5\n")
+	assert.NotContains(t, body, "nexa_grid_power_watts")
+	assert.Contains(t, body, "# TYPE nexa_charge_energy_kwh_total counter\nnexa_charge_energy_kwh_total{serial=\"ABC123\"} 1.5\n")
+}
+
+func TestPublishDetails(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+	tm := time.Unix(1700000000, 0)
+	warnStatus := 4
+	protectStatus := 0
+
+	e.PublishBatteryDetails(device, []models.BatteryPayload{
+		{SerialNumber: "BAT1", Soc: 55, Temperature: 21.5, Time: tm, WarnStatus: &warnStatus, ProtectStatus: &protectStatus},
+		{SerialNumber: "BAT2", Soc: 60, Temperature: 22},
+	})
+	e.PublishPvDetails(device, []models.PvPayload{
+		{Voltage: 35.2, Current: 4.1, Temp: 30, Time: tm},
+	})
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_battery_soc_percent{serial=\"ABC123\",battery=\"0\",battery_serial=\"BAT1\"} 55\n")
+	assert.Contains(t, body, "nexa_battery_soc_percent{serial=\"ABC123\",battery=\"1\",battery_serial=\"BAT2\"} 60\n")
+	assert.Contains(t, body, "nexa_battery_temperature_celsius{serial=\"ABC123\",battery=\"0\",battery_serial=\"BAT1\"} 21.5\n")
+	assert.Contains(t, body, "nexa_battery_timestamp_seconds{serial=\"ABC123\",battery=\"0\",battery_serial=\"BAT1\"} 1.7e+09\n")
+	assert.NotContains(t, body, "nexa_battery_timestamp_seconds{serial=\"ABC123\",battery=\"1\"")
+	assert.Contains(t, body, "nexa_battery_warn_status{serial=\"ABC123\",battery=\"0\",battery_serial=\"BAT1\"} 4\n")
+	assert.Contains(t, body, "nexa_battery_protect_status{serial=\"ABC123\",battery=\"0\",battery_serial=\"BAT1\"} 0\n")
+	assert.NotContains(t, body, "nexa_battery_warn_status{serial=\"ABC123\",battery=\"1\"")
+	assert.Contains(t, body, "nexa_pv_voltage_volts{serial=\"ABC123\",pv=\"0\"} 35.2\n")
+	assert.Contains(t, body, "nexa_pv_current_amperes{serial=\"ABC123\",pv=\"0\"} 4.1\n")
+	assert.Contains(t, body, "nexa_pv_temperature_celsius{serial=\"ABC123\",pv=\"0\"} 30\n")
+}
+
+func TestPublishMeterData(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+
+	meter := models.MeterPayload{
+		Time:                time.Unix(1700000000, 0),
+		Frequency:           50.01,
+		ActivePower:         -350,
+		ForwardActiveEnergy: 1234.5,
+		ReverseActiveEnergy: 321.9,
+	}
+	meter.Phases[1].Voltage = 231.4
+	meter.Phases[2].ActivePower = -350
+	e.PublishMeterData(device, meter)
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_meter_frequency_hertz{serial=\"ABC123\"} 50.01\n")
+	assert.Contains(t, body, "# TYPE nexa_meter_forward_energy_kwh_total counter\nnexa_meter_forward_energy_kwh_total{serial=\"ABC123\"} 1234.5\n")
+	assert.Contains(t, body, "nexa_meter_reverse_energy_kwh_total{serial=\"ABC123\"} 321.9\n")
+	assert.Contains(t, body, "nexa_meter_active_power_watts{serial=\"ABC123\",phase=\"total\"} -350\n")
+	assert.Contains(t, body, "nexa_meter_active_power_watts{serial=\"ABC123\",phase=\"c\"} -350\n")
+	assert.Contains(t, body, "nexa_meter_voltage_volts{serial=\"ABC123\",phase=\"b\"} 231.4\n")
+	assert.Contains(t, body, "nexa_meter_timestamp_seconds{serial=\"ABC123\"} 1.7e+09\n")
+}
+
+func TestPublishAlarms(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+
+	alarms := models.NewAlarmPayload(time.Unix(1700000000, 0))
+	alarms.AddBits("fault", models.AlarmCategoryFault, 0b11, nil)
+	e.PublishAlarms(device, alarms)
+	alarms = models.NewAlarmPayload(time.Unix(1700000180, 0))
+	alarms.AddBits("fault", models.AlarmCategoryFault, 0b10, nil)
+	e.PublishAlarms(device, alarms)
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_alarm_active{serial=\"ABC123\",category=\"fault\",alarm=\"fault_bit1\"} 1\n")
+	assert.NotContains(t, body, "fault_bit0")
+	assert.Contains(t, body, "nexa_alarms{serial=\"ABC123\",category=\"fault\"} 1\n")
+	assert.Contains(t, body, "nexa_alarms{serial=\"ABC123\",category=\"warning\"} 0\n")
+}
+
+func TestPublishParameterData(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+	chargingLimit := 95.0
+	dischargeLimit := 10.0
+
+	e.PublishParameterData(device, models.ParameterPayload{
+		ChargingLimit:     &chargingLimit,
+		DischargeLimit:    &dischargeLimit,
+		AllowGridCharging: models.ON,
+		NeverPowerOff:     models.OFF,
+	})
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_charging_limit_percent{serial=\"ABC123\"} 95\n")
+	assert.Contains(t, body, "nexa_discharge_limit_percent{serial=\"ABC123\"} 10\n")
+	assert.Contains(t, body, "nexa_allow_grid_charging{serial=\"ABC123\"} 1\n")
+	assert.Contains(t, body, "nexa_never_power_off{serial=\"ABC123\"} 0\n")
+	assert.NotContains(t, body, "nexa_default_output_power_watts")
+	assert.NotContains(t, body, "nexa_light_load_enable")
+}
+
+func TestPublishHealth(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device := models.NoahDevicePayload{Serial: "ABC123"}
+
+	health := models.NewServiceHealth()
+	health.UpdateSuccess(models.HealthCallStatus, 200*time.Millisecond)
+	health.UpdateError(models.HealthCallStatus, 400*time.Millisecond, errors.New("timeout"))
+	health.Source = "web"
+
+	e.PublishHealth(device, health)
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_api_up{serial=\"ABC123\"} 0\n")
+	assert.Contains(t, body, "nexa_api_source{serial=\"ABC123\",source=\"web\"} 1\n")
+	assert.Contains(t, body, "# TYPE nexa_api_call_failures_total counter\nnexa_api_call_failures_total{serial=\"ABC123\",call=\"status\"} 1\n")
+	assert.Contains(t, body, "nexa_api_call_consecutive_failures{serial=\"ABC123\",call=\"status\"} 1\n")
+	assert.Contains(t, body, "nexa_api_call_latency_seconds{serial=\"ABC123\",call=\"status\",stat=\"max\"} 0.4\n")
+	assert.Contains(t, body, "nexa_api_call_latency_seconds{serial=\"ABC123\",call=\"status\",stat=\"min\"} 0.2\n")
+	assert.Contains(t, body, "nexa_api_call_last_success_timestamp_seconds{serial=\"ABC123\",call=\"status\"}")
+}
+
+func TestSetDevices_RemovesOldDevices(t *testing.T) {
+	e := NewEndpoint(Options{})
+	device1 := models.NoahDevicePayload{Serial: "ABC123", Model: "NOAH 2000", Alias: "Balcony \"east\""}
+	device2 := models.NoahDevicePayload{Serial: "DEF456"}
+
+	e.SetDevices([]models.NoahDevicePayload{device1, device2})
+	e.PublishDeviceStatus(device1, models.DevicePayload{Soc: 50})
+	e.PublishDeviceStatus(device2, models.DevicePayload{Soc: 60})
+
+	body := scrape(t, e)
+	assert.Contains(t, body, "nexa_device_info{serial=\"ABC123\",model=\"NOAH 2000\",version=\"\",alias=\"Balcony \\\"east\\\"\",plant_id=\"0\"} 1\n")
+	assert.Contains(t, body, "nexa_soc_percent{serial=\"DEF456\"} 60\n")
+
+	e.SetDevices([]models.NoahDevicePayload{device1})
+
+	body = scrape(t, e)
+	assert.Contains(t, body, "nexa_soc_percent{serial=\"ABC123\"} 50\n")
+	assert.NotContains(t, body, "DEF456")
+}
+
+func TestWrite_SortedAndEmptyFamiliesOmitted(t *testing.T) {
+	r := newRegistry()
+	r.set("b_metric", typeGauge, "B", "2", 1)
+	r.set("b_metric", typeGauge, "B", "1", 2)
+	r.set("a_metric", typeCounter, "A", "1", 3)
+	r.set("c_metric", typeGauge, "C", "3", 4)
+	r.deleteExcept([]string{"1", "2"})
+
+	var b strings.Builder
+	assert.NoError(t, r.write(&b))
+	assert.Equal(t, `# HELP a_metric A
+# TYPE a_metric counter
+a_metric{serial="1"} 3
+# HELP b_metric B
+# TYPE b_metric gauge
+b_metric{serial="1"} 2
+b_metric{serial="2"} 1
+`, b.String())
+}
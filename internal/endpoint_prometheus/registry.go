@@ -0,0 +1,175 @@
+package endpoint_prometheus
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	serial string
+	labels string
+	value  float64
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series map[string]sample
+}
+
+// registry holds the current value of every series in the Prometheus text
+// exposition format. Series are grouped by device serial so all series of a
+// device can be removed at once.
+type registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+func newRegistry() *registry {
+	return &registry{
+		families: make(map[string]*family),
+	}
+}
+
+func (r *registry) family(name string, typ string, help string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: make(map[string]sample)}
+		r.families[name] = f
+	}
+	return f
+}
+
+// set sets the value of the series with the given labels. The serial is
+// always the first label.
+func (r *registry) set(name string, typ string, help string, serial string, value float64, labels ...label) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	l := formatLabels(append([]label{{"serial", serial}}, labels...))
+	r.family(name, typ, help).series[l] = sample{serial: serial, labels: l, value: value}
+}
+
+// replace removes all series of the device and sets the given one, used for
+// values like the work mode that are exposed as label.
+func (r *registry) replace(name string, typ string, help string, serial string, value float64, labels ...label) {
+	r.lock.Lock()
+	if f, ok := r.families[name]; ok {
+		f.deleteSerial(serial)
+	}
+	r.lock.Unlock()
+
+	r.set(name, typ, help, serial, value, labels...)
+}
+
+// clear removes all series of the device from the family, used for a set of
+// values that are exposed as labels, like the active alarms.
+func (r *registry) clear(name string, serial string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if f, ok := r.families[name]; ok {
+		f.deleteSerial(serial)
+	}
+}
+
+// deleteExcept removes the series of all devices not in serials.
+func (r *registry) deleteExcept(serials []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, f := range r.families {
+		for key, s := range f.series {
+			if !slices.Contains(serials, s.serial) {
+				delete(f.series, key)
+			}
+		}
+	}
+}
+
+func (f *family) deleteSerial(serial string) {
+	for key, s := range f.series {
+		if s.serial == serial {
+			delete(f.series, key)
+		}
+	}
+}
+
+func (r *registry) write(w io.Writer) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name, f := range r.families {
+		if len(f.series) > 0 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.typ)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatValue(s.value))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []label) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(l.name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l.value))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,172 @@
+package energy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
+	"os"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// File keeps the counters across restarts, the counters start at zero
+	// after a restart if it is empty
+	File string
+	// MaxGap is the longest regular time between two samples. Longer gaps,
+	// e.g. while nexa-mqtt was stopped or the API failed, are bridged with a
+	// linear change of the power between the samples around them, and the
+	// estimated energy is logged.
+	MaxGap time.Duration
+	// MaxBridge is the longest gap that is bridged. The energy of longer gaps
+	// is not counted, the integration starts again with the next sample.
+	MaxBridge time.Duration
+	// SaveInterval is the minimum time between two writes of File
+	SaveInterval time.Duration
+}
+
+// sample is the last power reading of a device
+type sample struct {
+	Time      time.Time `json:"time"`
+	Charge    float64   `json:"charge_w"`
+	Discharge float64   `json:"discharge_w"`
+	Solar     float64   `json:"solar_w"`
+	ACInput   float64   `json:"ac_input_w"`
+	ACOutput  float64   `json:"ac_output_w"`
+}
+
+type device struct {
+	Last   sample               `json:"last"`
+	Totals models.EnergyPayload `json:"totals"`
+}
+
+// Counters integrates the power values of the devices into monotonically
+// increasing energy counters.
+type Counters struct {
+	opts     Options
+	lock     sync.Mutex
+	devices  map[string]*device
+	lastSave time.Time
+	now      func() time.Time
+}
+
+// NewCounters returns the counters, restored from opts.File if it exists.
+func NewCounters(opts Options) (*Counters, error) {
+	c := &Counters{
+		opts:    opts,
+		devices: make(map[string]*device),
+		now:     time.Now,
+	}
+
+	if opts.File == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(opts.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read energy counters: %w", err)
+	}
+	if err := json.Unmarshal(b, &c.devices); err != nil {
+		return nil, fmt.Errorf("could not parse energy counters %s: %w", opts.File, err)
+	}
+	return c, nil
+}
+
+// Add integrates the power values of status since the last call for the
+// device and returns the new totals.
+func (c *Counters) Add(serial string, status models.DevicePayload) models.EnergyPayload {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	s := sample{
+		Time:      c.now(),
+		Charge:    status.ChargePower,
+		Discharge: status.DischargePower,
+		Solar:     status.SolarPower,
+		ACInput:   max(status.ACPower, 0),
+		ACOutput:  max(-status.ACPower, 0),
+	}
+
+	d, ok := c.devices[serial]
+	if !ok {
+		d = &device{}
+		c.devices[serial] = d
+	}
+
+	elapsed := s.Time.Sub(d.Last.Time)
+	if !d.Last.Time.IsZero() && elapsed > max(c.opts.MaxGap, c.opts.MaxBridge) {
+		slog.Warn("skipping gap in energy counting, it is too long to be bridged",
+			slog.String("device", serial),
+			slog.Time("from", d.Last.Time),
+			slog.Time("to", s.Time))
+	} else if !d.Last.Time.IsZero() && elapsed > 0 {
+		hours := elapsed.Hours()
+		delta := models.EnergyPayload{
+			Charge:    trapezoid(d.Last.Charge, s.Charge, hours),
+			Discharge: trapezoid(d.Last.Discharge, s.Discharge, hours),
+			Solar:     trapezoid(d.Last.Solar, s.Solar, hours),
+			ACInput:   trapezoid(d.Last.ACInput, s.ACInput, hours),
+			ACOutput:  trapezoid(d.Last.ACOutput, s.ACOutput, hours),
+		}
+		if elapsed > c.opts.MaxGap {
+			slog.Warn("bridging gap in energy counting with estimated energy",
+				slog.String("device", serial),
+				slog.Time("from", d.Last.Time),
+				slog.Time("to", s.Time),
+				slog.Float64("charge_wh", delta.Charge*1000),
+				slog.Float64("discharge_wh", delta.Discharge*1000),
+				slog.Float64("solar_wh", delta.Solar*1000),
+				slog.Float64("ac_input_wh", delta.ACInput*1000),
+				slog.Float64("ac_output_wh", delta.ACOutput*1000))
+		}
+		d.Totals.Charge += delta.Charge
+		d.Totals.Discharge += delta.Discharge
+		d.Totals.Solar += delta.Solar
+		d.Totals.ACInput += delta.ACInput
+		d.Totals.ACOutput += delta.ACOutput
+	}
+	d.Last = s
+
+	if c.opts.File != "" && s.Time.Sub(c.lastSave) >= c.opts.SaveInterval {
+		if err := c.save(); err != nil {
+			slog.Error("could not save energy counters", slog.String("error", err.Error()))
+		}
+	}
+
+	return d.Totals
+}
+
+// trapezoid returns the energy in kWh of a linear change from p1 to p2 watts
+func trapezoid(p1 float64, p2 float64, hours float64) float64 {
+	return (p1 + p2) / 2 * hours / 1000
+}
+
+// Save writes the counters to opts.File
+func (c *Counters) Save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.opts.File == "" {
+		return nil
+	}
+	return c.save()
+}
+
+// save writes the counters to opts.File. c.lock must be held by the caller.
+func (c *Counters) save() error {
+	b, err := json.Marshal(c.devices)
+	if err != nil {
+		return err
+	}
+	if err := misc.WriteFileAtomic(c.opts.File, b); err != nil {
+		return err
+	}
+
+	c.lastSave = c.now()
+	return nil
+}
@@ -0,0 +1,100 @@
+package energy
+
+import (
+	"nexa-mqtt/pkg/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock returns a now function that advances by the given steps
+func clock(start time.Time, steps ...time.Duration) func() time.Time {
+	tm := start
+	i := 0
+	return func() time.Time {
+		if i > 0 && i <= len(steps) {
+			tm = tm.Add(steps[i-1])
+		}
+		i++
+		return tm
+	}
+}
+
+func TestCounters_Add(t *testing.T) {
+	c, err := NewCounters(Options{MaxGap: 5 * time.Minute, MaxBridge: time.Hour})
+	assert.NoError(t, err)
+	c.now = clock(time.Now(), 30*time.Minute/10, 30*time.Minute)
+
+	// the first sample only starts the integration
+	totals := c.Add("device123", models.DevicePayload{ChargePower: 400, SolarPower: 500, ACPower: 100})
+	assert.Equal(t, models.EnergyPayload{}, totals)
+
+	// 3 minutes, charge power 400 W -> 200 W, ac power 100 W -> -300 W
+	totals = c.Add("device123", models.DevicePayload{ChargePower: 200, SolarPower: 500, ACPower: -300})
+	assert.InDelta(t, 0.015, totals.Charge, 1e-9)
+	assert.InDelta(t, 0.025, totals.Solar, 1e-9)
+	assert.InDelta(t, 0.0025, totals.ACInput, 1e-9)
+	assert.InDelta(t, 0.0075, totals.ACOutput, 1e-9)
+	assert.Equal(t, 0.0, totals.Discharge)
+
+	// a gap of 30 minutes is bridged linearly, charge power 200 W -> 0 W,
+	// discharge power 0 W -> 1000 W, ac power -300 W -> 0 W
+	totals2 := c.Add("device123", models.DevicePayload{DischargePower: 1000})
+	assert.InDelta(t, 0.015+0.05, totals2.Charge, 1e-9)
+	assert.InDelta(t, 0.25, totals2.Discharge, 1e-9)
+	assert.InDelta(t, 0.025+0.125, totals2.Solar, 1e-9)
+	assert.InDelta(t, 0.0025, totals2.ACInput, 1e-9)
+	assert.InDelta(t, 0.0075+0.075, totals2.ACOutput, 1e-9)
+}
+
+func TestCounters_AddLongGap(t *testing.T) {
+	c, err := NewCounters(Options{MaxGap: 5 * time.Minute, MaxBridge: time.Hour})
+	assert.NoError(t, err)
+	c.now = clock(time.Now(), 3*time.Minute, 2*time.Hour, 3*time.Minute)
+
+	c.Add("device123", models.DevicePayload{ChargePower: 400})
+	totals := c.Add("device123", models.DevicePayload{ChargePower: 400})
+	assert.InDelta(t, 0.02, totals.Charge, 1e-9)
+
+	// a gap of 2 hours is not bridged, the sample after it starts the
+	// integration again
+	totals = c.Add("device123", models.DevicePayload{ChargePower: 1000})
+	assert.InDelta(t, 0.02, totals.Charge, 1e-9)
+
+	// 3 minutes, charge power 1000 W -> 200 W
+	totals = c.Add("device123", models.DevicePayload{ChargePower: 200})
+	assert.InDelta(t, 0.02+0.03, totals.Charge, 1e-9)
+}
+
+func TestCounters_Persist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "energy.json")
+	start := time.Now()
+
+	c, err := NewCounters(Options{File: file, MaxGap: 5 * time.Minute, SaveInterval: time.Hour})
+	assert.NoError(t, err)
+	c.now = clock(start, time.Minute)
+	c.Add("device123", models.DevicePayload{SolarPower: 600})
+	// saved with the first sample, the second one is only kept in memory
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+	totals := c.Add("device123", models.DevicePayload{SolarPower: 600})
+	assert.InDelta(t, 0.01, totals.Solar, 1e-9)
+	assert.NoError(t, c.Save())
+
+	restored, err := NewCounters(Options{File: file, MaxGap: 5 * time.Minute, SaveInterval: time.Hour})
+	assert.NoError(t, err)
+	restored.now = clock(start.Add(2 * time.Minute))
+	totals = restored.Add("device123", models.DevicePayload{SolarPower: 600})
+	assert.InDelta(t, 0.02, totals.Solar, 1e-9)
+}
+
+func TestNewCounters_InvalidFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "energy.json")
+	assert.NoError(t, os.WriteFile(file, []byte("{invalid"), 0o600))
+
+	_, err := NewCounters(Options{File: file})
+	assert.ErrorContains(t, err, "could not parse energy counters")
+}
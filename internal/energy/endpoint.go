@@ -0,0 +1,26 @@
+package energy
+
+import (
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/pkg/models"
+)
+
+// Endpoint adds the energy totals to the device status and forwards all data
+// to the wrapped endpoint.
+type Endpoint struct {
+	endpoint.Endpoint
+	counters *Counters
+}
+
+func NewEndpoint(ep endpoint.Endpoint, counters *Counters) *Endpoint {
+	return &Endpoint{
+		Endpoint: ep,
+		counters: counters,
+	}
+}
+
+func (e *Endpoint) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
+	totals := e.counters.Add(device.Serial, status)
+	status.Energy = &totals
+	e.Endpoint.PublishDeviceStatus(device, status)
+}
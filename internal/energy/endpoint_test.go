@@ -0,0 +1,28 @@
+package energy
+
+import (
+	"nexa-mqtt/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestEndpoint_PublishDeviceStatus(t *testing.T) {
+	counters, _ := NewCounters(Options{MaxGap: 5 * time.Minute})
+	counters.now = clock(time.Now(), time.Hour/1000)
+	wrapped := &MockEndpoint{}
+	ep := NewEndpoint(wrapped, counters)
+
+	device := models.NoahDevicePayload{Serial: "device123"}
+	wrapped.On("PublishDeviceStatus", device, models.DevicePayload{SolarPower: 1000, Energy: &models.EnergyPayload{}}).Once()
+	wrapped.On("PublishDeviceStatus", device, models.DevicePayload{SolarPower: 1000, Energy: &models.EnergyPayload{Solar: 0.001}}).Once()
+	wrapped.On("PublishPvDetails", device, mock.Anything).Once()
+
+	ep.PublishDeviceStatus(device, models.DevicePayload{SolarPower: 1000})
+	ep.PublishDeviceStatus(device, models.DevicePayload{SolarPower: 1000})
+	// everything else is forwarded as is
+	ep.PublishPvDetails(device, []models.PvPayload{{Voltage: 30}})
+
+	wrapped.AssertExpectations(t)
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"nexa-mqtt/internal/logging"
 	"nexa-mqtt/internal/misc"
+	"strconv"
 	"strings"
 	"time"
 
@@ -35,6 +37,9 @@ func newClient(serverUrl string, username string, password string) *Client {
 
 	slog.Info("setting server url (app)", slog.String("url", serverUrl))
 
+	hashedPassword := hashPassword(password)
+	logging.AddSecret(password, hashedPassword)
+
 	return &Client{
 		client: &httpClient{
 			client: &http.Client{
@@ -46,7 +51,7 @@ func newClient(serverUrl string, username string, password string) *Client {
 		},
 		serverUrl: serverUrl,
 		username:  username,
-		password:  hashPassword(password),
+		password:  hashedPassword,
 		jar:       jar,
 	}
 }
@@ -61,7 +66,7 @@ func (h *Client) postForm(url string, data url.Values, responseBody any) error {
 			slog.Warn("re-login", slog.String("error", err.Error()))
 			if err := h.Login(); err != nil {
 				slog.Error("could not re-login", slog.String("error", err.Error()))
-				misc.Panic(err)
+				return fmt.Errorf("could not re-login: %w", err)
 			}
 			return h.postForm(url, data, responseBody)
 		} else {
@@ -84,6 +89,7 @@ func (h *Client) loginGetToken() error {
 	}
 
 	h.token = data.Token
+	logging.AddSecret(h.token)
 	return nil
 }
 
@@ -112,6 +118,9 @@ func (h *Client) Login() error {
 	}
 
 	if !data.Back.Success {
+		if misc.IsInvalidCredentialsMessage(data.Back.Msg) {
+			return fmt.Errorf("login failed: %w: %s", misc.ErrInvalidCredentials, data.Back.Msg)
+		}
 		return fmt.Errorf("login failed: %s", data.Back.Msg)
 	}
 
@@ -119,18 +128,56 @@ func (h *Client) Login() error {
 	return nil
 }
 
+// pageSize is the number of entries requested per page of a paged list. A
+// page with fewer entries is the last one.
+const pageSize = 20
+
+// maxPages limits the pages requested from a paged list
+const maxPages = 100
+
+// GetPlantList returns the plants of all pages
 func (h *Client) GetPlantList() (*PlantListV2, error) {
-	var data PlantListV2
-	if err := h.postForm(h.serverUrl+"/newTwoPlantAPI.do?op=getAllPlantListTwo", url.Values{
-		"plantStatus": {""},
-		"pageSize":    {"20"},
-		"language":    {"1"},
-		"toPageNum":   {"1"},
-		"order":       {"1"},
-	}, &data); err != nil {
-		return nil, err
+	var list PlantListV2
+	for page := 1; page <= maxPages; page++ {
+		var data PlantListV2
+		if err := h.postForm(h.serverUrl+"/newTwoPlantAPI.do?op=getAllPlantListTwo", url.Values{
+			"plantStatus": {""},
+			"pageSize":    {strconv.Itoa(pageSize)},
+			"language":    {"1"},
+			"toPageNum":   {strconv.Itoa(page)},
+			"order":       {"1"},
+		}, &data); err != nil {
+			return nil, err
+		}
+
+		list.PlantList = append(list.PlantList, data.PlantList...)
+		if len(data.PlantList) < pageSize {
+			break
+		}
 	}
-	return &data, nil
+	return &list, nil
+}
+
+// GetPlantDeviceList returns the devices of all pages of the plant
+func (h *Client) GetPlantDeviceList(plantId string) (*PlantDeviceListV2, error) {
+	var list PlantDeviceListV2
+	for page := 1; page <= maxPages; page++ {
+		var data PlantDeviceListV2
+		if err := h.postForm(h.serverUrl+"/newTwoPlantAPI.do?op=getAllDeviceListTwo", url.Values{
+			"plantId":  {plantId},
+			"pageNum":  {strconv.Itoa(page)},
+			"pageSize": {strconv.Itoa(pageSize)},
+			"language": {"1"},
+		}, &data); err != nil {
+			return nil, err
+		}
+
+		list.DeviceList = append(list.DeviceList, data.DeviceList...)
+		if len(data.DeviceList) < pageSize {
+			break
+		}
+	}
+	return &list, nil
 }
 
 func (h *Client) GetNoahPlantInfo(plantId string) (*NoahPlantInfo, error) {
@@ -2,8 +2,10 @@ package growatt_app
 
 import (
 	"errors"
+	"fmt"
 	"net/http/cookiejar"
 	"net/url"
+	"nexa-mqtt/internal/misc"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -107,14 +109,10 @@ func Test_postForm_RetryLoginFails(t *testing.T) {
 
 	mockHttpClient.On_newTwoLoginAPIV2("THE_TOKEN", "user", "secret", LoginResult{}, errors.New("login failed"))
 
-	defer func() {
-		if r := recover(); r != nil {
-			mockHttpClient.AssertExpectations(t)
-		}
-	}()
+	err := client.postForm("http://someurl", url.Values{}, nil)
 
-	client.postForm("http://someurl", url.Values{}, nil)
-	t.Errorf("Test failed, panic was expected")
+	assert.ErrorContains(t, err, "could not re-login")
+	mockHttpClient.AssertExpectations(t)
 }
 
 func TestLogin_Ok(t *testing.T) {
@@ -148,6 +146,22 @@ func TestLogin_NoSuccess(t *testing.T) {
 	mockHttpClient.AssertExpectations(t)
 }
 
+func TestLogin_InvalidCredentials(t *testing.T) {
+	mockHttpClient, client := setupMocks(t)
+
+	mockHttpClient.On_loginGetToken("SHINEuser", "secret", TokenResponse{Token: "THE_TOKEN"}, nil)
+
+	loginResult := LoginResult{}
+	loginResult.Back.Success = false
+	loginResult.Back.Msg = "502"
+	mockHttpClient.On_newTwoLoginAPIV2("THE_TOKEN", "user", "secret", loginResult, nil)
+
+	err := client.Login()
+	assert.ErrorIs(t, err, misc.ErrInvalidCredentials)
+
+	mockHttpClient.AssertExpectations(t)
+}
+
 func TestLogin_loginGetToken_Fail(t *testing.T) {
 	mockHttpClient, client := setupMocks(t)
 
@@ -206,6 +220,36 @@ func TestGetPlantList_Fail(t *testing.T) {
 	mockHttpClient.AssertExpectations(t)
 }
 
+func TestGetPlantDeviceList_Ok(t *testing.T) {
+	mockHttpClient, client := setupMocks(t)
+
+	var page1 PlantDeviceListV2
+	for i := range 20 {
+		page1.DeviceList = append(page1.DeviceList, PlantDeviceV2{DeviceSn: fmt.Sprintf("serial%d", i), DeviceType: "noah"})
+	}
+	mockHttpClient.OnGetPlantDeviceList("2", 1, page1, nil).Once()
+	mockHttpClient.OnGetPlantDeviceList("2", 2, PlantDeviceListV2{}, nil).Once()
+
+	data, err := client.GetPlantDeviceList("2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, page1, *data)
+
+	mockHttpClient.AssertExpectations(t)
+}
+
+func TestGetPlantDeviceList_Fail(t *testing.T) {
+	mockHttpClient, client := setupMocks(t)
+
+	mockHttpClient.OnGetPlantDeviceList("2", 1, PlantDeviceListV2{}, errors.New("getAllDeviceListTwo fail"))
+
+	data, err := client.GetPlantDeviceList("2")
+	assert.Error(t, err)
+	assert.Nil(t, data)
+
+	mockHttpClient.AssertExpectations(t)
+}
+
 func TestGetNoahPlantInfo_Ok(t *testing.T) {
 	mockHttpClient, client := setupMocks(t)
 
@@ -32,6 +32,14 @@ func (e *MockEndpoint) PublishPvDetails(device models.NoahDevicePayload, details
 	e.Called(device, details)
 }
 
+func (e *MockEndpoint) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	e.Called(device, meter)
+}
+
+func (e *MockEndpoint) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	e.Called(device, alarms)
+}
+
 func (e *MockEndpoint) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
 	e.Called(device, param)
 }
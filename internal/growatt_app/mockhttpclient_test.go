@@ -3,6 +3,7 @@ package growatt_app
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -85,6 +86,10 @@ func (m *MockHttpClient) OnLogin(username string, password string, err error) {
 }
 
 func (m *MockHttpClient) OnGetPlantList(result PlantListV2, err error) *mock.Call {
+	return m.OnGetPlantListPage(1, result, err)
+}
+
+func (m *MockHttpClient) OnGetPlantListPage(page int, result PlantListV2, err error) *mock.Call {
 	call := m.On(
 		"postForm",
 		"https://server-api.growatt.com/newTwoPlantAPI.do?op=getAllPlantListTwo",
@@ -93,7 +98,7 @@ func (m *MockHttpClient) OnGetPlantList(result PlantListV2, err error) *mock.Cal
 			"plantStatus": {""},
 			"pageSize":    {"20"},
 			"language":    {"1"},
-			"toPageNum":   {"1"},
+			"toPageNum":   {strconv.Itoa(page)},
 			"order":       {"1"},
 		},
 		&PlantListV2{},
@@ -111,6 +116,32 @@ func (m *MockHttpClient) OnGetPlantList(result PlantListV2, err error) *mock.Cal
 	return call.Return(err)
 }
 
+func (m *MockHttpClient) OnGetPlantDeviceList(plantId string, page int, result PlantDeviceListV2, err error) *mock.Call {
+	call := m.On(
+		"postForm",
+		"https://server-api.growatt.com/newTwoPlantAPI.do?op=getAllDeviceListTwo",
+		"",
+		url.Values{
+			"plantId":  {plantId},
+			"pageNum":  {strconv.Itoa(page)},
+			"pageSize": {"20"},
+			"language": {"1"},
+		},
+		&PlantDeviceListV2{},
+	)
+
+	if err == nil {
+		call = call.Run(
+			func(args mock.Arguments) {
+				responseBody := args.Get(3).(*PlantDeviceListV2)
+				*responseBody = result
+			},
+		)
+	}
+
+	return call.Return(err)
+}
+
 func (m *MockHttpClient) OnGetNoahPlantInfo(plantId string, result NoahPlantInfoObj, err error) *mock.Call {
 	call := m.On(
 		"postForm",
@@ -1,5 +1,7 @@
 package growatt_app
 
+import "strings"
+
 type TokenResponse struct {
 	Code  int    `json:"code"`
 	Data  string `json:"data"`
@@ -22,6 +24,21 @@ type PlantListV2 struct {
 	} `json:"PlantList"`
 }
 
+// from /newTwoPlantAPI.do?op=getAllDeviceListTwo
+type PlantDeviceListV2 struct {
+	DeviceList []PlantDeviceV2 `json:"deviceList"`
+}
+
+type PlantDeviceV2 struct {
+	DeviceSn   string `json:"deviceSn"`
+	DeviceType string `json:"deviceType"`
+}
+
+// IsNoah returns true for NOAH and NEXA devices
+func (d PlantDeviceV2) IsNoah() bool {
+	return strings.EqualFold(d.DeviceType, "noah") || strings.EqualFold(d.DeviceType, "nexa")
+}
+
 type ResponseContainerV2[T any] struct {
 	Msg    string `json:"msg"`
 	Result int    `json:"result"`
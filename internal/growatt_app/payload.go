@@ -17,6 +17,29 @@ func devicePayload(n *NoahStatus) models.DevicePayload {
 		GenerationTodayEnergy: misc.ParseFloat(n.Obj.EacToday),
 		WorkMode:              models.WorkModeFromString(n.Obj.WorkMode),
 		Status:                models.StatusFromString(n.Obj.Status),
+		Consumption:           consumptionPayload(n),
+	}
+}
+
+// consumptionPayload returns nil if neither a CT nor a smart plug is installed
+func consumptionPayload(n *NoahStatus) *models.ConsumptionPayload {
+	ct := misc.ParseFlag(n.Obj.IsHaveCt)
+	smartPlug := misc.S2i(n.Obj.GroplugNum) > 0
+	if !ct && !smartPlug {
+		return nil
+	}
+
+	householdLoad := misc.ParseFloat(n.Obj.LoadPower)
+	gridPower := misc.ParseFloat(n.Obj.GridPower)
+	smartPlugPower := misc.ParseFloat(n.Obj.GroplugPower)
+	otherPower := misc.ParseFloat(n.Obj.OtherPower)
+	return &models.ConsumptionPayload{
+		CT:             ct,
+		SmartPlug:      smartPlug,
+		HouseholdLoad:  &householdLoad,
+		GridPower:      &gridPower,
+		SmartPlugPower: &smartPlugPower,
+		OtherPower:     &otherPower,
 	}
 }
 
@@ -51,6 +51,28 @@ func Test_devicePayload(t *testing.T) {
 	assert.Equal(t, 3.3, dp.GenerationTodayEnergy)
 	assert.Equal(t, models.WorkMode("load_first"), dp.WorkMode)
 	assert.Equal(t, "on_grid", dp.Status)
+	assert.Nil(t, dp.Consumption)
+}
+
+func Test_consumptionPayload(t *testing.T) {
+	noahStatus := NoahStatus{}
+	noahStatus.Obj.IsHaveCt = "true"
+	noahStatus.Obj.GroplugNum = "0"
+	noahStatus.Obj.LoadPower = "412"
+	noahStatus.Obj.GridPower = "-120"
+	noahStatus.Obj.GroplugPower = "0"
+	noahStatus.Obj.OtherPower = "412"
+
+	cp := consumptionPayload(&noahStatus)
+
+	assert.True(t, cp.CT)
+	assert.False(t, cp.SmartPlug)
+	assert.Equal(t, 412.0, *cp.HouseholdLoad)
+	assert.Equal(t, -120.0, *cp.GridPower)
+	assert.Nil(t, cp.CTPower)
+	assert.Nil(t, cp.HouseholdLoadApartPlug)
+	assert.Equal(t, 0.0, *cp.SmartPlugPower)
+	assert.Equal(t, 412.0, *cp.OtherPower)
 }
 
 func Test_batteryPayload(t *testing.T) {
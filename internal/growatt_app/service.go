@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"nexa-mqtt/internal/devicefilter"
 	"nexa-mqtt/internal/endpoint"
 	"nexa-mqtt/internal/misc"
 	"nexa-mqtt/pkg/models"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -18,16 +21,23 @@ type Options struct {
 	PollingInterval               time.Duration
 	BatteryDetailsPollingInterval time.Duration
 	ParameterPollingInterval      time.Duration
+	EnumerationInterval           time.Duration        // 0 disables the periodic re-enumeration of the devices
+	DeviceFilter                  *devicefilter.Filter // nil publishes all devices
 }
 type GrowattAppService struct {
 	opts             Options
 	client           *Client
-	health           models.ServiceHealth
+	health           *models.HealthRegistry
 	devices          []models.NoahDevicePayload
 	endpoint         endpoint.Endpoint
 	loggedIn         bool
 	cancel           context.CancelFunc
+	pollers          sync.WaitGroup
+	devicesLock      sync.Mutex
+	devicePollers    map[string]context.CancelFunc
 	parameterTrigger map[string]chan struct{}
+	refreshTrigger   map[string]chan struct{}
+	enumerateTrigger chan struct{}
 	query            endpoint.ParameterQuery
 }
 
@@ -35,19 +45,52 @@ func NewGrowattAppService(options Options) *GrowattAppService {
 	service := GrowattAppService{
 		opts:             options,
 		client:           newClient(options.ServerUrl, options.Username, options.Password),
-		health:           models.NewServiceHealth(),
+		health:           models.NewHealthRegistry(),
 		loggedIn:         false,
 		parameterTrigger: make(map[string]chan struct{}),
+		refreshTrigger:   make(map[string]chan struct{}),
+		enumerateTrigger: make(chan struct{}, 1),
 	}
 	service.query = &service
 	return &service
 }
 
 func (g *GrowattAppService) TriggerParameterPolling(device models.NoahDevicePayload) {
+	g.devicesLock.Lock()
+	trigger := g.parameterTrigger[device.Serial]
+	g.devicesLock.Unlock()
+
+	select {
+	case trigger <- struct{}{}:
+	default: // Trigger already pending
+	}
+}
+
+// Refresh polls the status, the battery details and the parameters of the
+// device now
+func (g *GrowattAppService) Refresh(device models.NoahDevicePayload) error {
+	g.devicesLock.Lock()
+	trigger, ok := g.refreshTrigger[device.Serial]
+	g.devicesLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("device %s is not polled (app)", device.Serial)
+	}
 	select {
-	case g.parameterTrigger[device.Serial] <- struct{}{}:
+	case trigger <- struct{}{}:
 	default: // Trigger already pending
 	}
+	return nil
+}
+
+// Reenumerate enumerates the devices now, all devices of the account are
+// enumerated
+func (g *GrowattAppService) Reenumerate(_ models.NoahDevicePayload) error {
+	select {
+	case g.enumerateTrigger <- struct{}{}:
+	default: // Trigger already pending
+	}
+	return nil
 }
 
 func (g *GrowattAppService) Login() error {
@@ -60,26 +103,184 @@ func (g *GrowattAppService) Login() error {
 	return nil
 }
 
-func (g *GrowattAppService) StartPolling() {
-	g.enumerateDevices()
+// StartPolling enumerates the devices and starts a poller for each of them.
+// It returns an error if the devices cannot be enumerated. The devices are
+// enumerated again every EnumerationInterval and on Reenumerate.
+func (g *GrowattAppService) StartPolling() error {
+	devices, err := g.enumerateDevices()
+	if err != nil {
+		return err
+	}
+
 	var ctx context.Context
 	ctx, g.cancel = context.WithCancel(context.Background())
-	for _, device := range g.devices {
-		g.parameterTrigger[device.Serial] = make(chan struct{}, 1)
-		go g.poll(ctx, device)
+	g.updateDevices(ctx, devices)
+
+	g.pollers.Add(1)
+	go func() {
+		defer g.pollers.Done()
+		g.reenumerate(ctx)
+	}()
+	return nil
+}
+
+func (g *GrowattAppService) reenumerate(ctx context.Context) {
+	var tick <-chan time.Time // nil never ticks
+	if g.opts.EnumerationInterval > 0 {
+		ticker := time.NewTicker(g.opts.EnumerationInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			g.enumerateAgain(ctx)
+
+		case <-g.enumerateTrigger:
+			g.enumerateAgain(ctx)
+
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
+func (g *GrowattAppService) enumerateAgain(ctx context.Context) {
+	slog.Debug("re-enumerating devices (app)")
+	if devices, err := g.enumerateDevices(); err != nil {
+		slog.Warn("could not re-enumerate devices, keeping current devices (app)", slog.String("error", err.Error()))
+	} else {
+		g.updateDevices(ctx, devices)
+	}
+}
+
+// updateDevices stops the pollers of removed and changed devices and starts
+// pollers for new and changed devices. The endpoint is only updated if the
+// devices changed.
+func (g *GrowattAppService) updateDevices(ctx context.Context, devices []models.NoahDevicePayload) {
+	g.devicesLock.Lock()
+
+	if g.devicePollers == nil {
+		g.devicePollers = make(map[string]context.CancelFunc)
+	}
+	if g.parameterTrigger == nil {
+		g.parameterTrigger = make(map[string]chan struct{})
+	}
+	if g.refreshTrigger == nil {
+		g.refreshTrigger = make(map[string]chan struct{})
+	}
+
+	changed := len(devices) != len(g.devices)
+	for _, old := range g.devices {
+		i := slices.IndexFunc(devices, func(d models.NoahDevicePayload) bool { return d.Serial == old.Serial })
+		if i >= 0 && devices[i].Equal(old) {
+			continue
+		}
+		if i < 0 {
+			slog.Info("device removed (app)", slog.String("device", old.Serial))
+		} else {
+			slog.Info("device changed (app)", slog.String("device", old.Serial), slog.Int("batteries", len(devices[i].Batteries)))
+		}
+		if cancel, ok := g.devicePollers[old.Serial]; ok {
+			cancel()
+			delete(g.devicePollers, old.Serial)
+			delete(g.parameterTrigger, old.Serial)
+			delete(g.refreshTrigger, old.Serial)
+		}
+		changed = true
+	}
+
+	for _, device := range devices {
+		if _, ok := g.devicePollers[device.Serial]; ok {
+			continue
+		}
+		if !slices.ContainsFunc(g.devices, func(d models.NoahDevicePayload) bool { return d.Serial == device.Serial }) {
+			slog.Info("device added (app)", slog.String("device", device.Serial))
+			changed = true
+		}
+
+		pollCtx, cancel := context.WithCancel(ctx)
+		trigger := make(chan struct{}, 1)
+		refresh := make(chan struct{}, 1)
+		g.devicePollers[device.Serial] = cancel
+		g.parameterTrigger[device.Serial] = trigger
+		g.refreshTrigger[device.Serial] = refresh
+		g.pollers.Add(1)
+		go func() {
+			defer g.pollers.Done()
+			g.poll(pollCtx, device, trigger, refresh)
+		}()
+	}
+
+	g.devices = devices
+	g.devicesLock.Unlock()
+
+	// the endpoint is updated without holding devicesLock, it may apply a
+	// parameter command that triggers the parameter polling meanwhile
+	if changed {
+		g.health.Retain(devices)
+		g.endpoint.SetDevices(devices)
+	}
+}
+
+// knownDevices returns the currently polled devices matching f. They are kept
+// when the re-enumeration cannot query them.
+func (g *GrowattAppService) knownDevices(f func(models.NoahDevicePayload) bool) []models.NoahDevicePayload {
+	g.devicesLock.Lock()
+	defer g.devicesLock.Unlock()
+
+	var devices []models.NoahDevicePayload
+	for _, d := range g.devices {
+		if f(d) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// StopPolling stops all pollers. The devices are enumerated and announced
+// again by the next StartPolling.
 func (g *GrowattAppService) StopPolling() {
-	g.cancel()
+	if g.cancel != nil {
+		g.cancel()
+	}
+
+	g.devicesLock.Lock()
+	defer g.devicesLock.Unlock()
+
+	clear(g.devicePollers)
+	clear(g.parameterTrigger)
+	clear(g.refreshTrigger)
+	g.devices = nil
+}
+
+// Shutdown stops polling and waits until all pollers have returned or ctx
+// is done.
+func (g *GrowattAppService) Shutdown(ctx context.Context) error {
+	g.StopPolling()
+
+	done := make(chan struct{})
+	go func() {
+		g.pollers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("all pollers stopped (app)")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (g *GrowattAppService) fetchDevices() []models.NoahDevicePayload {
+func (g *GrowattAppService) fetchDevices() ([]models.NoahDevicePayload, error) {
 	slog.Info("fetching plant list")
 	list, err := g.client.GetPlantList()
 	if err != nil {
 		slog.Error("could not get plant list", slog.String("error", err.Error()))
-		misc.Panic(err)
+		return nil, err
 	}
 
 	var devices []models.NoahDevicePayload
@@ -88,32 +289,75 @@ func (g *GrowattAppService) fetchDevices() []models.NoahDevicePayload {
 		slog.Info("fetch plant details", slog.Int("plantId", plant.ID))
 		if info, err := g.client.GetNoahPlantInfo(fmt.Sprintf("%d", plant.ID)); err != nil {
 			slog.Error("could not get plant info", slog.Int("plantId", plant.ID), slog.String("error", err.Error()))
+			devices = append(devices, g.knownDevices(func(d models.NoahDevicePayload) bool {
+				return d.PlantId == plant.ID
+			})...)
 		} else {
-			if len(info.Obj.DeviceSn) > 0 {
+			for _, serial := range g.plantDevices(plant.ID, info.Obj.DeviceSn) {
 				devices = append(devices, models.NoahDevicePayload{
 					PlantId:   plant.ID,
-					Serial:    info.Obj.DeviceSn,
+					Serial:    serial,
 					Batteries: nil,
 				})
-				slog.Info("found device sn", slog.String("deviceSn", info.Obj.DeviceSn), slog.Int("plantId", plant.ID))
+				slog.Info("found device sn", slog.String("deviceSn", serial), slog.Int("plantId", plant.ID))
 			}
 		}
 	}
 
 	if len(devices) == 0 {
 		slog.Error("no nexa devices found")
-		misc.Panic(errors.New("no nexa devices found"))
+		return nil, errors.New("no nexa devices found")
 	}
 
-	return devices
+	return devices, nil
+}
+
+// plantDevices returns the serials of the NOAH/NEXA devices of a plant that has
+// at least one of them. isPlantNoahSystem only returns a single device, so the
+// device list of the plant is searched. If that fails, the single device is used.
+func (g *GrowattAppService) plantDevices(plantId int, deviceSn string) []string {
+	var serials []string
+	if list, err := g.client.GetPlantDeviceList(fmt.Sprintf("%d", plantId)); err != nil {
+		slog.Warn("could not get plant device list", slog.Int("plantId", plantId), slog.String("error", err.Error()))
+	} else {
+		for _, d := range list.DeviceList {
+			if d.IsNoah() && d.DeviceSn != "" && !slices.Contains(serials, d.DeviceSn) {
+				serials = append(serials, d.DeviceSn)
+			}
+		}
+	}
+
+	if deviceSn != "" && !slices.Contains(serials, deviceSn) {
+		serials = append([]string{deviceSn}, serials...)
+	}
+	return serials
 }
 
-func (g *GrowattAppService) enumerateDevices() {
-	devices := g.fetchDevices()
+func (g *GrowattAppService) enumerateDevices() ([]models.NoahDevicePayload, error) {
+	fetched, err := g.fetchDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []models.NoahDevicePayload
+	for _, device := range fetched {
+		if g.opts.DeviceFilter.Skip(device.Serial, device.PlantId) {
+			slog.Debug("skipping filtered device", slog.String("device", device.Serial))
+			continue
+		}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		slog.Error("no nexa devices found")
+		return nil, errors.New("no nexa devices found")
+	}
 
 	for i, device := range devices {
 		if data, err := g.client.GetNexaInfoBySn(device.Serial); err != nil {
 			slog.Error("could not get nexa status", slog.String("error", err.Error()), slog.String("serialNumber", device.Serial))
+			if known := g.knownDevices(func(d models.NoahDevicePayload) bool { return d.Serial == device.Serial }); len(known) > 0 {
+				devices[i] = known[0]
+			}
 		} else {
 			batCount := len(data.Obj.Noah.BatSns)
 			var batteries []models.NoahDeviceBatteryPayload
@@ -127,12 +371,11 @@ func (g *GrowattAppService) enumerateDevices() {
 			devices[i].Version = data.Obj.Noah.Version
 			devices[i].Alias = data.Obj.Noah.Alias
 			devices[i].Batteries = batteries
+			devices[i] = g.opts.DeviceFilter.Rename(devices[i])
 		}
 	}
 
-	g.devices = devices
-
-	g.endpoint.SetDevices(devices)
+	return devices, nil
 }
 
 func (g *GrowattAppService) SetEndpoint(e endpoint.Endpoint) {
@@ -153,21 +396,22 @@ func (g *GrowattAppService) ensureParameterLogin() error {
 	return nil
 }
 
-func (g *GrowattAppService) publishHealth(device models.NoahDevicePayload, err error) {
+func (g *GrowattAppService) publishHealth(device models.NoahDevicePayload, latency time.Duration, err error) {
+	health := g.health.Device(device.Serial)
 	if err != nil {
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallSet, latency, err)
 	} else {
-		g.health.UpdateSuccess(device.Serial)
+		health.UpdateSuccess(models.HealthCallSet, latency)
 		g.query.TriggerParameterPolling(device)
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattAppService) SetOutputPowerW(device models.NoahDevicePayload, mode models.WorkMode, power float64) error {
 	slog.Info("trying to set default system output power (app)", slog.String("device", device.Serial), slog.String("mode", string(mode)), slog.Float64("power", power))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set default system output power (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
@@ -175,17 +419,18 @@ func (g *GrowattAppService) SetOutputPowerW(device models.NoahDevicePayload, mod
 	if modeAsInt < 0 {
 		slog.Error("unable to set default system output power (app). Invalid mode", slog.String("device", device.Serial), slog.String("mode", string(mode)))
 		err := fmt.Errorf("invalid work mode: %s", mode)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Info("set default system output power (app)", slog.String("device", device.Serial), slog.Int("mode", modeAsInt), slog.Float64("power", power))
+	start := time.Now()
 	err := g.client.SetSystemOutputPower(device.Serial, modeAsInt, power)
 	if err != nil {
 		slog.Error("unable to set default system output power (app)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -193,17 +438,18 @@ func (g *GrowattAppService) SetChargingLimits(device models.NoahDevicePayload, c
 	slog.Info("trying to set charging limits (app)", slog.String("device", device.Serial), slog.Float64("chargingLimit", chargingLimit), slog.Float64("dischargeLimit", dischargeLimit))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set charging limits (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Info("set charging limit (app)", slog.String("device", device.Serial), slog.Float64("chargingLimit", chargingLimit), slog.Float64("dischargeLimit", dischargeLimit))
+	start := time.Now()
 	err := g.client.SetChargingSoc(device.Serial, chargingLimit, dischargeLimit)
 	if err != nil {
 		slog.Error("unable to set charging limits (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -211,16 +457,17 @@ func (g *GrowattAppService) SetAllowGridCharging(device models.NoahDevicePayload
 	slog.Info("trying to set allow charging  (app)", slog.String("device", device.Serial), slog.String("allow", string(allow)))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set allow charging (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetAllowGridCharging(device.Serial, misc.OnOffToInt(allow))
 	if err != nil {
 		slog.Error("unable to set allow charging (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -228,16 +475,17 @@ func (g *GrowattAppService) SetGridConnectionControl(device models.NoahDevicePay
 	slog.Info("trying to set grid connection  (app)", slog.String("device", device.Serial), slog.String("offlineEnable", string(offlineEnable)))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set grid connection (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetGridConnectionControl(device.Serial, misc.OnOffToInt(offlineEnable))
 	if err != nil {
 		slog.Error("unable to set grid connection (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -245,16 +493,17 @@ func (g *GrowattAppService) SetAcCouplePowerControl(device models.NoahDevicePayl
 	slog.Info("trying to set ac couple power control  (app)", slog.String("device", device.Serial), slog.String("1000WEnable", string(_1000WEnable)))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set ac couple power control (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetACCouplePowerControl(device.Serial, misc.OnOffToInt(_1000WEnable))
 	if err != nil {
 		slog.Error("unable to set ac couple power control (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -262,16 +511,17 @@ func (g *GrowattAppService) SetLightLoadEnable(device models.NoahDevicePayload,
 	slog.Info("trying to set light load enable (app)", slog.String("device", device.Serial), slog.String("enable", string(enable)))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set light load enable (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetLightLoadEnable(device.Serial, misc.OnOffToInt(enable))
 	if err != nil {
 		slog.Error("unable to set light load enable (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -279,16 +529,17 @@ func (g *GrowattAppService) SetNeverPowerOff(device models.NoahDevicePayload, en
 	slog.Info("trying to set never power off (app)", slog.String("device", device.Serial), slog.String("enable", string(enable)))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set set never power off (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetNeverPowerOff(device.Serial, misc.OnOffToInt(enable))
 	if err != nil {
 		slog.Error("unable to set set never power off (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -296,21 +547,23 @@ func (g *GrowattAppService) SetBackflow(device models.NoahDevicePayload, enableL
 	slog.Info("trying to set backflow (app)", slog.String("device", device.Serial), slog.String("enableLimit", string(enableLimit)), slog.Float64("powerSettingPercent", powerSettingPercent))
 	if err := g.ensureParameterLogin(); err != nil {
 		slog.Error("unable to set backflow (app)", slog.String("device", device.Serial))
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
+	start := time.Now()
 	err := g.client.SetBackflow(device.Serial, misc.OnOffToInt(enableLimit), powerSettingPercent)
 	if err != nil {
 		slog.Error("unable to set backflow (app)", slog.String("error", err.Error()))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
-func (g *GrowattAppService) poll(ctx context.Context, device models.NoahDevicePayload) {
+func (g *GrowattAppService) poll(ctx context.Context, device models.NoahDevicePayload, trigger <-chan struct{}, refresh <-chan struct{}) {
 	slog.Info("start polling growatt (app)",
+		slog.String("device", device.Serial),
 		slog.Int("interval", int(g.opts.PollingInterval/time.Second)),
 		slog.Int("battery-details-interval", int(g.opts.BatteryDetailsPollingInterval/time.Second)),
 		slog.Int("parameter-interval", int(g.opts.ParameterPollingInterval/time.Second)))
@@ -337,7 +590,20 @@ func (g *GrowattAppService) poll(ctx context.Context, device models.NoahDevicePa
 		case <-tickerParameter.C:
 			g.pollParameterData(device)
 
-		case <-g.parameterTrigger[device.Serial]:
+		case <-trigger:
+			g.pollParameterData(device)
+
+			tickerParameter.Stop()
+			select {
+			case <-tickerParameter.C:
+			default:
+			}
+			tickerParameter.Reset(g.opts.ParameterPollingInterval)
+
+		case <-refresh:
+			slog.Info("refreshing device (app)", slog.String("device", device.Serial))
+			g.pollStatus(device)
+			g.pollBatteryDetails(device)
 			g.pollParameterData(device)
 
 			tickerParameter.Stop()
@@ -348,7 +614,7 @@ func (g *GrowattAppService) poll(ctx context.Context, device models.NoahDevicePa
 			tickerParameter.Reset(g.opts.ParameterPollingInterval)
 
 		case <-ctx.Done():
-			slog.Info("stop polling growatt (app)")
+			slog.Info("stop polling growatt (app)", slog.String("device", device.Serial))
 			return
 		}
 	}
@@ -3,25 +3,32 @@ package growatt_app
 import (
 	"log/slog"
 	"nexa-mqtt/pkg/models"
+	"time"
 )
 
 func (g *GrowattAppService) pollStatus(device models.NoahDevicePayload) {
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if data, err := g.client.GetSystemStatus(device.Serial); err != nil {
 		slog.Error("could not get device data", slog.String("error", err.Error()), slog.String("device", device.Serial))
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallStatus, time.Since(start), err)
 	} else {
+		latency := time.Since(start)
 		payload := devicePayload(data)
 		g.endpoint.PublishDeviceStatus(device, payload)
-		g.health.UpdateSuccess(device.Serial)
+		health.UpdateSuccess(models.HealthCallStatus, latency)
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattAppService) pollBatteryDetails(device models.NoahDevicePayload) {
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if data, err := g.client.GetBatteryData(device.Serial); err != nil {
 		slog.Error("could not get battery data", slog.String("error", err.Error()), slog.String("device", device.Serial))
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallHistory, time.Since(start), err)
 	} else {
+		latency := time.Since(start)
 		var batteryPayloads []models.BatteryPayload
 
 		for _, bat := range data.Obj.Batter {
@@ -29,19 +36,22 @@ func (g *GrowattAppService) pollBatteryDetails(device models.NoahDevicePayload)
 		}
 
 		g.endpoint.PublishBatteryDetails(device, batteryPayloads)
-		g.health.UpdateSuccess(device.Serial)
+		health.UpdateSuccess(models.HealthCallHistory, latency)
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattAppService) pollParameterData(device models.NoahDevicePayload) {
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if data, err := g.client.GetNexaInfoBySn(device.Serial); err != nil {
 		slog.Error("could not get parameter data", slog.String("error", err.Error()), slog.String("device", device.Serial))
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallParameters, time.Since(start), err)
 	} else {
+		latency := time.Since(start)
 		payload := parameterPayload(data)
 		g.endpoint.PublishParameterData(device, payload)
-		g.health.UpdateSuccess(device.Serial)
+		health.UpdateSuccess(models.HealthCallParameters, latency)
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
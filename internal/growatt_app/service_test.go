@@ -1,13 +1,16 @@
 package growatt_app
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http/cookiejar"
 	"strconv"
 	"sync"
 	"time"
 
+	"nexa-mqtt/internal/devicefilter"
 	"nexa-mqtt/pkg/models"
 	"testing"
 
@@ -60,7 +63,7 @@ func setupGrowattAppServiceMock(t *testing.T) (*MockHttpClient, *GrowattAppServi
 	service := GrowattAppService{
 		client:           &client,
 		endpoint:         &endpoint,
-		health:           models.NewServiceHealth(),
+		health:           models.NewHealthRegistry(),
 		parameterTrigger: make(map[string]chan struct{}),
 		query:            parameterQuery,
 	}
@@ -118,9 +121,13 @@ func Test_fetchDevices_Ok(t *testing.T) {
 	mockHttpClient.OnGetNoahPlantInfo("2", NoahPlantInfoObj{IsPlantHaveNexa: false}, nil)
 	mockHttpClient.OnGetNoahPlantInfo("3", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: ""}, nil)
 	mockHttpClient.OnGetNoahPlantInfo("4", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial235"}, nil)
+	mockHttpClient.OnGetPlantDeviceList("1", 1, PlantDeviceListV2{}, nil)
+	mockHttpClient.OnGetPlantDeviceList("3", 1, PlantDeviceListV2{}, nil)
+	mockHttpClient.OnGetPlantDeviceList("4", 1, PlantDeviceListV2{}, errors.New("GetPlantDeviceList fails"))
 
-	devices := service.fetchDevices()
+	devices, err := service.fetchDevices()
 
+	assert.NoError(t, err)
 	assert.Equal(t, 2, len(devices))
 	assert.Equal(
 		t,
@@ -134,20 +141,69 @@ func Test_fetchDevices_Ok(t *testing.T) {
 	endpoint.AssertExpectations(t)
 }
 
+func Test_fetchDevices_Pages(t *testing.T) {
+	mockHttpClient, service, _, endpoint, _ := setupGrowattAppServiceMock(t)
+
+	// a full first page is followed by the second one
+	var page1 PlantListV2
+	for i := range 20 {
+		page1.PlantList = append(page1.PlantList, struct {
+			ID int `json:"id"`
+		}{ID: 100 + i})
+	}
+	mockHttpClient.OnGetPlantListPage(1, page1, nil).Once()
+	mockHttpClient.OnGetPlantListPage(2, PlantListV2{
+		PlantList: []struct {
+			ID int `json:"id"`
+		}{
+			{ID: 1},
+		},
+	}, nil).Once()
+
+	for i := range 20 {
+		mockHttpClient.OnGetNoahPlantInfo(strconv.Itoa(100+i), NoahPlantInfoObj{IsPlantHaveNexa: false}, nil)
+	}
+	mockHttpClient.OnGetNoahPlantInfo("1", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial234"}, nil)
+
+	// several devices in one plant, the device list has two pages
+	var devicePage1 PlantDeviceListV2
+	for i := range 19 {
+		devicePage1.DeviceList = append(devicePage1.DeviceList, PlantDeviceV2{DeviceSn: fmt.Sprintf("inverter%d", i), DeviceType: "inv"})
+	}
+	devicePage1.DeviceList = append(devicePage1.DeviceList, PlantDeviceV2{DeviceSn: "serial234", DeviceType: "noah"})
+	mockHttpClient.OnGetPlantDeviceList("1", 1, devicePage1, nil).Once()
+	mockHttpClient.OnGetPlantDeviceList("1", 2, PlantDeviceListV2{DeviceList: []PlantDeviceV2{
+		{DeviceSn: "serial235", DeviceType: "noah"},
+		{DeviceSn: "serial236", DeviceType: "nexa"},
+	}}, nil).Once()
+
+	devices, err := service.fetchDevices()
+
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]models.NoahDevicePayload{
+			{PlantId: 1, Serial: "serial234"},
+			{PlantId: 1, Serial: "serial235"},
+			{PlantId: 1, Serial: "serial236"},
+		},
+		devices)
+
+	mockHttpClient.AssertExpectations(t)
+	endpoint.AssertExpectations(t)
+}
+
 func Test_fetchDevices_GetPlantList_Fails(t *testing.T) {
 	mockHttpClient, service, _, endpoint, _ := setupGrowattAppServiceMock(t)
 
 	mockHttpClient.OnGetPlantList(PlantListV2{}, errors.New("GetPlantList fails"))
 
-	defer func() {
-		if r := recover(); r != nil {
-			mockHttpClient.AssertExpectations(t)
-			endpoint.AssertExpectations(t)
-		}
-	}()
+	devices, err := service.fetchDevices()
 
-	service.fetchDevices()
-	t.Errorf("Test failed, panic was expected")
+	assert.Error(t, err)
+	assert.Nil(t, devices)
+	mockHttpClient.AssertExpectations(t)
+	endpoint.AssertExpectations(t)
 }
 
 func Test_fetchDevices_NoDevices_Fails(t *testing.T) {
@@ -164,16 +220,82 @@ func Test_fetchDevices_NoDevices_Fails(t *testing.T) {
 
 	mockHttpClient.OnGetNoahPlantInfo("1", NoahPlantInfoObj{IsPlantHaveNexa: false}, nil)
 	mockHttpClient.OnGetNoahPlantInfo("2", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: ""}, nil)
+	mockHttpClient.OnGetPlantDeviceList("2", 1, PlantDeviceListV2{DeviceList: []PlantDeviceV2{{DeviceSn: "inverter123", DeviceType: "inv"}}}, nil)
+
+	devices, err := service.fetchDevices()
+
+	assert.Error(t, err)
+	assert.Nil(t, devices)
+	mockHttpClient.AssertExpectations(t)
+	endpoint.AssertExpectations(t)
+}
+
+func Test_enumerateDevices_Filter(t *testing.T) {
+	mockHttpClient, service, _, _, _ := setupGrowattAppServiceMock(t)
+	service.opts.DeviceFilter = devicefilter.New(devicefilter.Options{
+		Exclude: []string{"2"},
+		Overrides: map[string]devicefilter.Override{
+			"serial234": {Alias: "Garage", Batteries: []string{"Left"}},
+		},
+	})
+
+	mockHttpClient.OnGetPlantList(PlantListV2{
+		PlantList: []struct {
+			ID int `json:"id"`
+		}{
+			{ID: 1},
+			{ID: 2},
+		},
+	}, nil)
+
+	mockHttpClient.OnGetNoahPlantInfo("1", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial234"}, nil)
+	mockHttpClient.OnGetNoahPlantInfo("2", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "demo"}, nil)
+	mockHttpClient.OnGetPlantDeviceList("1", 1, PlantDeviceListV2{}, nil)
+	mockHttpClient.OnGetPlantDeviceList("2", 1, PlantDeviceListV2{}, nil)
+
+	nexaInfoObj := NexaInfoObj{}
+	nexaInfoObj.Noah.Model = "NEXA 2000"
+	nexaInfoObj.Noah.Alias = "NEXA 2000"
+	nexaInfoObj.Noah.BatSns = []string{"0XXX00XX00XX0000", "0XXX00XX00XX0001"}
+	mockHttpClient.OnGetNoahInfo("serial234", nexaInfoObj, nil)
+
+	devices, err := service.enumerateDevices()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []models.NoahDevicePayload{
+		{
+			PlantId: 1,
+			Serial:  "serial234",
+			Model:   "NEXA 2000",
+			Alias:   "Garage",
+			Batteries: []models.NoahDeviceBatteryPayload{
+				{Alias: "Left"},
+				{Alias: "BAT1"},
+			},
+		},
+	}, devices)
+	mockHttpClient.AssertExpectations(t)
+}
+
+func Test_enumerateDevices_AllFiltered(t *testing.T) {
+	mockHttpClient, service, _, _, _ := setupGrowattAppServiceMock(t)
+	service.opts.DeviceFilter = devicefilter.New(devicefilter.Options{Include: []string{"serial999"}})
+
+	mockHttpClient.OnGetPlantList(PlantListV2{
+		PlantList: []struct {
+			ID int `json:"id"`
+		}{
+			{ID: 1},
+		},
+	}, nil)
+	mockHttpClient.OnGetNoahPlantInfo("1", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial234"}, nil)
+	mockHttpClient.OnGetPlantDeviceList("1", 1, PlantDeviceListV2{}, nil)
 
-	defer func() {
-		if r := recover(); r != nil {
-			mockHttpClient.AssertExpectations(t)
-			endpoint.AssertExpectations(t)
-		}
-	}()
+	devices, err := service.enumerateDevices()
 
-	service.fetchDevices()
-	t.Errorf("Test failed, panic was expected")
+	assert.Error(t, err)
+	assert.Empty(t, devices)
+	mockHttpClient.AssertExpectations(t)
 }
 
 func Test_enumerateDevices_Ok(t *testing.T) {
@@ -192,6 +314,9 @@ func Test_enumerateDevices_Ok(t *testing.T) {
 	mockHttpClient.OnGetNoahPlantInfo("1", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial234"}, nil)
 	mockHttpClient.OnGetNoahPlantInfo("2", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial235"}, nil)
 	mockHttpClient.OnGetNoahPlantInfo("3", NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: "serial236"}, nil)
+	mockHttpClient.OnGetPlantDeviceList("1", 1, PlantDeviceListV2{}, nil)
+	mockHttpClient.OnGetPlantDeviceList("2", 1, PlantDeviceListV2{}, nil)
+	mockHttpClient.OnGetPlantDeviceList("3", 1, PlantDeviceListV2{}, nil)
 
 	nexaInfoObj1 := NexaInfoObj{}
 	nexaInfoObj1.Noah.Model = "NEXA 2000"
@@ -237,18 +362,10 @@ func Test_enumerateDevices_Ok(t *testing.T) {
 		},
 	}
 
-	endpoint.On(
-		"SetDevices",
-		expectedDevices,
-	)
-
-	service.enumerateDevices()
+	devices, err := service.enumerateDevices()
 
-	assert.Equal(t, 3, len(service.devices))
-	assert.Equal(
-		t,
-		expectedDevices,
-		service.devices)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedDevices, devices)
 
 	mockHttpClient.AssertExpectations(t)
 	endpoint.AssertExpectations(t)
@@ -784,6 +901,7 @@ func setupPoll(wg *sync.WaitGroup, mockHttpClient *MockHttpClient, device models
 		},
 	}, nil)
 	mockHttpClient.OnGetNoahPlantInfo(strconv.Itoa(device.PlantId), NoahPlantInfoObj{IsPlantHaveNexa: true, DeviceSn: device.Serial}, nil)
+	mockHttpClient.OnGetPlantDeviceList(strconv.Itoa(device.PlantId), 1, PlantDeviceListV2{DeviceList: []PlantDeviceV2{{DeviceSn: device.Serial, DeviceType: "noah"}}}, nil)
 	mockHttpClient.OnGetNoahInfo(device.Serial, nexaInfo, nil)
 
 	expectedDevices := []models.NoahDevicePayload{
@@ -957,3 +1075,61 @@ func TestPolling_multipleTimes(t *testing.T) {
 	mockEndpoint.AssertNumberOfCalls(t, "PublishParameterData", nLoops+1)
 	mockEndpoint.AssertNumberOfCalls(t, "PublishHealth", (nLoops+1)*3)
 }
+
+func TestRefresh(t *testing.T) {
+	mockHttpClient, service, device, mockEndpoint, _ := setupGrowattAppServiceMock(t)
+	var wg sync.WaitGroup
+
+	service.opts.PollingInterval = time.Hour
+	service.opts.BatteryDetailsPollingInterval = time.Hour
+	service.opts.ParameterPollingInterval = time.Hour
+
+	setupPoll(&wg, mockHttpClient, device, mockEndpoint)
+
+	wg.Add(6)
+	service.StartPolling()
+	wg.Wait()
+
+	wg.Add(6)
+	assert.NoError(t, service.Refresh(device))
+	wg.Wait()
+
+	service.StopPolling()
+
+	mockEndpoint.AssertNumberOfCalls(t, "PublishDeviceStatus", 2)
+	mockEndpoint.AssertNumberOfCalls(t, "PublishBatteryDetails", 2)
+	mockEndpoint.AssertNumberOfCalls(t, "PublishParameterData", 2)
+	mockEndpoint.AssertNumberOfCalls(t, "PublishHealth", 6)
+}
+
+func TestRefresh_UnknownDevice(t *testing.T) {
+	_, service, device, _, _ := setupGrowattAppServiceMock(t)
+
+	assert.EqualError(t, service.Refresh(device), "device "+device.Serial+" is not polled (app)")
+}
+
+func TestShutdown(t *testing.T) {
+	mockHttpClient, service, device, mockEndpoint, _ := setupGrowattAppServiceMock(t)
+	var wg sync.WaitGroup
+
+	service.opts.PollingInterval = time.Hour
+	service.opts.BatteryDetailsPollingInterval = time.Hour
+	service.opts.ParameterPollingInterval = time.Hour
+
+	setupPoll(&wg, mockHttpClient, device, mockEndpoint)
+
+	wg.Add(6)
+
+	service.StartPolling()
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, service.Shutdown(ctx))
+}
+
+func TestShutdown_NotStarted(t *testing.T) {
+	_, service, _, _, _ := setupGrowattAppServiceMock(t)
+
+	assert.NoError(t, service.Shutdown(context.Background()))
+}
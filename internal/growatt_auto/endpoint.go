@@ -0,0 +1,93 @@
+package growatt_auto
+
+import (
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/pkg/models"
+)
+
+// sourceEndpoint is the endpoint of a single source. It forwards the data of
+// the source only while it is the active source.
+type sourceEndpoint struct {
+	service *GrowattAutoService
+	source  string
+}
+
+// SetParameterApplier is ignored, parameters are applied by the active source.
+func (e *sourceEndpoint) SetParameterApplier(applier endpoint.ParameterApplier) {
+}
+
+func (e *sourceEndpoint) SetDevices(devices []models.NoahDevicePayload) {
+	if e.source == SourceWeb {
+		e.service.forget(devices)
+	}
+
+	e.service.lock.Lock()
+	e.service.devices[e.source] = devices
+	e.service.lock.Unlock()
+
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.SetDevices(devices)
+	}
+}
+
+func (e *sourceEndpoint) PublishDeviceStatus(device models.NoahDevicePayload, status models.DevicePayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishDeviceStatus(device, status)
+	}
+}
+
+func (e *sourceEndpoint) PublishBatteryDetails(device models.NoahDevicePayload, details []models.BatteryPayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishBatteryDetails(device, details)
+	}
+}
+
+func (e *sourceEndpoint) PublishPvDetails(device models.NoahDevicePayload, details []models.PvPayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishPvDetails(device, details)
+	}
+}
+
+func (e *sourceEndpoint) PublishMeterData(device models.NoahDevicePayload, meter models.MeterPayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishMeterData(device, meter)
+	}
+}
+
+func (e *sourceEndpoint) PublishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishAlarms(device, alarms)
+	}
+}
+
+func (e *sourceEndpoint) PublishParameterData(device models.NoahDevicePayload, param models.ParameterPayload) {
+	if ep := e.service.activeEndpoint(e.source); ep != nil {
+		ep.PublishParameterData(device, param)
+	}
+}
+
+// PublishHealth publishes the health of the active source with the source
+// added. The health of the web api decides about failover and failback.
+func (e *sourceEndpoint) PublishHealth(device models.NoahDevicePayload, health *models.ServiceHealth) {
+	if e.source == SourceWeb {
+		e.service.observe(device, health)
+	}
+
+	ep := e.service.activeEndpoint(e.source)
+	if ep == nil {
+		return
+	}
+
+	e.service.lock.Lock()
+	changed := e.service.healthSources[device.Serial] != e.source
+	e.service.healthSources[device.Serial] = e.source
+	e.service.lock.Unlock()
+
+	health.StateLock.Lock()
+	health.Source = e.source
+	// the health of the other source was published last, replace it
+	health.Send = health.Send || changed
+	health.StateLock.Unlock()
+
+	ep.PublishHealth(device, health)
+}
@@ -0,0 +1,102 @@
+package growatt_auto
+
+import (
+	"context"
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/pkg/models"
+	"sync"
+
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSource implements Source
+type MockSource struct {
+	mock.Mock
+
+	lock     sync.Mutex
+	endpoint endpoint.Endpoint
+}
+
+func (m *MockSource) Login() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockSource) StartPolling() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
+func (m *MockSource) StopPolling() {
+	m.Called()
+}
+
+func (m *MockSource) Shutdown(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetEndpoint(e endpoint.Endpoint) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.endpoint = e
+}
+
+// Endpoint returns the endpoint set by the service under test
+func (m *MockSource) Endpoint() endpoint.Endpoint {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.endpoint
+}
+
+func (m *MockSource) SetOutputPowerW(device models.NoahDevicePayload, mode models.WorkMode, power float64) error {
+	args := m.Called(device, mode, power)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetChargingLimits(device models.NoahDevicePayload, chargingLimit float64, dischargeLimit float64) error {
+	args := m.Called(device, chargingLimit, dischargeLimit)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetAllowGridCharging(device models.NoahDevicePayload, allow models.OnOff) error {
+	args := m.Called(device, allow)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetGridConnectionControl(device models.NoahDevicePayload, offlineEnable models.OnOff) error {
+	args := m.Called(device, offlineEnable)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetAcCouplePowerControl(device models.NoahDevicePayload, _1000WEnable models.OnOff) error {
+	args := m.Called(device, _1000WEnable)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetLightLoadEnable(device models.NoahDevicePayload, enable models.OnOff) error {
+	args := m.Called(device, enable)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetNeverPowerOff(device models.NoahDevicePayload, enable models.OnOff) error {
+	args := m.Called(device, enable)
+	return args.Error(0)
+}
+
+func (m *MockSource) SetBackflow(device models.NoahDevicePayload, enableLimit models.OnOff, powerSettingPercent float64) error {
+	args := m.Called(device, enableLimit, powerSettingPercent)
+	return args.Error(0)
+}
+
+func (m *MockSource) Refresh(device models.NoahDevicePayload) error {
+	args := m.Called(device)
+	return args.Error(0)
+}
+
+func (m *MockSource) Reenumerate(device models.NoahDevicePayload) error {
+	args := m.Called(device)
+	return args.Error(0)
+}
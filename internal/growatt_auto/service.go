@@ -0,0 +1,364 @@
+package growatt_auto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"nexa-mqtt/internal/endpoint"
+	"nexa-mqtt/internal/growatt_web"
+	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
+	"slices"
+	"sync"
+)
+
+const (
+	SourceWeb = "web"
+	SourceApp = "app"
+)
+
+// Source is a Growatt API service that polls the devices and applies
+// parameter changes.
+type Source interface {
+	endpoint.ParameterApplier
+	endpoint.Refresher
+	Login() error
+	StartPolling() error
+	StopPolling()
+	Shutdown(ctx context.Context) error
+	SetEndpoint(e endpoint.Endpoint)
+}
+
+type webSource struct {
+	*growatt_web.GrowattService
+}
+
+func (w webSource) StartPolling() error {
+	return w.GrowattService.StartPolling(growatt_web.NewDefaultDurationCalculator(w.GrowattService))
+}
+
+// WebSource adapts the web service to a Source using the default duration
+// calculator for the battery details.
+func WebSource(g *growatt_web.GrowattService) Source {
+	return webSource{g}
+}
+
+type Options struct {
+	// number of consecutive polling cycles of the web api with errors before
+	// failing over to the app api, and without errors before failing back
+	Threshold int
+	// backoff for starting the web api while the app api is active
+	Backoff misc.Backoff
+}
+
+// GrowattAutoService uses the web api as primary source and fails over to the
+// app api when the web api keeps failing. The web api keeps polling after a
+// failover, so the service fails back as soon as it has recovered.
+type GrowattAutoService struct {
+	opts      Options
+	primary   Source
+	secondary Source
+
+	lock          sync.Mutex
+	endpoint      endpoint.Endpoint
+	active        string
+	failures      map[string]int // consecutive failing polling cycles by device serial
+	successes     map[string]int // consecutive successful polling cycles by device serial
+	cycles        map[string]int // last observed polling cycle by device serial
+	switching     bool
+	devices       map[string][]models.NoahDevicePayload
+	healthSources map[string]string
+	cancel        context.CancelFunc
+	workers       sync.WaitGroup
+}
+
+func NewGrowattAutoService(options Options, web Source, app Source) *GrowattAutoService {
+	if options.Threshold < 1 {
+		options.Threshold = 1
+	}
+	if options.Backoff == (misc.Backoff{}) {
+		options.Backoff = misc.DefaultBackoff
+	}
+	return &GrowattAutoService{
+		opts:          options,
+		primary:       web,
+		secondary:     app,
+		active:        SourceWeb,
+		failures:      make(map[string]int),
+		successes:     make(map[string]int),
+		cycles:        make(map[string]int),
+		devices:       make(map[string][]models.NoahDevicePayload),
+		healthSources: make(map[string]string),
+	}
+}
+
+// Active returns the source that currently delivers the data.
+func (g *GrowattAutoService) Active() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.active
+}
+
+func (g *GrowattAutoService) SetEndpoint(e endpoint.Endpoint) {
+	g.lock.Lock()
+	g.endpoint = e
+	g.lock.Unlock()
+
+	if e == nil {
+		g.primary.SetEndpoint(nil)
+		g.secondary.SetEndpoint(nil)
+		return
+	}
+	g.primary.SetEndpoint(&sourceEndpoint{service: g, source: SourceWeb})
+	g.secondary.SetEndpoint(&sourceEndpoint{service: g, source: SourceApp})
+}
+
+// Login logs in to the web api. If that fails for another reason than invalid
+// credentials, the app api is tried, so polling can start with the app api.
+func (g *GrowattAutoService) Login() error {
+	err := g.primary.Login()
+	if err == nil || errors.Is(err, misc.ErrInvalidCredentials) {
+		return err
+	}
+
+	slog.Warn("could not login (web), trying app", slog.String("error", err.Error()))
+	if appErr := g.secondary.Login(); appErr != nil {
+		return errors.Join(err, appErr)
+	}
+	return nil
+}
+
+// StartPolling starts polling with the web api. If the web api cannot
+// enumerate the devices, polling starts with the app api and the web api is
+// started in the background.
+func (g *GrowattAutoService) StartPolling() error {
+	var ctx context.Context
+	ctx, g.cancel = context.WithCancel(context.Background())
+	g.switchTo(SourceWeb)
+
+	err := g.primary.StartPolling()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, misc.ErrInvalidCredentials) {
+		return err
+	}
+
+	slog.Warn("could not start polling (web), failing over to app", slog.String("error", err.Error()))
+	g.switchTo(SourceApp)
+	if appErr := g.secondary.StartPolling(); appErr != nil {
+		g.switchTo(SourceWeb)
+		return errors.Join(err, appErr)
+	}
+
+	g.workers.Add(1)
+	go func() {
+		defer g.workers.Done()
+		if err := misc.Retry(ctx, "start polling (web)", g.opts.Backoff, g.primary.StartPolling, nil); err != nil {
+			slog.Error("could not start polling (web)", slog.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (g *GrowattAutoService) StopPolling() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+	g.workers.Wait()
+
+	g.primary.StopPolling()
+	g.secondary.StopPolling()
+}
+
+// Shutdown stops polling of both apis and waits until all pollers have
+// returned or ctx is done.
+func (g *GrowattAutoService) Shutdown(ctx context.Context) error {
+	if g.cancel != nil {
+		g.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return errors.Join(g.primary.Shutdown(ctx), g.secondary.Shutdown(ctx))
+}
+
+// observe counts the polling cycles of the web api with and without errors per
+// device and starts a failover when a device reaches the threshold, and a
+// failback when all devices reach it. A cycle is counted once, with the
+// first health published after its status poll.
+func (g *GrowattAutoService) observe(device models.NoahDevicePayload, health *models.ServiceHealth) {
+	cycle := health.StatusPolls()
+	failed := health.PollingFailed()
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.switching || cycle == g.cycles[device.Serial] {
+		return
+	}
+	g.cycles[device.Serial] = cycle
+	if failed {
+		g.failures[device.Serial]++
+		g.successes[device.Serial] = 0
+	} else {
+		g.successes[device.Serial]++
+		g.failures[device.Serial] = 0
+	}
+
+	switch {
+	case g.active == SourceWeb && g.failures[device.Serial] >= g.opts.Threshold:
+		g.switching = true
+		g.workers.Add(1)
+		go func() {
+			defer g.workers.Done()
+			g.failover()
+		}()
+
+	case g.active == SourceApp && g.recovered():
+		g.switching = true
+		g.workers.Add(1)
+		go func() {
+			defer g.workers.Done()
+			g.failback()
+		}()
+	}
+}
+
+// recovered reports whether the web api succeeds for all devices for the
+// threshold. g.lock must be held by the caller.
+func (g *GrowattAutoService) recovered() bool {
+	if len(g.successes) == 0 {
+		return false
+	}
+	for _, successes := range g.successes {
+		if successes < g.opts.Threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// forget removes the counters of the devices the web api no longer polls.
+func (g *GrowattAutoService) forget(devices []models.NoahDevicePayload) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, counters := range []map[string]int{g.failures, g.successes, g.cycles} {
+		for serial := range counters {
+			if !slices.ContainsFunc(devices, func(d models.NoahDevicePayload) bool { return d.Serial == serial }) {
+				delete(counters, serial)
+			}
+		}
+	}
+}
+
+func (g *GrowattAutoService) failover() {
+	slog.Warn("web api keeps failing, failing over to app", slog.Int("threshold", g.opts.Threshold))
+	g.switchTo(SourceApp)
+	if err := g.secondary.StartPolling(); err != nil {
+		slog.Error("could not fail over to app, staying with web", slog.String("error", err.Error()))
+		g.switchTo(SourceWeb)
+	}
+
+	g.lock.Lock()
+	g.switching = false
+	g.lock.Unlock()
+}
+
+func (g *GrowattAutoService) failback() {
+	slog.Info("web api recovered, failing back from app", slog.Int("threshold", g.opts.Threshold))
+	g.secondary.StopPolling()
+	g.switchTo(SourceWeb)
+
+	g.lock.Lock()
+	g.switching = false
+	devices := g.devices[SourceWeb]
+	e := g.endpoint
+	g.lock.Unlock()
+
+	// the app api may have announced different devices
+	if e != nil && devices != nil {
+		e.SetDevices(devices)
+	}
+}
+
+func (g *GrowattAutoService) switchTo(source string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.active != source {
+		slog.Info("switching api", slog.String("from", g.active), slog.String("to", source))
+	}
+	g.active = source
+	clear(g.failures)
+	clear(g.successes)
+}
+
+// activeEndpoint returns the endpoint if source is the active source.
+func (g *GrowattAutoService) activeEndpoint(source string) endpoint.Endpoint {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.active != source {
+		return nil
+	}
+	return g.endpoint
+}
+
+func (g *GrowattAutoService) activeSource() Source {
+	if g.Active() == SourceApp {
+		return g.secondary
+	}
+	return g.primary
+}
+
+func (g *GrowattAutoService) SetOutputPowerW(device models.NoahDevicePayload, mode models.WorkMode, power float64) error {
+	return g.activeSource().SetOutputPowerW(device, mode, power)
+}
+
+func (g *GrowattAutoService) SetChargingLimits(device models.NoahDevicePayload, chargingLimit float64, dischargeLimit float64) error {
+	return g.activeSource().SetChargingLimits(device, chargingLimit, dischargeLimit)
+}
+
+func (g *GrowattAutoService) SetAllowGridCharging(device models.NoahDevicePayload, allow models.OnOff) error {
+	return g.activeSource().SetAllowGridCharging(device, allow)
+}
+
+func (g *GrowattAutoService) SetGridConnectionControl(device models.NoahDevicePayload, offlineEnable models.OnOff) error {
+	return g.activeSource().SetGridConnectionControl(device, offlineEnable)
+}
+
+func (g *GrowattAutoService) SetAcCouplePowerControl(device models.NoahDevicePayload, _1000WEnable models.OnOff) error {
+	return g.activeSource().SetAcCouplePowerControl(device, _1000WEnable)
+}
+
+func (g *GrowattAutoService) SetLightLoadEnable(device models.NoahDevicePayload, enable models.OnOff) error {
+	return g.activeSource().SetLightLoadEnable(device, enable)
+}
+
+func (g *GrowattAutoService) SetNeverPowerOff(device models.NoahDevicePayload, enable models.OnOff) error {
+	return g.activeSource().SetNeverPowerOff(device, enable)
+}
+
+func (g *GrowattAutoService) SetBackflow(device models.NoahDevicePayload, enableLimit models.OnOff, powerSettingPercent float64) error {
+	return g.activeSource().SetBackflow(device, enableLimit, powerSettingPercent)
+}
+
+func (g *GrowattAutoService) Refresh(device models.NoahDevicePayload) error {
+	return g.activeSource().Refresh(device)
+}
+
+func (g *GrowattAutoService) Reenumerate(device models.NoahDevicePayload) error {
+	return g.activeSource().Reenumerate(device)
+}
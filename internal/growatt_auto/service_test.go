@@ -0,0 +1,266 @@
+package growatt_auto
+
+import (
+	"errors"
+	"fmt"
+	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func setupAutoServiceMocks(t *testing.T) (*GrowattAutoService, *MockSource, *MockSource, *MockEndpoint, models.NoahDevicePayload) {
+	web := &MockSource{}
+	app := &MockSource{}
+	mockEndpoint := &MockEndpoint{}
+
+	service := NewGrowattAutoService(Options{
+		Threshold: 2,
+		Backoff:   misc.Backoff{Initial: time.Millisecond, Max: time.Millisecond, Factor: 1},
+	}, web, app)
+	service.SetEndpoint(mockEndpoint)
+
+	device := models.NoahDevicePayload{Serial: "device123", PlantId: 1}
+
+	return service, web, app, mockEndpoint, device
+}
+
+func okHealth() *models.ServiceHealth {
+	return okCycle(models.NewServiceHealth())
+}
+
+// failingCycle records a failing status poll, i.e. a failing polling cycle
+func failingCycle(health *models.ServiceHealth) *models.ServiceHealth {
+	health.UpdateError(models.HealthCallStatus, time.Second, fmt.Errorf("connection reset"))
+	return health
+}
+
+// okCycle records a successful status poll, i.e. a successful polling cycle
+func okCycle(health *models.ServiceHealth) *models.ServiceHealth {
+	health.UpdateSuccess(models.HealthCallStatus, time.Second)
+	return health
+}
+
+func TestLogin_Web(t *testing.T) {
+	service, web, app, _, _ := setupAutoServiceMocks(t)
+
+	web.On("Login").Return(nil)
+
+	assert.NoError(t, service.Login())
+	web.AssertExpectations(t)
+	app.AssertNotCalled(t, "Login")
+}
+
+func TestLogin_FallbackToApp(t *testing.T) {
+	service, web, app, _, _ := setupAutoServiceMocks(t)
+
+	web.On("Login").Return(errors.New("server error"))
+	app.On("Login").Return(nil)
+
+	assert.NoError(t, service.Login())
+	web.AssertExpectations(t)
+	app.AssertExpectations(t)
+}
+
+func TestLogin_InvalidCredentials(t *testing.T) {
+	service, web, app, _, _ := setupAutoServiceMocks(t)
+
+	web.On("Login").Return(fmt.Errorf("%w: 502", misc.ErrInvalidCredentials))
+
+	assert.ErrorIs(t, service.Login(), misc.ErrInvalidCredentials)
+	app.AssertNotCalled(t, "Login")
+}
+
+func TestPublish_OnlyActiveSource(t *testing.T) {
+	service, web, app, mockEndpoint, device := setupAutoServiceMocks(t)
+
+	web.On("StartPolling").Return(nil)
+	mockEndpoint.On("SetDevices", []models.NoahDevicePayload{device})
+	mockEndpoint.On("PublishDeviceStatus", device, models.DevicePayload{Soc: 50})
+
+	assert.NoError(t, service.StartPolling())
+	assert.Equal(t, SourceWeb, service.Active())
+
+	web.Endpoint().SetDevices([]models.NoahDevicePayload{device})
+	web.Endpoint().PublishDeviceStatus(device, models.DevicePayload{Soc: 50})
+	app.Endpoint().SetDevices([]models.NoahDevicePayload{device})
+	app.Endpoint().PublishDeviceStatus(device, models.DevicePayload{Soc: 60})
+
+	mockEndpoint.AssertExpectations(t)
+	mockEndpoint.AssertNumberOfCalls(t, "SetDevices", 1)
+	mockEndpoint.AssertNumberOfCalls(t, "PublishDeviceStatus", 1)
+}
+
+func TestFailoverAndFailback(t *testing.T) {
+	service, web, app, mockEndpoint, device := setupAutoServiceMocks(t)
+	webDevice := device
+	webDevice.Model = "NEXA 2000"
+
+	web.On("StartPolling").Return(nil)
+	app.On("StartPolling").Return(nil)
+	app.On("StopPolling")
+	mockEndpoint.On("SetDevices", mock.Anything)
+	mockEndpoint.On("PublishHealth", device, mock.Anything)
+
+	assert.NoError(t, service.StartPolling())
+	web.Endpoint().SetDevices([]models.NoahDevicePayload{webDevice})
+
+	health := models.NewServiceHealth()
+
+	// one failing cycle is below the threshold
+
+	web.Endpoint().PublishHealth(device, failingCycle(health))
+	web.Endpoint().PublishHealth(device, okCycle(health))
+	web.Endpoint().PublishHealth(device, failingCycle(health))
+	assert.Equal(t, SourceWeb, service.Active())
+
+	// the health of the other polls of the cycle is not counted
+
+	health.UpdateError(models.HealthCallParameters, time.Second, fmt.Errorf("connection reset"))
+	web.Endpoint().PublishHealth(device, health)
+	assert.Equal(t, SourceWeb, service.Active())
+
+	// failover after two failing cycles in a row
+
+	web.Endpoint().PublishHealth(device, failingCycle(health))
+	assert.Eventually(t, func() bool { return service.Active() == SourceApp }, time.Second, time.Millisecond)
+	service.workers.Wait()
+	app.AssertCalled(t, "StartPolling")
+
+	appHealth := okHealth()
+	appHealth.Send = false
+	app.Endpoint().PublishHealth(device, appHealth)
+	assert.Equal(t, SourceApp, appHealth.Source)
+	assert.True(t, appHealth.Send)
+
+	// failback after two successful cycles of the web api
+
+	health.UpdateSuccess(models.HealthCallParameters, time.Second)
+	web.Endpoint().PublishHealth(device, okCycle(health))
+	assert.Equal(t, SourceApp, service.Active())
+	web.Endpoint().PublishHealth(device, okCycle(health))
+	assert.Eventually(t, func() bool { return service.Active() == SourceWeb }, time.Second, time.Millisecond)
+	service.workers.Wait()
+	app.AssertCalled(t, "StopPolling")
+	mockEndpoint.AssertCalled(t, "SetDevices", []models.NoahDevicePayload{webDevice})
+
+	webHealth := okHealth()
+	web.Endpoint().PublishHealth(device, webHealth)
+	assert.Equal(t, SourceWeb, webHealth.Source)
+}
+
+func TestFailover_MultipleDevices(t *testing.T) {
+	service, web, app, mockEndpoint, device1 := setupAutoServiceMocks(t)
+	device2 := models.NoahDevicePayload{Serial: "device234", PlantId: 1}
+
+	web.On("StartPolling").Return(nil)
+	app.On("StartPolling").Return(nil)
+	app.On("StopPolling")
+	mockEndpoint.On("SetDevices", mock.Anything)
+	mockEndpoint.On("PublishHealth", mock.Anything, mock.Anything)
+
+	assert.NoError(t, service.StartPolling())
+	web.Endpoint().SetDevices([]models.NoahDevicePayload{device1, device2})
+
+	// the healthy device does not reset the failures of the other one
+
+	health1 := models.NewServiceHealth()
+	health2 := models.NewServiceHealth()
+	web.Endpoint().PublishHealth(device1, failingCycle(health1))
+	web.Endpoint().PublishHealth(device2, okCycle(health2))
+	assert.Equal(t, SourceWeb, service.Active())
+	web.Endpoint().PublishHealth(device1, failingCycle(health1))
+	assert.Eventually(t, func() bool { return service.Active() == SourceApp }, time.Second, time.Millisecond)
+	service.workers.Wait()
+
+	// failback once all devices recovered
+
+	web.Endpoint().PublishHealth(device2, okCycle(health2))
+	web.Endpoint().PublishHealth(device2, okCycle(health2))
+	web.Endpoint().PublishHealth(device1, okCycle(health1))
+	assert.Equal(t, SourceApp, service.Active())
+	web.Endpoint().PublishHealth(device1, okCycle(health1))
+	assert.Eventually(t, func() bool { return service.Active() == SourceWeb }, time.Second, time.Millisecond)
+	service.workers.Wait()
+}
+
+func TestFailover_AppFails(t *testing.T) {
+	service, web, app, mockEndpoint, device := setupAutoServiceMocks(t)
+
+	web.On("StartPolling").Return(nil)
+	app.On("StartPolling").Return(errors.New("app fails as well"))
+	mockEndpoint.On("PublishHealth", device, mock.Anything)
+
+	assert.NoError(t, service.StartPolling())
+
+	health := models.NewServiceHealth()
+	web.Endpoint().PublishHealth(device, failingCycle(health))
+	web.Endpoint().PublishHealth(device, failingCycle(health))
+	service.workers.Wait()
+
+	app.AssertCalled(t, "StartPolling")
+	assert.Equal(t, SourceWeb, service.Active())
+}
+
+func TestStartPolling_WebFails(t *testing.T) {
+	service, web, app, _, _ := setupAutoServiceMocks(t)
+
+	web.On("StartPolling").Return(errors.New("no nexa devices found")).Once()
+	web.On("StartPolling").Return(nil)
+	app.On("StartPolling").Return(nil)
+
+	assert.NoError(t, service.StartPolling())
+	assert.Equal(t, SourceApp, service.Active())
+
+	// the web api is started in the background
+	service.workers.Wait()
+	web.AssertNumberOfCalls(t, "StartPolling", 2)
+}
+
+func TestStartPolling_BothFail(t *testing.T) {
+	service, web, app, _, _ := setupAutoServiceMocks(t)
+
+	web.On("StartPolling").Return(errors.New("web fails"))
+	app.On("StartPolling").Return(errors.New("app fails"))
+
+	err := service.StartPolling()
+
+	assert.ErrorContains(t, err, "web fails")
+	assert.ErrorContains(t, err, "app fails")
+	assert.Equal(t, SourceWeb, service.Active())
+}
+
+func TestParameterApplier_ActiveSource(t *testing.T) {
+	service, web, app, _, device := setupAutoServiceMocks(t)
+
+	web.On("SetChargingLimits", device, 90.0, 10.0).Return(nil)
+	app.On("SetChargingLimits", device, 95.0, 5.0).Return(nil)
+
+	assert.NoError(t, service.SetChargingLimits(device, 90, 10))
+
+	service.switchTo(SourceApp)
+	assert.NoError(t, service.SetChargingLimits(device, 95, 5))
+
+	web.AssertExpectations(t)
+	app.AssertExpectations(t)
+}
+
+func TestRefresher_ActiveSource(t *testing.T) {
+	service, web, app, _, device := setupAutoServiceMocks(t)
+
+	web.On("Refresh", device).Return(nil).Once()
+	app.On("Refresh", device).Return(nil).Once()
+	app.On("Reenumerate", device).Return(nil).Once()
+
+	assert.NoError(t, service.Refresh(device))
+
+	service.switchTo(SourceApp)
+	assert.NoError(t, service.Refresh(device))
+	assert.NoError(t, service.Reenumerate(device))
+
+	web.AssertExpectations(t)
+	app.AssertExpectations(t)
+}
@@ -0,0 +1,129 @@
+package growatt_web
+
+import (
+	"context"
+	"log/slog"
+	"nexa-mqtt/internal/backfill"
+	"nexa-mqtt/pkg/models"
+	"slices"
+	"time"
+)
+
+// SetBackfill enables the backfill of gaps in the polled history data to
+// sink. state keeps the time of the last polled sample of each device. A nil
+// sink or state disables the backfill.
+func (g *GrowattService) SetBackfill(sink backfill.Sink, state *backfill.State) {
+	g.historyLock.Lock()
+	defer g.historyLock.Unlock()
+	g.backfillSink = sink
+	g.backfillState = state
+}
+
+// Backfill writes the history samples of the device after from up to and
+// including to, oldest first, to sink. It returns the number of written
+// samples.
+func (g *GrowattService) Backfill(ctx context.Context, device models.NoahDevicePayload, from time.Time, to time.Time, sink backfill.Sink) (int, error) {
+	startDate := from.In(g.opts.Location).Format("2006-01-02")
+	endDate := to.In(g.opts.Location).Format("2006-01-02")
+	slog.Info("backfilling history (web)", slog.String("device", device.Serial), slog.Time("from", from), slog.Time("to", to))
+
+	var samples []models.HistorySample
+	start := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		history, err := g.client.GetNoahHistoryPage(device.Serial, startDate, endDate, start)
+		if err != nil {
+			slog.Error("could not get device history", slog.String("error", err.Error()), slog.String("device", device.Serial), slog.Int("start", start))
+			return 0, err
+		}
+
+		for _, historyData := range history.Obj.Datas {
+			tm, err := time.ParseInLocation("2006-01-02 15:04:05", historyData.Time, g.opts.Location)
+			if err != nil {
+				slog.Warn("skipping history data with invalid time", slog.String("device", device.Serial), slog.String("time", historyData.Time))
+				continue
+			}
+			if tm.After(from) && !tm.After(to) {
+				samples = append(samples, historySample(device, historyData, tm))
+			}
+		}
+
+		// stop if the next page would not move on, instead of requesting the same page forever
+		if !history.Obj.HaveNext || len(history.Obj.Datas) == 0 || history.Obj.Start <= start {
+			break
+		}
+		start = history.Obj.Start
+	}
+
+	// the history is sorted newest first, pages may overlap
+	slices.SortFunc(samples, func(a, b models.HistorySample) int { return a.Time.Compare(b.Time) })
+	samples = slices.CompactFunc(samples, func(a, b models.HistorySample) bool { return a.Time.Equal(b.Time) })
+
+	for i, sample := range samples {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := sink.WriteSample(device, sample); err != nil {
+			slog.Error("could not write backfill sample", slog.String("error", err.Error()), slog.String("device", device.Serial), slog.Time("time", sample.Time))
+			return i, err
+		}
+	}
+
+	slog.Info("backfill complete (web)", slog.String("device", device.Serial), slog.Int("samples", len(samples)))
+	return len(samples), nil
+}
+
+// backfillGap records tm as the last polled sample of the device. If there is
+// a gap of more than two battery polling intervals since the previous sample,
+// e.g. because nexa-mqtt, the broker or the Growatt API was down, the gap is
+// backfilled in the background.
+func (g *GrowattService) backfillGap(ctx context.Context, device models.NoahDevicePayload, tm time.Time) {
+	g.historyLock.Lock()
+	sink := g.backfillSink
+	state := g.backfillState
+	g.historyLock.Unlock()
+
+	if sink == nil || state == nil || tm.IsZero() {
+		return
+	}
+
+	previous := state.Seen(device.Serial, tm)
+	if previous.IsZero() || tm.Sub(previous) <= 2*g.opts.BatteryDetailsPollingInterval {
+		return
+	}
+
+	from := previous
+	if g.opts.BackfillMaxAge > 0 && tm.Sub(from) > g.opts.BackfillMaxAge {
+		slog.Warn("gap is older than the maximum backfill age, backfilling only the newest part", slog.String("device", device.Serial), slog.Time("previous", previous), slog.String("maxAge", g.opts.BackfillMaxAge.String()))
+		from = tm.Add(-g.opts.BackfillMaxAge)
+	}
+
+	// the sample at tm was published by the poller
+	to := tm.Add(-time.Second)
+	g.pollers.Add(1)
+	go func() {
+		defer g.pollers.Done()
+		if _, err := g.Backfill(ctx, device, from, to, sink); err != nil {
+			slog.Warn("backfill failed", slog.String("device", device.Serial), slog.String("error", err.Error()))
+		}
+	}()
+}
+
+// BackfillAll writes the history samples of all devices after from up to and
+// including to, oldest first, to sink.
+func (g *GrowattService) BackfillAll(ctx context.Context, from time.Time, to time.Time, sink backfill.Sink) error {
+	devices, err := g.enumerateDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if _, err := g.Backfill(ctx, device, from, to, sink); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package growatt_web
+
+import (
+	"context"
+	"errors"
+	"nexa-mqtt/internal/backfill"
+	"nexa-mqtt/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSink implements backfill.Sink
+type MockSink struct {
+	mock.Mock
+}
+
+func (m *MockSink) WriteSample(device models.NoahDevicePayload, sample models.HistorySample) error {
+	args := m.Called(device, sample)
+	return args.Error(0)
+}
+
+func historyRow(tm time.Time, soc int) GrowattNoahHistoryData {
+	return GrowattNoahHistoryData{Time: tm.Format("2006-01-02 15:04:05"), TotalBatteryPackSoc: soc}
+}
+
+func matchSample(tm time.Time, soc float64) func(models.HistorySample) bool {
+	return func(s models.HistorySample) bool { return s.Time.Equal(tm) && s.Device.Soc == soc }
+}
+
+func Test_Backfill_Pages(t *testing.T) {
+	mockHttpClient, service, device, _ := setupGrowattServiceMocks(t)
+	sink := &MockSink{}
+
+	from := time.Date(2025, 5, 20, 8, 0, 0, 0, time.Local)
+	to := time.Date(2025, 5, 21, 9, 0, 0, 0, time.Local)
+	t1 := from.Add(3 * time.Minute)
+	t2 := from.Add(6 * time.Minute)
+	t3 := to
+
+	// newest first, the second page repeats the last row of the first page
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-21", 0, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas:    []GrowattNoahHistoryData{historyRow(to.Add(3*time.Minute), 90), historyRow(t3, 80), historyRow(t2, 70)},
+		Start:    3,
+		HaveNext: true,
+	}}, nil).Once()
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-21", 3, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas: []GrowattNoahHistoryData{historyRow(t2, 70), historyRow(t1, 60), historyRow(from, 50), {Time: "invalid"}},
+		Start: 7,
+	}}, nil).Once()
+
+	var written []time.Time
+	record := func(args mock.Arguments) { written = append(written, args.Get(1).(models.HistorySample).Time) }
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(t1, 60))).Run(record).Return(nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(t2, 70))).Run(record).Return(nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(t3, 80))).Run(record).Return(nil).Once()
+
+	n, err := service.Backfill(context.Background(), device, from, to, sink)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []time.Time{t1, t2, t3}, written)
+	mockHttpClient.AssertExpectations(t)
+	sink.AssertExpectations(t)
+}
+
+func Test_Backfill_StartDoesNotAdvance(t *testing.T) {
+	mockHttpClient, service, device, _ := setupGrowattServiceMocks(t)
+	sink := &MockSink{}
+
+	from := time.Date(2025, 5, 20, 8, 0, 0, 0, time.Local)
+	to := from.Add(time.Hour)
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-20", 0, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas:    []GrowattNoahHistoryData{historyRow(to, 80)},
+		Start:    0,
+		HaveNext: true,
+	}}, nil).Once()
+	sink.On("WriteSample", device, mock.Anything).Return(nil).Once()
+
+	n, err := service.Backfill(context.Background(), device, from, to, sink)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	mockHttpClient.AssertExpectations(t)
+	sink.AssertExpectations(t)
+}
+
+func Test_Backfill_Errors(t *testing.T) {
+	mockHttpClient, service, device, _ := setupGrowattServiceMocks(t)
+	sink := &MockSink{}
+
+	from := time.Date(2025, 5, 20, 8, 0, 0, 0, time.Local)
+	to := from.Add(time.Hour)
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-20", 0, GrowattNoahHistory{}, errors.New("GetNoahHistory fails")).Once()
+
+	n, err := service.Backfill(context.Background(), device, from, to, sink)
+	assert.EqualError(t, err, "GetNoahHistory fails")
+	assert.Equal(t, 0, n)
+
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-20", 0, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas: []GrowattNoahHistoryData{historyRow(to, 80), historyRow(from.Add(time.Minute), 70)},
+	}}, nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(from.Add(time.Minute), 70))).Return(nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(to, 80))).Return(errors.New("sink fails")).Once()
+
+	n, err = service.Backfill(context.Background(), device, from, to, sink)
+	assert.EqualError(t, err, "sink fails")
+	assert.Equal(t, 1, n)
+
+	mockHttpClient.AssertExpectations(t)
+	sink.AssertExpectations(t)
+}
+
+func Test_backfillGap(t *testing.T) {
+	mockHttpClient, service, device, _ := setupGrowattServiceMocks(t)
+	sink := &MockSink{}
+	state, err := backfill.NewState("")
+	assert.NoError(t, err)
+	service.opts.BatteryDetailsPollingInterval = 3 * time.Minute
+	service.SetBackfill(sink, state)
+
+	t0 := time.Date(2025, 5, 20, 8, 0, 0, 0, time.Local)
+	t1 := t0.Add(3 * time.Minute)
+	t2 := t1.Add(time.Hour)
+
+	// the first sample and a sample without gap are not backfilled
+	service.backfillGap(context.Background(), device, t0)
+	service.backfillGap(context.Background(), device, t1)
+	service.backfillGap(context.Background(), device, time.Time{})
+	service.pollers.Wait()
+
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-20", "2025-05-20", 0, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas: []GrowattNoahHistoryData{historyRow(t2, 80), historyRow(t2.Add(-3*time.Minute), 70), historyRow(t1, 60)},
+	}}, nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(t2.Add(-3*time.Minute), 70))).Return(nil).Once()
+
+	service.backfillGap(context.Background(), device, t2)
+	service.pollers.Wait()
+
+	assert.Equal(t, t2, state.Seen(device.Serial, t2))
+	mockHttpClient.AssertExpectations(t)
+	sink.AssertExpectations(t)
+}
+
+func Test_backfillGap_MaxAge(t *testing.T) {
+	mockHttpClient, service, device, _ := setupGrowattServiceMocks(t)
+	sink := &MockSink{}
+	state, err := backfill.NewState("")
+	assert.NoError(t, err)
+	service.opts.BatteryDetailsPollingInterval = 3 * time.Minute
+	service.opts.BackfillMaxAge = 24 * time.Hour
+	service.SetBackfill(sink, state)
+
+	t0 := time.Date(2025, 5, 18, 8, 0, 0, 0, time.Local)
+	t1 := time.Date(2025, 5, 20, 8, 0, 0, 0, time.Local)
+	service.backfillGap(context.Background(), device, t0)
+
+	mockHttpClient.OnGetNoahHistoryPage(device.Serial, "2025-05-19", "2025-05-20", 0, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{
+		Datas: []GrowattNoahHistoryData{historyRow(t1, 80), historyRow(t1.Add(-3*time.Minute), 70), historyRow(t1.Add(-24*time.Hour), 60)},
+	}}, nil).Once()
+	sink.On("WriteSample", device, mock.MatchedBy(matchSample(t1.Add(-3*time.Minute), 70))).Return(nil).Once()
+
+	service.backfillGap(context.Background(), device, t1)
+	service.pollers.Wait()
+
+	mockHttpClient.AssertExpectations(t)
+	sink.AssertExpectations(t)
+}
@@ -4,11 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"math"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"nexa-mqtt/internal/logging"
 	"nexa-mqtt/internal/misc"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,6 +32,7 @@ func newClient(serverUrl string, username string, password string) *Client {
 	}
 
 	slog.Info("setting server url (web)", slog.String("url", serverUrl))
+	logging.AddSecret(password)
 
 	return &Client{
 		client: &httpClient{
@@ -54,7 +58,7 @@ func (c *Client) postForm(url string, data url.Values, responseBody any) error {
 			slog.Warn("re-login (web)", slog.String("error", err.Error()))
 			if err := c.Login(); err != nil {
 				slog.Error("could not re-login", slog.String("error", err.Error()))
-				misc.Panic(err)
+				return fmt.Errorf("could not re-login: %w", err)
 			}
 			return c.postForm(url, data, responseBody)
 		} else {
@@ -74,11 +78,34 @@ func (c *Client) Login() error {
 		return err
 	}
 	if result.Result < 0 {
+		if misc.IsInvalidCredentialsMessage(result.Msg) {
+			return fmt.Errorf("%w: %s", misc.ErrInvalidCredentials, result.Msg)
+		}
 		return errors.New(result.Msg)
 	}
+	c.addSessionSecrets()
 	return nil
 }
 
+// addSessionSecrets keeps the session cookies out of the log output
+func (c *Client) addSessionSecrets() {
+	if c.jar == nil {
+		return
+	}
+	u, err := url.Parse(c.serverUrl)
+	if err != nil {
+		return
+	}
+	for _, cookie := range c.jar.Cookies(u) {
+		logging.AddSecret(cookie.Value)
+	}
+}
+
+// maxPages limits the pages requested from a paged list, in case the server
+// keeps announcing more pages
+const maxPages = 100
+
+// GetPlantList returns all plants of the account. The list is not paged.
 func (c *Client) GetPlantList() ([]GrowattPlant, error) {
 	var result []GrowattPlant
 	if err := c.postForm(c.serverUrl+"/index/getPlantListTitle", url.Values{}, &result); err != nil {
@@ -87,41 +114,76 @@ func (c *Client) GetPlantList() ([]GrowattPlant, error) {
 	return result, nil
 }
 
+// GetPlantDevices returns the devices of all pages of the plant
 func (c *Client) GetPlantDevices(plantId string) (*GrowattPlantDevices, error) {
-	var result GrowattPlantDevices
-	if err := c.postForm(c.serverUrl+"/panel/getDevicesByPlantList", url.Values{
-		"plantId":  {plantId},
-		"currPage": {"1"},
-	}, &result); err != nil {
-		return nil, err
+	var devices GrowattPlantDevices
+	for page := 1; page <= maxPages; page++ {
+		var result GrowattPlantDevices
+		if err := c.postForm(c.serverUrl+"/panel/getDevicesByPlantList", url.Values{
+			"plantId":  {plantId},
+			"currPage": {strconv.Itoa(page)},
+		}, &result); err != nil {
+			return nil, err
+		}
+
+		if page == 1 {
+			devices = result
+		} else {
+			devices.Obj.Datas = append(devices.Obj.Datas, result.Obj.Datas...)
+		}
+		if page >= result.Obj.Pages || len(result.Obj.Datas) == 0 {
+			break
+		}
 	}
-	return &result, nil
+	return &devices, nil
 }
 
+// GetNoahList returns the NOAH/NEXA devices of all pages of the plant
 func (c *Client) GetNoahList(plantId int) (*GrowattNoahList, error) {
-	var result GrowattNoahList
-	if err := c.postForm(c.serverUrl+"/device/getNoahList", url.Values{
-		"plantId":  {fmt.Sprintf("%d", plantId)},
-		"currPage": {"1"},
-	}, &result); err != nil {
-		return nil, err
-	}
-	return &result, nil
+	return c.getNoahList(url.Values{
+		"plantId": {fmt.Sprintf("%d", plantId)},
+	})
 }
 
 func (c *Client) GetNoahDetails(plantId int, serial string) (*GrowattNoahList, error) {
-	var result GrowattNoahList
-	if err := c.postForm(c.serverUrl+"/device/getNoahList", url.Values{
+	return c.getNoahList(url.Values{
 		"plantId":  {fmt.Sprintf("%d", plantId)},
 		"deviceSn": {serial},
-		"currPage": {"1"},
-	}, &result); err != nil {
-		return nil, err
+	})
+}
+
+// getNoahList requests all pages of the noah list filtered by values and
+// returns them as one list
+func (c *Client) getNoahList(values url.Values) (*GrowattNoahList, error) {
+	var list GrowattNoahList
+	for page := 1; page <= maxPages; page++ {
+		data := url.Values{"currPage": {strconv.Itoa(page)}}
+		maps.Copy(data, values)
+
+		var result GrowattNoahList
+		if err := c.postForm(c.serverUrl+"/device/getNoahList", data, &result); err != nil {
+			return nil, err
+		}
+
+		if page == 1 {
+			list = result
+		} else {
+			list.Datas = append(list.Datas, result.Datas...)
+		}
+		if page >= result.Pages || len(result.Datas) == 0 {
+			break
+		}
 	}
-	return &result, nil
+	return &list, nil
 }
 
 func (c *Client) GetNoahHistory(serial string, startDate string, endDate string) (*GrowattNoahHistory, error) {
+	return c.GetNoahHistoryPage(serial, startDate, endDate, 0)
+}
+
+// GetNoahHistoryPage returns the history rows from start on, newest first. If
+// Obj.HaveNext is set, Obj.Start is the start of the next page.
+func (c *Client) GetNoahHistoryPage(serial string, startDate string, endDate string, start int) (*GrowattNoahHistory, error) {
 	if startDate == "" {
 		startDate = time.Now().Format("2006-01-02")
 	}
@@ -131,7 +193,7 @@ func (c *Client) GetNoahHistory(serial string, startDate string, endDate string)
 	var result GrowattNoahHistory
 	if err := c.postForm(c.serverUrl+"/device/getNoahHistory", url.Values{
 		"deviceSn":  {serial},
-		"start":     {"0"},
+		"start":     {strconv.Itoa(start)},
 		"startDate": {startDate},
 		"endDate":   {endDate},
 	}, &result); err != nil {
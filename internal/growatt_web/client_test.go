@@ -4,6 +4,8 @@ import (
 	"errors"
 	"net/http/cookiejar"
 	"net/url"
+	"nexa-mqtt/internal/misc"
+	"slices"
 	"testing"
 	"time"
 
@@ -95,14 +97,10 @@ func Test_postForm_RetryLoginFails(t *testing.T) {
 
 	mockHttpClient.OnLogin("user", "secret", GrowattResult{}, errors.New("login failed"))
 
-	defer func() {
-		if r := recover(); r != nil {
-			mockHttpClient.AssertExpectations(t)
-		}
-	}()
+	err := client.postForm("http://someurl", url.Values{}, nil)
 
-	client.postForm("http://someurl", url.Values{}, nil)
-	t.Errorf("Test failed, panic was expected")
+	assert.ErrorContains(t, err, "could not re-login")
+	mockHttpClient.AssertExpectations(t)
 }
 
 func TestLogin_Ok(t *testing.T) {
@@ -125,6 +123,16 @@ func TestLogin_ErrResult(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestLogin_InvalidCredentials(t *testing.T) {
+	mockHttpClient, client := setupClientMocks(t)
+
+	mockHttpClient.OnLogin("user", "secret", GrowattResult{Response[any]{Result: -1, Msg: "502"}}, nil)
+
+	err := client.Login()
+
+	assert.ErrorIs(t, err, misc.ErrInvalidCredentials)
+}
+
 func TestLogin_Fails(t *testing.T) {
 	mockHttpClient, client := setupClientMocks(t)
 
@@ -185,6 +193,54 @@ func TestGetPlantDevices_Fails(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetPlantDevices_Pages(t *testing.T) {
+	mockHttpClient, client := setupClientMocks(t)
+
+	page1 := GrowattPlantDevices{}
+	page1.Obj.Pages = 2
+	page1.Obj.Datas = make([]struct {
+		DeviceType      string `json:"deviceType"`
+		PtoStatus       string `json:"ptoStatus"`
+		ShellyDeviceSn  string `json:"shellyDeviceSn"`
+		TimeServer      string `json:"timeServer"`
+		AccountName     string `json:"accountName"`
+		Timezone        string `json:"timezone"`
+		PlantID         string `json:"plantId"`
+		DeviceTypeName  string `json:"deviceTypeName"`
+		NominalPower    string `json:"nominalPower"`
+		BdcStatus       string `json:"bdcStatus"`
+		EToday          string `json:"eToday"`
+		EMonth          string `json:"eMonth"`
+		DatalogTypeTest string `json:"datalogTypeTest"`
+		ETotal          string `json:"eTotal"`
+		Pac             string `json:"pac"`
+		DatalogSn       string `json:"datalogSn"`
+		Alias           string `json:"alias"`
+		Location        string `json:"location"`
+		DeviceModel     string `json:"deviceModel"`
+		Sn              string `json:"sn"`
+		PlantName       string `json:"plantName"`
+		Status          string `json:"status"`
+		LastUpdateTime  string `json:"lastUpdateTime"`
+	}, 2)
+	page1.Obj.Datas[0].Sn = "Serial1"
+	page1.Obj.Datas[1].Sn = "Serial2"
+	page2 := page1
+	page2.Obj.Datas = slices.Clone(page1.Obj.Datas[:1])
+	page2.Obj.Datas[0].Sn = "Serial3"
+
+	mockHttpClient.OnGetPlantDevicesPage("pid", 1, page1, nil).Once()
+	mockHttpClient.OnGetPlantDevicesPage("pid", 2, page2, nil).Once()
+
+	result, err := client.GetPlantDevices("pid")
+
+	assert.NoError(t, err)
+	assert.Len(t, result.Obj.Datas, 3)
+	assert.Equal(t, "Serial1", result.Obj.Datas[0].Sn)
+	assert.Equal(t, "Serial3", result.Obj.Datas[2].Sn)
+	mockHttpClient.AssertExpectations(t)
+}
+
 func TestGetNoahList_Ok(t *testing.T) {
 	mockHttpClient, client := setupClientMocks(t)
 
@@ -207,6 +263,52 @@ func TestGetNoahList_Fails(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestGetNoahList_Pages(t *testing.T) {
+	mockHttpClient, client := setupClientMocks(t)
+
+	mockHttpClient.OnGetNoahListPage(12, 1, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 1, Pages: 3, Count: 5, Datas: []GrowattNoahListData{{Sn: "Serial1"}, {Sn: "Serial2"}}}}, nil).Once()
+	mockHttpClient.OnGetNoahListPage(12, 2, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 2, Pages: 3, Count: 5, Datas: []GrowattNoahListData{{Sn: "Serial3"}, {Sn: "Serial4"}}}}, nil).Once()
+	mockHttpClient.OnGetNoahListPage(12, 3, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 3, Pages: 3, Count: 5, Datas: []GrowattNoahListData{{Sn: "Serial5"}}}}, nil).Once()
+
+	result, err := client.GetNoahList(12)
+
+	assert.NoError(t, err)
+	var serials []string
+	for _, d := range result.Datas {
+		serials = append(serials, d.Sn)
+	}
+	assert.Equal(t, []string{"Serial1", "Serial2", "Serial3", "Serial4", "Serial5"}, serials)
+	assert.Equal(t, 5, result.Count)
+	mockHttpClient.AssertExpectations(t)
+}
+
+func TestGetNoahList_PageFails(t *testing.T) {
+	mockHttpClient, client := setupClientMocks(t)
+
+	mockHttpClient.OnGetNoahListPage(12, 1, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 1, Pages: 2, Datas: []GrowattNoahListData{{Sn: "Serial1"}}}}, nil).Once()
+	mockHttpClient.OnGetNoahListPage(12, 2, GrowattNoahList{}, errors.New("GetNoahList fails")).Once()
+
+	result, err := client.GetNoahList(12)
+
+	assert.Nil(t, result)
+	assert.Error(t, err)
+	mockHttpClient.AssertExpectations(t)
+}
+
+func TestGetNoahList_EmptyPage(t *testing.T) {
+	mockHttpClient, client := setupClientMocks(t)
+
+	// a server announcing more pages than it delivers must not be requested forever
+	mockHttpClient.OnGetNoahListPage(12, 1, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 1, Pages: 1000, Datas: []GrowattNoahListData{{Sn: "Serial1"}}}}, nil).Once()
+	mockHttpClient.OnGetNoahListPage(12, 2, GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 2, Pages: 1000}}, nil).Once()
+
+	result, err := client.GetNoahList(12)
+
+	assert.NoError(t, err)
+	assert.Len(t, result.Datas, 1)
+	mockHttpClient.AssertExpectations(t)
+}
+
 func TestGetNoahDetails_Ok(t *testing.T) {
 	mockHttpClient, client := setupClientMocks(t)
 
@@ -0,0 +1,266 @@
+package growatt_web
+
+import (
+	"net/http"
+	"nexa-mqtt/internal/growatt_web/webtest"
+	"nexa-mqtt/internal/misc"
+	"nexa-mqtt/pkg/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// The tests in this file run the service against the fake Growatt web server,
+// so that the http client, the cookie jar and the re-login are exercised too.
+
+func setupWebtest(t *testing.T) (*webtest.Server, *GrowattService, *MockEndpoint) {
+	srv := webtest.NewServer("user", "secret")
+	t.Cleanup(srv.Close)
+
+	srv.AddPlant(webtest.Plant{Id: 1001, Name: "Home"})
+	srv.AddDevice(webtest.Device{
+		PlantId:      1001,
+		Serial:       "0PVP50ZR16ST00A1",
+		Alias:        "NEXA 2000",
+		Model:        "NEXA 2000",
+		Version:      "11.11.11.11",
+		Status:       6,
+		WorkMode:     0,
+		Soc:          55,
+		SolarPower:   420,
+		ACPower:      300,
+		BatteryPower: 120,
+		EacToday:     1.5,
+		EacTotal:     321.4,
+		Batteries: []webtest.Battery{
+			{Serial: "0PVPBAT000000001", Soc: 54, Temp: 21.5},
+			{Serial: "0PVPBAT000000002", Soc: 56, Temp: 22},
+		},
+		Parameters: webtest.Parameters{
+			ChargingSocHighLimit:        100,
+			ChargingSocLowLimit:         10,
+			DefaultMode:                 0,
+			DefaultACCouplePower:        200,
+			AntiBackflowPowerPercentage: 50,
+		},
+	})
+
+	endpoint := &MockEndpoint{}
+	service := NewGrowattService(Options{
+		ServerUrl:                     srv.URL,
+		Username:                      "user",
+		Password:                      "secret",
+		PollingInterval:               time.Minute,
+		BatteryDetailsPollingInterval: time.Minute,
+		ParameterPollingInterval:      time.Minute,
+		Location:                      time.UTC,
+	})
+	service.endpoint = endpoint
+
+	return srv, service, endpoint
+}
+
+func webtestDevice(t *testing.T, service *GrowattService) models.NoahDevicePayload {
+	devices, err := service.enumerateDevices()
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+	return devices[0]
+}
+
+func matchHealthErrorContains(msg string) func(h *models.ServiceHealth) bool {
+	return func(h *models.ServiceHealth) bool { return h.Status == "error" && strings.Contains(h.Message, msg) }
+}
+
+func TestWebtest_Login(t *testing.T) {
+	srv, service, _ := setupWebtest(t)
+
+	err := service.Login()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, srv.Logins())
+}
+
+func TestWebtest_LoginInvalidCredentials(t *testing.T) {
+	_, service, _ := setupWebtest(t)
+	service.client.password = "wrong"
+
+	err := service.Login()
+
+	assert.ErrorIs(t, err, misc.ErrInvalidCredentials)
+}
+
+func TestWebtest_EnumerateDevices(t *testing.T) {
+	srv, service, _ := setupWebtest(t)
+	srv.PageSize = 2
+	srv.AddPlant(webtest.Plant{Id: 1002, Name: "Garden"})
+	for _, serial := range []string{"0PVP50ZR16ST00B1", "0PVP50ZR16ST00B2", "0PVP50ZR16ST00B3"} {
+		srv.AddDevice(webtest.Device{PlantId: 1002, Serial: serial, Alias: serial, Batteries: []webtest.Battery{{Serial: "bat"}}})
+	}
+	assert.NoError(t, service.Login())
+
+	devices, err := service.enumerateDevices()
+
+	assert.NoError(t, err)
+	var serials []string
+	for _, d := range devices {
+		serials = append(serials, d.Serial)
+	}
+	assert.Equal(t, []string{"0PVP50ZR16ST00A1", "0PVP50ZR16ST00B1", "0PVP50ZR16ST00B2", "0PVP50ZR16ST00B3"}, serials)
+	assert.Equal(t, 1001, devices[0].PlantId)
+	assert.Equal(t, "NEXA 2000", devices[0].Model)
+	assert.Len(t, devices[0].Batteries, 2)
+	assert.Equal(t, 2, srv.Requests(webtest.PathNoahList)-1, "second plant is requested in two pages")
+}
+
+func TestWebtest_PollStatus(t *testing.T) {
+	_, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+
+	endpoint.On("PublishDeviceStatus", device, mock.MatchedBy(func(p models.DevicePayload) bool {
+		return p.Soc == 55 && p.SolarPower == 420 && p.ACPower == 300 && p.ChargePower == 120 &&
+			p.BatteryNum == 2 && p.GenerationTotalEnergy == 321.4 && p.Status == models.OnGrid
+	})).Once()
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthOk)).Once()
+
+	service.pollStatus(device)
+
+	endpoint.AssertExpectations(t)
+}
+
+func TestWebtest_PollBatteryDetails(t *testing.T) {
+	_, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+
+	endpoint.On("PublishBatteryDetails", device, mock.MatchedBy(func(b []models.BatteryPayload) bool {
+		return len(b) == 2 && b[0].SerialNumber == "0PVPBAT000000001" && b[1].Soc == 56 && b[1].Temperature == 22
+	})).Once()
+	endpoint.On("PublishPvDetails", device, mock.Anything).Once()
+	endpoint.On("PublishAlarms", device, mock.Anything).Once()
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthOk)).Once()
+
+	tm := service.pollBatteryDetails(device, time.Time{})
+
+	assert.WithinDuration(t, time.Now(), tm, time.Minute)
+	endpoint.AssertExpectations(t)
+}
+
+func TestWebtest_SetParameters(t *testing.T) {
+	srv, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthOk))
+	assert.NoError(t, service.SetChargingLimits(device, 90, 20))
+	assert.NoError(t, service.SetOutputPowerW(device, models.WorkModeBatteryFirst, 400))
+	assert.NoError(t, service.SetAllowGridCharging(device, models.ON))
+
+	p := srv.Device(device.Serial).Parameters
+	assert.Equal(t, 90, p.ChargingSocHighLimit)
+	assert.Equal(t, 20, p.ChargingSocLowLimit)
+	assert.Equal(t, 1, p.DefaultMode)
+	assert.Equal(t, 400, p.DefaultACCouplePower)
+	assert.Equal(t, 1, p.AllowGridCharging)
+
+	endpoint.On("PublishParameterData", device, mock.MatchedBy(func(p models.ParameterPayload) bool {
+		return *p.ChargingLimit == 90 && *p.DischargeLimit == 20 && *p.DefaultACCouplePower == 400
+	})).Once()
+
+	service.pollParameterData(device)
+
+	endpoint.AssertExpectations(t)
+}
+
+func TestWebtest_ReloginAfterSessionExpired(t *testing.T) {
+	srv, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+
+	srv.ExpireSessions()
+	endpoint.On("PublishParameterData", device, mock.Anything).Once()
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthOk)).Once()
+
+	service.pollParameterData(device)
+
+	assert.Equal(t, 2, srv.Logins())
+	endpoint.AssertExpectations(t)
+}
+
+func TestWebtest_ServerError(t *testing.T) {
+	srv, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+
+	srv.Inject(webtest.PathNoahStatus, webtest.Fault{Status: http.StatusInternalServerError, Body: "internal error", Count: 1})
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthErrorContains("HTTP 500"))).Once()
+
+	service.pollStatus(device)
+
+	endpoint.AssertExpectations(t)
+
+	// the fault is used up
+	endpoint.On("PublishDeviceStatus", device, mock.Anything).Once()
+	endpoint.On("PublishHealth", device, mock.Anything).Once()
+
+	service.pollStatus(device)
+
+	endpoint.AssertExpectations(t)
+	assert.Equal(t, 2, srv.Requests(webtest.PathNoahStatus))
+}
+
+func TestWebtest_Timeout(t *testing.T) {
+	srv, service, endpoint := setupWebtest(t)
+	assert.NoError(t, service.Login())
+	device := webtestDevice(t, service)
+	service.client.client.(*httpClient).client.Timeout = 100 * time.Millisecond
+
+	srv.Inject(webtest.PathNoahList, webtest.Fault{Delay: 300 * time.Millisecond})
+	endpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthErrorContains("Client.Timeout"))).Once()
+
+	service.pollParameterData(device)
+
+	endpoint.AssertExpectations(t)
+}
+
+func TestWebtest_StartPolling(t *testing.T) {
+	srv, service, endpoint := setupWebtest(t)
+	service.opts.PollingInterval = 20 * time.Millisecond
+	assert.NoError(t, service.Login())
+
+	socs := make(chan float64, 100)
+	endpoint.On("SetDevices", mock.MatchedBy(func(d []models.NoahDevicePayload) bool { return len(d) == 1 })).Once()
+	endpoint.On("PublishDeviceStatus", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		socs <- args.Get(1).(models.DevicePayload).Soc
+	})
+	endpoint.On("PublishBatteryDetails", mock.Anything, mock.Anything)
+	endpoint.On("PublishPvDetails", mock.Anything, mock.Anything)
+	endpoint.On("PublishAlarms", mock.Anything, mock.Anything)
+	endpoint.On("PublishParameterData", mock.Anything, mock.Anything)
+	endpoint.On("PublishHealth", mock.Anything, mock.Anything)
+
+	assert.NoError(t, service.StartPolling(NewDefaultDurationCalculator(service)))
+	defer func() {
+		assert.NoError(t, service.Shutdown(t.Context()))
+	}()
+
+	assert.Equal(t, 55.0, <-socs)
+	srv.UpdateDevice("0PVP50ZR16ST00A1", func(d *webtest.Device) { d.Soc = 60 })
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case soc := <-socs:
+				if soc == 60 {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	endpoint.AssertExpectations(t)
+}
@@ -3,6 +3,7 @@ package growatt_web
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -66,12 +67,16 @@ func (m *MockHttpClient) OnGetPlantList(result []GrowattPlant, err error) *mock.
 }
 
 func (m *MockHttpClient) OnGetPlantDevices(plantId string, result GrowattPlantDevices, err error) *mock.Call {
+	return m.OnGetPlantDevicesPage(plantId, 1, result, err)
+}
+
+func (m *MockHttpClient) OnGetPlantDevicesPage(plantId string, page int, result GrowattPlantDevices, err error) *mock.Call {
 	call := m.On(
 		"postForm",
 		"https://openapi.growatt.com/panel/getDevicesByPlantList",
 		url.Values{
 			"plantId":  {plantId},
-			"currPage": {"1"},
+			"currPage": {strconv.Itoa(page)},
 		},
 		&GrowattPlantDevices{},
 	)
@@ -89,12 +94,16 @@ func (m *MockHttpClient) OnGetPlantDevices(plantId string, result GrowattPlantDe
 }
 
 func (m *MockHttpClient) OnGetNoahList(plantId int, result GrowattNoahList, err error) *mock.Call {
+	return m.OnGetNoahListPage(plantId, 1, result, err)
+}
+
+func (m *MockHttpClient) OnGetNoahListPage(plantId int, page int, result GrowattNoahList, err error) *mock.Call {
 	call := m.On(
 		"postForm",
 		"https://openapi.growatt.com/device/getNoahList",
 		url.Values{
 			"plantId":  {fmt.Sprintf("%d", plantId)},
-			"currPage": {"1"},
+			"currPage": {strconv.Itoa(page)},
 		},
 		&GrowattNoahList{},
 	)
@@ -136,12 +145,16 @@ func (m *MockHttpClient) OnGetNoahDetails(plantId int, serial string, result Gro
 }
 
 func (m *MockHttpClient) OnGetNoahHistory(serial string, startDate string, endDate string, result GrowattNoahHistory, err error) *mock.Call {
+	return m.OnGetNoahHistoryPage(serial, startDate, endDate, 0, result, err)
+}
+
+func (m *MockHttpClient) OnGetNoahHistoryPage(serial string, startDate string, endDate string, start int, result GrowattNoahHistory, err error) *mock.Call {
 	call := m.On(
 		"postForm",
 		"https://openapi.growatt.com/device/getNoahHistory",
 		url.Values{
 			"deviceSn":  {serial},
-			"start":     {"0"},
+			"start":     {strconv.Itoa(start)},
 			"startDate": {startDate},
 			"endDate":   {endDate},
 		},
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"nexa-mqtt/internal/misc"
 	"nexa-mqtt/pkg/models"
+	"strconv"
 	"time"
 )
 
@@ -29,39 +30,84 @@ func devicePayload(device models.NoahDevicePayload, status GrowattNoahStatusObj,
 		GenerationTodayEnergy: misc.ParseFloat(totals.EacToday),
 		WorkMode:              models.WorkModeFromString(status.WorkMode),
 		Status:                models.StatusFromString(status.Status),
+		Consumption:           consumptionPayload(status),
 	}
 	return payload
 }
 
+// consumptionPayload returns nil if neither a CT nor a smart plug is installed
+func consumptionPayload(status GrowattNoahStatusObj) *models.ConsumptionPayload {
+	ct := misc.ParseFlag(status.IsHaveCT)
+	smartPlug := misc.ParseFlag(status.GroplugFlag) || misc.ParseFlag(status.ShellyFlag) || misc.S2i(status.GroplugNum) > 0
+	if !ct && !smartPlug {
+		return nil
+	}
+
+	householdLoad := misc.ParseFloat(status.TotalHouseholdLoad)
+	householdLoadApartPlug := misc.ParseFloat(status.HouseholdLoadApartFromGroplug)
+	ctPower := misc.ParseFloat(status.CtSelfPower)
+	smartPlugPower := misc.ParseFloat(status.SmartSocketPower)
+	otherPower := misc.ParseFloat(status.OtherPower)
+	return &models.ConsumptionPayload{
+		CT:                     ct,
+		SmartPlug:              smartPlug,
+		HouseholdLoad:          &householdLoad,
+		HouseholdLoadApartPlug: &householdLoadApartPlug,
+		CTPower:                &ctPower,
+		SmartPlugPower:         &smartPlugPower,
+		OtherPower:             &otherPower,
+	}
+}
+
+// historyPayload returns the device values that are only part of the history data
+func historyPayload(historyData GrowattNoahHistoryData) models.DevicePayload {
+	soh := float64(historyData.BatterySoh)
+	return models.DevicePayload{
+		SystemTemperature: &historyData.SystemTemp,
+		MaxCellVoltage:    &historyData.MaxCellVoltage,
+		MinCellVoltage:    &historyData.MinCellVoltage,
+		BatterySoh:        &soh,
+		BatteryCycles:     &historyData.BatteryCycles,
+	}
+}
+
 func batteryPayload(historyData GrowattNoahHistoryData, tm time.Time, i int) models.BatteryPayload {
 	switch i {
 	case 0:
 		return models.BatteryPayload{
-			Time:         tm,
-			SerialNumber: historyData.Battery1SerialNum,
-			Soc:          float64(historyData.Battery1Soc),
-			Temperature:  historyData.Battery1Temp,
+			Time:          tm,
+			SerialNumber:  historyData.Battery1SerialNum,
+			Soc:           float64(historyData.Battery1Soc),
+			Temperature:   historyData.Battery1Temp,
+			WarnStatus:    &historyData.Battery1WarnStatus,
+			ProtectStatus: &historyData.Battery1ProtectStatus,
 		}
 	case 1:
 		return models.BatteryPayload{
-			Time:         tm,
-			SerialNumber: historyData.Battery2SerialNum,
-			Soc:          float64(historyData.Battery2Soc),
-			Temperature:  historyData.Battery2Temp,
+			Time:          tm,
+			SerialNumber:  historyData.Battery2SerialNum,
+			Soc:           float64(historyData.Battery2Soc),
+			Temperature:   historyData.Battery2Temp,
+			WarnStatus:    &historyData.Battery2WarnStatus,
+			ProtectStatus: &historyData.Battery2ProtectStatus,
 		}
 	case 2:
 		return models.BatteryPayload{
-			Time:         tm,
-			SerialNumber: historyData.Battery3SerialNum,
-			Soc:          float64(historyData.Battery3Soc),
-			Temperature:  historyData.Battery3Temp,
+			Time:          tm,
+			SerialNumber:  historyData.Battery3SerialNum,
+			Soc:           float64(historyData.Battery3Soc),
+			Temperature:   historyData.Battery3Temp,
+			WarnStatus:    &historyData.Battery3WarnStatus,
+			ProtectStatus: &historyData.Battery3ProtectStatus,
 		}
 	case 3:
 		return models.BatteryPayload{
-			Time:         tm,
-			SerialNumber: historyData.Battery4SerialNum,
-			Soc:          float64(historyData.Battery4Soc),
-			Temperature:  historyData.Battery4Temp,
+			Time:          tm,
+			SerialNumber:  historyData.Battery4SerialNum,
+			Soc:           float64(historyData.Battery4Soc),
+			Temperature:   historyData.Battery4Temp,
+			WarnStatus:    &historyData.Battery4WarnStatus,
+			ProtectStatus: &historyData.Battery4ProtectStatus,
 		}
 	}
 
@@ -103,6 +149,137 @@ func pvPayload(historyData GrowattNoahHistoryData, tm time.Time, i int) models.P
 	panic(fmt.Errorf("growatt_web.pvPayload: invalid index %d", i))
 }
 
+func meterPayload(historyData GrowattNoahHistoryData, tm time.Time) models.MeterPayload {
+	return models.MeterPayload{
+		Time:                tm,
+		Frequency:           historyData.Frequency,
+		ActivePower:         historyData.TotalActivePower,
+		ReactivePower:       historyData.TotalReactivePower,
+		ApparentPower:       historyData.TotalApparentPower,
+		PowerFactor:         historyData.TotalPowerFactor,
+		ForwardActiveEnergy: historyData.ForwardTotalActiveEnergy,
+		ReverseActiveEnergy: historyData.ReverseTotalActiveEnergy,
+		Phases: [3]models.MeterPhasePayload{
+			{
+				Voltage:       historyData.PhaseAVoltage,
+				Current:       historyData.PhaseACurrent,
+				ActivePower:   historyData.PhaseAActivePower,
+				ReactivePower: historyData.PhaseAReactivePower,
+				ApparentPower: historyData.PhaseAApparentPower,
+				PowerFactor:   historyData.PhaseAPowerFactor,
+			},
+			{
+				Voltage:       historyData.PhaseBVoltage,
+				Current:       historyData.PhaseBCurrent,
+				ActivePower:   historyData.PhaseBActivePower,
+				ReactivePower: historyData.PhaseBReactivePower,
+				ApparentPower: historyData.PhaseBApparentPower,
+				PowerFactor:   historyData.PhaseBPowerFactor,
+			},
+			{
+				Voltage:       historyData.PhaseCVoltage,
+				Current:       historyData.PhaseCCurrent,
+				ActivePower:   historyData.PhaseCActivePower,
+				ReactivePower: historyData.PhaseCReactivePower,
+				ApparentPower: historyData.PhaseCApparentPower,
+				PowerFactor:   historyData.PhaseCPowerFactor,
+			},
+		},
+	}
+}
+
+// batteryWarnNames and batteryProtectNames are the known meanings of the warn
+// and protect status bits of a battery. They follow the alarm layout of the
+// battery management system, the meaning of the other status fields is not
+// documented by Growatt.
+var (
+	batteryWarnNames = map[int]string{
+		1:  "high_voltage",
+		2:  "low_voltage",
+		3:  "high_temperature",
+		4:  "low_temperature",
+		7:  "high_discharge_current",
+		8:  "high_charge_current",
+		11: "internal_communication_failure",
+	}
+	batteryProtectNames = map[int]string{
+		1:  "cell_overvoltage",
+		2:  "cell_undervoltage",
+		3:  "over_temperature",
+		4:  "under_temperature",
+		7:  "discharge_overcurrent",
+		8:  "charge_overcurrent",
+		11: "system_error",
+	}
+)
+
+// alarmPayload decodes the diagnostic trouble code and the status bits of the
+// device and of the first batteries batteries into alarms
+func alarmPayload(historyData GrowattNoahHistoryData, tm time.Time, batteries int) models.AlarmPayload {
+	payload := models.NewAlarmPayload(tm)
+	if historyData.Dtc != 0 {
+		payload.Add(models.Alarm{
+			Name:     fmt.Sprintf("dtc_%d", historyData.Dtc),
+			Category: models.AlarmCategoryFault,
+			Source:   "dtc",
+			Code:     historyData.Dtc,
+		})
+	}
+	payload.AddBits("fault", models.AlarmCategoryFault, historyData.FaultStatus, nil)
+	payload.AddBits("pd_warn", models.AlarmCategoryWarning, historyData.PdWarnStatus, nil)
+	payload.AddBits("mppt_protect", models.AlarmCategoryProtection, historyData.MpptProtectStatus, nil)
+	payload.AddBits("ac_couple_warn", models.AlarmCategoryWarning, historyData.AcCoupleWarnStatus, nil)
+	payload.AddBits("ac_couple_protect", models.AlarmCategoryProtection, historyData.AcCoupleProtectStatus, nil)
+	for i := range min(batteries, 4) {
+		bat := batteryPayload(historyData, tm, i)
+		payload.AddBits(fmt.Sprintf("bat%d_warn", i), models.AlarmCategoryWarning, *bat.WarnStatus, batteryWarnNames)
+		payload.AddBits(fmt.Sprintf("bat%d_protect", i), models.AlarmCategoryProtection, *bat.ProtectStatus, batteryProtectNames)
+	}
+	return payload
+}
+
+// historySample returns the values of a history row. The device values that
+// are only part of the status data, e.g. the consumption, are missing.
+func historySample(device models.NoahDevicePayload, historyData GrowattNoahHistoryData, tm time.Time) models.HistorySample {
+	chargePower := 0.0
+	dischargePower := 0.0
+	if historyData.TotalBatteryPackChargingPower < 0 {
+		dischargePower = float64(-historyData.TotalBatteryPackChargingPower)
+	} else {
+		chargePower = float64(historyData.TotalBatteryPackChargingPower)
+	}
+
+	status := models.DevicePayload{
+		ACPower:               historyData.Pac,
+		SolarPower:            historyData.Ppv,
+		Soc:                   float64(historyData.TotalBatteryPackSoc),
+		ChargePower:           chargePower,
+		DischargePower:        dischargePower,
+		BatteryNum:            len(device.Batteries),
+		GenerationTotalEnergy: historyData.EacTotal,
+		GenerationTodayEnergy: historyData.EacToday,
+		WorkMode:              models.WorkModeFromString(strconv.Itoa(historyData.WorkMode)),
+		Status:                models.StatusFromString(strconv.Itoa(historyData.Status)),
+	}
+	status.UpdateHistoryFrom(historyPayload(historyData))
+
+	sample := models.HistorySample{
+		Time:   tm,
+		Device: status,
+	}
+	for i := range min(len(device.Batteries), 4) {
+		sample.Batteries = append(sample.Batteries, batteryPayload(historyData, tm, i))
+	}
+	for i := range 4 {
+		sample.Pvs = append(sample.Pvs, pvPayload(historyData, tm, i))
+	}
+	if historyData.EastronFlag != 0 {
+		meter := meterPayload(historyData, tm)
+		sample.Meter = &meter
+	}
+	return sample
+}
+
 func parameterPayload(detailsData GrowattNoahListData) models.ParameterPayload {
 	cl := misc.ParseFloat(detailsData.ChargingSocHighLimit)
 	dl := misc.ParseFloat(detailsData.ChargingSocLowLimit)
@@ -37,62 +37,112 @@ func Test_devicePayload(t *testing.T) {
 	assert.Equal(t, 4.2, payload.GenerationTodayEnergy)
 	assert.Equal(t, models.WorkMode(models.WorkModeBatteryFirst), payload.WorkMode)
 	assert.Equal(t, models.SmartSelfUse, payload.Status)
+	assert.Nil(t, payload.Consumption)
+}
+
+func Test_consumptionPayload(t *testing.T) {
+	status := GrowattNoahStatusObj{
+		IsHaveCT:                      "1",
+		ShellyFlag:                    "0",
+		GroplugFlag:                   "0",
+		GroplugNum:                    "1",
+		TotalHouseholdLoad:            "412.5",
+		HouseholdLoadApartFromGroplug: "300",
+		CtSelfPower:                   "-120",
+		SmartSocketPower:              "112.5",
+		OtherPower:                    "300",
+	}
+
+	payload := consumptionPayload(status)
+
+	assert.True(t, payload.CT)
+	assert.True(t, payload.SmartPlug)
+	assert.Equal(t, 412.5, *payload.HouseholdLoad)
+	assert.Equal(t, 300.0, *payload.HouseholdLoadApartPlug)
+	assert.Equal(t, -120.0, *payload.CTPower)
+	assert.Nil(t, payload.GridPower)
+	assert.Equal(t, 112.5, *payload.SmartPlugPower)
+	assert.Equal(t, 300.0, *payload.OtherPower)
+
+	payload = consumptionPayload(GrowattNoahStatusObj{IsHaveCT: "0", ShellyFlag: "1", GroplugNum: "0"})
+	assert.False(t, payload.CT)
+	assert.True(t, payload.SmartPlug)
+
+	assert.Nil(t, consumptionPayload(GrowattNoahStatusObj{IsHaveCT: "0", ShellyFlag: "0", GroplugFlag: "0", GroplugNum: "0"}))
 }
 
 func Test_batteryPayload(t *testing.T) {
 	historyData := GrowattNoahHistoryData{
-		Battery1SerialNum: "Serial123",
-		Battery1Soc:       44,
-		Battery1Temp:      35.0,
+		Battery1SerialNum:     "Serial123",
+		Battery1Soc:           44,
+		Battery1Temp:          35.0,
+		Battery1WarnStatus:    1,
+		Battery1ProtectStatus: 10,
 
-		Battery2SerialNum: "Serial223",
-		Battery2Soc:       55,
-		Battery2Temp:      36.0,
+		Battery2SerialNum:     "Serial223",
+		Battery2Soc:           55,
+		Battery2Temp:          36.0,
+		Battery2WarnStatus:    2,
+		Battery2ProtectStatus: 20,
 
-		Battery3SerialNum: "Serial323",
-		Battery3Soc:       66,
-		Battery3Temp:      37.0,
+		Battery3SerialNum:     "Serial323",
+		Battery3Soc:           66,
+		Battery3Temp:          37.0,
+		Battery3WarnStatus:    3,
+		Battery3ProtectStatus: 30,
 
-		Battery4SerialNum: "Serial423",
-		Battery4Soc:       77,
-		Battery4Temp:      38.0,
+		Battery4SerialNum:     "Serial423",
+		Battery4Soc:           77,
+		Battery4Temp:          38.0,
+		Battery4WarnStatus:    4,
+		Battery4ProtectStatus: 40,
 	}
 	tm := time.Now().Truncate(time.Second)
+	warnStatus := []int{1, 2, 3, 4}
+	protectStatus := []int{10, 20, 30, 40}
 
 	payload := batteryPayload(historyData, tm, 0)
 
 	assert.Equal(t, models.BatteryPayload{
-		Time:         tm,
-		SerialNumber: "Serial123",
-		Soc:          44.0,
-		Temperature:  35.0,
+		Time:          tm,
+		SerialNumber:  "Serial123",
+		Soc:           44.0,
+		Temperature:   35.0,
+		WarnStatus:    &warnStatus[0],
+		ProtectStatus: &protectStatus[0],
 	}, payload)
 
 	payload = batteryPayload(historyData, tm, 1)
 
 	assert.Equal(t, models.BatteryPayload{
-		Time:         tm,
-		SerialNumber: "Serial223",
-		Soc:          55.0,
-		Temperature:  36.0,
+		Time:          tm,
+		SerialNumber:  "Serial223",
+		Soc:           55.0,
+		Temperature:   36.0,
+		WarnStatus:    &warnStatus[1],
+		ProtectStatus: &protectStatus[1],
 	}, payload)
 
 	payload = batteryPayload(historyData, tm, 2)
 
 	assert.Equal(t, models.BatteryPayload{
-		Time:         tm,
-		SerialNumber: "Serial323",
-		Soc:          66.0,
-		Temperature:  37.0,
+		Time:          tm,
+		SerialNumber:  "Serial323",
+		Soc:           66.0,
+		Temperature:   37.0,
+		WarnStatus:    &warnStatus[2],
+		ProtectStatus: &protectStatus[2],
 	}, payload)
 
 	payload = batteryPayload(historyData, tm, 3)
 
 	assert.Equal(t, models.BatteryPayload{
-		Time:         tm,
-		SerialNumber: "Serial423",
-		Soc:          77.0,
-		Temperature:  38.0,
+		Time:          tm,
+		SerialNumber:  "Serial423",
+		Soc:           77.0,
+		Temperature:   38.0,
+		WarnStatus:    &warnStatus[3],
+		ProtectStatus: &protectStatus[3],
 	}, payload)
 
 	defer func() {
@@ -104,6 +154,130 @@ func Test_batteryPayload(t *testing.T) {
 	t.Errorf("Test failed, panic was expected")
 }
 
+func Test_historyPayload(t *testing.T) {
+	historyData := GrowattNoahHistoryData{
+		SystemTemp:     31.5,
+		MaxCellVoltage: 3.342,
+		MinCellVoltage: 3.301,
+		BatterySoh:     98,
+		BatteryCycles:  112,
+	}
+
+	payload := historyPayload(historyData)
+
+	assert.Equal(t, 31.5, *payload.SystemTemperature)
+	assert.Equal(t, 3.342, *payload.MaxCellVoltage)
+	assert.Equal(t, 3.301, *payload.MinCellVoltage)
+	assert.Equal(t, 98.0, *payload.BatterySoh)
+	assert.Equal(t, 112, *payload.BatteryCycles)
+}
+
+func Test_meterPayload(t *testing.T) {
+	historyData := GrowattNoahHistoryData{
+		Frequency:                50.02,
+		TotalActivePower:         -412.3,
+		TotalPowerFactor:         0.98,
+		ForwardTotalActiveEnergy: 1234.5,
+		ReverseTotalActiveEnergy: 321.9,
+		PhaseAVoltage:            230.1,
+		PhaseBCurrent:            1.8,
+		PhaseCActivePower:        -412.3,
+		PhaseCPowerFactor:        0.97,
+	}
+	tm := time.Now().Truncate(time.Second)
+
+	payload := meterPayload(historyData, tm)
+
+	assert.Equal(t, tm, payload.Time)
+	assert.Equal(t, 50.02, payload.Frequency)
+	assert.Equal(t, -412.3, payload.ActivePower)
+	assert.Equal(t, 0.98, payload.PowerFactor)
+	assert.Equal(t, 1234.5, payload.ForwardActiveEnergy)
+	assert.Equal(t, 321.9, payload.ReverseActiveEnergy)
+	assert.Equal(t, 230.1, payload.Phases[0].Voltage)
+	assert.Equal(t, 1.8, payload.Phases[1].Current)
+	assert.Equal(t, -412.3, payload.Phases[2].ActivePower)
+	assert.Equal(t, 0.97, payload.Phases[2].PowerFactor)
+}
+
+func Test_historySample(t *testing.T) {
+	historyData := GrowattNoahHistoryData{
+		Pac:                           -314,
+		Ppv:                           420.5,
+		TotalBatteryPackSoc:           63,
+		TotalBatteryPackChargingPower: -120,
+		EacToday:                      3.1,
+		EacTotal:                      319.8,
+		WorkMode:                      0,
+		Status:                        6,
+		SystemTemp:                    31.5,
+		Battery1Soc:                   64,
+		Battery2Soc:                   62,
+		Pv1Voltage:                    33.15,
+		EastronFlag:                   1,
+		TotalActivePower:              -412.3,
+	}
+	device := models.NoahDevicePayload{Serial: "serial123", Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}, {Alias: "BAT1"}}}
+	tm := time.Now().Truncate(time.Second)
+
+	sample := historySample(device, historyData, tm)
+
+	assert.Equal(t, tm, sample.Time)
+	assert.Equal(t, -314.0, sample.Device.ACPower)
+	assert.Equal(t, 420.5, sample.Device.SolarPower)
+	assert.Equal(t, 63.0, sample.Device.Soc)
+	assert.Equal(t, 0.0, sample.Device.ChargePower)
+	assert.Equal(t, 120.0, sample.Device.DischargePower)
+	assert.Equal(t, 2, sample.Device.BatteryNum)
+	assert.Equal(t, 3.1, sample.Device.GenerationTodayEnergy)
+	assert.Equal(t, 319.8, sample.Device.GenerationTotalEnergy)
+	assert.Equal(t, models.WorkMode(models.WorkModeLoadFirst), sample.Device.WorkMode)
+	assert.Equal(t, models.OnGrid, sample.Device.Status)
+	assert.Equal(t, 31.5, *sample.Device.SystemTemperature)
+	assert.Len(t, sample.Batteries, 2)
+	assert.Equal(t, 62.0, sample.Batteries[1].Soc)
+	assert.Len(t, sample.Pvs, 4)
+	assert.Equal(t, 33.15, sample.Pvs[0].Voltage)
+	assert.Equal(t, -412.3, sample.Meter.ActivePower)
+
+	historyData.EastronFlag = 0
+	assert.Nil(t, historySample(device, historyData, tm).Meter)
+}
+
+func Test_alarmPayload(t *testing.T) {
+	historyData := GrowattNoahHistoryData{
+		Dtc:                   5002,
+		FaultStatus:           0b101,
+		MpptProtectStatus:     0b10,
+		Battery1WarnStatus:    0b1000,
+		Battery2ProtectStatus: 0b10000001,
+		Battery3WarnStatus:    1, // battery 3 is not installed
+	}
+	tm := time.Now().Truncate(time.Second)
+
+	payload := alarmPayload(historyData, tm, 2)
+
+	assert.Equal(t, tm, payload.Time)
+	assert.True(t, payload.Fault)
+	assert.True(t, payload.Warning)
+	assert.True(t, payload.Protection)
+	assert.Equal(t, []models.Alarm{
+		{Name: "dtc_5002", Category: models.AlarmCategoryFault, Source: "dtc", Code: 5002},
+		{Name: "fault_bit0", Category: models.AlarmCategoryFault, Source: "fault_status", Code: 0},
+		{Name: "fault_bit2", Category: models.AlarmCategoryFault, Source: "fault_status", Code: 2},
+		{Name: "mppt_protect_bit1", Category: models.AlarmCategoryProtection, Source: "mppt_protect_status", Code: 1},
+		{Name: "bat0_warn_high_temperature", Category: models.AlarmCategoryWarning, Source: "bat0_warn_status", Code: 3},
+		{Name: "bat1_protect_bit0", Category: models.AlarmCategoryProtection, Source: "bat1_protect_status", Code: 0},
+		{Name: "bat1_protect_discharge_overcurrent", Category: models.AlarmCategoryProtection, Source: "bat1_protect_status", Code: 7},
+	}, payload.Alarms)
+
+	payload = alarmPayload(GrowattNoahHistoryData{}, tm, 4)
+	assert.False(t, payload.Fault)
+	assert.False(t, payload.Warning)
+	assert.False(t, payload.Protection)
+	assert.Empty(t, payload.Alarms)
+}
+
 func Test_parameterPayload(t *testing.T) {
 	detailsData := GrowattNoahListData{
 		ChargingSocHighLimit:        "95",
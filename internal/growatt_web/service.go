@@ -2,11 +2,16 @@ package growatt_web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"nexa-mqtt/internal/backfill"
+	"nexa-mqtt/internal/devicefilter"
 	"nexa-mqtt/internal/endpoint"
 	"nexa-mqtt/internal/misc"
 	"nexa-mqtt/pkg/models"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -17,7 +22,10 @@ type Options struct {
 	PollingInterval               time.Duration
 	BatteryDetailsPollingInterval time.Duration
 	ParameterPollingInterval      time.Duration
+	EnumerationInterval           time.Duration // 0 disables the periodic re-enumeration of the devices
 	Location                      *time.Location
+	BackfillMaxAge                time.Duration        // gaps are only backfilled up to this age, 0 backfills all gaps
+	DeviceFilter                  *devicefilter.Filter // nil publishes all devices
 }
 
 type DurationCalculator interface {
@@ -28,27 +36,72 @@ type DurationCalculator interface {
 type GrowattService struct {
 	opts             Options
 	client           *Client
-	health           models.ServiceHealth
+	health           *models.HealthRegistry
 	devices          []models.NoahDevicePayload
 	endpoint         endpoint.Endpoint
 	cancel           context.CancelFunc
+	pollers          sync.WaitGroup
+	devicesLock      sync.Mutex
+	devicePollers    map[string]context.CancelFunc
 	parameterTrigger map[string]chan struct{}
+	refreshTrigger   map[string]chan struct{}
+	enumerateTrigger chan struct{}
+	historyLock      sync.Mutex
+	history          map[string]models.DevicePayload // last values from the history data
+	alarms           map[string]models.AlarmPayload  // last active alarms, guarded by historyLock
+	backfillSink     backfill.Sink                   // guarded by historyLock
+	backfillState    *backfill.State                 // guarded by historyLock
 }
 
 func NewGrowattService(options Options) *GrowattService {
 	return &GrowattService{
 		opts:             options,
 		client:           newClient(options.ServerUrl, options.Username, options.Password),
-		health:           models.NewServiceHealth(),
+		health:           models.NewHealthRegistry(),
 		parameterTrigger: make(map[string]chan struct{}),
+		refreshTrigger:   make(map[string]chan struct{}),
+		enumerateTrigger: make(chan struct{}, 1),
+		history:          make(map[string]models.DevicePayload),
+		alarms:           make(map[string]models.AlarmPayload),
 	}
 }
 
 func (g *GrowattService) TriggerParameterPolling(device models.NoahDevicePayload) {
+	g.devicesLock.Lock()
+	trigger := g.parameterTrigger[device.Serial]
+	g.devicesLock.Unlock()
+
+	select {
+	case trigger <- struct{}{}:
+	default: // Trigger already pending
+	}
+}
+
+// Refresh polls the status, the battery details and the parameters of the
+// device now
+func (g *GrowattService) Refresh(device models.NoahDevicePayload) error {
+	g.devicesLock.Lock()
+	trigger, ok := g.refreshTrigger[device.Serial]
+	g.devicesLock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("device %s is not polled (web)", device.Serial)
+	}
+	select {
+	case trigger <- struct{}{}:
+	default: // Trigger already pending
+	}
+	return nil
+}
+
+// Reenumerate enumerates the devices now, all devices of the account are
+// enumerated
+func (g *GrowattService) Reenumerate(_ models.NoahDevicePayload) error {
 	select {
-	case g.parameterTrigger[device.Serial] <- struct{}{}:
+	case g.enumerateTrigger <- struct{}{}:
 	default: // Trigger already pending
 	}
+	return nil
 }
 
 func (g *GrowattService) Login() error {
@@ -59,20 +112,176 @@ func (g *GrowattService) Login() error {
 	return nil
 }
 
-func (g *GrowattService) StartPolling(dc DurationCalculator) {
-	g.devices = g.enumerateDevices()
-	g.endpoint.SetDevices(g.devices)
+// StartPolling enumerates the devices and starts a poller for each of them.
+// It returns an error if the devices cannot be enumerated. The devices are
+// enumerated again every EnumerationInterval and on Reenumerate.
+func (g *GrowattService) StartPolling(dc DurationCalculator) error {
+	devices, err := g.enumerateDevices()
+	if err != nil {
+		return err
+	}
 
 	var ctx context.Context
 	ctx, g.cancel = context.WithCancel(context.Background())
-	for _, device := range g.devices {
-		g.parameterTrigger[device.Serial] = make(chan struct{}, 1)
-		go g.poll(ctx, device, dc)
+	g.updateDevices(ctx, devices, dc)
+
+	g.pollers.Add(1)
+	go func() {
+		defer g.pollers.Done()
+		g.reenumerate(ctx, dc)
+	}()
+	return nil
+}
+
+func (g *GrowattService) reenumerate(ctx context.Context, dc DurationCalculator) {
+	var tick <-chan time.Time // nil never ticks
+	if g.opts.EnumerationInterval > 0 {
+		ticker := time.NewTicker(g.opts.EnumerationInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			g.enumerateAgain(ctx, dc)
+
+		case <-g.enumerateTrigger:
+			g.enumerateAgain(ctx, dc)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *GrowattService) enumerateAgain(ctx context.Context, dc DurationCalculator) {
+	slog.Debug("re-enumerating devices (web)")
+	if devices, err := g.enumerateDevices(); err != nil {
+		slog.Warn("could not re-enumerate devices, keeping current devices (web)", slog.String("error", err.Error()))
+	} else {
+		g.updateDevices(ctx, devices, dc)
 	}
 }
 
+// updateDevices stops the pollers of removed and changed devices and starts
+// pollers for new and changed devices. The endpoint is only updated if the
+// devices changed.
+func (g *GrowattService) updateDevices(ctx context.Context, devices []models.NoahDevicePayload, dc DurationCalculator) {
+	g.devicesLock.Lock()
+
+	if g.devicePollers == nil {
+		g.devicePollers = make(map[string]context.CancelFunc)
+	}
+	if g.parameterTrigger == nil {
+		g.parameterTrigger = make(map[string]chan struct{})
+	}
+	if g.refreshTrigger == nil {
+		g.refreshTrigger = make(map[string]chan struct{})
+	}
+
+	changed := len(devices) != len(g.devices)
+	for _, old := range g.devices {
+		i := slices.IndexFunc(devices, func(d models.NoahDevicePayload) bool { return d.Serial == old.Serial })
+		if i >= 0 && devices[i].Equal(old) {
+			continue
+		}
+		if i < 0 {
+			slog.Info("device removed (web)", slog.String("device", old.Serial))
+		} else {
+			slog.Info("device changed (web)", slog.String("device", old.Serial), slog.Int("batteries", len(devices[i].Batteries)))
+		}
+		if cancel, ok := g.devicePollers[old.Serial]; ok {
+			cancel()
+			delete(g.devicePollers, old.Serial)
+			delete(g.parameterTrigger, old.Serial)
+			delete(g.refreshTrigger, old.Serial)
+		}
+		changed = true
+	}
+
+	for _, device := range devices {
+		if _, ok := g.devicePollers[device.Serial]; ok {
+			continue
+		}
+		if !slices.ContainsFunc(g.devices, func(d models.NoahDevicePayload) bool { return d.Serial == device.Serial }) {
+			slog.Info("device added (web)", slog.String("device", device.Serial))
+			changed = true
+		}
+
+		pollCtx, cancel := context.WithCancel(ctx)
+		trigger := make(chan struct{}, 1)
+		refresh := make(chan struct{}, 1)
+		g.devicePollers[device.Serial] = cancel
+		g.parameterTrigger[device.Serial] = trigger
+		g.refreshTrigger[device.Serial] = refresh
+		g.pollers.Add(1)
+		go func() {
+			defer g.pollers.Done()
+			g.poll(pollCtx, device, dc, trigger, refresh)
+		}()
+	}
+
+	g.devices = devices
+	g.devicesLock.Unlock()
+
+	// the endpoint is updated without holding devicesLock, it may apply a
+	// parameter command that triggers the parameter polling meanwhile
+	if changed {
+		g.health.Retain(devices)
+		g.endpoint.SetDevices(devices)
+	}
+}
+
+// knownDevices returns the currently polled devices matching f. They are kept
+// when the re-enumeration cannot query them.
+func (g *GrowattService) knownDevices(f func(models.NoahDevicePayload) bool) []models.NoahDevicePayload {
+	g.devicesLock.Lock()
+	defer g.devicesLock.Unlock()
+
+	var devices []models.NoahDevicePayload
+	for _, d := range g.devices {
+		if f(d) {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// StopPolling stops all pollers. The devices are enumerated and announced
+// again by the next StartPolling.
 func (g *GrowattService) StopPolling() {
-	g.cancel()
+	if g.cancel != nil {
+		g.cancel()
+	}
+
+	g.devicesLock.Lock()
+	defer g.devicesLock.Unlock()
+
+	clear(g.devicePollers)
+	clear(g.parameterTrigger)
+	clear(g.refreshTrigger)
+	g.devices = nil
+}
+
+// Shutdown stops polling and waits until all pollers have returned or ctx
+// is done.
+func (g *GrowattService) Shutdown(ctx context.Context) error {
+	g.StopPolling()
+
+	done := make(chan struct{})
+	go func() {
+		g.pollers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("all pollers stopped (web)")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (g *GrowattService) SetEndpoint(e endpoint.Endpoint) {
@@ -82,14 +291,15 @@ func (g *GrowattService) SetEndpoint(e endpoint.Endpoint) {
 	}
 }
 
-func (g *GrowattService) publishHealth(device models.NoahDevicePayload, err error) {
+func (g *GrowattService) publishHealth(device models.NoahDevicePayload, latency time.Duration, err error) {
+	health := g.health.Device(device.Serial)
 	if err != nil {
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallSet, latency, err)
 	} else {
-		g.health.UpdateSuccess(device.Serial)
+		health.UpdateSuccess(models.HealthCallSet, latency)
 		g.TriggerParameterPolling(device)
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattService) SetOutputPowerW(device models.NoahDevicePayload, mode models.WorkMode, power float64) error {
@@ -99,17 +309,18 @@ func (g *GrowattService) SetOutputPowerW(device models.NoahDevicePayload, mode m
 	if modeAsInt < 0 {
 		slog.Error("unable to set default system output power (web). Invalid mode", slog.String("device", device.Serial), slog.String("mode", string(mode)))
 		err := fmt.Errorf("invalid work mode: %s", mode)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set default system output power (web)", slog.String("device", device.Serial), slog.Int("mode", modeAsInt), slog.Float64("power", power))
+	start := time.Now()
 	err := g.client.SetSystemOutputPower(device.Serial, modeAsInt, power)
 	if err != nil {
 		slog.Error("unable to set default system output power (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -117,6 +328,7 @@ func (g *GrowattService) SetChargingLimits(device models.NoahDevicePayload, char
 	slog.Info("trying to set charging limits (web)", slog.String("device", device.Serial), slog.Float64("chargingLimit", chargingLimit), slog.Float64("dischargeLimit", dischargeLimit))
 
 	slog.Debug("set charging limit low (web)", slog.String("device", device.Serial), slog.Float64("dischargeLimit", dischargeLimit))
+	start := time.Now()
 	err := g.client.SetChargingSocLowLimit(device.Serial, dischargeLimit)
 	if err != nil {
 		slog.Error("unable to set charging limit low (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
@@ -129,7 +341,7 @@ func (g *GrowattService) SetChargingLimits(device models.NoahDevicePayload, char
 		}
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -140,17 +352,18 @@ func (g *GrowattService) SetAllowGridCharging(device models.NoahDevicePayload, a
 	if on < 0 {
 		slog.Error("unable to set allow grid charging (web). Invalid allow value", slog.String("device", device.Serial), slog.String("allow", string(allow)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", allow)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set allow grid charging (web)", slog.String("device", device.Serial), slog.Int("allow", on))
+	start := time.Now()
 	err := g.client.SetAllowGridCharging(device.Serial, on)
 	if err != nil {
 		slog.Error("unable to set allow grid charging (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -161,17 +374,18 @@ func (g *GrowattService) SetGridConnectionControl(device models.NoahDevicePayloa
 	if on < 0 {
 		slog.Error("unable to set grid connection control (web). Invalid offlineEnable value", slog.String("device", device.Serial), slog.String("offlineEnable", string(offlineEnable)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", offlineEnable)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set grid connection control (web)", slog.String("device", device.Serial), slog.Int("offlineEnable", on))
+	start := time.Now()
 	err := g.client.SetGridConnectionControl(device.Serial, on)
 	if err != nil {
 		slog.Error("unable to set grid connection (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -182,17 +396,18 @@ func (g *GrowattService) SetAcCouplePowerControl(device models.NoahDevicePayload
 	if on < 0 {
 		slog.Error("unable to set ac couple power control (web). Invalid _1000WEnable value", slog.String("device", device.Serial), slog.String("_1000WEnable", string(_1000WEnable)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", _1000WEnable)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set ac couple power control (web)", slog.String("device", device.Serial), slog.Int("_1000WEnable", on))
+	start := time.Now()
 	err := g.client.SetACCouplePowerControl(device.Serial, on)
 	if err != nil {
 		slog.Error("unable to set ac couple power control (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -203,17 +418,18 @@ func (g *GrowattService) SetLightLoadEnable(device models.NoahDevicePayload, ena
 	if on < 0 {
 		slog.Error("unable to set light load enable (web). Invalid enable value", slog.String("device", device.Serial), slog.String("enable", string(enable)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", enable)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set light load enable (web)", slog.String("device", device.Serial), slog.Int("enable", misc.OnOffToInt(enable)))
+	start := time.Now()
 	err := g.client.SetLightLoadEnable(device.Serial, misc.OnOffToInt(enable))
 	if err != nil {
 		slog.Error("unable to set light load enable (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -224,17 +440,18 @@ func (g *GrowattService) SetNeverPowerOff(device models.NoahDevicePayload, enabl
 	if on < 0 {
 		slog.Error("unable to set never power off (web). Invalid enable value", slog.String("device", device.Serial), slog.String("enable", string(enable)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", enable)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set never power off (web)", slog.String("device", device.Serial), slog.Int("enable", on))
+	start := time.Now()
 	err := g.client.SetNeverPowerOff(device.Serial, on)
 	if err != nil {
 		slog.Error("unable to set never power off (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
@@ -245,40 +462,54 @@ func (g *GrowattService) SetBackflow(device models.NoahDevicePayload, enableLimi
 	if on < 0 {
 		slog.Error("unable to set backflow (web). Invalid enable value", slog.String("device", device.Serial), slog.String("enable", string(enableLimit)))
 		err := fmt.Errorf("invalid ON/OFF value: %s", enableLimit)
-		g.publishHealth(device, err)
+		g.publishHealth(device, 0, err)
 		return err
 	}
 
 	slog.Debug("set backflow (web)", slog.String("device", device.Serial), slog.Int("enableLimit", on), slog.Float64("powerSettingPercent", powerSettingPercent))
+	start := time.Now()
 	err := g.client.SetAntiBackflowSetting(device.Serial, on, powerSettingPercent)
 	if err != nil {
 		slog.Error("unable to set backflow (web)", slog.String("error", err.Error()), slog.String("device", device.Serial))
 	}
 
-	g.publishHealth(device, err)
+	g.publishHealth(device, time.Since(start), err)
 	return err
 }
 
-func (g *GrowattService) enumerateDevices() []models.NoahDevicePayload {
+func (g *GrowattService) enumerateDevices() ([]models.NoahDevicePayload, error) {
 	var enumeratedDevices []models.NoahDevicePayload
 
 	plantList, err := g.client.GetPlantList()
 	if err != nil {
 		slog.Error("could not get plant list", slog.String("error", err.Error()))
-		return enumeratedDevices
+		return nil, err
 	}
 
 	for _, plant := range plantList {
 		if devices, err := g.client.GetNoahList(misc.S2i(plant.PlantId)); err != nil {
 			slog.Error("could not get plant devices", slog.String("plantId", plant.PlantId), slog.String("error", err.Error()))
+			enumeratedDevices = append(enumeratedDevices, g.knownDevices(func(d models.NoahDevicePayload) bool {
+				return d.PlantId == misc.S2i(plant.PlantId)
+			})...)
 		} else {
 			for _, dev := range devices.Datas {
+				if g.opts.DeviceFilter.Skip(dev.Sn, misc.S2i(dev.PlantID)) {
+					slog.Debug("skipping filtered device", slog.String("device", dev.Sn))
+					continue
+				}
 
 				if history, err := g.client.GetNoahHistory(dev.Sn, "", ""); err != nil {
 					slog.Error("could not get device history", slog.String("device", dev.Sn), slog.String("error", err.Error()))
+					enumeratedDevices = append(enumeratedDevices, g.knownDevices(func(d models.NoahDevicePayload) bool {
+						return d.Serial == dev.Sn
+					})...)
 				} else {
 					if len(history.Obj.Datas) == 0 {
 						slog.Info("could not get device history, data empty", slog.String("device", dev.Sn))
+						enumeratedDevices = append(enumeratedDevices, g.knownDevices(func(d models.NoahDevicePayload) bool {
+							return d.Serial == dev.Sn
+						})...)
 					} else {
 						var batCount = history.Obj.Datas[0].BatteryPackageQuantity
 						var batteries []models.NoahDeviceBatteryPayload
@@ -296,7 +527,7 @@ func (g *GrowattService) enumerateDevices() []models.NoahDevicePayload {
 							Batteries: batteries,
 						}
 
-						enumeratedDevices = append(enumeratedDevices, d)
+						enumeratedDevices = append(enumeratedDevices, g.opts.DeviceFilter.Rename(d))
 					}
 				}
 
@@ -304,11 +535,17 @@ func (g *GrowattService) enumerateDevices() []models.NoahDevicePayload {
 		}
 	}
 
-	return enumeratedDevices
+	if len(enumeratedDevices) == 0 {
+		slog.Error("no nexa devices found")
+		return nil, errors.New("no nexa devices found")
+	}
+
+	return enumeratedDevices, nil
 }
 
-func (g *GrowattService) poll(ctx context.Context, device models.NoahDevicePayload, dc DurationCalculator) {
+func (g *GrowattService) poll(ctx context.Context, device models.NoahDevicePayload, dc DurationCalculator, trigger <-chan struct{}, refresh <-chan struct{}) {
 	slog.Info("start polling growatt (web)",
+		slog.String("device", device.Serial),
 		slog.Int("interval", int(g.opts.PollingInterval/time.Second)),
 		slog.Int("battery-details-interval", int(g.opts.BatteryDetailsPollingInterval/time.Second)),
 		slog.Int("parameter-interval", int(g.opts.ParameterPollingInterval/time.Second)))
@@ -333,6 +570,7 @@ func (g *GrowattService) poll(ctx context.Context, device models.NoahDevicePaylo
 
 		case <-timerBatteryPolling.C:
 			lastTimestamp = g.pollBatteryDetails(device, lastTimestamp)
+			g.backfillGap(ctx, device, lastTimestamp)
 			durationToWait, lastTimestamp, retryDuration = dc.Next(lastTimestamp, retryDuration)
 			timerBatteryPolling.Reset(durationToWait)
 
@@ -341,7 +579,21 @@ func (g *GrowattService) poll(ctx context.Context, device models.NoahDevicePaylo
 		case <-tickerParameter.C:
 			g.pollParameterData(device)
 
-		case <-g.parameterTrigger[device.Serial]:
+		case <-trigger:
+			g.pollParameterData(device)
+
+			tickerParameter.Stop()
+			select {
+			case <-tickerParameter.C:
+			default:
+			}
+			tickerParameter.Reset(g.opts.ParameterPollingInterval)
+
+		case <-refresh:
+			slog.Info("refreshing device (web)", slog.String("device", device.Serial))
+			g.pollStatus(device)
+			// the schedule of the battery details and the backfill are kept
+			g.pollBatteryDetails(device, time.Time{})
 			g.pollParameterData(device)
 
 			tickerParameter.Stop()
@@ -352,54 +604,65 @@ func (g *GrowattService) poll(ctx context.Context, device models.NoahDevicePaylo
 			tickerParameter.Reset(g.opts.ParameterPollingInterval)
 
 		case <-ctx.Done():
-			slog.Info("stop polling growatt (web)")
+			slog.Info("stop polling growatt (web)", slog.String("device", device.Serial))
 			return
 		}
 	}
 }
 
 func (g *GrowattService) pollStatus(device models.NoahDevicePayload) {
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if status, err := g.client.GetNoahStatus(device.PlantId, device.Serial); err != nil {
 		slog.Error("could not get device data", slog.String("error", err.Error()), slog.String("device", device.Serial))
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallStatus, time.Since(start), err)
 	} else {
+		health.UpdateSuccess(models.HealthCallStatus, time.Since(start))
+		start = time.Now()
 		if totals, err := g.client.GetNoahTotals(device.PlantId, device.Serial); err != nil {
 			slog.Error("could not get device totals", slog.String("error", err.Error()), slog.String("device", device.Serial))
-			g.health.UpdateError(device.Serial, err)
+			health.UpdateError(models.HealthCallTotals, time.Since(start), err)
 		} else {
+			health.UpdateSuccess(models.HealthCallTotals, time.Since(start))
 			payload := devicePayload(device, status.Obj, totals.Obj)
+			g.historyLock.Lock()
+			payload.UpdateHistoryFrom(g.history[device.Serial])
+			g.historyLock.Unlock()
 			g.endpoint.PublishDeviceStatus(device, payload)
-			g.health.UpdateSuccess(device.Serial)
 		}
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattService) pollParameterData(device models.NoahDevicePayload) {
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if details, err := g.client.GetNoahDetails(device.PlantId, device.Serial); err != nil {
 		slog.Error("could not get device details data", slog.String("error", err.Error()))
-		g.health.UpdateError(device.Serial, err)
+		health.UpdateError(models.HealthCallParameters, time.Since(start), err)
 	} else {
 		if len(details.Datas) != 1 {
 			slog.Error("could not get device details data", slog.String("device", device.Serial))
-			g.health.UpdateError(device.Serial, fmt.Errorf("no devices available"))
+			health.UpdateError(models.HealthCallParameters, time.Since(start), fmt.Errorf("no devices available"))
 		} else {
 			paramPayload := parameterPayload(details.Datas[0])
 
 			g.endpoint.PublishParameterData(device, paramPayload)
-			g.health.UpdateSuccess(device.Serial)
+			health.UpdateSuccess(models.HealthCallParameters, time.Since(start))
 		}
 	}
-	g.endpoint.PublishHealth(device, &g.health)
+	g.endpoint.PublishHealth(device, health)
 }
 
 func (g *GrowattService) pollBatteryDetails(device models.NoahDevicePayload, lastTimestamp time.Time) time.Time {
-
+	health := g.health.Device(device.Serial)
+	start := time.Now()
 	if history, err := g.client.GetNoahHistory(device.Serial, "", ""); err != nil {
 		slog.Error("could not get device history", slog.String("error", err.Error()), slog.String("device", device.Serial))
-		g.health.UpdateError(device.Serial, err)
-		g.endpoint.PublishHealth(device, &g.health)
+		health.UpdateError(models.HealthCallHistory, time.Since(start), err)
+		g.endpoint.PublishHealth(device, health)
 	} else {
+		latency := time.Since(start)
 		if len(history.Obj.Datas) == 0 {
 			slog.Info("could not get device history, data empty", slog.String("device", device.Serial))
 		} else {
@@ -416,6 +679,10 @@ func (g *GrowattService) pollBatteryDetails(device models.NoahDevicePayload, las
 				return tm
 			}
 
+			g.historyLock.Lock()
+			g.history[device.Serial] = historyPayload(historyData)
+			g.historyLock.Unlock()
+
 			var batteries []models.BatteryPayload
 			for i := 0; i < len(device.Batteries); i++ {
 				batteries = append(batteries, batteryPayload(historyData, tm, i))
@@ -430,14 +697,38 @@ func (g *GrowattService) pollBatteryDetails(device models.NoahDevicePayload, las
 
 			g.endpoint.PublishPvDetails(device, pvs)
 
-			g.health.UpdateSuccess(device.Serial)
-			g.endpoint.PublishHealth(device, &g.health)
+			if historyData.EastronFlag != 0 {
+				g.endpoint.PublishMeterData(device, meterPayload(historyData, tm))
+			}
+
+			g.publishAlarms(device, alarmPayload(historyData, tm, len(device.Batteries)))
+
+			health.UpdateSuccess(models.HealthCallHistory, latency)
+			g.endpoint.PublishHealth(device, health)
 			return tm
 		}
 	}
 	return time.Time{}
 }
 
+// publishAlarms publishes the active alarms and logs the alarms raised or
+// cleared since the last poll.
+func (g *GrowattService) publishAlarms(device models.NoahDevicePayload, alarms models.AlarmPayload) {
+	g.historyLock.Lock()
+	raised, cleared := alarms.Changes(g.alarms[device.Serial])
+	g.alarms[device.Serial] = alarms
+	g.historyLock.Unlock()
+
+	for _, a := range raised {
+		slog.Warn("alarm raised", slog.String("alarm", a.Name), slog.String("category", string(a.Category)), slog.String("device", device.Serial))
+	}
+	for _, a := range cleared {
+		slog.Info("alarm cleared", slog.String("alarm", a.Name), slog.String("category", string(a.Category)), slog.String("device", device.Serial))
+	}
+
+	g.endpoint.PublishAlarms(device, alarms)
+}
+
 type defaultDurationCalculator struct {
 	defaultDuration time.Duration
 }
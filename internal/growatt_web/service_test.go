@@ -1,9 +1,11 @@
 package growatt_web
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"net/http/cookiejar"
+	"nexa-mqtt/internal/devicefilter"
 	"nexa-mqtt/pkg/models"
 	"strconv"
 	"sync"
@@ -53,8 +55,10 @@ func setupGrowattServiceMocks(t *testing.T) (*MockHttpClient, *GrowattService, m
 		},
 		client:           &client,
 		endpoint:         &endpoint,
-		health:           models.NewServiceHealth(),
+		health:           models.NewHealthRegistry(),
 		parameterTrigger: make(map[string]chan struct{}),
+		history:          make(map[string]models.DevicePayload),
+		alarms:           make(map[string]models.AlarmPayload),
 	}
 
 	device := models.NoahDevicePayload{
@@ -440,8 +444,9 @@ func Test_enumerateDevices_GetPlantListFails(t *testing.T) {
 
 	mockHttpClient.OnGetPlantList([]GrowattPlant{}, errors.New("GetPlantList fails"))
 
-	result := service.enumerateDevices()
+	result, err := service.enumerateDevices()
 
+	assert.Error(t, err)
 	assert.Equal(t, 0, len(result))
 	mockHttpClient.AssertExpectations(t)
 }
@@ -458,8 +463,9 @@ func Test_enumerateDevices_GetNoahListFails(t *testing.T) {
 	mockHttpClient.OnGetNoahList(1, GrowattNoahList{}, errors.New("GrowattNoahList fails"))
 	mockHttpClient.OnGetNoahList(2, GrowattNoahList{}, errors.New("GrowattNoahList fails"))
 
-	result := service.enumerateDevices()
+	result, err := service.enumerateDevices()
 
+	assert.Error(t, err)
 	assert.Equal(t, 0, len(result))
 	mockHttpClient.AssertExpectations(t)
 }
@@ -483,12 +489,44 @@ func Test_enumerateDevices_GetNoahHistoryFails(t *testing.T) {
 	today := time.Now().Format("2006-01-02")
 	mockHttpClient.OnGetNoahHistory("Serial123", today, today, GrowattNoahHistory{}, errors.New("GrowattNoahList fails"))
 
-	result := service.enumerateDevices()
+	result, err := service.enumerateDevices()
 
+	assert.Error(t, err)
 	assert.Equal(t, 0, len(result))
 	mockHttpClient.AssertExpectations(t)
 }
 
+func Test_enumerateDevices_KeepsKnownDevices(t *testing.T) {
+	mockHttpClient, service, _, _ := setupGrowattServiceMocks(t)
+
+	known := []models.NoahDevicePayload{
+		{PlantId: 1, Serial: "Serial123", Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}}},
+		{PlantId: 2, Serial: "Serial234", Batteries: []models.NoahDeviceBatteryPayload{{Alias: "BAT0"}}},
+	}
+	service.devices = known
+
+	plantList := []GrowattPlant{
+		{PlantId: "1", PlantName: "plant1"},
+		{PlantId: "2", PlantName: "plant2"},
+	}
+	mockHttpClient.OnGetPlantList(plantList, nil)
+
+	dev1 := GrowattNoahList{PagedListResponse[GrowattNoahListData]{Datas: []GrowattNoahListData{
+		{Sn: "Serial123", PlantID: "1"},
+	}}}
+	mockHttpClient.OnGetNoahList(1, dev1, nil)
+	mockHttpClient.OnGetNoahList(2, GrowattNoahList{}, errors.New("GrowattNoahList fails"))
+
+	today := time.Now().Format("2006-01-02")
+	mockHttpClient.OnGetNoahHistory("Serial123", today, today, GrowattNoahHistory{}, errors.New("GetNoahHistory fails"))
+
+	result, err := service.enumerateDevices()
+
+	assert.NoError(t, err)
+	assert.Equal(t, known, result)
+	mockHttpClient.AssertExpectations(t)
+}
+
 func Test_enumerateDevices_GetNoahHistoryNoData(t *testing.T) {
 	mockHttpClient, service, _, _ := setupGrowattServiceMocks(t)
 
@@ -509,12 +547,87 @@ func Test_enumerateDevices_GetNoahHistoryNoData(t *testing.T) {
 	hist1 := GrowattNoahHistory{Obj: GrowattNoahHistoryObj{}}
 	mockHttpClient.OnGetNoahHistory("Serial123", today, today, hist1, nil)
 
-	result := service.enumerateDevices()
+	result, err := service.enumerateDevices()
 
+	assert.Error(t, err)
 	assert.Equal(t, 0, len(result))
 	mockHttpClient.AssertExpectations(t)
 }
 
+func Test_enumerateDevices_Pages(t *testing.T) {
+	mockHttpClient, service, _, _ := setupGrowattServiceMocks(t)
+
+	mockHttpClient.OnGetPlantList([]GrowattPlant{{PlantId: "1", PlantName: "plant1"}}, nil)
+
+	page1 := GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 1, Pages: 2, Datas: []GrowattNoahListData{
+		{Sn: "Serial123", PlantID: "1", DeviceModel: "NEXA 2000"},
+		{Sn: "Serial234", PlantID: "1", DeviceModel: "NEXA 2000"},
+	}}}
+	mockHttpClient.OnGetNoahListPage(1, 1, page1, nil).Once()
+	page2 := GrowattNoahList{PagedListResponse[GrowattNoahListData]{CurrPage: 2, Pages: 2, Datas: []GrowattNoahListData{
+		{Sn: "Serial345", PlantID: "1", DeviceModel: "NEXA 2000"},
+	}}}
+	mockHttpClient.OnGetNoahListPage(1, 2, page2, nil).Once()
+
+	today := time.Now().Format("2006-01-02")
+	hist := GrowattNoahHistory{Obj: GrowattNoahHistoryObj{Datas: []GrowattNoahHistoryData{
+		{BatteryPackageQuantity: 2},
+	}}}
+	mockHttpClient.OnGetNoahHistory("Serial123", today, today, hist, nil)
+	mockHttpClient.OnGetNoahHistory("Serial234", today, today, hist, nil)
+	mockHttpClient.OnGetNoahHistory("Serial345", today, today, hist, nil)
+
+	result, err := service.enumerateDevices()
+
+	assert.NoError(t, err)
+	var serials []string
+	for _, d := range result {
+		assert.Equal(t, 1, d.PlantId)
+		assert.Len(t, d.Batteries, 2)
+		serials = append(serials, d.Serial)
+	}
+	assert.Equal(t, []string{"Serial123", "Serial234", "Serial345"}, serials)
+	mockHttpClient.AssertExpectations(t)
+}
+
+func Test_enumerateDevices_Filter(t *testing.T) {
+	mockHttpClient, service, _, _ := setupGrowattServiceMocks(t)
+	service.opts.DeviceFilter = devicefilter.New(devicefilter.Options{
+		Exclude: []string{"Demo"},
+		Overrides: map[string]devicefilter.Override{
+			"Serial123": {Alias: "Garage", Model: "NEXA", Batteries: []string{"Left", "Right"}},
+		},
+	})
+
+	mockHttpClient.OnGetPlantList([]GrowattPlant{{PlantId: "1", PlantName: "plant1"}}, nil)
+
+	dev := GrowattNoahList{PagedListResponse[GrowattNoahListData]{Datas: []GrowattNoahListData{
+		{Sn: "Serial123", PlantID: "1", DeviceModel: "NEXA 2000", Alias: "NEXA 2000"},
+		{Sn: "Demo", PlantID: "1", DeviceModel: "NEXA 2000"},
+	}}}
+	mockHttpClient.OnGetNoahList(1, dev, nil)
+
+	today := time.Now().Format("2006-01-02")
+	hist := GrowattNoahHistory{Obj: GrowattNoahHistoryObj{Datas: []GrowattNoahHistoryData{
+		{BatteryPackageQuantity: 1},
+	}}}
+	mockHttpClient.OnGetNoahHistory("Serial123", today, today, hist, nil)
+
+	result, err := service.enumerateDevices()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []models.NoahDevicePayload{
+		{
+			PlantId:   1,
+			Serial:    "Serial123",
+			Model:     "NEXA",
+			Alias:     "Garage",
+			Batteries: []models.NoahDeviceBatteryPayload{{Alias: "Left"}},
+		},
+	}, result)
+	mockHttpClient.AssertExpectations(t)
+}
+
 func Test_enumerateDevices_Ok(t *testing.T) {
 	mockHttpClient, service, _, _ := setupGrowattServiceMocks(t)
 
@@ -548,8 +661,9 @@ func Test_enumerateDevices_Ok(t *testing.T) {
 	}}}
 	mockHttpClient.OnGetNoahHistory("Serial345", today, today, hist3, nil)
 
-	result := service.enumerateDevices()
+	result, err := service.enumerateDevices()
 
+	assert.NoError(t, err)
 	assert.Equal(t, 3, len(result))
 
 	assert.Equal(t, 1, result[0].PlantId)
@@ -613,6 +727,44 @@ func Test_pollStatus_OkCharge(t *testing.T) {
 	mockEndpoint.AssertExpectations(t)
 }
 
+func Test_pollStatus_WithHistory(t *testing.T) {
+	mockHttpClient, service, device, mockEndpoint := setupGrowattServiceMocks(t)
+
+	soh := 97.0
+	cycles := 120
+	service.history[device.Serial] = models.DevicePayload{BatterySoh: &soh, BatteryCycles: &cycles}
+
+	mockHttpClient.OnGetNoahStatus(device.PlantId, device.Serial, GrowattNoahStatus{
+		Response: Response[GrowattNoahStatusObj]{
+			Obj: GrowattNoahStatusObj{
+				TotalBatteryPackSoc: "93",
+				WorkMode:            "0",
+				Status:              "6",
+			}}}, nil)
+	mockHttpClient.OnGetNoahTotals(device.PlantId, device.Serial, GrowattNoahTotals{}, nil)
+
+	mockEndpoint.On(
+		"PublishDeviceStatus",
+		device,
+		models.DevicePayload{
+			Soc:           93.0,
+			BatteryNum:    4,
+			WorkMode:      models.WorkMode("load_first"),
+			Status:        "on_grid",
+			BatterySoh:    &soh,
+			BatteryCycles: &cycles,
+		},
+	)
+	mockEndpoint.On("PublishHealth",
+		device,
+		mock.MatchedBy(matchHealthOk))
+
+	service.pollStatus(device)
+
+	mockHttpClient.AssertExpectations(t)
+	mockEndpoint.AssertExpectations(t)
+}
+
 func Test_pollStatus_OkDischarge(t *testing.T) {
 	mockHttpClient, service, device, mockEndpoint := setupGrowattServiceMocks(t)
 
@@ -797,9 +949,11 @@ func Test_pollBatteryDetails_Ok(t *testing.T) {
 			Time:                   tm.Format("2006-01-02 15:04:05"),
 			BatteryPackageQuantity: 4,
 
-			Battery1SerialNum: "serial124",
-			Battery1Soc:       93,
-			Battery1Temp:      39.0,
+			Battery1SerialNum:     "serial124",
+			Battery1Soc:           93,
+			Battery1Temp:          39.0,
+			Battery1WarnStatus:    2,
+			Battery1ProtectStatus: 8,
 
 			Battery2SerialNum: "serial125",
 			Battery2Soc:       78,
@@ -828,16 +982,25 @@ func Test_pollBatteryDetails_Ok(t *testing.T) {
 			Pv4Voltage: 7.09,
 			Pv4Current: 0.03,
 			Pv4Temp:    20.5,
+
+			SystemTemp:     31.5,
+			MaxCellVoltage: 3.342,
+			MinCellVoltage: 3.301,
+			BatterySoh:     98,
+			BatteryCycles:  112,
 		}}}}, nil)
 
+	warnStatus := 2
+	protectStatus := 8
+	noStatus := 0
 	mockEndpoint.On(
 		"PublishBatteryDetails",
 		device,
 		[]models.BatteryPayload{
-			{Time: tm, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0},
-			{Time: tm, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0},
-			{Time: tm, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0},
-			{Time: tm, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0},
+			{Time: tm, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0, WarnStatus: &warnStatus, ProtectStatus: &protectStatus},
+			{Time: tm, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: tm, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: tm, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
 		},
 	)
 	mockEndpoint.On(
@@ -850,6 +1013,10 @@ func Test_pollBatteryDetails_Ok(t *testing.T) {
 			{Time: tm, Voltage: 7.09, Current: 0.03, Temp: 20.5},
 		},
 	)
+	alarms := models.NewAlarmPayload(tm)
+	alarms.Add(models.Alarm{Name: "bat0_warn_high_voltage", Category: models.AlarmCategoryWarning, Source: "bat0_warn_status", Code: 1})
+	alarms.Add(models.Alarm{Name: "bat0_protect_over_temperature", Category: models.AlarmCategoryProtection, Source: "bat0_protect_status", Code: 3})
+	mockEndpoint.On("PublishAlarms", device, alarms)
 	mockEndpoint.On(
 		"PublishHealth",
 		device,
@@ -858,10 +1025,80 @@ func Test_pollBatteryDetails_Ok(t *testing.T) {
 	lastTimestamp := service.pollBatteryDetails(device, tm.Add(-3*time.Minute))
 
 	assert.True(t, lastTimestamp.Equal(tm))
+	systemTemp := 31.5
+	maxCellVoltage := 3.342
+	minCellVoltage := 3.301
+	soh := 98.0
+	cycles := 112
+	assert.Equal(t, models.DevicePayload{
+		SystemTemperature: &systemTemp,
+		MaxCellVoltage:    &maxCellVoltage,
+		MinCellVoltage:    &minCellVoltage,
+		BatterySoh:        &soh,
+		BatteryCycles:     &cycles,
+	}, service.history[device.Serial])
 	mockHttpClient.AssertExpectations(t)
 	mockEndpoint.AssertExpectations(t)
 }
 
+func Test_pollBatteryDetails_Meter(t *testing.T) {
+	mockHttpClient, service, device, mockEndpoint := setupGrowattServiceMocks(t)
+
+	today := time.Now().Format("2006-01-02")
+	tm := time.Now().Add(-3 * time.Minute).Truncate(time.Second)
+	mockHttpClient.OnGetNoahHistory(device.Serial, today, today, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{Datas: []GrowattNoahHistoryData{
+		{
+			Time:                     tm.Format("2006-01-02 15:04:05"),
+			EastronFlag:              1,
+			Frequency:                50.01,
+			TotalActivePower:         -230.5,
+			ForwardTotalActiveEnergy: 1234.5,
+			ReverseTotalActiveEnergy: 321.9,
+			PhaseAVoltage:            231.2,
+		}}}}, nil)
+
+	meter := models.MeterPayload{
+		Time:                tm,
+		Frequency:           50.01,
+		ActivePower:         -230.5,
+		ForwardActiveEnergy: 1234.5,
+		ReverseActiveEnergy: 321.9,
+	}
+	meter.Phases[0].Voltage = 231.2
+	mockEndpoint.On("PublishBatteryDetails", device, mock.Anything)
+	mockEndpoint.On("PublishPvDetails", device, mock.Anything)
+	mockEndpoint.On("PublishMeterData", device, meter)
+	mockEndpoint.On("PublishAlarms", device, mock.Anything)
+	mockEndpoint.On("PublishHealth", device, mock.MatchedBy(matchHealthOk))
+
+	lastTimestamp := service.pollBatteryDetails(device, time.Time{})
+
+	assert.True(t, lastTimestamp.Equal(tm))
+	mockHttpClient.AssertExpectations(t)
+	mockEndpoint.AssertExpectations(t)
+}
+
+func Test_publishAlarms(t *testing.T) {
+	_, service, device, mockEndpoint := setupGrowattServiceMocks(t)
+
+	tm := time.Now().Truncate(time.Second)
+	first := models.NewAlarmPayload(tm)
+	first.AddBits("fault", models.AlarmCategoryFault, 0b11, nil)
+	second := models.NewAlarmPayload(tm.Add(3 * time.Minute))
+	second.AddBits("fault", models.AlarmCategoryFault, 0b10, nil)
+	mockEndpoint.On("PublishAlarms", device, first)
+	mockEndpoint.On("PublishAlarms", device, second)
+
+	service.publishAlarms(device, first)
+	service.publishAlarms(device, second)
+
+	raised, cleared := second.Changes(first)
+	assert.Empty(t, raised)
+	assert.Equal(t, []models.Alarm{{Name: "fault_bit0", Category: models.AlarmCategoryFault, Source: "fault_status", Code: 0}}, cleared)
+	assert.Equal(t, second, service.alarms[device.Serial])
+	mockEndpoint.AssertExpectations(t)
+}
+
 func Test_pollBatteryDetails_OnGetNoahHistoryFails(t *testing.T) {
 	mockHttpClient, service, device, mockEndpoint := setupGrowattServiceMocks(t)
 
@@ -936,14 +1173,15 @@ func Test_pollBatteryDetails_InvalidDate(t *testing.T) {
 			Pv4Temp:    20.5,
 		}}}}, nil)
 
+	noStatus := 0
 	mockEndpoint.On(
 		"PublishBatteryDetails",
 		device,
 		[]models.BatteryPayload{
-			{Time: time.Time{}, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0},
-			{Time: time.Time{}, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0},
-			{Time: time.Time{}, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0},
-			{Time: time.Time{}, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0},
+			{Time: time.Time{}, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: time.Time{}, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: time.Time{}, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: time.Time{}, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
 		},
 	)
 	mockEndpoint.On(
@@ -956,6 +1194,7 @@ func Test_pollBatteryDetails_InvalidDate(t *testing.T) {
 			{Time: time.Time{}, Voltage: 7.09, Current: 0.03, Temp: 20.5},
 		},
 	)
+	mockEndpoint.On("PublishAlarms", device, models.NewAlarmPayload(time.Time{}))
 	mockEndpoint.On("PublishHealth",
 		device,
 		mock.MatchedBy(matchHealthOk))
@@ -1075,6 +1314,31 @@ func setupPoll(wg *sync.WaitGroup, mockHttpClient *MockHttpClient, device models
 		},
 	).Run(func(args mock.Arguments) { wg.Done() })
 
+	// after the first battery details polling the status includes the history values
+	zero := 0.0
+	noCycles := 0
+	mockEndpoint.On(
+		"PublishDeviceStatus",
+		device,
+		models.DevicePayload{
+			ACPower:               -400.0,
+			SolarPower:            538.0,
+			Soc:                   93.0,
+			ChargePower:           132.0,
+			DischargePower:        0.0,
+			BatteryNum:            4,
+			GenerationTotalEnergy: 9.6,
+			GenerationTodayEnergy: 3.3,
+			WorkMode:              models.WorkMode("load_first"),
+			Status:                "on_grid",
+			SystemTemperature:     &zero,
+			MaxCellVoltage:        &zero,
+			MinCellVoltage:        &zero,
+			BatterySoh:            &zero,
+			BatteryCycles:         &noCycles,
+		},
+	).Run(func(args mock.Arguments) { wg.Done() }).Maybe()
+
 	// ----- pollBatteryDetails
 
 	mockHttpClient.OnGetNoahHistory(device.Serial, today, today, GrowattNoahHistory{Obj: GrowattNoahHistoryObj{Datas: []GrowattNoahHistoryData{
@@ -1115,14 +1379,15 @@ func setupPoll(wg *sync.WaitGroup, mockHttpClient *MockHttpClient, device models
 			Pv4Temp:    20.5,
 		}}}}, nil)
 
+	noStatus := 0
 	mockEndpoint.On(
 		"PublishBatteryDetails",
 		device,
 		[]models.BatteryPayload{
-			{Time: tm, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0},
-			{Time: tm, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0},
-			{Time: tm, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0},
-			{Time: tm, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0},
+			{Time: tm, SerialNumber: "serial124", Soc: 93.0, Temperature: 39.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: tm, SerialNumber: "serial125", Soc: 78.0, Temperature: 41.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: tm, SerialNumber: "serial126", Soc: 82.0, Temperature: 40.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
+			{Time: tm, SerialNumber: "serial127", Soc: 66.0, Temperature: 36.0, WarnStatus: &noStatus, ProtectStatus: &noStatus},
 		},
 	).Run(func(args mock.Arguments) { wg.Done() })
 
@@ -1137,6 +1402,8 @@ func setupPoll(wg *sync.WaitGroup, mockHttpClient *MockHttpClient, device models
 		},
 	).Run(func(args mock.Arguments) { wg.Done() })
 
+	mockEndpoint.On("PublishAlarms", device, models.NewAlarmPayload(tm))
+
 	mockEndpoint.On(
 		"PublishHealth",
 		device,
@@ -1261,6 +1528,80 @@ func TestPolling_multipleTimes(t *testing.T) {
 	mockEndpoint.AssertNumberOfCalls(t, "PublishHealth", 3*(nLoops+1))
 }
 
+type idleDurationCalculator struct {
+}
+
+func (m *idleDurationCalculator) Initial() (time.Duration, time.Duration) {
+	return 0, time.Hour
+}
+
+func (m *idleDurationCalculator) Next(lastTimestamp time.Time, retryDuration time.Duration) (time.Duration, time.Time, time.Duration) {
+	return time.Hour, lastTimestamp, time.Hour
+}
+
+func TestUpdateDevices(t *testing.T) {
+	mockHttpClient, service, device1, mockEndpoint := setupGrowattServiceMocks(t)
+	var wg sync.WaitGroup
+
+	device2 := device1
+	device2.Serial = randSerial(10)
+
+	service.opts.PollingInterval = time.Hour
+	service.opts.BatteryDetailsPollingInterval = time.Hour
+	service.opts.ParameterPollingInterval = time.Hour
+
+	setupPoll(&wg, mockHttpClient, device1, mockEndpoint)
+	setupPoll(&wg, mockHttpClient, device2, mockEndpoint)
+	mockEndpoint.On("SetDevices", []models.NoahDevicePayload{device1, device2})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wg.Add(7)
+	service.updateDevices(ctx, []models.NoahDevicePayload{device1}, &idleDurationCalculator{})
+	wg.Wait()
+	mockEndpoint.AssertCalled(t, "SetDevices", []models.NoahDevicePayload{device1})
+
+	// unchanged devices neither restart the poller nor update the endpoint
+
+	service.updateDevices(ctx, []models.NoahDevicePayload{device1}, &idleDurationCalculator{})
+	mockEndpoint.AssertNumberOfCalls(t, "SetDevices", 1)
+
+	// new device
+
+	wg.Add(7)
+	service.updateDevices(ctx, []models.NoahDevicePayload{device1, device2}, &idleDurationCalculator{})
+	wg.Wait()
+	mockEndpoint.AssertCalled(t, "SetDevices", []models.NoahDevicePayload{device1, device2})
+	assert.Len(t, service.devicePollers, 2)
+
+	// removed device
+
+	service.updateDevices(ctx, []models.NoahDevicePayload{device2}, &idleDurationCalculator{})
+	mockEndpoint.AssertCalled(t, "SetDevices", []models.NoahDevicePayload{device2})
+	mockEndpoint.AssertNumberOfCalls(t, "SetDevices", 3)
+	assert.Len(t, service.devicePollers, 1)
+	assert.Contains(t, service.devicePollers, device2.Serial)
+	assert.NotContains(t, service.parameterTrigger, device1.Serial)
+	// the health record of the removed device is pruned
+	assert.Empty(t, service.health.Device(device1.Serial).Calls)
+	assert.NotEmpty(t, service.health.Device(device2.Serial).Calls)
+
+	// polling restarts with all devices after it was stopped
+
+	service.StopPolling()
+	assert.Empty(t, service.devicePollers)
+
+	wg.Add(7)
+	service.updateDevices(ctx, []models.NoahDevicePayload{device2}, &idleDurationCalculator{})
+	wg.Wait()
+	mockEndpoint.AssertNumberOfCalls(t, "SetDevices", 4)
+	assert.Contains(t, service.devicePollers, device2.Serial)
+
+	cancel()
+	service.pollers.Wait()
+}
+
 func TestDefaultDurationCalculator_Initial(t *testing.T) {
 	calculator := &defaultDurationCalculator{}
 
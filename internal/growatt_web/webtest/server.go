@@ -0,0 +1,498 @@
+// Package webtest provides a fake Growatt web server for tests. It serves the
+// endpoints used by growatt_web over real HTTP, including the session cookie,
+// the redirect of requests without a session to the HTML login page and
+// injected faults.
+package webtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PathLogin        = "/login"
+	PathPlantList    = "/index/getPlantListTitle"
+	PathNoahList     = "/device/getNoahList"
+	PathNoahHistory  = "/device/getNoahHistory"
+	PathNoahStatus   = "/panel/noah/getNoahStatusData"
+	PathNoahTotals   = "/panel/noah/getNoahTotalData"
+	PathTcpSet       = "/tcpSet.do"
+	sessionCookie    = "JSESSIONID"
+	loginPage        = "<!DOCTYPE html>\n<html><head><title>Login</title></head><body><form action=\"/login\"></form></body></html>"
+	defaultPageSize  = 20
+	historyTimeFmt   = "2006-01-02 15:04:05"
+	wrongCredentials = "User name or password is incorrect"
+)
+
+type Plant struct {
+	Id   int
+	Name string
+}
+
+type Battery struct {
+	Serial string
+	Soc    int
+	Temp   float64
+}
+
+// Parameters are the settings of a device as returned by the noah list and
+// changed by tcpSet.do
+type Parameters struct {
+	ChargingSocHighLimit        int
+	ChargingSocLowLimit         int
+	DefaultMode                 int
+	DefaultACCouplePower        int
+	AllowGridCharging           int
+	GridConnectionControl       int
+	AcCouplePowerControl        int
+	LightLoadEnable             int
+	NeverPowerOff               int
+	AntiBackflowEnable          int
+	AntiBackflowPowerPercentage int
+}
+
+type Device struct {
+	PlantId      int
+	Serial       string
+	Alias        string
+	Model        string
+	Version      string
+	Status       int // e.g. -1 offline, 5 heating, 6 on grid
+	WorkMode     int
+	Soc          int
+	SolarPower   float64
+	ACPower      float64
+	BatteryPower float64 // positive while charging
+	EacToday     float64
+	EacTotal     float64
+	FaultStatus  int
+	Batteries    []Battery
+	Parameters   Parameters
+}
+
+// Fault replaces the response of a path
+type Fault struct {
+	Status int           // HTTP status, 200 if 0
+	Body   string        // response body, the regular response if empty
+	Delay  time.Duration // delay before the response is sent
+	Count  int           // number of requests the fault applies to, 0 for all
+}
+
+type Server struct {
+	*httptest.Server
+	// Location is the time zone of the history timestamps
+	Location *time.Location
+	// PageSize is the number of devices on a page of the noah list
+	PageSize int
+
+	lock     sync.Mutex
+	username string
+	password string
+	sessions map[string]bool
+	plants   []Plant
+	devices  []*Device
+	faults   map[string]*Fault
+	requests map[string]int
+	logins   int
+}
+
+// NewServer starts a server that accepts the given credentials. It is closed
+// with Close.
+func NewServer(username string, password string) *Server {
+	s := &Server{
+		Location: time.UTC,
+		PageSize: defaultPageSize,
+		username: username,
+		password: password,
+		sessions: make(map[string]bool),
+		faults:   make(map[string]*Fault),
+		requests: make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathLogin, s.handleLogin)
+	mux.HandleFunc(PathPlantList, s.session(s.handlePlantList))
+	mux.HandleFunc(PathNoahList, s.session(s.handleNoahList))
+	mux.HandleFunc(PathNoahHistory, s.session(s.handleNoahHistory))
+	mux.HandleFunc(PathNoahStatus, s.session(s.handleNoahStatus))
+	mux.HandleFunc(PathNoahTotals, s.session(s.handleNoahTotals))
+	mux.HandleFunc(PathTcpSet, s.session(s.handleTcpSet))
+	s.Server = httptest.NewServer(s.faulty(mux))
+	return s
+}
+
+func (s *Server) AddPlant(p Plant) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.plants = append(s.plants, p)
+}
+
+func (s *Server) AddDevice(d Device) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.devices = append(s.devices, &d)
+}
+
+// UpdateDevice changes the state of a device
+func (s *Server) UpdateDevice(serial string, update func(d *Device)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.device(serial); d != nil {
+		update(d)
+	}
+}
+
+// Device returns a copy of the state of a device
+func (s *Server) Device(serial string) Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.device(serial); d != nil {
+		return *d
+	}
+	return Device{}
+}
+
+// Inject makes the requests of path fail until the fault is cleared or used
+// up
+func (s *Server) Inject(path string, f Fault) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults[path] = &f
+}
+
+func (s *Server) ClearFaults() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.faults = make(map[string]*Fault)
+}
+
+// ExpireSessions logs out all clients, their next request is redirected to
+// the login page
+func (s *Server) ExpireSessions() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions = make(map[string]bool)
+}
+
+// Requests returns the number of requests of path, including failed ones
+func (s *Server) Requests(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[path]
+}
+
+// Logins returns the number of successful logins
+func (s *Server) Logins() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.logins
+}
+
+// device returns the device with the serial, s.lock must be held
+func (s *Server) device(serial string) *Device {
+	for _, d := range s.devices {
+		if d.Serial == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+// faulty counts the requests and applies the injected faults
+func (s *Server) faulty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.requests[r.URL.Path]++
+		var fault *Fault
+		if f, ok := s.faults[r.URL.Path]; ok && r.Method == http.MethodPost {
+			copied := *f
+			fault = &copied
+			if f.Count > 0 {
+				if f.Count--; f.Count == 0 {
+					delete(s.faults, r.URL.Path)
+				}
+			}
+		}
+		s.lock.Unlock()
+
+		if fault == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if fault.Status == 0 && fault.Body == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fault.Status != 0 {
+			w.WriteHeader(fault.Status)
+		}
+		_, _ = w.Write([]byte(fault.Body))
+	})
+}
+
+// session redirects requests without a valid session to the login page,
+// like the Growatt server does
+func (s *Server) session(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		s.lock.Lock()
+		valid := err == nil && s.sessions[cookie.Value]
+		s.lock.Unlock()
+
+		if !valid {
+			http.Redirect(w, r, PathLogin, http.StatusFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(loginPage))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.PostForm.Get("account") != s.username || r.PostForm.Get("password") != s.password {
+		writeJson(w, map[string]any{"result": -2, "msg": wrongCredentials})
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	s.lock.Lock()
+	s.sessions[id] = true
+	s.logins++
+	s.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/"})
+	writeJson(w, map[string]any{"result": 1, "msg": "OK"})
+}
+
+func (s *Server) handlePlantList(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	plants := []map[string]any{}
+	for _, p := range s.plants {
+		plants = append(plants, map[string]any{"id": strconv.Itoa(p.Id), "plantName": p.Name})
+	}
+	writeJson(w, plants)
+}
+
+func (s *Server) handleNoahList(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	plantId := r.PostForm.Get("plantId")
+	serial := r.PostForm.Get("deviceSn")
+	var matching []*Device
+	for _, d := range s.devices {
+		if strconv.Itoa(d.PlantId) == plantId && (serial == "" || d.Serial == serial) {
+			matching = append(matching, d)
+		}
+	}
+
+	page := max(1, atoi(r.PostForm.Get("currPage")))
+	pageSize := max(1, s.PageSize)
+	pages := max(1, (len(matching)+pageSize-1)/pageSize)
+	datas := []map[string]any{}
+	for _, d := range matching[min(len(matching), (page-1)*pageSize):min(len(matching), page*pageSize)] {
+		p := d.Parameters
+		datas = append(datas, map[string]any{
+			"sn":                          d.Serial,
+			"plantId":                     strconv.Itoa(d.PlantId),
+			"alias":                       d.Alias,
+			"deviceModel":                 d.Model,
+			"version":                     d.Version,
+			"chargingSocHighLimit":        strconv.Itoa(p.ChargingSocHighLimit),
+			"chargingSocLowLimit":         strconv.Itoa(p.ChargingSocLowLimit),
+			"defaultMode":                 strconv.Itoa(p.DefaultMode),
+			"defaultACCouplePower":        strconv.Itoa(p.DefaultACCouplePower),
+			"allowGridCharging":           strconv.Itoa(p.AllowGridCharging),
+			"gridConnectionControl":       strconv.Itoa(p.GridConnectionControl),
+			"acCouplePowerControl":        strconv.Itoa(p.AcCouplePowerControl),
+			"lightLoadEnable":             strconv.Itoa(p.LightLoadEnable),
+			"neverPowerOff":               strconv.Itoa(p.NeverPowerOff),
+			"antiBackflowEnable":          strconv.Itoa(p.AntiBackflowEnable),
+			"antiBackflowPowerPercentage": strconv.Itoa(p.AntiBackflowPowerPercentage),
+		})
+	}
+
+	writeJson(w, map[string]any{
+		"currPage": page,
+		"pages":    pages,
+		"pageSize": pageSize,
+		"count":    len(matching),
+		"datas":    datas,
+	})
+}
+
+// handleNoahHistory returns the current state of the device as the only
+// history row
+func (s *Server) handleNoahHistory(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.device(r.PostForm.Get("deviceSn"))
+	if d == nil {
+		writeJson(w, map[string]any{"result": 1, "obj": map[string]any{"datas": []any{}}})
+		return
+	}
+
+	row := map[string]any{
+		"deviceSn":                      d.Serial,
+		"time":                          time.Now().In(s.Location).Format(historyTimeFmt),
+		"status":                        d.Status,
+		"workMode":                      d.WorkMode,
+		"pac":                           d.ACPower,
+		"ppv":                           d.SolarPower,
+		"eacToday":                      d.EacToday,
+		"eacTotal":                      d.EacTotal,
+		"totalBatteryPackSoc":           d.Soc,
+		"totalBatteryPackChargingPower": int(d.BatteryPower),
+		"batteryPackageQuantity":        len(d.Batteries),
+		"faultStatus":                   d.FaultStatus,
+	}
+	for i, b := range d.Batteries[:min(len(d.Batteries), 4)] {
+		row[fmt.Sprintf("battery%dSerialNum", i+1)] = b.Serial
+		row[fmt.Sprintf("battery%dSoc", i+1)] = b.Soc
+		row[fmt.Sprintf("battery%dTemp", i+1)] = b.Temp
+	}
+
+	writeJson(w, map[string]any{
+		"result": 1,
+		"obj": map[string]any{
+			"datas":    []any{row},
+			"start":    0,
+			"haveNext": false,
+		},
+	})
+}
+
+func (s *Server) handleNoahStatus(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.device(r.PostForm.Get("deviceSn"))
+	if d == nil || strconv.Itoa(d.PlantId) != r.URL.Query().Get("plantId") {
+		writeJson(w, map[string]any{"result": 0, "msg": "device not found"})
+		return
+	}
+
+	writeJson(w, map[string]any{
+		"result": 1,
+		"obj": map[string]any{
+			"status":                        strconv.Itoa(d.Status),
+			"workMode":                      strconv.Itoa(d.WorkMode),
+			"totalBatteryPackSoc":           strconv.Itoa(d.Soc),
+			"batteryPackageQuantity":        strconv.Itoa(len(d.Batteries)),
+			"ppv":                           formatFloat(d.SolarPower),
+			"pac":                           formatFloat(d.ACPower),
+			"totalBatteryPackChargingPower": formatFloat(d.BatteryPower),
+			"isHaveCT":                      "false",
+			"groplugFlag":                   "false",
+			"shellyFlag":                    "false",
+			"groplugNum":                    "0",
+		},
+	})
+}
+
+func (s *Server) handleNoahTotals(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.device(r.PostForm.Get("deviceSn"))
+	if d == nil || strconv.Itoa(d.PlantId) != r.URL.Query().Get("plantId") {
+		writeJson(w, map[string]any{"result": 0, "msg": "device not found"})
+		return
+	}
+
+	writeJson(w, map[string]any{
+		"result": 1,
+		"obj": map[string]any{
+			"eacToday": formatFloat(d.EacToday),
+			"eacTotal": formatFloat(d.EacTotal),
+		},
+	})
+}
+
+// handleTcpSet changes the parameters of a device like the Growatt server
+func (s *Server) handleTcpSet(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	form := r.PostForm
+	d := s.device(form.Get("serialNum"))
+	if form.Get("action") != "noahSet" || d == nil {
+		writeJson(w, map[string]any{"success": false, "msg": "inv_set_fail"})
+		return
+	}
+
+	p := &d.Parameters
+	param1, param2 := atoi(form.Get("param1")), atoi(form.Get("param2"))
+	switch form.Get("type") {
+	case "charging_soc_high_limit":
+		p.ChargingSocHighLimit = param1
+	case "charging_soc_low_limit":
+		p.ChargingSocLowLimit = param1
+	case "system_out_put_power":
+		p.DefaultMode, p.DefaultACCouplePower = param1, param2
+	case "allow_grid_charging":
+		p.AllowGridCharging = param1
+	case "grid_connection_control":
+		p.GridConnectionControl = param1
+	case "ac_couple_power_control":
+		p.AcCouplePowerControl = param1
+	case "light_load_enable":
+		p.LightLoadEnable = param1
+	case "never_power_off":
+		p.NeverPowerOff = param1
+	case "anti_back_flow_setting":
+		p.AntiBackflowEnable, p.AntiBackflowPowerPercentage = param1, param2
+	default:
+		writeJson(w, map[string]any{"success": false, "msg": "inv_set_fail"})
+		return
+	}
+	writeJson(w, map[string]any{"success": true, "msg": "inv_set_success"})
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// atoi returns 0 for invalid numbers, like the lenient Growatt server
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
@@ -0,0 +1,73 @@
+package homeassistant
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Cleanup removes all entities of nexa-mqtt from Home Assistant. It retires
+// the topics of the state file and the retained discovery messages of NEXA
+// devices received from the broker within wait, then deletes the state file.
+// It returns the retired topics. nexa-mqtt must not be running, it would
+// announce the entities again.
+func Cleanup(client mqtt.Client, topicPrefix string, stateFile string, wait time.Duration) ([]string, error) {
+	state, err := loadState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	topics := state.topicSet()
+	token := client.Subscribe(fmt.Sprintf("%s/#", topicPrefix), 0, func(_ mqtt.Client, message mqtt.Message) {
+		if len(message.Payload()) > 0 && isDiscoveryTopic(topicPrefix, message.Topic()) {
+			lock.Lock()
+			topics[message.Topic()] = struct{}{}
+			lock.Unlock()
+		}
+	})
+	if token.Wait(); token.Error() != nil {
+		return nil, fmt.Errorf("could not subscribe to the discovery topics: %w", token.Error())
+	}
+	time.Sleep(wait)
+	client.Unsubscribe(fmt.Sprintf("%s/#", topicPrefix)).Wait()
+
+	lock.Lock()
+	retired := slices.Sorted(maps.Keys(topics))
+	lock.Unlock()
+
+	for _, topic := range retired {
+		slog.Info("retiring home assistant entity", slog.String("topic", topic))
+		// an empty retained message also deletes the retained discovery message
+		token := client.Publish(topic, 1, true, "")
+		if token.Wait(); token.Error() != nil {
+			return nil, fmt.Errorf("could not retire %s: %w", topic, token.Error())
+		}
+	}
+
+	if stateFile != "" {
+		if err := os.Remove(stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return retired, err
+		}
+	}
+	return retired, nil
+}
+
+// isDiscoveryTopic reports whether topic is the discovery topic of an entity
+// or device of nexa-mqtt, e.g. homeassistant/sensor/nexa_{serial}/SoC/config
+func isDiscoveryTopic(topicPrefix string, topic string) bool {
+	rest, ok := strings.CutPrefix(topic, topicPrefix+"/")
+	if !ok || !strings.HasSuffix(rest, "/config") {
+		return false
+	}
+	parts := strings.Split(rest, "/")
+	return (len(parts) == 3 || len(parts) == 4) && strings.HasPrefix(parts[1], "nexa_")
+}
@@ -0,0 +1,65 @@
+package homeassistant
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// message implements mqtt.Message
+type message struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m message) Topic() string   { return m.topic }
+func (m message) Payload() []byte { return []byte(m.payload) }
+
+func okToken() *MockToken {
+	token := NewMockToken()
+	token.On("Error", "Error").Return(nil)
+	return token
+}
+
+func TestCleanup(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "homeassistant.json")
+	assert.NoError(t, saveState(stateFile, discoveryState{Topics: []string{"homeassistant/sensor/nexa_device123/SoC/config"}}))
+
+	mockClient := MockMqttClient{}
+	mockClient.On("Subscribe", "homeassistant/#", byte(0), mock.Anything).Return(okToken()).Run(func(args mock.Arguments) {
+		callback := args.Get(2).(mqtt.MessageHandler)
+		callback(&mockClient, message{topic: "homeassistant/device/nexa_device234/config", payload: "{}"})
+		callback(&mockClient, message{topic: "homeassistant/sensor/nexa_device234/SoC/config", payload: "{}"})
+		callback(&mockClient, message{topic: "homeassistant/sensor/nexa_device345/SoC/config", payload: ""})
+		callback(&mockClient, message{topic: "homeassistant/sensor/zigbee_123/temperature/config", payload: "{}"})
+		callback(&mockClient, message{topic: "homeassistant/status", payload: "online"})
+	})
+	mockClient.On("Unsubscribe", "homeassistant/#").Return(NewMockToken())
+	mockClient.On("Publish", mock.Anything, byte(1), true, "").Return(okToken())
+
+	retired, err := Cleanup(&mockClient, "homeassistant", stateFile, time.Millisecond)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"homeassistant/device/nexa_device234/config",
+		"homeassistant/sensor/nexa_device123/SoC/config",
+		"homeassistant/sensor/nexa_device234/SoC/config",
+	}, retired)
+	mockClient.AssertNumberOfCalls(t, "Publish", 3)
+	_, err = os.Stat(stateFile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestIsDiscoveryTopic(t *testing.T) {
+	assert.True(t, isDiscoveryTopic("homeassistant", "homeassistant/sensor/nexa_device123/SoC/config"))
+	assert.True(t, isDiscoveryTopic("homeassistant", "homeassistant/device/nexa_device123/config"))
+	assert.False(t, isDiscoveryTopic("homeassistant", "homeassistant/sensor/zigbee_123/SoC/config"))
+	assert.False(t, isDiscoveryTopic("homeassistant", "other/sensor/nexa_device123/SoC/config"))
+	assert.False(t, isDiscoveryTopic("homeassistant", "homeassistant/sensor/nexa_device123/SoC"))
+}
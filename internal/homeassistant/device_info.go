@@ -10,6 +10,12 @@ type DeviceInfo struct {
 	TopicPrefix  string
 	Batteries    []BatteryInfo
 	PVs          []PVInfo
+	Meter        *MeterInfo // nil if no smart meter is connected
+	// seconds without a state after which the status entities become
+	// unavailable, 0 keeps the last state
+	ExpireAfter int
+	// the same for the battery, pv, meter and alarm entities
+	DetailsExpireAfter int
 }
 
 func (d DeviceInfo) StateTopic() string {
@@ -24,19 +30,34 @@ func (d DeviceInfo) ParameterCommandTopic() string {
 	return fmt.Sprintf("%s/%s/parameters/set", d.TopicPrefix, d.SerialNumber)
 }
 
+func (d DeviceInfo) CommandTopic() string {
+	return fmt.Sprintf("%s/%s/command", d.TopicPrefix, d.SerialNumber)
+}
+
 func (d DeviceInfo) HealthTopic() string {
 	return fmt.Sprintf("%s/%s/health", d.TopicPrefix, d.SerialNumber)
 }
 
+func (d DeviceInfo) AlarmsTopic() string {
+	return fmt.Sprintf("%s/%s/alarms", d.TopicPrefix, d.SerialNumber)
+}
+
 func (d DeviceInfo) AvailabilityTopic() string {
 	return fmt.Sprintf("%s/availability", d.TopicPrefix)
 }
 
 type BatteryInfo struct {
-	Alias      string
-	StateTopic string
+	Alias        string
+	SerialNumber string // empty until the first battery details are polled
+	StateTopic   string
+	Device       *Device // the battery entities belong to the NEXA if nil
 }
 
 type PVInfo struct {
 	StateTopic string
+	Device     *Device // the pv entities belong to the NEXA if nil
+}
+
+type MeterInfo struct {
+	StateTopic string
 }
@@ -1,6 +1,9 @@
 package homeassistant
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func generateDevice(info DeviceInfo) Device {
 	return Device{
@@ -13,6 +16,34 @@ func generateDevice(info DeviceInfo) Device {
 	}
 }
 
+// generateBatteryDevice returns the sub-device of a battery, it is linked to
+// the NEXA and identified by the serial of the battery
+func generateBatteryDevice(info DeviceInfo, battery BatteryInfo) Device {
+	return Device{
+		Identifiers:  []string{fmt.Sprintf("nexa_battery_%s", battery.SerialNumber)},
+		Name:         strings.TrimSpace(fmt.Sprintf("%s %s", info.Alias, battery.Alias)),
+		Manufacturer: "Growatt",
+		Model:        "Battery",
+		SerialNumber: battery.SerialNumber,
+		ViaDevice:    fmt.Sprintf("nexa_%s", info.SerialNumber),
+	}
+}
+
+// generatePVDevice returns the sub-device of the i-th pv input of the NEXA
+func generatePVDevice(info DeviceInfo, i int) Device {
+	return Device{
+		Identifiers: []string{fmt.Sprintf("nexa_%s_pv%d", info.SerialNumber, i)},
+		Name:        strings.TrimSpace(fmt.Sprintf("%s PV%d", info.Alias, i)),
+		Model:       "PV Input",
+		ViaDevice:   fmt.Sprintf("nexa_%s", info.SerialNumber),
+	}
+}
+
+// ptr returns a pointer to v, for the optional fields of the discovery payloads
+func ptr[T any](v T) *T {
+	return &v
+}
+
 func generateOrigin(appVersion string) Origin {
 	return Origin{
 		Name:       "nexa-mqtt",
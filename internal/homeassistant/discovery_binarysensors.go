@@ -24,8 +24,9 @@ func generateBinarySensorDiscoveryPayload(appVersion string, info DeviceInfo) []
 				// value_json.status may be "online", "offline", "heating", ...
 				ValueTemplate: fmt.Sprintf("{{ 'offline' if value_json.status == '%s' else 'online' }}", models.Offline),
 			},
-			PayloadOff: "offline",
-			PayloadOn:  "online",
+			PayloadOff:  "offline",
+			PayloadOn:   "online",
+			ExpireAfter: info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -41,24 +42,75 @@ func generateBinarySensorDiscoveryPayload(appVersion string, info DeviceInfo) []
 				// value_json.status may be "online", "offline", "heating", ...
 				ValueTemplate: fmt.Sprintf("{{ 'heating' if value_json.status == '%s' else 'not-heating' }}", models.Heating),
 			},
-			PayloadOff: "not-heating",
-			PayloadOn:  "heating",
+			PayloadOff:  "not-heating",
+			PayloadOn:   "heating",
+			ExpireAfter: info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:        "API Health",
-				UniqueId:    fmt.Sprintf("%s_api_health", info.SerialNumber),
-				DeviceClass: DeviceClassConnectivity,
-				Device:      device,
-				Origin:      origin,
+				Name:           "API Health",
+				UniqueId:       fmt.Sprintf("%s_api_health", info.SerialNumber),
+				DeviceClass:    DeviceClassConnectivity,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
-				StateTopic:    info.HealthTopic(),
-				ValueTemplate: "{{ value_json.status }}",
+				StateTopic:          info.HealthTopic(),
+				ValueTemplate:       "{{ value_json.status }}",
+				JsonAttributesTopic: info.HealthTopic(),
 			},
 			PayloadOff: "error",
 			PayloadOn:  "ok",
 		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Fault",
+				UniqueId:    fmt.Sprintf("%s_alarm_fault", info.SerialNumber),
+				DeviceClass: DeviceClassProblem,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.AlarmsTopic(),
+				ValueTemplate: "{{ 'ON' if value_json.fault else 'OFF' }}",
+			},
+			PayloadOff:  string(models.OFF),
+			PayloadOn:   string(models.ON),
+			ExpireAfter: info.DetailsExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Warning",
+				UniqueId:    fmt.Sprintf("%s_alarm_warning", info.SerialNumber),
+				DeviceClass: DeviceClassProblem,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.AlarmsTopic(),
+				ValueTemplate: "{{ 'ON' if value_json.warning else 'OFF' }}",
+			},
+			PayloadOff:  string(models.OFF),
+			PayloadOn:   string(models.ON),
+			ExpireAfter: info.DetailsExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Protection",
+				UniqueId:    fmt.Sprintf("%s_alarm_protection", info.SerialNumber),
+				DeviceClass: DeviceClassProblem,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.AlarmsTopic(),
+				ValueTemplate: "{{ 'ON' if value_json.protection else 'OFF' }}",
+			},
+			PayloadOff:  string(models.OFF),
+			PayloadOn:   string(models.ON),
+			ExpireAfter: info.DetailsExpireAfter,
+		},
 	}
 
 	return binarySensors
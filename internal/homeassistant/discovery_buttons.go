@@ -0,0 +1,43 @@
+package homeassistant
+
+import (
+	"fmt"
+	"nexa-mqtt/pkg/models"
+)
+
+func generateButtonDiscoveryPayload(appVersion string, info DeviceInfo) []Button {
+	device := generateDevice(info)
+	origin := generateOrigin(appVersion)
+
+	buttons := []Button{
+		{
+			CommonConfig: CommonConfig{
+				Name:     "Refresh",
+				UniqueId: fmt.Sprintf("%s_refresh", info.SerialNumber),
+				Icon:     IconRefresh,
+				Device:   device,
+				Origin:   origin,
+			},
+			CommandConfig: CommandConfig{
+				CommandTopic: info.CommandTopic(),
+			},
+			PayloadPress: models.CommandRefresh,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "Rediscover",
+				UniqueId:       fmt.Sprintf("%s_rediscover", info.SerialNumber),
+				Icon:           IconMagnify,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			CommandConfig: CommandConfig{
+				CommandTopic: info.CommandTopic(),
+			},
+			PayloadPress: models.CommandRediscover,
+		},
+	}
+
+	return buttons
+}
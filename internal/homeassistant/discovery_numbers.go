@@ -9,12 +9,13 @@ func generateNumberDiscoveryPayload(appVersion string, info DeviceInfo) []Number
 	numbers := []Number{
 		{
 			CommonConfig: CommonConfig{
-				Name:        "Default AC Output Power",
-				UniqueId:    fmt.Sprintf("%s_default_output_w", info.SerialNumber),
-				Icon:        "",
-				DeviceClass: DeviceClassPower,
-				Device:      device,
-				Origin:      origin,
+				Name:           "Default AC Output Power",
+				UniqueId:       fmt.Sprintf("%s_default_output_w", info.SerialNumber),
+				Icon:           "",
+				DeviceClass:    DeviceClassPower,
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -33,11 +34,12 @@ func generateNumberDiscoveryPayload(appVersion string, info DeviceInfo) []Number
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "Charging Limit",
-				UniqueId: fmt.Sprintf("%s_charging_limit", info.SerialNumber),
-				Icon:     IconBatteryArrowUpOutline,
-				Device:   device,
-				Origin:   origin,
+				Name:           "Charging Limit",
+				UniqueId:       fmt.Sprintf("%s_charging_limit", info.SerialNumber),
+				Icon:           IconBatteryArrowUpOutline,
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -56,11 +58,12 @@ func generateNumberDiscoveryPayload(appVersion string, info DeviceInfo) []Number
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "Discharge Limit",
-				UniqueId: fmt.Sprintf("%s_discharge_limit", info.SerialNumber),
-				Icon:     IconBatteryArrowDownOutline,
-				Device:   device,
-				Origin:   origin,
+				Name:           "Discharge Limit",
+				UniqueId:       fmt.Sprintf("%s_discharge_limit", info.SerialNumber),
+				Icon:           IconBatteryArrowDownOutline,
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -79,11 +82,12 @@ func generateNumberDiscoveryPayload(appVersion string, info DeviceInfo) []Number
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "Anti Backflow Power Percentage",
-				UniqueId: fmt.Sprintf("%s_anti_backflow_power_percentage", info.SerialNumber),
-				Icon:     "",
-				Device:   device,
-				Origin:   origin,
+				Name:           "Anti Backflow Power Percentage",
+				UniqueId:       fmt.Sprintf("%s_anti_backflow_power_percentage", info.SerialNumber),
+				Icon:           "",
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
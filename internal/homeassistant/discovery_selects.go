@@ -12,11 +12,12 @@ func generateSelectDiscoveryPayload(appVersion string, info DeviceInfo) []Select
 	selects := []Select{
 		{
 			CommonConfig: CommonConfig{
-				Name:        "Default Mode",
-				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "default_mode"),
-				DeviceClass: DeviceClassEnum,
-				Device:      device,
-				Origin:      origin,
+				Name:           "Default Mode",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "default_mode"),
+				DeviceClass:    DeviceClassEnum,
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -3,6 +3,7 @@ package homeassistant
 import (
 	"fmt"
 	"nexa-mqtt/pkg/models"
+	"strings"
 )
 
 func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor {
@@ -22,8 +23,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.ac_w }}",
 			},
-			StateClass:        StateClassMeasurement,
-			UnitOfMeasurement: UnitWatt,
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -38,8 +41,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.solar_w }}",
 			},
-			StateClass:        StateClassMeasurement,
-			UnitOfMeasurement: UnitWatt,
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -54,8 +59,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.charge_w }}",
 			},
-			StateClass:        StateClassMeasurement,
-			UnitOfMeasurement: UnitWatt,
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -70,8 +77,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.discharge_w }}",
 			},
-			StateClass:        StateClassMeasurement,
-			UnitOfMeasurement: UnitWatt,
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -85,8 +94,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.generation_total_kwh }}",
 			},
-			StateClass:        StateClassTotalIncreasing,
-			UnitOfMeasurement: UnitKilowattHours,
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -100,8 +111,10 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.generation_today_kwh }}",
 			},
-			StateClass:        StateClassTotalIncreasing,
-			UnitOfMeasurement: UnitKilowattHours,
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -115,22 +128,26 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.soc }}",
 			},
-			StateClass:        StateClassMeasurement,
-			UnitOfMeasurement: UnitPercent,
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitPercent,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "Number Of Batteries",
-				UniqueId: fmt.Sprintf("%s_%s", info.SerialNumber, "battery_num"),
-				Icon:     IconCarBattery,
-				Device:   device,
-				Origin:   origin,
+				Name:           "Number Of Batteries",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "battery_num"),
+				Icon:           IconCarBattery,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.battery_num }}",
 			},
-			StateClass: StateClassMeasurement,
+			StateClass:  StateClassMeasurement,
+			ExpireAfter: info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -144,7 +161,8 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				StateTopic:    info.StateTopic(),
 				ValueTemplate: "{{ value_json.work_mode }}",
 			},
-			Options: []string{models.WorkModeLoadFirst, models.WorkModeBatteryFirst, models.SmartSelfUse},
+			Options:     []string{models.WorkModeLoadFirst, models.WorkModeBatteryFirst, models.SmartSelfUse},
+			ExpireAfter: info.ExpireAfter,
 		},
 		{
 			CommonConfig: CommonConfig{
@@ -167,18 +185,320 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 				models.Heating,
 				models.OnGrid,
 				models.OffGrid},
+			ExpireAfter: info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:     "Active Alarms",
+				UniqueId: fmt.Sprintf("%s_%s", info.SerialNumber, "alarms"),
+				Icon:     IconAlertOutline,
+				Device:   device,
+				Origin:   origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic: info.AlarmsTopic(),
+				// the state of a sensor is limited to 255 characters, the
+				// attributes hold the complete alarms
+				ValueTemplate:       "{{ ((value_json.alarms | map(attribute='name') | join(', ')) or 'none')[:255] }}",
+				JsonAttributesTopic: info.AlarmsTopic(),
+			},
+			ExpireAfter: info.DetailsExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Household Load",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "household_load"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).household_load_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Household Load Apart From Smart Plugs",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "household_load_apart_from_plugs"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).household_load_apart_from_plugs_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "CT Power",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "ct_power"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).ct_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Grid Power",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "grid_power"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).grid_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Smart Plug Power",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "smart_plug_power"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).smart_plug_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Other Power",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "other_power"),
+				DeviceClass: DeviceClassPower,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.consumption | default({})).other_w | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitWatt,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Charge Energy",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "charge_energy"),
+				Icon:        IconBatteryPlus,
+				DeviceClass: DeviceClassEnergy,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.energy | default({})).charge_kwh | default(None) }}",
+			},
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Discharge Energy",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "discharge_energy"),
+				Icon:        IconBatteryMinus,
+				DeviceClass: DeviceClassEnergy,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.energy | default({})).discharge_kwh | default(None) }}",
+			},
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "Solar Energy",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "solar_energy"),
+				Icon:        IconSolarPower,
+				DeviceClass: DeviceClassEnergy,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.energy | default({})).solar_kwh | default(None) }}",
+			},
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "AC Input Energy",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "ac_input_energy"),
+				DeviceClass: DeviceClassEnergy,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.energy | default({})).ac_input_kwh | default(None) }}",
+			},
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:        "AC Output Energy",
+				UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "ac_output_energy"),
+				DeviceClass: DeviceClassEnergy,
+				Device:      device,
+				Origin:      origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ (value_json.energy | default({})).ac_output_kwh | default(None) }}",
+			},
+			StateClass:                StateClassTotalIncreasing,
+			UnitOfMeasurement:         UnitKilowattHours,
+			SuggestedDisplayPrecision: ptr(2),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "System Temperature",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "system_temp"),
+				DeviceClass:    DeviceClassTemperature,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ value_json.system_temp | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitCelsius,
+			SuggestedDisplayPrecision: ptr(1),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "Max Cell Voltage",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "max_cell_voltage"),
+				DeviceClass:    DeviceClassVoltage,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ value_json.max_cell_voltage | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitVoltage,
+			SuggestedDisplayPrecision: ptr(3),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "Min Cell Voltage",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "min_cell_voltage"),
+				DeviceClass:    DeviceClassVoltage,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ value_json.min_cell_voltage | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitVoltage,
+			SuggestedDisplayPrecision: ptr(3),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "Battery SoH",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "battery_soh"),
+				Icon:           IconBatteryHeart,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ value_json.battery_soh | default(None) }}",
+			},
+			StateClass:                StateClassMeasurement,
+			UnitOfMeasurement:         UnitPercent,
+			SuggestedDisplayPrecision: ptr(0),
+			ExpireAfter:               info.ExpireAfter,
+		},
+		{
+			CommonConfig: CommonConfig{
+				Name:           "Battery Cycles",
+				UniqueId:       fmt.Sprintf("%s_%s", info.SerialNumber, "battery_cycles"),
+				Icon:           IconBatterySync,
+				EntityCategory: EntityCategoryDiagnostic,
+				Device:         device,
+				Origin:         origin,
+			},
+			StateConfig: StateConfig{
+				StateTopic:    info.StateTopic(),
+				ValueTemplate: "{{ value_json.battery_cycles | default(None) }}",
+			},
+			StateClass:  StateClassTotalIncreasing,
+			ExpireAfter: info.ExpireAfter,
 		},
 	}
 
 	for _, b := range info.Batteries {
+		batDevice := device
+		if b.Device != nil {
+			batDevice = *b.Device
+		}
 		sensors = append(sensors, []Sensor{
 			{
 				CommonConfig: CommonConfig{
-					Name:        fmt.Sprintf("%s Timestamp", b.Alias),
-					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "time"),
-					DeviceClass: DeviceClassTimestamp,
-					Device:      device,
-					Origin:      origin,
+					Name:             fmt.Sprintf("%s Timestamp", b.Alias),
+					UniqueId:         fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "time"),
+					DeviceClass:      DeviceClassTimestamp,
+					EntityCategory:   EntityCategoryDiagnostic,
+					EnabledByDefault: ptr(false),
+					Device:           batDevice,
+					Origin:           origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    b.StateTopic,
@@ -190,44 +510,84 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 					Name:        fmt.Sprintf("%s SoC", b.Alias),
 					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "soc"),
 					DeviceClass: DeviceClassBattery,
-					Device:      device,
+					Device:      batDevice,
 					Origin:      origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    b.StateTopic,
 					ValueTemplate: "{{ value_json.soc }}",
 				},
-				StateClass:        StateClassMeasurement,
-				UnitOfMeasurement: UnitPercent,
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitPercent,
+				SuggestedDisplayPrecision: ptr(0),
+				ExpireAfter:               info.DetailsExpireAfter,
 			},
 			{
 				CommonConfig: CommonConfig{
 					Name:        fmt.Sprintf("%s Temperature", b.Alias),
 					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "temp"),
 					DeviceClass: DeviceClassTemperature,
-					Device:      device,
+					Device:      batDevice,
 					Origin:      origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    b.StateTopic,
 					ValueTemplate: "{{ value_json.temp }}",
 				},
-				StateClass:        StateClassMeasurement,
-				UnitOfMeasurement: UnitCelsius,
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitCelsius,
+				SuggestedDisplayPrecision: ptr(1),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:           fmt.Sprintf("%s Warning Status", b.Alias),
+					UniqueId:       fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "warn_status"),
+					Icon:           IconAlertOutline,
+					EntityCategory: EntityCategoryDiagnostic,
+					Device:         batDevice,
+					Origin:         origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    b.StateTopic,
+					ValueTemplate: "{{ value_json.warn_status | default(None) }}",
+				},
+				ExpireAfter: info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:           fmt.Sprintf("%s Protection Status", b.Alias),
+					UniqueId:       fmt.Sprintf("%s_%s_%s", info.SerialNumber, b.Alias, "protect_status"),
+					Icon:           IconShieldAlertOutline,
+					EntityCategory: EntityCategoryDiagnostic,
+					Device:         batDevice,
+					Origin:         origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    b.StateTopic,
+					ValueTemplate: "{{ value_json.protect_status | default(None) }}",
+				},
+				ExpireAfter: info.DetailsExpireAfter,
 			},
 		}...)
 	}
 
 	for i, pv := range info.PVs {
 		name := fmt.Sprintf("PV%d", i)
+		pvDevice := device
+		if pv.Device != nil {
+			pvDevice = *pv.Device
+		}
 		sensors = append(sensors, []Sensor{
 			{
 				CommonConfig: CommonConfig{
-					Name:        fmt.Sprintf("%s Timestamp", name),
-					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "time"),
-					DeviceClass: DeviceClassTimestamp,
-					Device:      device,
-					Origin:      origin,
+					Name:             fmt.Sprintf("%s Timestamp", name),
+					UniqueId:         fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "time"),
+					DeviceClass:      DeviceClassTimestamp,
+					EntityCategory:   EntityCategoryDiagnostic,
+					EnabledByDefault: ptr(false),
+					Device:           pvDevice,
+					Origin:           origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    pv.StateTopic,
@@ -239,47 +599,308 @@ func generateSensorDiscoveryPayload(appVersion string, info DeviceInfo) []Sensor
 					Name:        fmt.Sprintf("%s Voltage", name),
 					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "voltage"),
 					DeviceClass: DeviceClassVoltage,
-					Device:      device,
+					Device:      pvDevice,
 					Origin:      origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    pv.StateTopic,
 					ValueTemplate: "{{ value_json.voltage }}",
 				},
-				StateClass:        StateClassMeasurement,
-				UnitOfMeasurement: UnitVoltage,
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitVoltage,
+				SuggestedDisplayPrecision: ptr(1),
+				ExpireAfter:               info.DetailsExpireAfter,
 			},
 			{
 				CommonConfig: CommonConfig{
 					Name:        fmt.Sprintf("%s Current", name),
 					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "current"),
 					DeviceClass: DeviceClassCurrent,
-					Device:      device,
+					Device:      pvDevice,
 					Origin:      origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    pv.StateTopic,
 					ValueTemplate: "{{ value_json.current }}",
 				},
-				StateClass:        StateClassMeasurement,
-				UnitOfMeasurement: UnitCurrent,
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitCurrent,
+				SuggestedDisplayPrecision: ptr(2),
+				ExpireAfter:               info.DetailsExpireAfter,
 			},
 			{
 				CommonConfig: CommonConfig{
-					Name:        fmt.Sprintf("%s Temperature", name),
-					UniqueId:    fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "temp"),
-					DeviceClass: DeviceClassTemperature,
-					Device:      device,
-					Origin:      origin,
+					Name:             fmt.Sprintf("%s Temperature", name),
+					UniqueId:         fmt.Sprintf("%s_%s_%s", info.SerialNumber, name, "temp"),
+					DeviceClass:      DeviceClassTemperature,
+					EnabledByDefault: ptr(false),
+					Device:           pvDevice,
+					Origin:           origin,
 				},
 				StateConfig: StateConfig{
 					StateTopic:    pv.StateTopic,
 					ValueTemplate: "{{ value_json.temp }}",
 				},
-				StateClass:        StateClassMeasurement,
-				UnitOfMeasurement: UnitCelsius,
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitCelsius,
+				SuggestedDisplayPrecision: ptr(1),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+		}...)
+	}
+
+	if m := info.Meter; m != nil {
+		sensors = append(sensors, []Sensor{
+			{
+				CommonConfig: CommonConfig{
+					Name:             "Meter Timestamp",
+					UniqueId:         fmt.Sprintf("%s_%s", info.SerialNumber, "meter_time"),
+					DeviceClass:      DeviceClassTimestamp,
+					EntityCategory:   EntityCategoryDiagnostic,
+					EnabledByDefault: ptr(false),
+					Device:           device,
+					Origin:           origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.time }}",
+				},
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:             "Meter Frequency",
+					UniqueId:         fmt.Sprintf("%s_%s", info.SerialNumber, "meter_frequency"),
+					DeviceClass:      DeviceClassFrequency,
+					EnabledByDefault: ptr(false),
+					Device:           device,
+					Origin:           origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.frequency }}",
+				},
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitHertz,
+				SuggestedDisplayPrecision: ptr(2),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:        "Meter Active Power",
+					UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "meter_active_power"),
+					DeviceClass: DeviceClassPower,
+					Device:      device,
+					Origin:      origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.active_power_w }}",
+				},
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitWatt,
+				SuggestedDisplayPrecision: ptr(0),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:             "Meter Reactive Power",
+					UniqueId:         fmt.Sprintf("%s_%s", info.SerialNumber, "meter_reactive_power"),
+					DeviceClass:      DeviceClassReactivePower,
+					EnabledByDefault: ptr(false),
+					Device:           device,
+					Origin:           origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.reactive_power_var }}",
+				},
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitVoltAmpereReactive,
+				SuggestedDisplayPrecision: ptr(0),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:             "Meter Apparent Power",
+					UniqueId:         fmt.Sprintf("%s_%s", info.SerialNumber, "meter_apparent_power"),
+					DeviceClass:      DeviceClassApparentPower,
+					EnabledByDefault: ptr(false),
+					Device:           device,
+					Origin:           origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.apparent_power_va }}",
+				},
+				StateClass:                StateClassMeasurement,
+				UnitOfMeasurement:         UnitVoltAmpere,
+				SuggestedDisplayPrecision: ptr(0),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:             "Meter Power Factor",
+					UniqueId:         fmt.Sprintf("%s_%s", info.SerialNumber, "meter_power_factor"),
+					DeviceClass:      DeviceClassPowerFactor,
+					EnabledByDefault: ptr(false),
+					Device:           device,
+					Origin:           origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.power_factor }}",
+				},
+				StateClass:                StateClassMeasurement,
+				SuggestedDisplayPrecision: ptr(2),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:        "Meter Forward Energy",
+					UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "meter_forward_energy"),
+					DeviceClass: DeviceClassEnergy,
+					Device:      device,
+					Origin:      origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.forward_active_energy_kwh }}",
+				},
+				StateClass:                StateClassTotalIncreasing,
+				UnitOfMeasurement:         UnitKilowattHours,
+				SuggestedDisplayPrecision: ptr(2),
+				ExpireAfter:               info.DetailsExpireAfter,
+			},
+			{
+				CommonConfig: CommonConfig{
+					Name:        "Meter Reverse Energy",
+					UniqueId:    fmt.Sprintf("%s_%s", info.SerialNumber, "meter_reverse_energy"),
+					DeviceClass: DeviceClassEnergy,
+					Device:      device,
+					Origin:      origin,
+				},
+				StateConfig: StateConfig{
+					StateTopic:    m.StateTopic,
+					ValueTemplate: "{{ value_json.reverse_active_energy_kwh }}",
+				},
+				StateClass:                StateClassTotalIncreasing,
+				UnitOfMeasurement:         UnitKilowattHours,
+				SuggestedDisplayPrecision: ptr(2),
+				ExpireAfter:               info.DetailsExpireAfter,
 			},
 		}...)
+
+		for i, phase := range []string{"A", "B", "C"} {
+			sensors = append(sensors, []Sensor{
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Voltage", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "voltage"),
+						DeviceClass:      DeviceClassVoltage,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].voltage }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					UnitOfMeasurement:         UnitVoltage,
+					SuggestedDisplayPrecision: ptr(1),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Current", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "current"),
+						DeviceClass:      DeviceClassCurrent,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].current }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					UnitOfMeasurement:         UnitCurrent,
+					SuggestedDisplayPrecision: ptr(2),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Active Power", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "active_power"),
+						DeviceClass:      DeviceClassPower,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].active_power_w }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					UnitOfMeasurement:         UnitWatt,
+					SuggestedDisplayPrecision: ptr(0),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Reactive Power", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "reactive_power"),
+						DeviceClass:      DeviceClassReactivePower,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].reactive_power_var }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					UnitOfMeasurement:         UnitVoltAmpereReactive,
+					SuggestedDisplayPrecision: ptr(0),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Apparent Power", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "apparent_power"),
+						DeviceClass:      DeviceClassApparentPower,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].apparent_power_va }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					UnitOfMeasurement:         UnitVoltAmpere,
+					SuggestedDisplayPrecision: ptr(0),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+				{
+					CommonConfig: CommonConfig{
+						Name:             fmt.Sprintf("Meter Phase %s Power Factor", phase),
+						UniqueId:         fmt.Sprintf("%s_meter_%s_%s", info.SerialNumber, strings.ToLower(phase), "power_factor"),
+						DeviceClass:      DeviceClassPowerFactor,
+						EnabledByDefault: ptr(false),
+						Device:           device,
+						Origin:           origin,
+					},
+					StateConfig: StateConfig{
+						StateTopic:    m.StateTopic,
+						ValueTemplate: fmt.Sprintf("{{ value_json.phases[%d].power_factor }}", i),
+					},
+					StateClass:                StateClassMeasurement,
+					SuggestedDisplayPrecision: ptr(2),
+					ExpireAfter:               info.DetailsExpireAfter,
+				},
+			}...)
+		}
 	}
 
 	return sensors
@@ -11,10 +11,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 	switches := []Switch{
 		{
 			CommonConfig: CommonConfig{
-				Name:     "AllowGridCharging",
-				UniqueId: fmt.Sprintf("%s_allow_grid_charging", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "AllowGridCharging",
+				UniqueId:       fmt.Sprintf("%s_allow_grid_charging", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -27,10 +28,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "GridConnectionControl",
-				UniqueId: fmt.Sprintf("%s_grid_connection_control", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "GridConnectionControl",
+				UniqueId:       fmt.Sprintf("%s_grid_connection_control", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -43,10 +45,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "AcCouplePowerControl",
-				UniqueId: fmt.Sprintf("%s_ac_couple_power_control", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "AcCouplePowerControl",
+				UniqueId:       fmt.Sprintf("%s_ac_couple_power_control", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -59,10 +62,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "LightLoadEnable",
-				UniqueId: fmt.Sprintf("%s_light_load_enable", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "LightLoadEnable",
+				UniqueId:       fmt.Sprintf("%s_light_load_enable", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -75,10 +79,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "NeverPowerOff",
-				UniqueId: fmt.Sprintf("%s_never_power_off", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "NeverPowerOff",
+				UniqueId:       fmt.Sprintf("%s_never_power_off", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
@@ -91,10 +96,11 @@ func generateSwitchDiscoveryPayload(appVersion string, info DeviceInfo) []Switch
 		},
 		{
 			CommonConfig: CommonConfig{
-				Name:     "AntiBackflowEnable",
-				UniqueId: fmt.Sprintf("%s_anti_backflow_enable", info.SerialNumber),
-				Device:   device,
-				Origin:   origin,
+				Name:           "AntiBackflowEnable",
+				UniqueId:       fmt.Sprintf("%s_anti_backflow_enable", info.SerialNumber),
+				EntityCategory: EntityCategoryConfig,
+				Device:         device,
+				Origin:         origin,
 			},
 			StateConfig: StateConfig{
 				StateTopic:    info.ParameterStateTopic(),
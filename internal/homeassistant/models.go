@@ -3,16 +3,28 @@ package homeassistant
 type DeviceClass string
 
 const (
-	DeviceClassNone         DeviceClass = ""
-	DeviceClassEnergy       DeviceClass = "energy"
-	DeviceClassBattery      DeviceClass = "battery"
-	DeviceClassTemperature  DeviceClass = "temperature"
-	DeviceClassPower        DeviceClass = "power"
-	DeviceClassConnectivity DeviceClass = "connectivity"
-	DeviceClassEnum         DeviceClass = "enum"
-	DeviceClassTimestamp    DeviceClass = "timestamp"
-	DeviceClassVoltage      DeviceClass = "voltage"
-	DeviceClassCurrent      DeviceClass = "current"
+	DeviceClassNone          DeviceClass = ""
+	DeviceClassEnergy        DeviceClass = "energy"
+	DeviceClassBattery       DeviceClass = "battery"
+	DeviceClassTemperature   DeviceClass = "temperature"
+	DeviceClassPower         DeviceClass = "power"
+	DeviceClassConnectivity  DeviceClass = "connectivity"
+	DeviceClassEnum          DeviceClass = "enum"
+	DeviceClassTimestamp     DeviceClass = "timestamp"
+	DeviceClassVoltage       DeviceClass = "voltage"
+	DeviceClassCurrent       DeviceClass = "current"
+	DeviceClassProblem       DeviceClass = "problem"
+	DeviceClassFrequency     DeviceClass = "frequency"
+	DeviceClassReactivePower DeviceClass = "reactive_power"
+	DeviceClassApparentPower DeviceClass = "apparent_power"
+	DeviceClassPowerFactor   DeviceClass = "power_factor"
+)
+
+type EntityCategory string
+
+const (
+	EntityCategoryConfig     EntityCategory = "config"
+	EntityCategoryDiagnostic EntityCategory = "diagnostic"
 )
 
 type StateClass string
@@ -25,12 +37,15 @@ const (
 type Unit string
 
 const (
-	UnitKilowattHours Unit = "kWh"
-	UnitWatt          Unit = "W"
-	UnitPercent       Unit = "%"
-	UnitCelsius       Unit = "°C"
-	UnitVoltage       Unit = "V"
-	UnitCurrent       Unit = "A"
+	UnitKilowattHours      Unit = "kWh"
+	UnitWatt               Unit = "W"
+	UnitPercent            Unit = "%"
+	UnitCelsius            Unit = "°C"
+	UnitVoltage            Unit = "V"
+	UnitCurrent            Unit = "A"
+	UnitHertz              Unit = "Hz"
+	UnitVoltAmpereReactive Unit = "var"
+	UnitVoltAmpere         Unit = "VA"
 )
 
 type Icon string
@@ -43,6 +58,12 @@ const (
 	IconHeatWave                Icon = "mdi:heat-wave"
 	IconBatteryArrowUpOutline   Icon = "mdi:battery-arrow-up-outline"
 	IconBatteryArrowDownOutline Icon = "mdi:battery-arrow-down-outline"
+	IconBatteryHeart            Icon = "mdi:battery-heart-variant"
+	IconBatterySync             Icon = "mdi:battery-sync"
+	IconAlertOutline            Icon = "mdi:alert-outline"
+	IconShieldAlertOutline      Icon = "mdi:shield-alert-outline"
+	IconRefresh                 Icon = "mdi:refresh"
+	IconMagnify                 Icon = "mdi:magnify"
 )
 
 type Device struct {
@@ -53,6 +74,7 @@ type Device struct {
 	SwVersion    string   `json:"sw_version,omitempty"`
 	Model        string   `json:"model,omitempty"`
 	SerialNumber string   `json:"serial_number,omitempty"`
+	ViaDevice    string   `json:"via_device,omitempty"`
 }
 
 type Origin struct {
@@ -69,18 +91,22 @@ const (
 )
 
 type CommonConfig struct {
-	Name              string      `json:"name"`
-	UniqueId          string      `json:"unique_id,omitempty"`
-	Icon              Icon        `json:"icon,omitempty"`
-	DeviceClass       DeviceClass `json:"device_class,omitempty"`
-	Device            Device      `json:"device,omitempty"`
-	Origin            Origin      `json:"origin,omitempty"`
-	AvailabilityTopic string      `json:"availability_topic,omitempty"`
+	Platform          string         `json:"platform,omitempty"` // only in device-based discovery
+	Name              string         `json:"name"`
+	UniqueId          string         `json:"unique_id,omitempty"`
+	Icon              Icon           `json:"icon,omitempty"`
+	DeviceClass       DeviceClass    `json:"device_class,omitempty"`
+	Device            Device         `json:"device,omitzero"`
+	Origin            Origin         `json:"origin,omitzero"`
+	AvailabilityTopic string         `json:"availability_topic,omitempty"`
+	EntityCategory    EntityCategory `json:"entity_category,omitempty"`
+	EnabledByDefault  *bool          `json:"enabled_by_default,omitempty"` // nil is enabled
 }
 
 type StateConfig struct {
-	StateTopic    string `json:"state_topic"`
-	ValueTemplate string `json:"value_template,omitempty"`
+	StateTopic          string `json:"state_topic"`
+	ValueTemplate       string `json:"value_template,omitempty"`
+	JsonAttributesTopic string `json:"json_attributes_topic,omitempty"`
 }
 
 type CommandConfig struct {
@@ -92,8 +118,9 @@ type CommandConfig struct {
 type BinarySensor struct {
 	CommonConfig
 	StateConfig
-	PayloadOff string `json:"payload_off,omitempty"`
-	PayloadOn  string `json:"payload_on,omitempty"`
+	PayloadOff  string `json:"payload_off,omitempty"`
+	PayloadOn   string `json:"payload_on,omitempty"`
+	ExpireAfter int    `json:"expire_after,omitempty"` // seconds
 }
 
 // see https://www.home-assistant.io/integrations/switch.mqtt/
@@ -105,12 +132,15 @@ type Switch struct {
 	PayloadOn  string `json:"payload_on,omitempty"`
 }
 
+// see https://www.home-assistant.io/integrations/sensor.mqtt/
 type Sensor struct {
 	CommonConfig
 	StateConfig
-	StateClass        StateClass `json:"state_class,omitempty"`
-	UnitOfMeasurement Unit       `json:"unit_of_measurement,omitempty"`
-	Options           []string   `json:"options,omitempty"`
+	StateClass                StateClass `json:"state_class,omitempty"`
+	UnitOfMeasurement         Unit       `json:"unit_of_measurement,omitempty"`
+	SuggestedDisplayPrecision *int       `json:"suggested_display_precision,omitempty"`
+	Options                   []string   `json:"options,omitempty"`
+	ExpireAfter               int        `json:"expire_after,omitempty"` // seconds
 }
 
 type Select struct {
@@ -134,3 +164,18 @@ type Number struct {
 	Min               float64    `json:"min"`
 	Max               float64    `json:"max"`
 }
+
+// see https://www.home-assistant.io/integrations/button.mqtt/
+type Button struct {
+	CommonConfig
+	CommandConfig
+	PayloadPress string `json:"payload_press,omitempty"`
+}
+
+// see https://www.home-assistant.io/integrations/mqtt/#device-discovery-payload
+type DeviceDiscovery struct {
+	Device            Device         `json:"device"`
+	Origin            Origin         `json:"origin"`
+	AvailabilityTopic string         `json:"availability_topic,omitempty"`
+	Components        map[string]any `json:"components"`
+}
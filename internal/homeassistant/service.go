@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"nexa-mqtt/pkg/models"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -20,19 +23,61 @@ type Options struct {
 	TopicPrefix    string
 	Version        string
 	SwitchAsSelect bool
+	// DeviceDiscovery publishes one discovery payload per device instead of
+	// one per entity, supported by Home Assistant 2024.11 and later
+	DeviceDiscovery bool
+	// StateFile keeps the discovery topics across restarts, so entities that
+	// went away while nexa-mqtt was stopped are retired too. Empty keeps them
+	// in memory only.
+	StateFile string
+	// BatteryDevices announces each battery as a device linked to its NEXA,
+	// once its serial is known. Only supported by the per-entity discovery,
+	// ignored by the device discovery.
+	BatteryDevices bool
+	// PVDevices announces each pv input as a device linked to its NEXA. Only
+	// supported by the per-entity discovery, ignored by the device discovery.
+	PVDevices bool
+	// PollingInterval and DetailsPollingInterval are the longest intervals
+	// the device status and the battery, pv, meter and alarm data are polled
+	// in. Their entities become unavailable when no state was received for
+	// three intervals. 0 keeps the last state.
+	PollingInterval        time.Duration
+	DetailsPollingInterval time.Duration
 }
 
 type Service struct {
 	options Options
 
+	lock              sync.Mutex
 	devices           []DeviceInfo
 	statusChangeToken mqtt.Token
+	// discovery topics sent by the last sendDiscovery
+	topics map[string]struct{}
+	// platform by entity unique id by device discovery topic, sent by the
+	// last sendDiscovery
+	components map[string]map[string]string
+	// topics restored from the state file whose device was not announced
+	// since, they are kept until the periodic discovery
+	restored map[string]struct{}
 }
 
 func NewService(opts Options) *Service {
+	// the device discovery payload announces a single device
+	if opts.DeviceDiscovery && (opts.BatteryDevices || opts.PVDevices) {
+		slog.Warn("battery and pv devices are only supported by the entity discovery, they are ignored")
+		opts.BatteryDevices = false
+		opts.PVDevices = false
+	}
 	s := &Service{
 		options: opts,
 	}
+	if state, err := loadState(opts.StateFile); err != nil {
+		slog.Error("could not load home assistant state", slog.String("error", err.Error()))
+	} else {
+		s.topics = state.topicSet()
+		s.components = state.Components
+		s.restored = state.topicSet()
+	}
 	s.statusChangeToken = opts.MqttClient.Subscribe(fmt.Sprintf("%s/status", opts.TopicPrefix), 0, s.haStatusChange)
 	go s.discoveryLooper()
 	return s
@@ -41,114 +86,256 @@ func NewService(opts Options) *Service {
 func (s *Service) discoveryLooper() {
 	for {
 		<-time.After(6 * time.Hour)
+		s.lock.Lock()
 		if len(s.devices) > 0 {
-			s.sendDiscovery()
+			s.sendDiscovery(true)
 		}
+		s.lock.Unlock()
 	}
 }
 
 func (s *Service) haStatusChange(client mqtt.Client, message mqtt.Message) {
-	s.sendDiscovery()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sendDiscovery(false)
 }
 
+// SetDevices replaces the announced devices. Entities of removed devices and
+// batteries are retired.
 func (s *Service) SetDevices(devices []DeviceInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	s.devices = devices
-	s.sendDiscovery()
+	s.sendDiscovery(false)
 }
 
-func (s *Service) sendDiscovery() {
+// sendDiscovery publishes the discovery payloads of all devices. An empty
+// payload is sent to each topic of the previous run that is no longer used,
+// which removes the entity from Home Assistant. Topics restored from the state
+// file are only retired if their device is announced or retireRestored is
+// set, so the entities of accounts that are still logging in are kept. s.lock
+// must be held by the caller.
+func (s *Service) sendDiscovery(retireRestored bool) {
+	previous := s.topics
+	s.topics = make(map[string]struct{})
+	previousComponents := s.components
+	s.components = make(map[string]map[string]string)
+
+	announced := make(map[string]bool)
 	for _, d := range s.devices {
-		sensors := generateSensorDiscoveryPayload(s.options.Version, d)
-		for _, sensor := range sensors {
-			sensor.AvailabilityTopic = d.AvailabilityTopic()
-			if b, err := json.Marshal(sensor); err != nil {
-				slog.Error("could not marshal sensor discovery payload", slog.Any("sensor", sensor))
-			} else {
-				topic := s.sensorTopic(sensor)
-				s.options.MqttClient.Publish(topic, 0, false, string(b))
-			}
+		announced[d.SerialNumber] = true
+	}
+	s.migrateDiscovery(previous, announced)
+
+	for _, d := range s.devices {
+		if s.options.DeviceDiscovery {
+			s.sendDeviceDiscovery(d, previousComponents)
+		} else {
+			s.sendEntityDiscovery(d)
 		}
+	}
 
-		selects := generateSelectDiscoveryPayload(s.options.Version, d)
-		for _, sel := range selects {
-			sel.AvailabilityTopic = d.AvailabilityTopic()
-			if b, err := json.Marshal(sel); err != nil {
-				slog.Error("could not marshal select discovery payload", slog.Any("select", sel))
-			} else {
-				topic := s.selectTopic(sel)
-				s.options.MqttClient.Publish(topic, 0, false, string(b))
+	restored := make(map[string]struct{})
+	for topic := range previous {
+		if _, ok := s.topics[topic]; ok {
+			continue
+		}
+		if _, ok := s.restored[topic]; ok && !retireRestored && !announced[topicSerial(topic)] {
+			restored[topic] = struct{}{}
+			s.topics[topic] = struct{}{}
+			if components, ok := previousComponents[topic]; ok {
+				s.components[topic] = components
 			}
+			continue
 		}
+		slog.Info("retiring home assistant entity", slog.String("topic", topic))
+		s.options.MqttClient.Publish(topic, 0, false, "")
+	}
+	s.restored = restored
 
-		numbers := generateNumberDiscoveryPayload(s.options.Version, d)
-		for _, number := range numbers {
-			number.AvailabilityTopic = d.AvailabilityTopic()
-			if b, err := json.Marshal(number); err != nil {
-				slog.Error("could not marshal number discovery payload", slog.Any("number", number))
-			} else {
-				topic := s.numberTopic(number)
-				s.options.MqttClient.Publish(topic, 0, false, string(b))
-			}
+	if s.options.StateFile != "" && !maps.Equal(previous, s.topics) {
+		if err := saveState(s.options.StateFile, newDiscoveryState(s.topics, s.components)); err != nil {
+			slog.Error("could not save home assistant state", slog.String("error", err.Error()))
 		}
+	}
+}
 
-		binarySensors := generateBinarySensorDiscoveryPayload(s.options.Version, d)
-		for _, sensor := range binarySensors {
-			sensor.AvailabilityTopic = d.AvailabilityTopic()
-			if b, err := json.Marshal(sensor); err != nil {
-				slog.Error("could not marshal binary sensor discovery payload", slog.Any("sensor", sensor))
-			} else {
-				topic := s.binarySensorTopic(sensor)
-				s.options.MqttClient.Publish(topic, 0, false, string(b))
-			}
+// migrateDiscovery tells Home Assistant to keep the entities of the topics
+// of the other discovery format, they are announced with the current format
+// next. See https://www.home-assistant.io/integrations/mqtt/#migration-from-single-component-to-device-based-discovery
+func (s *Service) migrateDiscovery(previous map[string]struct{}, announced map[string]bool) {
+	for topic := range previous {
+		if s.isDeviceTopic(topic) != s.options.DeviceDiscovery && announced[topicSerial(topic)] {
+			slog.Info("migrating home assistant discovery", slog.String("topic", topic))
+			s.options.MqttClient.Publish(topic, 0, false, `{"migrate_discovery":true}`)
+		}
+	}
+}
+
+// sendEntityDiscovery publishes a discovery payload for each entity of the
+// device
+func (s *Service) sendEntityDiscovery(d DeviceInfo) {
+	for _, c := range s.deviceComponents(d) {
+		if b, err := json.Marshal(c.config); err != nil {
+			slog.Error("could not marshal discovery payload", slog.String("platform", c.platform), slog.Any("config", c.config))
+		} else {
+			s.publish(s.entityTopic(c.platform, d.SerialNumber, c.name), string(b))
+		}
+	}
+}
+
+// sendDeviceDiscovery publishes a single discovery payload with all entities
+// of the device. Entities sent for the device by the previous run that are no
+// longer used are removed by sending only their platform.
+func (s *Service) sendDeviceDiscovery(d DeviceInfo, previousComponents map[string]map[string]string) {
+	topic := s.deviceTopic(d.SerialNumber)
+	payload := DeviceDiscovery{
+		Device:            generateDevice(d),
+		Origin:            generateOrigin(s.options.Version),
+		AvailabilityTopic: d.AvailabilityTopic(),
+		Components:        make(map[string]any),
+	}
+
+	platforms := make(map[string]string)
+	for _, c := range s.deviceComponents(d) {
+		payload.Components[c.uniqueId] = c.config
+		platforms[c.uniqueId] = c.platform
+	}
+	for id, platform := range previousComponents[topic] {
+		if _, ok := platforms[id]; !ok {
+			slog.Info("retiring home assistant entity", slog.String("topic", topic), slog.String("entity", id))
+			payload.Components[id] = map[string]string{"platform": platform}
+		}
+	}
+
+	if b, err := json.Marshal(payload); err != nil {
+		slog.Error("could not marshal device discovery payload", slog.String("device", d.SerialNumber))
+	} else {
+		s.publish(topic, string(b))
+		s.components[topic] = platforms
+	}
+}
+
+// component is the discovery config of a single entity
+type component struct {
+	platform string
+	name     string
+	uniqueId string
+	config   any
+}
+
+// deviceComponents returns the entities of the device. With device-based
+// discovery the device, origin and availability are sent once for all
+// entities, so they are left out of the entity configs.
+func (s *Service) deviceComponents(d DeviceInfo) []component {
+	if !s.options.DeviceDiscovery {
+		d = s.withSubDevices(d)
+	}
+	d.ExpireAfter = expireAfter(s.options.PollingInterval)
+	d.DetailsExpireAfter = expireAfter(s.options.DetailsPollingInterval)
+
+	var components []component
+	add := func(platform string, common *CommonConfig, config any) {
+		if s.options.DeviceDiscovery {
+			common.Platform = platform
+			common.Device = Device{}
+			common.Origin = Origin{}
+		} else {
+			common.AvailabilityTopic = d.AvailabilityTopic()
 		}
+		components = append(components, component{platform: platform, name: common.Name, uniqueId: common.UniqueId, config: config})
+	}
+
+	for _, sensor := range generateSensorDiscoveryPayload(s.options.Version, d) {
+		add("sensor", &sensor.CommonConfig, &sensor)
+	}
+
+	for _, sel := range generateSelectDiscoveryPayload(s.options.Version, d) {
+		add("select", &sel.CommonConfig, &sel)
+	}
+
+	for _, number := range generateNumberDiscoveryPayload(s.options.Version, d) {
+		add("number", &number.CommonConfig, &number)
+	}
 
-		switches := generateSwitchDiscoveryPayload(s.options.Version, d)
-		for _, sw := range switches {
-			if s.options.SwitchAsSelect {
-				sel := Select{
-					CommonConfig:  sw.CommonConfig,
-					StateConfig:   sw.StateConfig,
-					CommandConfig: sw.CommandConfig,
-					Options:       []string{string(models.OFF), string(models.ON)},
-				}
-				sel.AvailabilityTopic = d.AvailabilityTopic()
-				if b, err := json.Marshal(sel); err != nil {
-					slog.Error("could not marshal select discovery payload", slog.Any("select", sel))
-				} else {
-					topic := s.selectTopic(sel)
-					s.options.MqttClient.Publish(topic, 0, false, string(b))
-				}
-			} else {
-				sw.AvailabilityTopic = d.AvailabilityTopic()
-				if b, err := json.Marshal(sw); err != nil {
-					slog.Error("could not marshal switch discovery payload", slog.Any("sensor", sw))
-				} else {
-					topic := s.switchTopic(sw)
-					s.options.MqttClient.Publish(topic, 0, false, string(b))
-				}
+	for _, sensor := range generateBinarySensorDiscoveryPayload(s.options.Version, d) {
+		add("binary_sensor", &sensor.CommonConfig, &sensor)
+	}
+
+	for _, button := range generateButtonDiscoveryPayload(s.options.Version, d) {
+		add("button", &button.CommonConfig, &button)
+	}
+
+	for _, sw := range generateSwitchDiscoveryPayload(s.options.Version, d) {
+		if s.options.SwitchAsSelect {
+			sel := Select{
+				CommonConfig:  sw.CommonConfig,
+				StateConfig:   sw.StateConfig,
+				CommandConfig: sw.CommandConfig,
+				Options:       []string{string(models.OFF), string(models.ON)},
 			}
+			add("select", &sel.CommonConfig, &sel)
+		} else {
+			add("switch", &sw.CommonConfig, &sw)
 		}
 	}
+
+	return components
 }
 
-func (s *Service) sensorTopic(sensor Sensor) string {
-	return fmt.Sprintf("%s/sensor/%s/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", sensor.Device.SerialNumber), strings.ReplaceAll(sensor.Name, " ", ""))
+// withSubDevices returns a copy of the device info with the sub-devices of
+// the batteries and pv inputs set, as far as they are enabled
+func (s *Service) withSubDevices(d DeviceInfo) DeviceInfo {
+	if s.options.BatteryDevices {
+		d.Batteries = slices.Clone(d.Batteries)
+		for i, b := range d.Batteries {
+			if b.SerialNumber != "" {
+				device := generateBatteryDevice(d, b)
+				d.Batteries[i].Device = &device
+			}
+		}
+	}
+	if s.options.PVDevices {
+		d.PVs = slices.Clone(d.PVs)
+		for i := range d.PVs {
+			device := generatePVDevice(d, i)
+			d.PVs[i].Device = &device
+		}
+	}
+	return d
 }
 
-func (s *Service) selectTopic(sensor Select) string {
-	return fmt.Sprintf("%s/select/%s/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", sensor.Device.SerialNumber), strings.ReplaceAll(sensor.Name, " ", ""))
+// expireAfter returns the expire_after of the entities polled in interval in
+// seconds, a few missed polls are tolerated
+func expireAfter(interval time.Duration) int {
+	return int((3 * interval).Seconds())
 }
 
-func (s *Service) binarySensorTopic(sensor BinarySensor) string {
-	return fmt.Sprintf("%s/binary_sensor/%s/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", sensor.Device.SerialNumber), strings.ReplaceAll(sensor.Name, " ", ""))
+func (s *Service) publish(topic string, payload string) {
+	s.options.MqttClient.Publish(topic, 0, false, payload)
+	s.topics[topic] = struct{}{}
 }
 
-func (s *Service) numberTopic(number Number) string {
-	return fmt.Sprintf("%s/number/%s/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", number.Device.SerialNumber), strings.ReplaceAll(number.Name, " ", ""))
+func (s *Service) entityTopic(platform string, serial string, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", s.options.TopicPrefix, platform, fmt.Sprintf("nexa_%s", serial), strings.ReplaceAll(name, " ", ""))
+}
 
+func (s *Service) isDeviceTopic(topic string) bool {
+	return strings.HasPrefix(topic, s.options.TopicPrefix+"/device/")
 }
 
-func (s *Service) switchTopic(sw Switch) string {
-	return fmt.Sprintf("%s/switch/%s/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", sw.Device.SerialNumber), strings.ReplaceAll(sw.Name, " ", ""))
+// topicSerial returns the serial of the device of a discovery topic
+func topicSerial(topic string) string {
+	for _, part := range strings.Split(topic, "/") {
+		if serial, ok := strings.CutPrefix(part, "nexa_"); ok {
+			return serial
+		}
+	}
+	return ""
+}
 
+func (s *Service) deviceTopic(serial string) string {
+	return fmt.Sprintf("%s/device/%s/config", s.options.TopicPrefix, fmt.Sprintf("nexa_%s", serial))
 }
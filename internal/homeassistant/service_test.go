@@ -1,8 +1,14 @@
 package homeassistant
 
 import (
+	"encoding/json"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 func Test_sendDiscovery(t *testing.T) {
@@ -72,6 +78,7 @@ func Test_sendDiscovery(t *testing.T) {
 
 	setupTopics(&mockClient, "device123")
 	setupSwitchTopics(&mockClient, "device123")
+	setupButtonTopics(&mockClient, "device123")
 	setupBatteryTopics(&mockClient, "device123", "BAT0")
 	setupBatteryTopics(&mockClient, "device123", "BAT1")
 	setupPVTopics(&mockClient, "device123", "PV0")
@@ -80,13 +87,14 @@ func Test_sendDiscovery(t *testing.T) {
 	setupPVTopics(&mockClient, "device123", "PV3")
 	setupTopics(&mockClient, "device234")
 	setupSwitchTopics(&mockClient, "device234")
+	setupButtonTopics(&mockClient, "device234")
 	setupBatteryTopics(&mockClient, "device234", "BAT0")
 	setupPVTopics(&mockClient, "device234", "PV0")
 	setupPVTopics(&mockClient, "device234", "PV1")
 	setupPVTopics(&mockClient, "device234", "PV2")
 	setupPVTopics(&mockClient, "device234", "PV3")
 
-	service.sendDiscovery()
+	service.sendDiscovery(false)
 
 	mockClient.AssertExpectations(t)
 }
@@ -159,6 +167,7 @@ func Test_sendDiscoverySwitchAsSelect(t *testing.T) {
 
 	setupTopics(&mockClient, "device123")
 	setupSwitchTopicsAsSelect(&mockClient, "device123")
+	setupButtonTopics(&mockClient, "device123")
 	setupBatteryTopics(&mockClient, "device123", "BAT0")
 	setupBatteryTopics(&mockClient, "device123", "BAT1")
 	setupPVTopics(&mockClient, "device123", "PV0")
@@ -167,65 +176,210 @@ func Test_sendDiscoverySwitchAsSelect(t *testing.T) {
 	setupPVTopics(&mockClient, "device123", "PV3")
 	setupTopics(&mockClient, "device234")
 	setupSwitchTopicsAsSelect(&mockClient, "device234")
+	setupButtonTopics(&mockClient, "device234")
 	setupBatteryTopics(&mockClient, "device234", "BAT0")
 	setupPVTopics(&mockClient, "device234", "PV0")
 	setupPVTopics(&mockClient, "device234", "PV1")
 	setupPVTopics(&mockClient, "device234", "PV2")
 	setupPVTopics(&mockClient, "device234", "PV3")
 
-	service.sendDiscovery()
+	service.sendDiscovery(false)
 
 	mockClient.AssertExpectations(t)
 }
 
+func Test_sendDiscoveryMeter(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:  &mockClient,
+			TopicPrefix: "homeassistant",
+			Version:     "version",
+		},
+	}
+
+	service.SetDevices([]DeviceInfo{{SerialNumber: "device123", TopicPrefix: "test", Meter: &MeterInfo{StateTopic: "test/device123/METER"}}})
+
+	payloads := make(map[string]string)
+	for _, call := range mockClient.Calls {
+		payloads[call.Arguments.String(0)] = call.Arguments.String(3)
+	}
+	assert.Equal(t,
+		`{"name":"Meter Forward Energy","unique_id":"device123_meter_forward_energy","device_class":"energy","device":{"identifiers":["nexa_device123"],"manufacturer":"Growatt","serial_number":"device123"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/device123/METER","value_template":"{{ value_json.forward_active_energy_kwh }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`,
+		payloads["homeassistant/sensor/nexa_device123/MeterForwardEnergy/config"])
+	assert.Equal(t,
+		`{"name":"Meter Phase B Voltage","unique_id":"device123_meter_b_voltage","device_class":"voltage","device":{"identifiers":["nexa_device123"],"manufacturer":"Growatt","serial_number":"device123"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","enabled_by_default":false,"state_topic":"test/device123/METER","value_template":"{{ value_json.phases[1].voltage }}","state_class":"measurement","unit_of_measurement":"V","suggested_display_precision":1}`,
+		payloads["homeassistant/sensor/nexa_device123/MeterPhaseBVoltage/config"])
+	assert.Contains(t, payloads, "homeassistant/sensor/nexa_device123/MeterReverseEnergy/config")
+	assert.Contains(t, payloads, "homeassistant/sensor/nexa_device123/MeterPhaseCPowerFactor/config")
+
+	// without a meter no meter entities are announced
+	mockClient.Calls = nil
+	service.SetDevices([]DeviceInfo{{SerialNumber: "device123", TopicPrefix: "test"}})
+	var retired []string
+	for _, call := range mockClient.Calls {
+		if call.Arguments.Get(3) == "" {
+			retired = append(retired, call.Arguments.String(0))
+		}
+	}
+	assert.Contains(t, retired, "homeassistant/sensor/nexa_device123/MeterForwardEnergy/config")
+}
+
+func TestSetDevices_RetiresRemovedEntities(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:  &mockClient,
+			TopicPrefix: "homeassistant",
+			Version:     "version",
+		},
+	}
+
+	device := func(serial string, batteries ...string) DeviceInfo {
+		d := DeviceInfo{SerialNumber: serial, TopicPrefix: "test"}
+		for _, bat := range batteries {
+			d.Batteries = append(d.Batteries, BatteryInfo{Alias: bat, StateTopic: "test/" + serial + "/" + bat})
+		}
+		return d
+	}
+
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0", "BAT1"), device("device234", "BAT0")})
+	firstRun := len(mockClient.Calls)
+
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0")})
+
+	var retired []string
+	for _, call := range mockClient.Calls[firstRun:] {
+		if call.Arguments.Get(3) == "" {
+			retired = append(retired, call.Arguments.String(0))
+		}
+	}
+	assert.Contains(t, retired, "homeassistant/sensor/nexa_device123/BAT1SoC/config")
+	assert.Contains(t, retired, "homeassistant/sensor/nexa_device234/SoC/config")
+	assert.Contains(t, retired, "homeassistant/sensor/nexa_device234/BAT0SoC/config")
+	assert.Contains(t, retired, "homeassistant/switch/nexa_device234/AllowGridCharging/config")
+	assert.NotContains(t, retired, "homeassistant/sensor/nexa_device123/BAT0SoC/config")
+	assert.NotContains(t, retired, "homeassistant/sensor/nexa_device123/SoC/config")
+
+	// no changes, nothing is retired
+
+	secondRun := len(mockClient.Calls)
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0")})
+	for _, call := range mockClient.Calls[secondRun:] {
+		assert.NotEqual(t, "", call.Arguments.Get(3))
+	}
+}
+
 func setupTopics(mockClient *MockMqttClient, serial string) {
 	r := strings.NewReplacer("$SERIAL", serial)
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/ACPower/config"),
-		r.Replace(`{"name":"AC Power","unique_id":"$SERIAL_ac_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.ac_w }}","state_class":"measurement","unit_of_measurement":"W"}`))
+		r.Replace(`{"name":"AC Power","unique_id":"$SERIAL_ac_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.ac_w }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/SolarPower/config"),
-		r.Replace(`{"name":"Solar Power","unique_id":"$SERIAL_solar_power","icon":"mdi:solar-power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.solar_w }}","state_class":"measurement","unit_of_measurement":"W"}`))
+		r.Replace(`{"name":"Solar Power","unique_id":"$SERIAL_solar_power","icon":"mdi:solar-power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.solar_w }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/SoC/config"),
-		r.Replace(`{"name":"SoC","unique_id":"$SERIAL_soc","device_class":"battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.soc }}","state_class":"measurement","unit_of_measurement":"%"}`))
+		r.Replace(`{"name":"SoC","unique_id":"$SERIAL_soc","device_class":"battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.soc }}","state_class":"measurement","unit_of_measurement":"%","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/ChargingPower/config"),
-		r.Replace(`{"name":"Charging Power","unique_id":"$SERIAL_charging_power","icon":"mdi:battery-plus","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.charge_w }}","state_class":"measurement","unit_of_measurement":"W"}`))
+		r.Replace(`{"name":"Charging Power","unique_id":"$SERIAL_charging_power","icon":"mdi:battery-plus","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.charge_w }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/DischargePower/config"),
-		r.Replace(`{"name":"Discharge Power","unique_id":"$SERIAL_discharge_power","icon":"mdi:battery-minus","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.discharge_w }}","state_class":"measurement","unit_of_measurement":"W"}`))
+		r.Replace(`{"name":"Discharge Power","unique_id":"$SERIAL_discharge_power","icon":"mdi:battery-minus","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.discharge_w }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/NumberOfBatteries/config"),
-		r.Replace(`{"name":"Number Of Batteries","unique_id":"$SERIAL_battery_num","icon":"mdi:car-battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.battery_num }}","state_class":"measurement"}`))
+		r.Replace(`{"name":"Number Of Batteries","unique_id":"$SERIAL_battery_num","icon":"mdi:car-battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.battery_num }}","state_class":"measurement"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/GenerationTotal/config"),
-		r.Replace(`{"name":"Generation Total","unique_id":"$SERIAL_generation_total","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.generation_total_kwh }}","state_class":"total_increasing","unit_of_measurement":"kWh"}`))
+		r.Replace(`{"name":"Generation Total","unique_id":"$SERIAL_generation_total","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.generation_total_kwh }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/GenerationToday/config"),
-		r.Replace(`{"name":"Generation Today","unique_id":"$SERIAL_generation_today","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.generation_today_kwh }}","state_class":"total_increasing","unit_of_measurement":"kWh"}`))
+		r.Replace(`{"name":"Generation Today","unique_id":"$SERIAL_generation_today","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.generation_today_kwh }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/WorkingMode/config"),
 		r.Replace(`{"name":"Working Mode","unique_id":"$SERIAL_work_mode","device_class":"enum","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.work_mode }}","options":["load_first","battery_first","smart_self_use"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/Status/config"),
 		r.Replace(`{"name":"Status","unique_id":"$SERIAL_status","device_class":"enum","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ value_json.status }}","options":["offline","load_first","battery_first","smart_self_use","fault","heating","on_grid","off_grid"]}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/ActiveAlarms/config"),
+		r.Replace(`{"name":"Active Alarms","unique_id":"$SERIAL_alarms","icon":"mdi:alert-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/alarms","value_template":"{{ ((value_json.alarms | map(attribute='name') | join(', ')) or 'none')[:255] }}","json_attributes_topic":"test/$SERIAL/alarms"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/binary_sensor/nexa_$SERIAL/Fault/config"),
+		r.Replace(`{"name":"Fault","unique_id":"$SERIAL_alarm_fault","device_class":"problem","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/alarms","value_template":"{{ 'ON' if value_json.fault else 'OFF' }}","payload_off":"OFF","payload_on":"ON"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/binary_sensor/nexa_$SERIAL/Warning/config"),
+		r.Replace(`{"name":"Warning","unique_id":"$SERIAL_alarm_warning","device_class":"problem","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/alarms","value_template":"{{ 'ON' if value_json.warning else 'OFF' }}","payload_off":"OFF","payload_on":"ON"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/binary_sensor/nexa_$SERIAL/Protection/config"),
+		r.Replace(`{"name":"Protection","unique_id":"$SERIAL_alarm_protection","device_class":"problem","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/alarms","value_template":"{{ 'ON' if value_json.protection else 'OFF' }}","payload_off":"OFF","payload_on":"ON"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/HouseholdLoad/config"),
+		r.Replace(`{"name":"Household Load","unique_id":"$SERIAL_household_load","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).household_load_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/HouseholdLoadApartFromSmartPlugs/config"),
+		r.Replace(`{"name":"Household Load Apart From Smart Plugs","unique_id":"$SERIAL_household_load_apart_from_plugs","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).household_load_apart_from_plugs_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/CTPower/config"),
+		r.Replace(`{"name":"CT Power","unique_id":"$SERIAL_ct_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).ct_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/GridPower/config"),
+		r.Replace(`{"name":"Grid Power","unique_id":"$SERIAL_grid_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).grid_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/SmartPlugPower/config"),
+		r.Replace(`{"name":"Smart Plug Power","unique_id":"$SERIAL_smart_plug_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).smart_plug_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/OtherPower/config"),
+		r.Replace(`{"name":"Other Power","unique_id":"$SERIAL_other_power","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.consumption | default({})).other_w | default(None) }}","state_class":"measurement","unit_of_measurement":"W","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/ChargeEnergy/config"),
+		r.Replace(`{"name":"Charge Energy","unique_id":"$SERIAL_charge_energy","icon":"mdi:battery-plus","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.energy | default({})).charge_kwh | default(None) }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/DischargeEnergy/config"),
+		r.Replace(`{"name":"Discharge Energy","unique_id":"$SERIAL_discharge_energy","icon":"mdi:battery-minus","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.energy | default({})).discharge_kwh | default(None) }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/SolarEnergy/config"),
+		r.Replace(`{"name":"Solar Energy","unique_id":"$SERIAL_solar_energy","icon":"mdi:solar-power","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.energy | default({})).solar_kwh | default(None) }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/ACInputEnergy/config"),
+		r.Replace(`{"name":"AC Input Energy","unique_id":"$SERIAL_ac_input_energy","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.energy | default({})).ac_input_kwh | default(None) }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/ACOutputEnergy/config"),
+		r.Replace(`{"name":"AC Output Energy","unique_id":"$SERIAL_ac_output_energy","device_class":"energy","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ (value_json.energy | default({})).ac_output_kwh | default(None) }}","state_class":"total_increasing","unit_of_measurement":"kWh","suggested_display_precision":2}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/SystemTemperature/config"),
+		r.Replace(`{"name":"System Temperature","unique_id":"$SERIAL_system_temp","device_class":"temperature","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.system_temp | default(None) }}","state_class":"measurement","unit_of_measurement":"°C","suggested_display_precision":1}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/MaxCellVoltage/config"),
+		r.Replace(`{"name":"Max Cell Voltage","unique_id":"$SERIAL_max_cell_voltage","device_class":"voltage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.max_cell_voltage | default(None) }}","state_class":"measurement","unit_of_measurement":"V","suggested_display_precision":3}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/MinCellVoltage/config"),
+		r.Replace(`{"name":"Min Cell Voltage","unique_id":"$SERIAL_min_cell_voltage","device_class":"voltage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.min_cell_voltage | default(None) }}","state_class":"measurement","unit_of_measurement":"V","suggested_display_precision":3}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/BatterySoH/config"),
+		r.Replace(`{"name":"Battery SoH","unique_id":"$SERIAL_battery_soh","icon":"mdi:battery-heart-variant","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.battery_soh | default(None) }}","state_class":"measurement","unit_of_measurement":"%","suggested_display_precision":0}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/BatteryCycles/config"),
+		r.Replace(`{"name":"Battery Cycles","unique_id":"$SERIAL_battery_cycles","icon":"mdi:battery-sync","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL","value_template":"{{ value_json.battery_cycles | default(None) }}","state_class":"total_increasing"}`))
 
 	mockClient.OnPublish(
 		r.Replace("homeassistant/number/nexa_$SERIAL/ChargingLimit/config"),
-		r.Replace(`{"name":"Charging Limit","unique_id":"$SERIAL_charging_limit","icon":"mdi:battery-arrow-up-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.charging_limit }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"charging_limit\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":70,"max":100}`))
+		r.Replace(`{"name":"Charging Limit","unique_id":"$SERIAL_charging_limit","icon":"mdi:battery-arrow-up-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.charging_limit }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"charging_limit\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":70,"max":100}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/number/nexa_$SERIAL/DischargeLimit/config"),
-		r.Replace(`{"name":"Discharge Limit","unique_id":"$SERIAL_discharge_limit","icon":"mdi:battery-arrow-down-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.discharge_limit }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"discharge_limit\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":0,"max":30}`))
+		r.Replace(`{"name":"Discharge Limit","unique_id":"$SERIAL_discharge_limit","icon":"mdi:battery-arrow-down-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.discharge_limit }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"discharge_limit\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":0,"max":30}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/number/nexa_$SERIAL/AntiBackflowPowerPercentage/config"),
-		r.Replace(`{"name":"Anti Backflow Power Percentage","unique_id":"$SERIAL_anti_backflow_power_percentage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_power_percentage }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_power_percentage\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":0,"max":100}`))
+		r.Replace(`{"name":"Anti Backflow Power Percentage","unique_id":"$SERIAL_anti_backflow_power_percentage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_power_percentage }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_power_percentage\": {{ value }}}","state_class":"measurement","unit_of_measurement":"%","mode":"slider","step":1,"min":0,"max":100}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/number/nexa_$SERIAL/DefaultACOutputPower/config"),
-		r.Replace(`{"name":"Default AC Output Power","unique_id":"$SERIAL_default_output_w","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.default_output_w }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"default_output_w\": {{ value }}}","state_class":"measurement","unit_of_measurement":"W","mode":"slider","step":1,"min":0,"max":1000}`))
+		r.Replace(`{"name":"Default AC Output Power","unique_id":"$SERIAL_default_output_w","device_class":"power","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.default_output_w }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"default_output_w\": {{ value }}}","state_class":"measurement","unit_of_measurement":"W","mode":"slider","step":1,"min":0,"max":1000}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/DefaultMode/config"),
-		r.Replace(`{"name":"Default Mode","unique_id":"$SERIAL_default_mode","device_class":"enum","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.default_mode }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"default_mode\": \"{{ value }}\"}","options":["load_first","battery_first","smart_self_use"],"component":"select"}`))
+		r.Replace(`{"name":"Default Mode","unique_id":"$SERIAL_default_mode","device_class":"enum","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.default_mode }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"default_mode\": \"{{ value }}\"}","options":["load_first","battery_first","smart_self_use"],"component":"select"}`))
 
 	mockClient.OnPublish(
 		r.Replace("homeassistant/binary_sensor/nexa_$SERIAL/Connectivity/config"),
@@ -235,78 +389,395 @@ func setupTopics(mockClient *MockMqttClient, serial string) {
 		r.Replace(`{"name":"Heating","unique_id":"$SERIAL_heating","icon":"mdi:heat-wave","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL","value_template":"{{ 'heating' if value_json.status == 'heating' else 'not-heating' }}","payload_off":"not-heating","payload_on":"heating"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/binary_sensor/nexa_$SERIAL/APIHealth/config"),
-		r.Replace(`{"name":"API Health","unique_id":"$SERIAL_api_health","device_class":"connectivity","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/health","value_template":"{{ value_json.status }}","payload_off":"error","payload_on":"ok"}`))
+		r.Replace(`{"name":"API Health","unique_id":"$SERIAL_api_health","device_class":"connectivity","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL/health","value_template":"{{ value_json.status }}","json_attributes_topic":"test/$SERIAL/health","payload_off":"error","payload_on":"ok"}`))
 }
 
 func setupSwitchTopics(mockClient *MockMqttClient, serial string) {
 	r := strings.NewReplacer("$SERIAL", serial)
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/AllowGridCharging/config"),
-		r.Replace(`{"name":"AllowGridCharging","unique_id":"$SERIAL_allow_grid_charging","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.allow_grid_charging }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"allow_grid_charging\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"AllowGridCharging","unique_id":"$SERIAL_allow_grid_charging","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.allow_grid_charging }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"allow_grid_charging\": \"{{ value }}\"}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/GridConnectionControl/config"),
-		r.Replace(`{"name":"GridConnectionControl","unique_id":"$SERIAL_grid_connection_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.grid_connection_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"grid_connection_control\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"GridConnectionControl","unique_id":"$SERIAL_grid_connection_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.grid_connection_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"grid_connection_control\": \"{{ value }}\"}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/AcCouplePowerControl/config"),
-		r.Replace(`{"name":"AcCouplePowerControl","unique_id":"$SERIAL_ac_couple_power_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.ac_couple_power_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"ac_couple_power_control\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"AcCouplePowerControl","unique_id":"$SERIAL_ac_couple_power_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.ac_couple_power_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"ac_couple_power_control\": \"{{ value }}\"}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/LightLoadEnable/config"),
-		r.Replace(`{"name":"LightLoadEnable","unique_id":"$SERIAL_light_load_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.light_load_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"light_load_enable\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"LightLoadEnable","unique_id":"$SERIAL_light_load_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.light_load_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"light_load_enable\": \"{{ value }}\"}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/NeverPowerOff/config"),
-		r.Replace(`{"name":"NeverPowerOff","unique_id":"$SERIAL_never_power_off","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.never_power_off }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"never_power_off\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"NeverPowerOff","unique_id":"$SERIAL_never_power_off","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.never_power_off }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"never_power_off\": \"{{ value }}\"}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/switch/nexa_$SERIAL/AntiBackflowEnable/config"),
-		r.Replace(`{"name":"AntiBackflowEnable","unique_id":"$SERIAL_anti_backflow_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_enable\": \"{{ value }}\"}"}`))
+		r.Replace(`{"name":"AntiBackflowEnable","unique_id":"$SERIAL_anti_backflow_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_enable\": \"{{ value }}\"}"}`))
 }
 
 func setupSwitchTopicsAsSelect(mockClient *MockMqttClient, serial string) {
 	r := strings.NewReplacer("$SERIAL", serial)
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/AllowGridCharging/config"),
-		r.Replace(`{"name":"AllowGridCharging","unique_id":"$SERIAL_allow_grid_charging","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.allow_grid_charging }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"allow_grid_charging\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"AllowGridCharging","unique_id":"$SERIAL_allow_grid_charging","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.allow_grid_charging }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"allow_grid_charging\": \"{{ value }}\"}","options":["OFF","ON"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/GridConnectionControl/config"),
-		r.Replace(`{"name":"GridConnectionControl","unique_id":"$SERIAL_grid_connection_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.grid_connection_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"grid_connection_control\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"GridConnectionControl","unique_id":"$SERIAL_grid_connection_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.grid_connection_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"grid_connection_control\": \"{{ value }}\"}","options":["OFF","ON"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/AcCouplePowerControl/config"),
-		r.Replace(`{"name":"AcCouplePowerControl","unique_id":"$SERIAL_ac_couple_power_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.ac_couple_power_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"ac_couple_power_control\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"AcCouplePowerControl","unique_id":"$SERIAL_ac_couple_power_control","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.ac_couple_power_control }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"ac_couple_power_control\": \"{{ value }}\"}","options":["OFF","ON"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/LightLoadEnable/config"),
-		r.Replace(`{"name":"LightLoadEnable","unique_id":"$SERIAL_light_load_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.light_load_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"light_load_enable\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"LightLoadEnable","unique_id":"$SERIAL_light_load_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.light_load_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"light_load_enable\": \"{{ value }}\"}","options":["OFF","ON"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/NeverPowerOff/config"),
-		r.Replace(`{"name":"NeverPowerOff","unique_id":"$SERIAL_never_power_off","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.never_power_off }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"never_power_off\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"NeverPowerOff","unique_id":"$SERIAL_never_power_off","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.never_power_off }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"never_power_off\": \"{{ value }}\"}","options":["OFF","ON"]}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/select/nexa_$SERIAL/AntiBackflowEnable/config"),
-		r.Replace(`{"name":"AntiBackflowEnable","unique_id":"$SERIAL_anti_backflow_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_enable\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+		r.Replace(`{"name":"AntiBackflowEnable","unique_id":"$SERIAL_anti_backflow_enable","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"config","state_topic":"test/$SERIAL/parameters","value_template":"{{ value_json.anti_backflow_enable }}","command_topic":"test/$SERIAL/parameters/set","command_template":"{\"anti_backflow_enable\": \"{{ value }}\"}","options":["OFF","ON"]}`))
+}
+
+func setupButtonTopics(mockClient *MockMqttClient, serial string) {
+	r := strings.NewReplacer("$SERIAL", serial)
+	mockClient.OnPublish(
+		r.Replace("homeassistant/button/nexa_$SERIAL/Refresh/config"),
+		r.Replace(`{"name":"Refresh","unique_id":"$SERIAL_refresh","icon":"mdi:refresh","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","command_topic":"test/$SERIAL/command","payload_press":"refresh"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/button/nexa_$SERIAL/Rediscover/config"),
+		r.Replace(`{"name":"Rediscover","unique_id":"$SERIAL_rediscover","icon":"mdi:magnify","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","command_topic":"test/$SERIAL/command","payload_press":"rediscover"}`))
 }
 
 func setupBatteryTopics(mockClient *MockMqttClient, serial string, name string) {
 	r := strings.NewReplacer("$BAT", name, "$SERIAL", serial)
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$BATTimestamp/config"),
-		r.Replace(`{"name":"$BAT Timestamp","unique_id":"$SERIAL_$BAT_time","device_class":"timestamp","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.time }}"}`))
+		r.Replace(`{"name":"$BAT Timestamp","unique_id":"$SERIAL_$BAT_time","device_class":"timestamp","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","enabled_by_default":false,"state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.time }}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$BATSoC/config"),
-		r.Replace(`{"name":"$BAT SoC","unique_id":"$SERIAL_$BAT_soc","device_class":"battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.soc }}","state_class":"measurement","unit_of_measurement":"%"}`))
+		r.Replace(`{"name":"$BAT SoC","unique_id":"$SERIAL_$BAT_soc","device_class":"battery","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.soc }}","state_class":"measurement","unit_of_measurement":"%","suggested_display_precision":0}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$BATTemperature/config"),
-		r.Replace(`{"name":"$BAT Temperature","unique_id":"$SERIAL_$BAT_temp","device_class":"temperature","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.temp }}","state_class":"measurement","unit_of_measurement":"°C"}`))
+		r.Replace(`{"name":"$BAT Temperature","unique_id":"$SERIAL_$BAT_temp","device_class":"temperature","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.temp }}","state_class":"measurement","unit_of_measurement":"°C","suggested_display_precision":1}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/$BATWarningStatus/config"),
+		r.Replace(`{"name":"$BAT Warning Status","unique_id":"$SERIAL_$BAT_warn_status","icon":"mdi:alert-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.warn_status | default(None) }}"}`))
+	mockClient.OnPublish(
+		r.Replace("homeassistant/sensor/nexa_$SERIAL/$BATProtectionStatus/config"),
+		r.Replace(`{"name":"$BAT Protection Status","unique_id":"$SERIAL_$BAT_protect_status","icon":"mdi:shield-alert-outline","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","state_topic":"test/$SERIAL/$BAT","value_template":"{{ value_json.protect_status | default(None) }}"}`))
 }
 
 func setupPVTopics(mockClient *MockMqttClient, serial string, name string) {
 	r := strings.NewReplacer("$PV", name, "$SERIAL", serial)
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$PVTimestamp/config"),
-		r.Replace(`{"name":"$PV Timestamp","unique_id":"$SERIAL_$PV_time","device_class":"timestamp","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.time }}"}`))
+		r.Replace(`{"name":"$PV Timestamp","unique_id":"$SERIAL_$PV_time","device_class":"timestamp","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","entity_category":"diagnostic","enabled_by_default":false,"state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.time }}"}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$PVVoltage/config"),
-		r.Replace(`{"name":"$PV Voltage","unique_id":"$SERIAL_$PV_voltage","device_class":"voltage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.voltage }}","state_class":"measurement","unit_of_measurement":"V"}`))
+		r.Replace(`{"name":"$PV Voltage","unique_id":"$SERIAL_$PV_voltage","device_class":"voltage","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.voltage }}","state_class":"measurement","unit_of_measurement":"V","suggested_display_precision":1}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$PVCurrent/config"),
-		r.Replace(`{"name":"$PV Current","unique_id":"$SERIAL_$PV_current","device_class":"current","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.current }}","state_class":"measurement","unit_of_measurement":"A"}`))
+		r.Replace(`{"name":"$PV Current","unique_id":"$SERIAL_$PV_current","device_class":"current","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.current }}","state_class":"measurement","unit_of_measurement":"A","suggested_display_precision":2}`))
 	mockClient.OnPublish(
 		r.Replace("homeassistant/sensor/nexa_$SERIAL/$PVTemperature/config"),
-		r.Replace(`{"name":"$PV Temperature","unique_id":"$SERIAL_$PV_temp","device_class":"temperature","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.temp }}","state_class":"measurement","unit_of_measurement":"°C"}`))
+		r.Replace(`{"name":"$PV Temperature","unique_id":"$SERIAL_$PV_temp","device_class":"temperature","device":{"identifiers":["nexa_$SERIAL"],"manufacturer":"Growatt","serial_number":"$SERIAL"},"origin":{"name":"nexa-mqtt","sw_version":"version","support_url":"https://github.com/mgerczuk/nexa-mqtt"},"availability_topic":"test/availability","enabled_by_default":false,"state_topic":"test/$SERIAL/$PV","value_template":"{{ value_json.temp }}","state_class":"measurement","unit_of_measurement":"°C","suggested_display_precision":1}`))
+}
+
+func Test_sendDeviceDiscovery(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:      &mockClient,
+			TopicPrefix:     "homeassistant",
+			Version:         "version",
+			DeviceDiscovery: true,
+		},
+	}
+
+	service.SetDevices([]DeviceInfo{{SerialNumber: "device123", TopicPrefix: "test", Batteries: []BatteryInfo{{Alias: "BAT0", StateTopic: "test/device123/BAT0"}}}})
+
+	assert.Len(t, mockClient.Calls, 1)
+	assert.Equal(t, "homeassistant/device/nexa_device123/config", mockClient.Calls[0].Arguments.String(0))
+
+	var payload struct {
+		Device            Device                    `json:"device"`
+		Origin            Origin                    `json:"origin"`
+		AvailabilityTopic string                    `json:"availability_topic"`
+		Components        map[string]map[string]any `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(mockClient.Calls[0].Arguments.String(3)), &payload))
+	assert.Equal(t, []string{"nexa_device123"}, payload.Device.Identifiers)
+	assert.Equal(t, "nexa-mqtt", payload.Origin.Name)
+	assert.Equal(t, "test/availability", payload.AvailabilityTopic)
+	assert.Equal(t, map[string]any{
+		"platform":                    "sensor",
+		"name":                        "SoC",
+		"unique_id":                   "device123_soc",
+		"device_class":                "battery",
+		"state_topic":                 "test/device123",
+		"value_template":              "{{ value_json.soc }}",
+		"state_class":                 "measurement",
+		"unit_of_measurement":         "%",
+		"suggested_display_precision": float64(0),
+	}, payload.Components["device123_soc"])
+	assert.Equal(t, "switch", payload.Components["device123_allow_grid_charging"]["platform"])
+	assert.Equal(t, "number", payload.Components["device123_charging_limit"]["platform"])
+	assert.Contains(t, payload.Components, "device123_BAT0_soc")
+}
+
+func Test_sendDeviceDiscoveryIgnoresSubDevices(t *testing.T) {
+	mockClient := &MockMqttClient{}
+	mockClient.On("Subscribe", "homeassistant/status", byte(0), mock.Anything).Return(NewMockToken())
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := NewService(Options{
+		MqttClient:      mockClient,
+		TopicPrefix:     "homeassistant",
+		Version:         "version",
+		DeviceDiscovery: true,
+		BatteryDevices:  true,
+		PVDevices:       true,
+	})
+
+	service.SetDevices([]DeviceInfo{{
+		SerialNumber: "device123",
+		TopicPrefix:  "test",
+		Batteries:    []BatteryInfo{{Alias: "BAT0", SerialNumber: "0PVPBAT01", StateTopic: "test/device123/BAT0"}},
+		PVs:          []PVInfo{{StateTopic: "test/device123/PV0"}},
+	}})
+
+	// the entities of the batteries and pv inputs belong to the NEXA
+	mockClient.AssertNumberOfCalls(t, "Publish", 1)
+	publish := mockClient.Calls[len(mockClient.Calls)-1]
+	assert.Equal(t, "homeassistant/device/nexa_device123/config", publish.Arguments.String(0))
+
+	var payload struct {
+		Device     Device                    `json:"device"`
+		Components map[string]map[string]any `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(publish.Arguments.String(3)), &payload))
+	assert.Equal(t, []string{"nexa_device123"}, payload.Device.Identifiers)
+	assert.Contains(t, payload.Components, "device123_BAT0_soc")
+	assert.NotContains(t, payload.Components["device123_BAT0_soc"], "device")
+}
+
+func TestSetDevices_RetiresRemovedComponents(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:      &mockClient,
+			TopicPrefix:     "homeassistant",
+			Version:         "version",
+			DeviceDiscovery: true,
+		},
+	}
+
+	device := func(serial string, batteries ...string) DeviceInfo {
+		d := DeviceInfo{SerialNumber: serial, TopicPrefix: "test"}
+		for _, bat := range batteries {
+			d.Batteries = append(d.Batteries, BatteryInfo{Alias: bat, StateTopic: "test/" + serial + "/" + bat})
+		}
+		return d
+	}
+
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0", "BAT1"), device("device234", "BAT0")})
+	firstRun := len(mockClient.Calls)
+
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0")})
+
+	payloads := make(map[string]string)
+	for _, call := range mockClient.Calls[firstRun:] {
+		payloads[call.Arguments.String(0)] = call.Arguments.String(3)
+	}
+	assert.Equal(t, "", payloads["homeassistant/device/nexa_device234/config"])
+
+	var payload struct {
+		Components map[string]map[string]any `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(payloads["homeassistant/device/nexa_device123/config"]), &payload))
+	assert.Equal(t, map[string]any{"platform": "sensor"}, payload.Components["device123_BAT1_soc"])
+	assert.Equal(t, "sensor", payload.Components["device123_BAT0_soc"]["platform"])
+	assert.Contains(t, payload.Components["device123_BAT0_soc"], "state_topic")
+
+	// the removed components are only sent once
+
+	secondRun := len(mockClient.Calls)
+	service.SetDevices([]DeviceInfo{device("device123", "BAT0")})
+	assert.Len(t, mockClient.Calls[secondRun:], 1)
+	assert.NotContains(t, mockClient.Calls[secondRun].Arguments.String(3), "device123_BAT1_soc")
+}
+
+func TestSetDevices_RetiresRestoredEntities(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "homeassistant.json")
+	device := func(serial string, batteries ...string) DeviceInfo {
+		d := DeviceInfo{SerialNumber: serial, TopicPrefix: "test"}
+		for _, bat := range batteries {
+			d.Batteries = append(d.Batteries, BatteryInfo{Alias: bat, StateTopic: "test/" + serial + "/" + bat})
+		}
+		return d
+	}
+	newService := func(switchAsSelect bool) (*Service, *MockMqttClient) {
+		mockClient := &MockMqttClient{}
+		mockClient.On("Subscribe", "homeassistant/status", byte(0), mock.Anything).Return(NewMockToken())
+		mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+		return NewService(Options{
+			MqttClient:     mockClient,
+			TopicPrefix:    "homeassistant",
+			Version:        "version",
+			SwitchAsSelect: switchAsSelect,
+			StateFile:      stateFile,
+		}), mockClient
+	}
+	retired := func(mockClient *MockMqttClient) []string {
+		var topics []string
+		for _, call := range mockClient.Calls {
+			if call.Method == "Publish" && call.Arguments.Get(3) == "" {
+				topics = append(topics, call.Arguments.String(0))
+			}
+		}
+		return topics
+	}
+
+	first, _ := newService(false)
+	first.SetDevices([]DeviceInfo{device("device123", "BAT0", "BAT1"), device("device234", "BAT0")})
+	assert.FileExists(t, stateFile)
+
+	// after a restart device234 is not announced yet, its entities are kept
+
+	second, mockClient := newService(true)
+	second.SetDevices([]DeviceInfo{device("device123", "BAT0")})
+	assert.Contains(t, retired(mockClient), "homeassistant/sensor/nexa_device123/BAT1SoC/config")
+	assert.Contains(t, retired(mockClient), "homeassistant/switch/nexa_device123/AllowGridCharging/config")
+	assert.NotContains(t, retired(mockClient), "homeassistant/sensor/nexa_device234/SoC/config")
+	assert.NotContains(t, retired(mockClient), "homeassistant/select/nexa_device123/AllowGridCharging/config")
+
+	// the periodic discovery retires them
+
+	second.lock.Lock()
+	second.sendDiscovery(true)
+	second.lock.Unlock()
+	assert.Contains(t, retired(mockClient), "homeassistant/sensor/nexa_device234/SoC/config")
+	assert.Contains(t, retired(mockClient), "homeassistant/switch/nexa_device234/AllowGridCharging/config")
+
+	state, err := loadState(stateFile)
+	assert.NoError(t, err)
+	assert.Contains(t, state.Topics, "homeassistant/select/nexa_device123/AllowGridCharging/config")
+	assert.NotContains(t, state.Topics, "homeassistant/sensor/nexa_device234/SoC/config")
+}
+
+func TestSetDevices_MigratesDiscovery(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "homeassistant.json")
+	newService := func(deviceDiscovery bool) (*Service, *MockMqttClient) {
+		mockClient := &MockMqttClient{}
+		mockClient.On("Subscribe", "homeassistant/status", byte(0), mock.Anything).Return(NewMockToken())
+		mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+		return NewService(Options{
+			MqttClient:      mockClient,
+			TopicPrefix:     "homeassistant",
+			Version:         "version",
+			DeviceDiscovery: deviceDiscovery,
+			StateFile:       stateFile,
+		}), mockClient
+	}
+
+	first, _ := newService(false)
+	first.SetDevices([]DeviceInfo{{SerialNumber: "device123", TopicPrefix: "test"}})
+
+	second, mockClient := newService(true)
+	second.SetDevices([]DeviceInfo{{SerialNumber: "device123", TopicPrefix: "test"}})
+
+	var payloads []string
+	for _, call := range mockClient.Calls {
+		if call.Method == "Publish" && call.Arguments.String(0) == "homeassistant/sensor/nexa_device123/SoC/config" {
+			payloads = append(payloads, call.Arguments.String(3))
+		}
+	}
+	assert.Equal(t, []string{`{"migrate_discovery":true}`, ""}, payloads)
+}
+
+func Test_sendDiscoverySubDevices(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:     &mockClient,
+			TopicPrefix:    "homeassistant",
+			Version:        "version",
+			BatteryDevices: true,
+			PVDevices:      true,
+		},
+	}
+
+	service.SetDevices([]DeviceInfo{{
+		SerialNumber: "device123",
+		Alias:        "Garage",
+		TopicPrefix:  "test",
+		Batteries: []BatteryInfo{
+			{Alias: "BAT0", SerialNumber: "0PVPBAT01", StateTopic: "test/device123/BAT0"},
+			{Alias: "BAT1", StateTopic: "test/device123/BAT1"},
+		},
+		PVs: []PVInfo{{StateTopic: "test/device123/PV0"}},
+	}})
+
+	payloads := make(map[string]string)
+	for _, call := range mockClient.Calls {
+		payloads[call.Arguments.String(0)] = call.Arguments.String(3)
+	}
+	device := func(topic string) Device {
+		var sensor Sensor
+		assert.NoError(t, json.Unmarshal([]byte(payloads[topic]), &sensor))
+		return sensor.Device
+	}
+
+	assert.Equal(t, Device{
+		Identifiers:  []string{"nexa_battery_0PVPBAT01"},
+		Name:         "Garage BAT0",
+		Manufacturer: "Growatt",
+		Model:        "Battery",
+		SerialNumber: "0PVPBAT01",
+		ViaDevice:    "nexa_device123",
+	}, device("homeassistant/sensor/nexa_device123/BAT0SoC/config"))
+	// the serial of BAT1 is not known yet
+	assert.Equal(t, []string{"nexa_device123"}, device("homeassistant/sensor/nexa_device123/BAT1SoC/config").Identifiers)
+	assert.Equal(t, Device{
+		Identifiers: []string{"nexa_device123_pv0"},
+		Name:        "Garage PV0",
+		Model:       "PV Input",
+		ViaDevice:   "nexa_device123",
+	}, device("homeassistant/sensor/nexa_device123/PV0Voltage/config"))
+	assert.Equal(t, []string{"nexa_device123"}, device("homeassistant/sensor/nexa_device123/SoC/config").Identifiers)
+}
+
+func Test_sendDiscoveryExpireAfter(t *testing.T) {
+	mockClient := MockMqttClient{}
+	mockClient.On("Publish", mock.Anything, byte(0), false, mock.Anything).Return(NewMockToken())
+	service := &Service{
+		options: Options{
+			MqttClient:             &mockClient,
+			TopicPrefix:            "homeassistant",
+			Version:                "version",
+			PollingInterval:        30 * time.Second,
+			DetailsPollingInterval: 3 * time.Minute,
+		},
+	}
+
+	service.SetDevices([]DeviceInfo{{
+		SerialNumber: "device123",
+		TopicPrefix:  "test",
+		Batteries:    []BatteryInfo{{Alias: "BAT0", StateTopic: "test/device123/BAT0"}},
+	}})
+
+	expireAfter := make(map[string]any)
+	for _, call := range mockClient.Calls {
+		var payload map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(call.Arguments.String(3)), &payload))
+		expireAfter[call.Arguments.String(0)] = payload["expire_after"]
+	}
+	assert.Equal(t, float64(90), expireAfter["homeassistant/sensor/nexa_device123/SoC/config"])
+	assert.Equal(t, float64(90), expireAfter["homeassistant/binary_sensor/nexa_device123/Connectivity/config"])
+	assert.Equal(t, float64(540), expireAfter["homeassistant/sensor/nexa_device123/BAT0SoC/config"])
+	assert.Equal(t, float64(540), expireAfter["homeassistant/binary_sensor/nexa_device123/Fault/config"])
+	// the health is published on errors too, the timestamps show the last state
+	assert.Nil(t, expireAfter["homeassistant/binary_sensor/nexa_device123/APIHealth/config"])
+	assert.Nil(t, expireAfter["homeassistant/sensor/nexa_device123/BAT0Timestamp/config"])
+	assert.Nil(t, expireAfter["homeassistant/number/nexa_device123/ChargingLimit/config"])
 }
@@ -0,0 +1,63 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"nexa-mqtt/internal/misc"
+	"os"
+	"slices"
+)
+
+// discoveryState is the content of the state file, the discovery topics sent
+// by the last run
+type discoveryState struct {
+	Topics []string `json:"topics"`
+	// platform by entity unique id by device discovery topic
+	Components map[string]map[string]string `json:"components,omitempty"`
+}
+
+// loadState returns the discovery topics saved in file. A missing file is no
+// error.
+func loadState(file string) (discoveryState, error) {
+	var state discoveryState
+	if file == "" {
+		return state, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("could not read home assistant state: %w", err)
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("could not parse home assistant state %s: %w", file, err)
+	}
+	return state, nil
+}
+
+// saveState writes the state to file
+func saveState(file string, state discoveryState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return misc.WriteFileAtomic(file, b)
+}
+
+func newDiscoveryState(topics map[string]struct{}, components map[string]map[string]string) discoveryState {
+	return discoveryState{
+		Topics:     slices.Sorted(maps.Keys(topics)),
+		Components: components,
+	}
+}
+
+func (st discoveryState) topicSet() map[string]struct{} {
+	topics := make(map[string]struct{}, len(st.Topics))
+	for _, topic := range st.Topics {
+		topics[topic] = struct{}{}
+	}
+	return topics
+}
@@ -14,7 +14,8 @@ var (
 func Init(defaultLogLevel string) {
 	logLevel = new(slog.LevelVar)
 	jsonHandler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
-		Level: logLevel,
+		Level:       logLevel,
+		ReplaceAttr: redactAttr,
 	})
 	logger = slog.New(jsonHandler)
 	slog.SetDefault(logger)
@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// secrets shorter than this are not replaced inside of other strings, they
+// would garble the log output
+const minSecretLength = 4
+
+var (
+	secretsLock sync.RWMutex
+	secrets     []string
+
+	// attribute, form field and header names whose value is never logged
+	sensitiveKeys = []string{"password", "passwd", "token", "secret", "cookie", "authorization", "session"}
+
+	// "key":"value" and key=value pairs with a sensitive key inside of a string,
+	// e.g. a response body, a query string or an error message
+	sensitivePairs = regexp.MustCompile(`(?i)("[\w-]*(?:password|passwd|token|secret|cookie|authorization|session)[\w-]*"\s*:\s*"?|\b[\w-]*(?:password|passwd|token|secret|cookie|authorization|session)[\w-]*=)([^"&,;\s}]+)`)
+	bearerToken    = regexp.MustCompile(`(?i)(bearer\s+)[^"\s]+`)
+)
+
+// AddSecret registers values that must never appear in the log output, e.g.
+// passwords from the configuration or tokens received at runtime.
+func AddSecret(values ...string) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		known := false
+		for _, s := range secrets {
+			if s == value {
+				known = true
+				break
+			}
+		}
+		if !known {
+			secrets = append(secrets, value)
+		}
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact removes registered secrets and values of sensitive keys from s.
+func Redact(s string) string {
+	secretsLock.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsLock.RUnlock()
+
+	s = sensitivePairs.ReplaceAllString(s, "${1}"+redacted)
+	return bearerToken.ReplaceAllString(s, "${1}"+redacted)
+}
+
+func redactValues(values map[string][]string) map[string][]string {
+	result := make(map[string][]string, len(values))
+	for key, vals := range values {
+		if isSensitiveKey(key) {
+			result[key] = []string{redacted}
+			continue
+		}
+		r := make([]string, len(vals))
+		for i, v := range vals {
+			r[i] = Redact(v)
+		}
+		result[key] = r
+	}
+	return result
+}
+
+// redactAttr is used as slog.HandlerOptions.ReplaceAttr so that no log record
+// contains a password, token or session cookie.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if isSensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case url.Values:
+			return slog.Any(a.Key, url.Values(redactValues(x)))
+		case http.Header:
+			return slog.Any(a.Key, http.Header(redactValues(x)))
+		case []*http.Cookie:
+			return slog.String(a.Key, redacted)
+		case error:
+			return slog.String(a.Key, Redact(x.Error()))
+		}
+	}
+	return a
+}
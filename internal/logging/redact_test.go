@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{
+		Level:       slog.LevelDebug,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+func TestRedact(t *testing.T) {
+	AddSecret("s3cr3t-password", "abc")
+	defer func() { secrets = nil }()
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"login with s3cr3t-password failed", "login with [REDACTED] failed"},
+		{`{"result":1,"token":"eyJhbGciOi","msg":"ok"}`, `{"result":1,"token":"[REDACTED]","msg":"ok"}`},
+		{`{"back":{"userPassword": "xyz"}}`, `{"back":{"userPassword": "[REDACTED]"}}`},
+		{"https://host/path?a=1&token=abcdef&b=2", "https://host/path?a=1&token=[REDACTED]&b=2"},
+		{"JSESSIONID=0123456789ABCDEF; Path=/", "JSESSIONID=[REDACTED]; Path=/"},
+		{"Authorization: Bearer eyJhbGciOi", "Authorization: Bearer [REDACTED]"},
+		// secrets shorter than minSecretLength are ignored
+		{"abc def", "abc def"},
+		{"GROWATT_PASSWORD is required", "GROWATT_PASSWORD is required"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, Redact(tt.in))
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	AddSecret("s3cr3t-password")
+	defer func() { secrets = nil }()
+
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf)
+
+	logger.Debug("HTTP Request",
+		slog.String("url", "https://host/login"),
+		slog.Any("data", url.Values{"account": {"user"}, "password": {"s3cr3t-password"}}),
+		slog.Any("header", http.Header{"Cookie": {"JSESSIONID=0123"}, "Accept": {"*/*"}}),
+		slog.String("token", "abcdef"),
+		slog.Any("error", errors.New("could not login with s3cr3t-password")),
+		slog.Group("mqtt", slog.String("password", "other"), slog.String("username", "user")),
+	)
+
+	out := buf.String()
+	assert.NotContains(t, out, "s3cr3t-password")
+	assert.NotContains(t, out, "abcdef")
+	assert.NotContains(t, out, "0123")
+	assert.NotContains(t, out, "other")
+	assert.Contains(t, out, `"account":["user"]`)
+	assert.Contains(t, out, `"password":["[REDACTED]"]`)
+	assert.Contains(t, out, `"Accept":["*/*"]`)
+	assert.Contains(t, out, `"token":"[REDACTED]"`)
+	assert.Contains(t, out, `"error":"could not login with [REDACTED]"`)
+	assert.Contains(t, out, `"username":"user"`)
+}
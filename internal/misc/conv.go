@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"nexa-mqtt/pkg/models"
 	"strconv"
+	"strings"
 )
 
 func S2i(s string) int {
@@ -45,3 +46,8 @@ func OnOffToInt(s models.OnOff) int {
 	slog.Error("Invalid ON/OFF value", slog.String("s", string(s)))
 	return -1
 }
+
+// ParseFlag returns true for the flag values "1" and "true" used by the Growatt APIs
+func ParseFlag(s string) bool {
+	return s == "1" || strings.EqualFold(s, "true")
+}
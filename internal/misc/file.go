@@ -0,0 +1,25 @@
+package misc
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes b to a temporary file that replaces file, so a crash
+// while writing does not leave a truncated file behind.
+func WriteFileAtomic(file string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,28 @@
+package misc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "state.json")
+
+	assert.NoError(t, WriteFileAtomic(file, []byte(`{"a":1}`)))
+	assert.NoError(t, WriteFileAtomic(file, []byte(`{}`)))
+
+	b, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(b))
+
+	// the temporary files are removed
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte(`{}`)))
+}
@@ -0,0 +1,88 @@
+package misc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCredentials is returned by a login when the Growatt server
+// rejected the username or password. Retrying will not help.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// IsInvalidCredentialsMessage reports whether a login failure message of the
+// Growatt servers clearly says that the username or password is wrong.
+// "501" (user does not exist) and "502" (wrong password) are the codes of the
+// app api.
+func IsInvalidCredentialsMessage(msg string) bool {
+	msg = strings.ToLower(strings.TrimSpace(msg))
+	switch msg {
+	case "501", "502":
+		return true
+	}
+	return strings.Contains(msg, "password") || strings.Contains(msg, "not exist")
+}
+
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Factor  float64
+	Jitter  float64 // random deviation of each delay, e.g. 0.2 for +/- 20%
+}
+
+var DefaultBackoff = Backoff{
+	Initial: 5 * time.Second,
+	Max:     5 * time.Minute,
+	Factor:  2,
+	Jitter:  0.2,
+}
+
+// Delay returns the time to wait after the given failed attempt (starting at 1).
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := float64(b.Initial)
+	for i := 1; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Factor
+	}
+	d = min(d, float64(b.Max))
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// RetryFunc is called after each failed attempt before waiting for the next one.
+type RetryFunc func(attempt int, err error, wait time.Duration)
+
+// Retry calls fn until it succeeds, returns ErrInvalidCredentials or ctx is
+// done. Between the attempts it waits according to the backoff.
+func Retry(ctx context.Context, name string, b Backoff, fn func() error, onRetry RetryFunc) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("retry succeeded", slog.String("operation", name), slog.Int("attempt", attempt))
+			}
+			return nil
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			return err
+		}
+
+		wait := b.Delay(attempt)
+		slog.Warn("operation failed, retrying", slog.String("operation", name), slog.Int("attempt", attempt), slog.String("wait", wait.Round(time.Second).String()), slog.String("error", err.Error()))
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package misc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testBackoff = Backoff{
+	Initial: time.Millisecond,
+	Max:     4 * time.Millisecond,
+	Factor:  2,
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	assert.Equal(t, time.Millisecond, testBackoff.Delay(1))
+	assert.Equal(t, 2*time.Millisecond, testBackoff.Delay(2))
+	assert.Equal(t, 4*time.Millisecond, testBackoff.Delay(3))
+	assert.Equal(t, 4*time.Millisecond, testBackoff.Delay(10))
+}
+
+func TestBackoff_DelayJitter(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: time.Minute, Factor: 2, Jitter: 0.2}
+
+	for range 100 {
+		d := b.Delay(2)
+		assert.GreaterOrEqual(t, d, 1600*time.Millisecond)
+		assert.LessOrEqual(t, d, 2400*time.Millisecond)
+	}
+}
+
+func TestRetry_SucceedsAfterFailures(t *testing.T) {
+	calls := 0
+	var attempts []int
+
+	err := Retry(context.Background(), "test", testBackoff, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	}, func(attempt int, err error, wait time.Duration) {
+		attempts = append(attempts, attempt)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []int{1, 2}, attempts)
+}
+
+func TestRetry_InvalidCredentials(t *testing.T) {
+	calls := 0
+
+	err := Retry(context.Background(), "test", testBackoff, func() error {
+		calls++
+		return fmt.Errorf("login failed: %w", ErrInvalidCredentials)
+	}, nil)
+
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetry_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	err := Retry(ctx, "test", Backoff{Initial: time.Hour, Max: time.Hour, Factor: 2}, func() error {
+		return errors.New("temporary")
+	}, func(attempt int, err error, wait time.Duration) {
+		cancel()
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestIsInvalidCredentialsMessage(t *testing.T) {
+	assert.True(t, IsInvalidCredentialsMessage("502"))
+	assert.True(t, IsInvalidCredentialsMessage("501"))
+	assert.True(t, IsInvalidCredentialsMessage("Wrong password"))
+	assert.True(t, IsInvalidCredentialsMessage("User does not exist"))
+	assert.False(t, IsInvalidCredentialsMessage("server error"))
+	assert.False(t, IsInvalidCredentialsMessage(""))
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+type AlarmCategory string
+
+const (
+	AlarmCategoryFault      AlarmCategory = "fault"
+	AlarmCategoryWarning    AlarmCategory = "warning"
+	AlarmCategoryProtection AlarmCategory = "protection"
+)
+
+// Alarm is a single active fault, warning or protection. It is named after
+// the status field and the meaning of the bit if it is known, e.g.
+// "bat0_protect_cell_overvoltage", otherwise after the bit, e.g.
+// "bat0_warn_bit2", or after the code for diagnostic trouble codes, e.g.
+// "dtc_5002".
+type Alarm struct {
+	Name     string        `json:"name"`
+	Category AlarmCategory `json:"category"`
+	Source   string        `json:"source"` // status field, e.g. "fault_status"
+	Code     int           `json:"code"`   // bit number or diagnostic trouble code
+}
+
+type AlarmPayload struct {
+	Time       time.Time `json:"time"`
+	Fault      bool      `json:"fault"`      // any fault is active
+	Warning    bool      `json:"warning"`    // any warning is active
+	Protection bool      `json:"protection"` // any protection is active
+	Alarms     []Alarm   `json:"alarms"`
+}
+
+// NewAlarmPayload returns a payload without active alarms
+func NewAlarmPayload(tm time.Time) AlarmPayload {
+	return AlarmPayload{
+		Time:   tm,
+		Alarms: []Alarm{},
+	}
+}
+
+func (p *AlarmPayload) Add(a Alarm) {
+	p.Alarms = append(p.Alarms, a)
+	switch a.Category {
+	case AlarmCategoryFault:
+		p.Fault = true
+	case AlarmCategoryWarning:
+		p.Warning = true
+	case AlarmCategoryProtection:
+		p.Protection = true
+	}
+}
+
+// AddBits adds an alarm for every bit set in value. names holds the known
+// meanings of the bits, the other bits are named after their number.
+func (p *AlarmPayload) AddBits(source string, category AlarmCategory, value int, names map[int]string) {
+	for bit := 0; bit < 32; bit++ {
+		if value&(1<<bit) != 0 {
+			name := fmt.Sprintf("%s_bit%d", source, bit)
+			if meaning, ok := names[bit]; ok {
+				name = fmt.Sprintf("%s_%s", source, meaning)
+			}
+			p.Add(Alarm{
+				Name:     name,
+				Category: category,
+				Source:   fmt.Sprintf("%s_status", source),
+				Code:     bit,
+			})
+		}
+	}
+}
+
+// Changes returns the alarms that are active in p but not in previous and
+// the alarms that were active in previous but are no longer active in p.
+func (p AlarmPayload) Changes(previous AlarmPayload) (raised []Alarm, cleared []Alarm) {
+	active := func(alarms []Alarm, name string) bool {
+		for _, a := range alarms {
+			if a.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, a := range p.Alarms {
+		if !active(previous.Alarms, a.Name) {
+			raised = append(raised, a)
+		}
+	}
+	for _, a := range previous.Alarms {
+		if !active(p.Alarms, a.Name) {
+			cleared = append(cleared, a)
+		}
+	}
+	return raised, cleared
+}
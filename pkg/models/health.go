@@ -0,0 +1,257 @@
+package models
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type HealthCall string
+
+const (
+	HealthCallStatus     HealthCall = "status"
+	HealthCallTotals     HealthCall = "totals"
+	HealthCallHistory    HealthCall = "history"
+	HealthCallParameters HealthCall = "parameters"
+	HealthCallSet        HealthCall = "set"
+)
+
+const (
+	HealthUndefined = "undefined"
+	HealthOk        = "ok"
+	HealthError     = "error"
+)
+
+const (
+	ServiceStateLogin       = "login"
+	ServiceStateEnumerating = "enumerating"
+	ServiceStateRunning     = "running"
+	ServiceStateFailed      = "failed"
+)
+
+// number of request latencies used for the rolling latency statistics
+const latencyWindow = 20
+
+// a health payload is re-sent after this interval even if the status did not
+// change, so that the counters and latency statistics stay current
+const healthRefreshInterval = 5 * time.Minute
+
+type LatencyStats struct {
+	LastMs  int64 `json:"last_ms"`
+	AvgMs   int64 `json:"avg_ms"`
+	MinMs   int64 `json:"min_ms"`
+	MaxMs   int64 `json:"max_ms"`
+	Samples int   `json:"samples"`
+
+	window []time.Duration
+}
+
+func (l *LatencyStats) add(latency time.Duration) {
+	l.window = append(l.window, latency)
+	if len(l.window) > latencyWindow {
+		l.window = l.window[len(l.window)-latencyWindow:]
+	}
+
+	var sum, lo, hi time.Duration
+	for i, d := range l.window {
+		sum += d
+		if i == 0 || d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+
+	l.LastMs = latency.Milliseconds()
+	l.AvgMs = (sum / time.Duration(len(l.window))).Milliseconds()
+	l.MinMs = lo.Milliseconds()
+	l.MaxMs = hi.Milliseconds()
+	l.Samples = len(l.window)
+}
+
+type CallHealth struct {
+	Status              string       `json:"status"`
+	LastSuccess         *time.Time   `json:"last_success,omitempty"`
+	LastError           *time.Time   `json:"last_error,omitempty"`
+	Message             string       `json:"message,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	TotalFailures       int          `json:"total_failures"`
+	Latency             LatencyStats `json:"latency"`
+	Count               int          `json:"-"` // number of calls with and without errors
+}
+
+// ServiceHealth is the health record of the API calls for a single device.
+type ServiceHealth struct {
+	Status      string                     `json:"status"`
+	LastSuccess *time.Time                 `json:"last_success,omitempty"`
+	LastError   *time.Time                 `json:"last_error,omitempty"`
+	Message     string                     `json:"message,omitempty"`
+	Calls       map[HealthCall]*CallHealth `json:"calls,omitempty"`
+	Source      string                     `json:"source,omitempty"` // api that delivers the data in auto mode, web or app
+	StateLock   sync.Mutex                 `json:"-"`
+	Send        bool                       `json:"-"`
+	LastSent    time.Time                  `json:"-"`
+}
+
+func NewServiceHealth() *ServiceHealth {
+	return &ServiceHealth{
+		Status: HealthUndefined,
+		Calls:  make(map[HealthCall]*CallHealth),
+	}
+}
+
+func (h *ServiceHealth) call(call HealthCall) *CallHealth {
+	c, ok := h.Calls[call]
+	if !ok {
+		c = &CallHealth{Status: HealthUndefined}
+		h.Calls[call] = c
+	}
+	return c
+}
+
+// UpdateSuccess records a successful API call. A latency of 0 means that no
+// request was made and is not added to the latency statistics.
+func (h *ServiceHealth) UpdateSuccess(call HealthCall, latency time.Duration) {
+	h.StateLock.Lock()
+	defer h.StateLock.Unlock()
+
+	tm := time.Now().Round(time.Second)
+	c := h.call(call)
+	h.Send = h.Send || c.Status != HealthOk || time.Since(h.LastSent) >= healthRefreshInterval
+	c.Status = HealthOk
+	c.Count++
+	c.LastSuccess = &tm
+	c.Message = ""
+	c.ConsecutiveFailures = 0
+	if latency > 0 {
+		c.Latency.add(latency)
+	}
+
+	h.LastSuccess = &tm
+	h.updateStatus()
+}
+
+// UpdateError records a failed API call. A latency of 0 means that no request
+// was made and is not added to the latency statistics.
+func (h *ServiceHealth) UpdateError(call HealthCall, latency time.Duration, err error) {
+	h.StateLock.Lock()
+	defer h.StateLock.Unlock()
+
+	tm := time.Now().Round(time.Second)
+	c := h.call(call)
+	c.Status = HealthError
+	c.Count++
+	c.LastError = &tm
+	c.Message = err.Error()
+	c.ConsecutiveFailures++
+	c.TotalFailures++
+	if latency > 0 {
+		c.Latency.add(latency)
+	}
+
+	h.LastError = &tm
+	h.updateStatus()
+	h.Send = true
+}
+
+// updateStatus derives the overall status from the status of the single
+// calls: the device is healthy when no call type is currently failing.
+func (h *ServiceHealth) updateStatus() {
+	status := HealthUndefined
+	message := ""
+	var lastError time.Time
+	for _, c := range h.Calls {
+		switch c.Status {
+		case HealthError:
+			status = HealthError
+			if c.LastError != nil && !c.LastError.Before(lastError) {
+				lastError = *c.LastError
+				message = c.Message
+			}
+		case HealthOk:
+			if status == HealthUndefined {
+				status = HealthOk
+			}
+		}
+	}
+	h.Status = status
+	h.Message = message
+}
+
+// PollingFailed reports whether one of the polling calls is currently
+// failing. Failed parameter changes are not taken into account.
+func (h *ServiceHealth) PollingFailed() bool {
+	h.StateLock.Lock()
+	defer h.StateLock.Unlock()
+
+	for _, call := range []HealthCall{HealthCallStatus, HealthCallTotals, HealthCallHistory, HealthCallParameters} {
+		if c, ok := h.Calls[call]; ok && c.Status == HealthError {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusPolls returns the number of status polls, i.e. the number of polling
+// cycles of the device.
+func (h *ServiceHealth) StatusPolls() int {
+	h.StateLock.Lock()
+	defer h.StateLock.Unlock()
+
+	if c, ok := h.Calls[HealthCallStatus]; ok {
+		return c.Count
+	}
+	return 0
+}
+
+// HealthRegistry holds a ServiceHealth record per device serial.
+type HealthRegistry struct {
+	lock    sync.Mutex
+	devices map[string]*ServiceHealth
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{
+		devices: make(map[string]*ServiceHealth),
+	}
+}
+
+// Device returns the health record of the device with the given serial,
+// creating it if necessary.
+func (r *HealthRegistry) Device(serial string) *ServiceHealth {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	h, ok := r.devices[serial]
+	if !ok {
+		h = NewServiceHealth()
+		r.devices[serial] = h
+	}
+	return h
+}
+
+// Retain removes the health records of all devices that are not in devices,
+// e.g. of devices that were removed from the account.
+func (r *HealthRegistry) Retain(devices []NoahDevicePayload) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for serial := range r.devices {
+		if !slices.ContainsFunc(devices, func(d NoahDevicePayload) bool { return d.Serial == serial }) {
+			delete(r.devices, serial)
+		}
+	}
+}
+
+// ServiceState is the state of nexa-mqtt itself, independent of a single
+// device. While a step of the startup is retried, Attempt and NextRetry
+// describe the retry.
+type ServiceState struct {
+	Account   string     `json:"account,omitempty"` // empty for the first account
+	State     string     `json:"state"`
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	Attempt   int        `json:"attempt,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+}
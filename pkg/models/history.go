@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// HistorySample is one row of the history data, republished by the backfill
+// with its original timestamp.
+type HistorySample struct {
+	Time      time.Time        `json:"time"`
+	Device    DevicePayload    `json:"device"`
+	Batteries []BatteryPayload `json:"batteries"`
+	Pvs       []PvPayload      `json:"pvs"`
+	Meter     *MeterPayload    `json:"meter,omitempty"` // only with a smart meter
+}
@@ -2,7 +2,7 @@ package models
 
 import (
 	"fmt"
-	"sync"
+	"slices"
 	"time"
 )
 
@@ -20,6 +20,12 @@ const (
 	OffGrid              = "off_grid"
 )
 
+// Commands of the command topic of a device
+const (
+	CommandRefresh    = "refresh"    // poll the status, battery details and parameters now
+	CommandRediscover = "rediscover" // enumerate the devices and announce them again
+)
+
 type OnOff string
 
 const (
@@ -84,13 +90,57 @@ type DevicePayload struct {
 	GenerationTodayEnergy float64  `json:"generation_today_kwh"`
 	WorkMode              WorkMode `json:"work_mode,omitempty"`
 	Status                string   `json:"status,omitempty"`
+
+	Consumption *ConsumptionPayload `json:"consumption,omitempty"` // only with a CT or a smart plug
+	Energy      *EnergyPayload      `json:"energy,omitempty"`      // integrated by nexa-mqtt
+
+	// from the history data, only available in web mode
+	SystemTemperature *float64 `json:"system_temp,omitempty"`
+	MaxCellVoltage    *float64 `json:"max_cell_voltage,omitempty"`
+	MinCellVoltage    *float64 `json:"min_cell_voltage,omitempty"`
+	BatterySoh        *float64 `json:"battery_soh,omitempty"`
+	BatteryCycles     *int     `json:"battery_cycles,omitempty"`
+}
+
+// ConsumptionPayload contains the household consumption measured by a CT or
+// smart plugs (Groplug, Shelly). Values not delivered by the API in use are nil.
+type ConsumptionPayload struct {
+	CT                     bool     `json:"ct"`         // a CT is installed
+	SmartPlug              bool     `json:"smart_plug"` // a smart plug is installed
+	HouseholdLoad          *float64 `json:"household_load_w,omitempty"`
+	HouseholdLoadApartPlug *float64 `json:"household_load_apart_from_plugs_w,omitempty"` // web only
+	CTPower                *float64 `json:"ct_w,omitempty"`                              // web only
+	GridPower              *float64 `json:"grid_w,omitempty"`                            // app only
+	SmartPlugPower         *float64 `json:"smart_plug_w,omitempty"`
+	OtherPower             *float64 `json:"other_w,omitempty"`
+}
+
+// EnergyPayload contains energy totals that nexa-mqtt integrates from the
+// power values, Growatt only reports the generated energy.
+type EnergyPayload struct {
+	Charge    float64 `json:"charge_kwh"`
+	Discharge float64 `json:"discharge_kwh"`
+	Solar     float64 `json:"solar_kwh"`
+	ACInput   float64 `json:"ac_input_kwh"`  // positive ac_w, e.g. charging from the grid
+	ACOutput  float64 `json:"ac_output_kwh"` // negative ac_w, delivered to the house or the grid
+}
+
+// UpdateHistoryFrom copies the values only available from the history data
+func (p *DevicePayload) UpdateHistoryFrom(src DevicePayload) {
+	p.SystemTemperature = src.SystemTemperature
+	p.MaxCellVoltage = src.MaxCellVoltage
+	p.MinCellVoltage = src.MinCellVoltage
+	p.BatterySoh = src.BatterySoh
+	p.BatteryCycles = src.BatteryCycles
 }
 
 type BatteryPayload struct {
-	Time         time.Time `json:"time"`
-	SerialNumber string    `json:"serial"`
-	Soc          float64   `json:"soc"`
-	Temperature  float64   `json:"temp"`
+	Time          time.Time `json:"time"`
+	SerialNumber  string    `json:"serial"`
+	Soc           float64   `json:"soc"`
+	Temperature   float64   `json:"temp"`
+	WarnStatus    *int      `json:"warn_status,omitempty"`    // bit field, only available in web mode
+	ProtectStatus *int      `json:"protect_status,omitempty"` // bit field, only available in web mode
 }
 
 type PvPayload struct {
@@ -100,6 +150,29 @@ type PvPayload struct {
 	Temp    float64   `json:"temp"`
 }
 
+// MeterPayload contains the data of an Eastron smart meter connected to the
+// device, only available in web mode.
+type MeterPayload struct {
+	Time                time.Time            `json:"time"`
+	Frequency           float64              `json:"frequency"`
+	ActivePower         float64              `json:"active_power_w"`
+	ReactivePower       float64              `json:"reactive_power_var"`
+	ApparentPower       float64              `json:"apparent_power_va"`
+	PowerFactor         float64              `json:"power_factor"`
+	ForwardActiveEnergy float64              `json:"forward_active_energy_kwh"` // imported from the grid
+	ReverseActiveEnergy float64              `json:"reverse_active_energy_kwh"` // exported to the grid
+	Phases              [3]MeterPhasePayload `json:"phases"`
+}
+
+type MeterPhasePayload struct {
+	Voltage       float64 `json:"voltage"`
+	Current       float64 `json:"current"`
+	ActivePower   float64 `json:"active_power_w"`
+	ReactivePower float64 `json:"reactive_power_var"`
+	ApparentPower float64 `json:"apparent_power_va"`
+	PowerFactor   float64 `json:"power_factor"`
+}
+
 type ParameterPayload struct {
 	ChargingLimit               *float64  `json:"charging_limit,omitempty"`
 	DischargeLimit              *float64  `json:"discharge_limit,omitempty"`
@@ -171,37 +244,13 @@ type NoahDeviceBatteryPayload struct {
 	Alias string `json:"alias"`
 }
 
-type ServiceHealth struct {
-	Status      string          `json:"status"`
-	LastSuccess *time.Time      `json:"last_success,omitempty"`
-	Message     string          `json:"message,omitempty"`
-	StateLock   sync.Mutex      `json:"-"`
-	Send        map[string]bool `json:"-"`
-}
-
-func NewServiceHealth() ServiceHealth {
-	return ServiceHealth{
-		Status: "undefined",
-		Send:   make(map[string]bool),
-	}
-}
-
-func (h *ServiceHealth) UpdateSuccess(serial string) {
-	h.StateLock.Lock()
-	defer h.StateLock.Unlock()
-
-	tm := time.Now().Round(time.Second)
-	h.Send[serial] = h.Status != "ok"
-	h.Status = "ok"
-	h.LastSuccess = &tm
-	h.Message = ""
-}
-
-func (h *ServiceHealth) UpdateError(serial string, err error) {
-	h.StateLock.Lock()
-	defer h.StateLock.Unlock()
-
-	h.Status = "error"
-	h.Message = err.Error()
-	h.Send[serial] = true
+// Equal reports whether both devices are announced identically, e.g. have the
+// same batteries.
+func (d NoahDevicePayload) Equal(other NoahDevicePayload) bool {
+	return d.PlantId == other.PlantId &&
+		d.Serial == other.Serial &&
+		d.Model == other.Model &&
+		d.Version == other.Version &&
+		d.Alias == other.Alias &&
+		slices.Equal(d.Batteries, other.Batteries)
 }